@@ -41,6 +41,8 @@ with a tabular key-value mapping file.
 
 Input:
    - Output of 'lexicmap search' with the flag -a/--all.
+     Bit scores and E-values are also shown if the input has the columns "bitscore" and "evalue",
+     e.g., with '--columns +bitscore,evalue'.
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -105,7 +107,12 @@ Input:
 		var scanner *bufio.Scanner
 
 		ncols := 21
-		items := make([]string, ncols)
+		items := make([]string, ncols+1) // extra columns, e.g., "truncated", are ignored
+		nItems := ncols + 1
+
+		// optional columns, located by the header line
+		var iBitscore, iEvalue int
+		var bitscore, evalue string
 
 		var query, qlen, hits, sgenome, sseqid, qcovGnm, hsp, qcovHSP, alenHSP, pident, gaps, qstart, qend, sstart, send, sstr, slen string
 		var cigar, qseq, sseq, align string
@@ -139,10 +146,22 @@ Input:
 				}
 				if headerLine {
 					headerLine = false
+
+					iBitscore, iEvalue = -1, -1
+					for i, name := range strings.Split(line, "\t") {
+						switch name {
+						case "bitscore":
+							iBitscore = i
+						case "evalue":
+							iEvalue = i
+						}
+					}
+					nItems = max(ncols, iBitscore+1, iEvalue+1) + 1
+					items = make([]string, nItems)
 					continue
 				}
 
-				stringSplitNByByte(line, '\t', ncols, &items)
+				stringSplitNByByte(line, '\t', nItems, &items)
 				if len(items) < ncols {
 					checkError(fmt.Errorf("the input has only %d columns, did you forgot to add -a/--all for 'lexicmap search'?", len(items)))
 				}
@@ -222,6 +241,10 @@ Input:
 				}
 
 				fmt.Fprintf(outfh, " HSP #%s\n", hsp)
+				if iBitscore >= 0 && iEvalue >= 0 && max(iBitscore, iEvalue) < len(items) {
+					bitscore, evalue = items[iBitscore], items[iEvalue]
+					fmt.Fprintf(outfh, " Score = %s bits, Expect = %s\n", bitscore, evalue)
+				}
 				fmt.Fprintf(outfh, " Query coverage per seq = %s%%, Aligned length = %s, Identities = %s%%, Gaps = %s\n",
 					qcovHSP, alenHSP, pident, gaps)
 				fmt.Fprintf(outfh, " Query range = %s-%s, Subject range = %s-%s, Strand = Plus/%s\n\n",
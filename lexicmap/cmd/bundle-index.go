@@ -0,0 +1,163 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+	"github.com/shenwei356/util/pathutil"
+	"github.com/spf13/cobra"
+)
+
+var bundleIndexCmd = &cobra.Command{
+	Use:   "bundle-index",
+	Short: "Pack an index into a single file for distribution and searching",
+	Long: `Pack an index into a single file for distribution and searching
+
+An index is a directory of many files, which is inconvenient to distribute,
+or to put on object-store-backed mounts. This command packs all files of an index
+into one seekable bundle file, i.e., an uncompressed tar archive, where the data
+of each file is stored contiguously.
+
+The bundle file can be directly used in "lexicmap search -d index.lmi.tar",
+where seed and genome data are read from offsets inside the bundle without extraction.
+Both in-memory seed searching and memory-mapped genome data are also supported.
+
+An index bundle can be extracted with:
+
+    mkdir index.lmi; tar -xf index.lmi.tar -C index.lmi
+
+Attention:
+  1. index.Index bundles are read-only, other utils commands only accept index directories.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		// ------------------------------
+
+		dbDir := getFlagString(cmd, "index")
+		if dbDir == "" {
+			checkError(fmt.Errorf("flag -d/--index needed"))
+		}
+		dbDir = filepath.Clean(dbDir)
+
+		outFile := getFlagString(cmd, "out-file")
+		if outFile == "" {
+			outFile = dbDir + ".tar"
+		}
+		force := getFlagBool(cmd, "force")
+
+		ok, err := pathutil.DirExists(dbDir)
+		checkError(err)
+		if !ok {
+			checkError(fmt.Errorf("index directory not found: %s", dbDir))
+		}
+
+		absDir, err := filepath.Abs(dbDir)
+		checkError(err)
+		absFile, err := filepath.Abs(outFile)
+		checkError(err)
+		if strings.HasPrefix(absFile, absDir+string(filepath.Separator)) {
+			checkError(fmt.Errorf("the output file should not be in the index directory: %s", outFile))
+		}
+
+		ok, err = pathutil.Exists(outFile)
+		checkError(err)
+		if ok && !force {
+			checkError(fmt.Errorf("output file existed: %s, use --force to overwrite", outFile))
+		}
+
+		// ---------------------------------------------------------------
+
+		timeStart := time.Now()
+		defer func() {
+			if opt.Verbose {
+				log.Info()
+				log.Infof("elapsed time: %s", time.Since(timeStart))
+				log.Info()
+			}
+		}()
+
+		// check the index
+		fileInfo := filepath.Join(dbDir, index.FileInfo)
+		info, err := index.ReadIndexInfo(fileInfo)
+		if err != nil {
+			checkError(fmt.Errorf("failed to read info file: %s", err))
+		}
+		if info.MainVersion != index.MainVersion {
+			checkError(fmt.Errorf("index main versions do not match: %d (index) != %d (tool). please upgrade it with \"lexicmap utils upgrade-index\" first", info.MainVersion, index.MainVersion))
+		}
+
+		if opt.Verbose {
+			log.Infof("packing index %s into %s", dbDir, outFile)
+		}
+
+		// write to a temporary file first, in case of interruption
+		tmpFile := outFile + index.ExtTmpDir
+		err = bundle.Create(dbDir, tmpFile)
+		if err != nil {
+			os.Remove(tmpFile)
+			checkError(fmt.Errorf("failed to create the index bundle: %s", err))
+		}
+
+		// check the table of contents
+		_, err = bundle.Mount(tmpFile)
+		if err != nil {
+			os.Remove(tmpFile)
+			checkError(fmt.Errorf("failed to read the index bundle: %s", err))
+		}
+		_, err = index.ReadIndexInfo(filepath.Join(tmpFile, index.FileInfo))
+		if err != nil {
+			os.Remove(tmpFile)
+			checkError(fmt.Errorf("failed to read info file in the index bundle: %s", err))
+		}
+		checkError(bundle.Unmount(tmpFile))
+
+		checkError(os.Rename(tmpFile, outFile))
+
+		if opt.Verbose {
+			fi, err := os.Stat(outFile)
+			checkError(err)
+			log.Infof("index bundle saved: %s (%s)", outFile, humanize.IBytes(uint64(fi.Size())))
+		}
+	},
+}
+
+func init() {
+	utilsCmd.AddCommand(bundleIndexCmd)
+
+	bundleIndexCmd.Flags().StringP("index", "d", "",
+		formatFlagUsage(`Index directory created by "lexicmap index".`))
+	bundleIndexCmd.Flags().StringP("out-file", "o", "",
+		formatFlagUsage(`Output bundle file (default: the index directory + ".tar").`))
+	bundleIndexCmd.Flags().BoolP("force", "", false,
+		formatFlagUsage(`Overwrite existing output file.`))
+
+	bundleIndexCmd.SetUsageTemplate(usageTemplate(""))
+}
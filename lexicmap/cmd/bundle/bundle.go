@@ -0,0 +1,424 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package bundle packs an index directory into a single seekable file,
+// i.e., an uncompressed tar archive, and provides read-only access to
+// files in it, just like accessing files in the original directory.
+//
+// A bundle is mounted with Mount() at the path of the bundle file,
+// then a path like "index.lmi.tar/seeds/chunk_000.bin" is resolved to
+// the data section of "seeds/chunk_000.bin" in the bundle.
+// Paths not in any mounted bundle are read from the file system.
+package bundle
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidBundle means the file is not a valid bundle.
+var ErrInvalidBundle = errors.New("bundle: invalid bundle file")
+
+// entry is a regular file in a bundle.
+type entry struct {
+	offset int64 // offset of the data in the bundle file
+	size   int64 // size of the data
+}
+
+// Bundle is a single-file index, i.e., an uncompressed tar archive,
+// in which the offsets of all regular files are recorded as a table of contents.
+type Bundle struct {
+	file string
+	fh   *os.File
+	size int64
+	refs int // the number of Mount() calls not unmounted yet
+
+	entries map[string]*entry // relative paths (slash-separated) -> entries
+	names   []string          // sorted relative paths
+}
+
+var mounted = make(map[string]*Bundle)
+var mountedMu sync.RWMutex
+
+// Mount opens a bundle file and reads its table of contents,
+// so that files in it can be accessed with Open(), ReadFile(), and List().
+// A bundle is only opened once, and it's kept open until each Mount() call
+// is paired with an Unmount() call.
+func Mount(file string) (*Bundle, error) {
+	file = filepath.Clean(file)
+
+	mountedMu.Lock()
+	defer mountedMu.Unlock()
+
+	if b, ok := mounted[file]; ok {
+		b.refs++
+		return b, nil
+	}
+
+	b, err := openBundle(file)
+	if err != nil {
+		return nil, err
+	}
+	b.refs = 1
+	mounted[file] = b
+	return b, nil
+}
+
+// Unmount releases a mounted bundle file,
+// which is closed when no other mounts of it remain.
+func Unmount(file string) error {
+	file = filepath.Clean(file)
+
+	mountedMu.Lock()
+	defer mountedMu.Unlock()
+
+	b, ok := mounted[file]
+	if !ok {
+		return nil
+	}
+	b.refs--
+	if b.refs > 0 {
+		return nil
+	}
+	delete(mounted, file)
+	return b.fh.Close()
+}
+
+// IsBundle tells if the path is a regular file starting with a tar header,
+// which could be mounted as a bundle.
+func IsBundle(file string) (bool, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return false, err
+	}
+	if !fi.Mode().IsRegular() {
+		return false, nil
+	}
+
+	fh, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+
+	_, err = tar.NewReader(fh).Next()
+	return err == nil, nil
+}
+
+// openBundle reads the table of contents of a bundle file.
+func openBundle(file string) (*Bundle, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	b := &Bundle{
+		file:    file,
+		fh:      fh,
+		size:    fi.Size(),
+		entries: make(map[string]*entry, 1024),
+		names:   make([]string, 0, 1024),
+	}
+
+	// The tar reader reads headers block by block without buffering,
+	// and skips file data with Seek(), so the current offset of the
+	// file handler after reading a header is where the data starts.
+	tr := tar.NewReader(fh)
+	var hdr *tar.Header
+	var offset int64
+	var name string
+	for {
+		hdr, err = tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			fh.Close()
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidBundle, file, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		offset, err = fh.Seek(0, io.SeekCurrent)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		if offset+hdr.Size > b.size {
+			fh.Close()
+			return nil, fmt.Errorf("%w: %s: data of %s out of range", ErrInvalidBundle, file, hdr.Name)
+		}
+
+		name = path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if _, ok := b.entries[name]; !ok {
+			b.names = append(b.names, name)
+		}
+		b.entries[name] = &entry{offset: offset, size: hdr.Size}
+	}
+
+	if len(b.entries) == 0 {
+		fh.Close()
+		return nil, fmt.Errorf("%w: %s: no files", ErrInvalidBundle, file)
+	}
+
+	sort.Strings(b.names)
+
+	return b, nil
+}
+
+// lookup finds the mounted bundle containing the path,
+// and returns the relative path in the bundle.
+func lookup(file string) (*Bundle, string, bool) {
+	mountedMu.RLock()
+	defer mountedMu.RUnlock()
+
+	if len(mounted) == 0 {
+		return nil, "", false
+	}
+
+	file = filepath.Clean(file)
+	var b *Bundle
+	var ok bool
+	for dir := file; ; {
+		if b, ok = mounted[dir]; ok {
+			if dir == file {
+				return b, ".", true
+			}
+			rel, err := filepath.Rel(dir, file)
+			if err != nil {
+				return nil, "", false
+			}
+			return b, filepath.ToSlash(rel), true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return nil, "", false
+}
+
+// File is a read-only file, either a regular file,
+// or the data section of a file in a bundle.
+type File struct {
+	*io.SectionReader
+
+	fh     *os.File // the underlying file
+	offset int64    // offset of the data in the underlying file
+	shared bool     // the underlying file is shared by a bundle, and it should not be closed
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	if f.shared {
+		return nil
+	}
+	return f.fh.Close()
+}
+
+// Base returns the underlying file and the offset of the data in it,
+// e.g., for memory-mapping the data.
+func (f *File) Base() (*os.File, int64) {
+	return f.fh, f.offset
+}
+
+// Open opens a file in a mounted bundle or in the file system.
+func Open(file string) (*File, error) {
+	if b, name, ok := lookup(file); ok {
+		return b.open(name, file)
+	}
+
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	return &File{
+		SectionReader: io.NewSectionReader(fh, 0, fi.Size()),
+		fh:            fh,
+	}, nil
+}
+
+// open opens a file in the bundle.
+func (b *Bundle) open(name string, file string) (*File, error) {
+	e, ok := b.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: file, Err: fs.ErrNotExist}
+	}
+
+	return &File{
+		SectionReader: io.NewSectionReader(b.fh, e.offset, e.size),
+		fh:            b.fh,
+		offset:        e.offset,
+		shared:        true,
+	}, nil
+}
+
+// ReadFile reads the whole file in a mounted bundle or in the file system.
+func ReadFile(file string) ([]byte, error) {
+	if b, name, ok := lookup(file); ok {
+		f, err := b.open(name, file)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, f.Size())
+		_, err = io.ReadFull(f, data)
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	return os.ReadFile(file)
+}
+
+// List returns paths of all regular files in a directory (recursively)
+// in a mounted bundle or in the file system, in lexicographic order.
+func List(dir string) ([]string, error) {
+	files := make([]string, 0, 64)
+
+	if b, name, ok := lookup(dir); ok {
+		prefix := ""
+		if name != "." {
+			prefix = name + "/"
+		}
+		for _, p := range b.names {
+			if strings.HasPrefix(p, prefix) {
+				files = append(files, filepath.Join(dir, filepath.FromSlash(p[len(prefix):])))
+			}
+		}
+		if len(files) == 0 {
+			return nil, &fs.PathError{Op: "open", Path: dir, Err: fs.ErrNotExist}
+		}
+		return files, nil
+	}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Create packs all files in a directory into a bundle file.
+// The file should not be in the directory.
+func Create(dir string, file string) error {
+	files, err := List(dir)
+	if err != nil {
+		return err
+	}
+
+	outfh, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	outfi, err := outfh.Stat()
+	if err != nil {
+		outfh.Close()
+		return err
+	}
+
+	tw := tar.NewWriter(outfh)
+
+	var fi os.FileInfo
+	var hdr *tar.Header
+	var rel string
+	var fh *os.File
+	for _, f := range files {
+		fi, err = os.Stat(f)
+		if err != nil {
+			outfh.Close()
+			return err
+		}
+		if os.SameFile(fi, outfi) {
+			continue
+		}
+
+		rel, err = filepath.Rel(dir, f)
+		if err != nil {
+			outfh.Close()
+			return err
+		}
+
+		hdr, err = tar.FileInfoHeader(fi, "")
+		if err != nil {
+			outfh.Close()
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			outfh.Close()
+			return err
+		}
+
+		fh, err = os.Open(f)
+		if err != nil {
+			outfh.Close()
+			return err
+		}
+		_, err = io.Copy(tw, fh)
+		fh.Close()
+		if err != nil {
+			outfh.Close()
+			return fmt.Errorf("failed to add %s: %s", f, err)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		outfh.Close()
+		return err
+	}
+	return outfh.Close()
+}
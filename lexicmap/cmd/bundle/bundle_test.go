@@ -0,0 +1,137 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package bundle
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "index")
+	files := map[string][]byte{
+		"info.toml":                         []byte("k = 31\n"),
+		"seeds/chunk_000.bin":               bytes.Repeat([]byte{1, 2, 3}, 1000),
+		"seeds/chunk_000.bin.idx":           {},
+		"genomes/batch_0000/genomes.bin":    bytes.Repeat([]byte("ACGT"), 300),
+		"genomes/batch_0000/genomes.bin.id": []byte("x"),
+	}
+	for name, data := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := dir + ".tar"
+	if err := Create(dir, file); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+
+	ok, err := IsBundle(file)
+	if err != nil || !ok {
+		t.Fatalf("should be a bundle: %s", err)
+	}
+
+	// not mounted yet
+	if _, err = Open(filepath.Join(file, "info.toml")); err == nil {
+		t.Errorf("should fail before mounting")
+	}
+
+	if _, err = Mount(file); err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+
+	for name, data := range files {
+		p := filepath.Join(file, filepath.FromSlash(name))
+
+		d, err := ReadFile(p)
+		if err != nil {
+			t.Fatalf("read %s: %s", name, err)
+		}
+		if !bytes.Equal(d, data) {
+			t.Errorf("unmatched data of %s", name)
+		}
+
+		// random access
+		f, err := Open(p)
+		if err != nil {
+			t.Fatalf("open %s: %s", name, err)
+		}
+		if f.Size() != int64(len(data)) {
+			t.Errorf("unmatched size of %s: %d != %d", name, f.Size(), len(data))
+		}
+		if len(data) > 10 {
+			f.Seek(5, io.SeekStart)
+			buf := make([]byte, 5)
+			if _, err = io.ReadFull(f, buf); err != nil {
+				t.Fatalf("read %s: %s", name, err)
+			}
+			if !bytes.Equal(buf, data[5:10]) {
+				t.Errorf("unmatched data of %s after seeking", name)
+			}
+
+			fh, offset := f.Base()
+			if _, err = fh.ReadAt(buf, offset+5); err != nil {
+				t.Fatalf("read %s: %s", name, err)
+			}
+			if !bytes.Equal(buf, data[5:10]) {
+				t.Errorf("unmatched data of %s from the underlying file", name)
+			}
+		}
+		f.Close()
+	}
+
+	if _, err = Open(filepath.Join(file, "masks.bin")); !os.IsNotExist(err) {
+		t.Errorf("should return a not-exist error: %v", err)
+	}
+
+	list, err := List(filepath.Join(file, "seeds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0] != filepath.Join(file, "seeds", "chunk_000.bin") {
+		t.Errorf("unexpected files in seeds: %v", list)
+	}
+
+	// a bundle mounted twice is kept open until both mounts are released
+	if _, err = Mount(file); err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	if err = Unmount(file); err != nil {
+		t.Fatalf("unmount: %s", err)
+	}
+	if _, err = ReadFile(filepath.Join(file, "info.toml")); err != nil {
+		t.Errorf("should be still mounted: %s", err)
+	}
+	if err = Unmount(file); err != nil {
+		t.Fatalf("unmount: %s", err)
+	}
+	if _, err = ReadFile(filepath.Join(file, "info.toml")); err == nil {
+		t.Errorf("should fail after unmounting")
+	}
+}
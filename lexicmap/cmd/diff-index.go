@@ -0,0 +1,423 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/lexichash"
+	"github.com/spf13/cobra"
+	"github.com/zeebo/wyhash"
+)
+
+var diffIndexCmd = &cobra.Command{
+	Use:   "diff-index",
+	Short: "Compare two indexes and report the differences",
+	Long: `Compare two indexes and report the differences
+
+Output (TSV format with four columns: category, item, index1, index2).
+Only differences are reported:
+
+  category          item            index1/index2
+  ---------------   -------------   --------------------------------------------
+  info              field name      values in the index information file
+  masks             mask index      masks, compared only when k and the mask
+                                    numbers are the same
+  genome_removed    genome ID       yes/no, the genome exists or not
+  genome_added      genome ID       no/yes, the genome exists or not
+  genome_checksum   genome ID       checksums of sequences of common genomes
+  seeds             total           total numbers of seeds
+  seeds             mask index      numbers of seeds of each mask, compared only when
+                                    the mask numbers are the same
+  second_masks      mask index      masks of the second mask set with a smaller k
+  second_seeds      total           total numbers of seeds of the second mask set
+  second_seeds      mask index      numbers of seeds of each mask of the second mask set
+
+Attention:
+  1. Checksums of genomes are computed from sequences and IDs of all contigs,
+     genome chunks are merged, and the order of contigs is ignored.
+     Use --skip-checksums to skip it for large indexes.
+  2. All seed data are read for counting seeds of masks.
+     Use --skip-seeds to skip it for large indexes.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		// ------------------------------
+
+		if len(args) != 2 {
+			checkError(fmt.Errorf("two index directories are needed"))
+		}
+		dbDirs := [2]string{args[0], args[1]}
+
+		outFile := getFlagString(cmd, "out-file")
+		skipChecksums := getFlagBool(cmd, "skip-checksums")
+		skipSeeds := getFlagBool(cmd, "skip-seeds")
+
+		// ---------------------------------------------------------------
+
+		timeStart := time.Now()
+		defer func() {
+			if opt.Verbose {
+				log.Info()
+				log.Infof("elapsed time: %s", time.Since(timeStart))
+				log.Info()
+			}
+		}()
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(outFile, ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		outfh.WriteString("category\titem\tindex1\tindex2\n")
+
+		// ---------------------------------------------------------------
+		// info
+
+		var infos [2]*index.IndexInfo
+		for i, dbDir := range dbDirs {
+			infos[i], err = index.ReadIndexInfo(filepath.Join(dbDir, index.FileInfo))
+			if err != nil {
+				checkError(fmt.Errorf("failed to read info file: %s", err))
+			}
+		}
+
+		var nInfo int
+		v1, v2 := reflect.ValueOf(*infos[0]), reflect.ValueOf(*infos[1])
+		t := v1.Type()
+		for i := 0; i < t.NumField(); i++ {
+			a, b := fmt.Sprintf("%v", v1.Field(i).Interface()), fmt.Sprintf("%v", v2.Field(i).Interface())
+			if a != b {
+				fmt.Fprintf(outfh, "info\t%s\t%s\t%s\n", t.Field(i).Tag.Get("toml"), a, b)
+				nInfo++
+			}
+		}
+
+		// ---------------------------------------------------------------
+		// masks
+
+		var lhs [2]*lexichash.LexicHash
+		for i, dbDir := range dbDirs {
+			lhs[i], err = lexichash.NewFromFile(filepath.Join(dbDir, index.FileMasks))
+			if err != nil {
+				checkError(fmt.Errorf("failed to read masks: %s", err))
+			}
+		}
+
+		nMasks := diffMasks(outfh, "masks", lhs)
+
+		// the second mask set, compared only when both indexes have it with the same k
+		hasSecondMasks := infos[0].K2 > 0 && infos[0].K2 == infos[1].K2
+		if hasSecondMasks {
+			for i, dbDir := range dbDirs {
+				lhs[i], err = lexichash.NewFromFile(filepath.Join(dbDir, index.FileMasksK(int(infos[i].K2))))
+				if err != nil {
+					checkError(fmt.Errorf("failed to read masks of the second mask set: %s", err))
+				}
+			}
+			nMasks += diffMasks(outfh, "second_masks", lhs)
+		}
+
+		// ---------------------------------------------------------------
+		// genomes
+
+		var maps [2]map[string]*[]uint64
+		for i, dbDir := range dbDirs {
+			maps[i], err = index.ReadGenomeMapName2Idx(filepath.Join(dbDir, index.FileGenomeIndex))
+			if err != nil {
+				checkError(fmt.Errorf("failed to read genome index mapping file: %s", err))
+			}
+		}
+
+		removed := make([]string, 0, 128)
+		common := make([]string, 0, len(maps[0]))
+		for id := range maps[0] {
+			if _, ok := maps[1][id]; ok {
+				common = append(common, id)
+			} else {
+				removed = append(removed, id)
+			}
+		}
+		added := make([]string, 0, 128)
+		for id := range maps[1] {
+			if _, ok := maps[0][id]; !ok {
+				added = append(added, id)
+			}
+		}
+		sort.Strings(removed)
+		sort.Strings(added)
+		sort.Strings(common)
+
+		for _, id := range removed {
+			fmt.Fprintf(outfh, "genome_removed\t%s\tyes\tno\n", id)
+		}
+		for _, id := range added {
+			fmt.Fprintf(outfh, "genome_added\t%s\tno\tyes\n", id)
+		}
+
+		var nChanged int
+		if !skipChecksums {
+			var checksums [2]map[string]uint64
+			for i, dbDir := range dbDirs {
+				if opt.Verbose {
+					log.Infof("computing checksums of %d common genomes in %s", len(common), dbDir)
+				}
+				checksums[i], err = genomeChecksums(dbDir, maps[i], common, infos[i].GenomeBatches, opt.NumCPUs)
+				checkError(err)
+			}
+
+			var c1, c2 uint64
+			for _, id := range common {
+				c1, c2 = checksums[0][id], checksums[1][id]
+				if c1 != c2 {
+					fmt.Fprintf(outfh, "genome_checksum\t%s\t%016x\t%016x\n", id, c1, c2)
+					nChanged++
+				}
+			}
+		}
+
+		// ---------------------------------------------------------------
+		// seeds
+
+		var nSeedMasks int
+		if !skipSeeds {
+			var seeds [2][]int // seeds of each mask
+			var totals [2]int
+			for i, dbDir := range dbDirs {
+				if opt.Verbose {
+					log.Infof("reading seeds data of %d chunks in %s", infos[i].Chunks, dbDir)
+				}
+				seeds[i], totals[i], err = seedsOfMasks(filepath.Join(dbDir, index.DirSeeds), infos[i].Chunks, opt.NumCPUs)
+				checkError(err)
+			}
+			nSeedMasks = diffSeeds(outfh, "seeds", seeds, totals)
+
+			if hasSecondMasks {
+				for i, dbDir := range dbDirs {
+					nChunks2, err := secondSeedsChunks(dbDir, infos[i])
+					checkError(err)
+					if opt.Verbose {
+						log.Infof("reading seeds data of %d chunks of the second mask set in %s", nChunks2, dbDir)
+					}
+					seeds[i], totals[i], err = seedsOfMasks(filepath.Join(dbDir, index.DirSeedsK(int(infos[i].K2))), nChunks2, opt.NumCPUs)
+					checkError(err)
+				}
+				nSeedMasks += diffSeeds(outfh, "second_seeds", seeds, totals)
+			}
+		}
+
+		if opt.Verbose {
+			log.Infof("differences:")
+			log.Infof("  fields in the info file: %d", nInfo)
+			log.Infof("  masks: %d", nMasks)
+			log.Infof("  genomes removed: %d, added: %d, sequences changed: %d", len(removed), len(added), nChanged)
+			log.Infof("  masks with different numbers of seeds: %d", nSeedMasks)
+		}
+	},
+}
+
+func init() {
+	utilsCmd.AddCommand(diffIndexCmd)
+
+	diffIndexCmd.Flags().StringP("out-file", "o", "-",
+		formatFlagUsage(`Out file, supports the ".gz" suffix ("-" for stdout).`))
+	diffIndexCmd.Flags().BoolP("skip-checksums", "", false,
+		formatFlagUsage(`Do not compare checksums of genome sequences.`))
+	diffIndexCmd.Flags().BoolP("skip-seeds", "", false,
+		formatFlagUsage(`Do not compare numbers of seeds of masks.`))
+
+	diffIndexCmd.SetUsageTemplate(usageTemplate("idx1 idx2"))
+}
+
+// diffMasks writes different masks of two mask sets with the same k and mask number,
+// and returns the number of them.
+func diffMasks(outfh *bufio.Writer, category string, lhs [2]*lexichash.LexicHash) int {
+	if lhs[0].K != lhs[1].K || len(lhs[0].Masks) != len(lhs[1].Masks) {
+		return 0
+	}
+	var n int
+	decoder := lexichash.MustDecoder()
+	k := uint8(lhs[0].K)
+	for i, m := range lhs[0].Masks {
+		if m != lhs[1].Masks[i] {
+			fmt.Fprintf(outfh, "%s\t%d\t%s\t%s\n", category, i+1, decoder(m, k), decoder(lhs[1].Masks[i], k))
+			n++
+		}
+	}
+	return n
+}
+
+// seedsOfMasks returns the numbers of seeds of each mask and the total number
+// in a seeds directory.
+func seedsOfMasks(dirSeeds string, nChunks int, threads int) ([]int, int, error) {
+	chunks, err := indexSeedStats(dirSeeds, nChunks, threads)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	seeds := make([]int, 0, 1024)
+	var total int
+	for _, c := range chunks {
+		for _, m := range c.masks {
+			seeds = append(seeds, m.seeds)
+		}
+		total += c.seeds
+	}
+	return seeds, total, nil
+}
+
+// diffSeeds writes different total numbers of seeds and numbers of seeds of masks,
+// and returns the number of masks with different numbers of seeds.
+func diffSeeds(outfh *bufio.Writer, category string, seeds [2][]int, totals [2]int) int {
+	if totals[0] != totals[1] {
+		fmt.Fprintf(outfh, "%s\ttotal\t%d\t%d\n", category, totals[0], totals[1])
+	}
+	if len(seeds[0]) != len(seeds[1]) {
+		return 0
+	}
+	var n int
+	for i, v := range seeds[0] {
+		if v != seeds[1][i] {
+			fmt.Fprintf(outfh, "%s\t%d\t%d\t%d\n", category, i+1, v, seeds[1][i])
+			n++
+		}
+	}
+	return n
+}
+
+// genomeChecksums computes checksums of given genomes.
+// A checksum is computed from sequences and IDs of all contigs,
+// where genome chunks are merged and the order of contigs is ignored.
+func genomeChecksums(dbDir string, m map[string]*[]uint64, ids []string, nBatches int, threads int) (map[string]uint64, error) {
+	// genomes to read in each batch
+	type target struct {
+		idx int
+		id  string
+	}
+	batches := make([][]target, nBatches)
+	var batch int
+	for _, id := range ids {
+		for _, batchIDAndRefID := range *m[id] {
+			batch = int(batchIDAndRefID >> index.BITS_GENOME_IDX)
+			if batch >= nBatches {
+				return nil, fmt.Errorf("genome batch out of range in the genome index mapping file: %s, batch %d", id, batch)
+			}
+			batches[batch] = append(batches[batch], target{idx: int(batchIDAndRefID & index.MASK_GENOME_IDX), id: id})
+		}
+	}
+
+	// checksums of contigs of each genome
+	contigs := make(map[string][]string, len(ids))
+	var mu sync.Mutex
+
+	var wg sync.WaitGroup
+	tokens := make(chan int, threads)
+	var _err error
+	for batch, targets := range batches {
+		if len(targets) == 0 {
+			continue
+		}
+		wg.Add(1)
+		tokens <- 1
+		go func(batch int, targets []target) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+
+			rdr, err := genome.NewReader(filepath.Join(dbDir, index.DirGenomes, index.BatchDir(batch), index.FileGenomes))
+			if err == nil {
+				defer rdr.Close()
+
+				var g *genome.Genome
+				for _, t := range targets {
+					g, err = rdr.Seq(t.idx)
+					if err != nil {
+						break
+					}
+					hashes := contigChecksums(g)
+					genome.RecycleGenome(g)
+
+					mu.Lock()
+					contigs[t.id] = append(contigs[t.id], hashes...)
+					mu.Unlock()
+				}
+			}
+			if err != nil {
+				mu.Lock()
+				_err = err
+				mu.Unlock()
+			}
+		}(batch, targets)
+	}
+	wg.Wait()
+	if _err != nil {
+		return nil, _err
+	}
+
+	checksums := make(map[string]uint64, len(ids))
+	for id, hashes := range contigs {
+		sort.Strings(hashes)
+		checksums[id] = wyhash.HashString(strings.Join(hashes, "\n"), 0)
+	}
+	return checksums, nil
+}
+
+// contigChecksums returns the "<seqid>\t<checksum>" of all contigs in a genome.
+func contigChecksums(g *genome.Genome) []string {
+	var interval int
+	if g.NumSeqs > 1 {
+		interval = (g.Len - g.GenomeSize) / (g.NumSeqs - 1)
+	}
+
+	hashes := make([]string, 0, g.NumSeqs)
+	var start, end int
+	for i, size := range g.SeqSizes {
+		end = start + size
+		if end > len(g.Seq) {
+			end = len(g.Seq)
+		}
+		if start > end {
+			start = end
+		}
+		hashes = append(hashes, fmt.Sprintf("%s\t%016x", *g.SeqIDs[i], wyhash.Hash(g.Seq[start:end], 0)))
+		start = end + interval
+	}
+	return hashes
+}
@@ -0,0 +1,438 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package genome
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
+)
+
+// MmapReader is a genome data reader backed by memory-mapped files.
+// Different from Reader, it does not hold any file handler after creation,
+// and it is safe for concurrent use by multiple goroutines,
+// as extracting a subsequence is just slicing the mapped data and decoding 2-bit bases.
+//
+// On platforms not supporting mmap, the whole data file is read into memory.
+type MmapReader struct {
+	batch uint32
+	nSeqs uint32
+
+	Index []uint64 // index data of all genome records, (offset, nbases)
+
+	file string // path of the genome data file
+	data []byte // mapped genome data file
+
+	mapped []byte // the whole mapped region, which might start before the data
+}
+
+// NewMmapReader returns a memory-mapped reader from a genome file.
+// Please call Close() to unmap the data after using it.
+func NewMmapReader(file string) (*MmapReader, error) {
+	if strings.HasSuffix(file, GenomeIndexFileExt) {
+		return nil, fmt.Errorf("genome file, not the index file should be given")
+	}
+
+	// ------------ genome index file ----------------
+
+	fileIndex := filepath.Clean(file) + GenomeIndexFileExt
+	idx, err := bundle.ReadFile(fileIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	// magic number, versions, batch number and the number of seqs
+	if len(idx) < 24 {
+		return nil, newFileError(fileIndex, "", int64(len(idx)), ErrBrokenFile)
+	}
+	if !bytes.Equal(MagicIdx[:], idx[:8]) {
+		return nil, newFileError(fileIndex, "", 0, ErrInvalidFileFormat)
+	}
+	if MainVersion != idx[8] {
+		return nil, newFileError(fileIndex, "", 8, ErrVersionMismatch)
+	}
+
+	r := &MmapReader{file: file}
+	r.batch = be.Uint32(idx[16:20])
+	r.nSeqs = be.Uint32(idx[20:24])
+
+	// each record takes 12 bytes
+	if int64(len(idx)) < 24+int64(r.nSeqs)*12 {
+		return nil, newFileError(fileIndex, "", 20, ErrBrokenFile)
+	}
+
+	// ------------ genome data file ----------------
+
+	fh, err := bundle.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	size := fh.Size()
+	if size < 16 {
+		return nil, newFileError(file, "", size, ErrBrokenFile)
+	}
+
+	r.Index = make([]uint64, r.nSeqs<<1)
+	var i2 int
+	var offset uint64
+	buf := idx[24:]
+	for i := 0; i < int(r.nSeqs); i++ {
+		i2 = i << 1
+		offset = be.Uint64(buf[:8])
+		// a genome record takes at least 22 bytes
+		if offset < 16 || offset+22 > uint64(size) {
+			return nil, newFileError(fileIndex, util.GenomeRecord(i), 24+int64(i)*12,
+				fmt.Errorf("%w: offset %d out of the range of data file size %d", ErrBrokenFile, offset, size))
+		}
+		r.Index[i2] = offset
+		r.Index[i2+1] = uint64(be.Uint32(buf[8:12]))
+		buf = buf[12:]
+	}
+
+	// the data might be a section of a bundle file
+	base, start := fh.Base()
+	r.mapped, r.data, err = mmapFile(base, start, int(size))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(Magic[:], r.data[:8]) {
+		munmapFile(r.mapped)
+		return nil, newFileError(file, "", 0, ErrInvalidFileFormat)
+	}
+	if MainVersion != r.data[8] {
+		munmapFile(r.mapped)
+		return nil, newFileError(file, "", 8, ErrVersionMismatch)
+	}
+
+	return r, nil
+}
+
+// Close unmaps the data file.
+// The reader should not be used after calling it.
+func (r *MmapReader) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	err := munmapFile(r.mapped)
+	r.data = nil
+	r.mapped = nil
+	return err
+}
+
+// Batch returns the batch id of the data file.
+func (r *MmapReader) Batch() int {
+	return int(r.batch)
+}
+
+// NumGenomes returns the number of genomes in the data file.
+func (r *MmapReader) NumGenomes() int {
+	return int(r.nSeqs)
+}
+
+// Seq returns the sequence with index of genome (0-based).
+func (r *MmapReader) Seq(idx int) (*Genome, error) {
+	return r.SubSeq(idx, 0, math.MaxInt)
+}
+
+// GenomeInfo returns the genome information of a genome (idx is 0-based),
+// Please call RecycleGenome() after using the result.
+func (r *MmapReader) GenomeInfo(idx int) (*Genome, error) {
+	if idx < 0 || idx >= int(r.nSeqs) {
+		return nil, fmt.Errorf("sequence index (%d) out of range: [0, %d]", idx, int(r.nSeqs)-1)
+	}
+
+	g := PoolGenome.Get().(*Genome)
+	_, err := r.genomeInfo(g, int(r.Index[idx<<1]), -1)
+	if err != nil {
+		RecycleGenome(g)
+		return nil, newFileError(r.file, util.GenomeRecord(idx), int64(r.Index[idx<<1]), err)
+	}
+	return g, nil
+}
+
+// genomeInfo parses the genome information starting at the offset,
+// and returns the offset of the 2-bit sequence data.
+// If nBasesIdx >= 0, the size of the 2-bit sequence is checked with it.
+func (r *MmapReader) genomeInfo(g *Genome, offset int, nBasesIdx int) (int, error) {
+	data := r.data
+	if offset < 16 || offset+2 > len(data) {
+		return -1, ErrBrokenFile
+	}
+
+	// ID
+	idLen := int(be.Uint16(data[offset : offset+2]))
+	offset += 2
+	if offset+idLen+12 > len(data) {
+		return -1, ErrBrokenFile
+	}
+	g.ID = g.ID[:0]
+	g.ID = append(g.ID, data[offset:offset+idLen]...)
+	offset += idLen
+
+	// genome size, Len of concatenated seqs, NumSeqs
+	g.GenomeSize = int(be.Uint32(data[offset : offset+4]))
+	g.Len = int(be.Uint32(data[offset+4 : offset+8]))
+	g.NumSeqs = int(be.Uint32(data[offset+8 : offset+12]))
+	offset += 12
+
+	// SeqSizes and SeqIDs
+	g.SeqSizes = g.SeqSizes[:0]
+	g.SeqIDs = g.SeqIDs[:0]
+	var idLen2 int
+	for i := 0; i < g.NumSeqs; i++ {
+		if offset+6 > len(data) {
+			return -1, ErrBrokenFile
+		}
+		g.SeqSizes = append(g.SeqSizes, int(be.Uint32(data[offset:offset+4])))
+
+		idLen2 = int(be.Uint16(data[offset+4 : offset+6]))
+		offset += 6
+		if offset+idLen2 > len(data) {
+			return -1, ErrBrokenFile
+		}
+		id := poolID.Get().(*[]byte)
+		*id = append((*id)[:0], data[offset:offset+idLen2]...)
+		g.SeqIDs = append(g.SeqIDs, id)
+		offset += idLen2
+	}
+
+	// the number of bytes and bases
+	if offset+8 > len(data) {
+		return -1, ErrBrokenFile
+	}
+	nBytes := int(be.Uint32(data[offset : offset+4]))
+	if offset+8+nBytes > len(data) {
+		return -1, ErrBrokenFile
+	}
+	if nBasesIdx >= 0 {
+		err := checkTwoBitSize(uint32(nBytes), be.Uint32(data[offset+4:offset+8]), nBasesIdx, -1, int64(offset), int64(len(data)))
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	return offset + 8, nil
+}
+
+// SubSeq returns the subsequence of a genome (idx is 0-based),
+// from start to end (both are 0-based and included).
+// Please call RecycleGenome() after using the result.
+func (r *MmapReader) SubSeq(idx int, start int, end int) (*Genome, error) {
+	if idx < 0 || idx >= int(r.nSeqs) {
+		return nil, fmt.Errorf("sequence index (%d) out of range: [0, %d]", idx, int(r.nSeqs)-1)
+	}
+
+	i2 := idx << 1
+	offset := int(r.Index[i2])
+	nBases := int(r.Index[i2+1])
+
+	if start < 0 {
+		start = 0
+	}
+	if end >= nBases-1 {
+		end = nBases - 1
+	}
+	if end < start {
+		end = start
+	}
+
+	g := PoolGenome.Get().(*Genome)
+
+	offset0 := offset
+	offset, err := r.genomeInfo(g, offset, nBases)
+	if err != nil {
+		RecycleGenome(g)
+		return nil, newFileError(r.file, util.GenomeRecord(idx), int64(offset0), err)
+	}
+
+	err = r.decode(g, offset, start, end)
+	if err != nil {
+		RecycleGenome(g)
+		return nil, newFileError(r.file, util.GenomeRecord(idx), int64(offset), err)
+	}
+	return g, nil
+}
+
+// SubSeq2 returns the subsequence of one genome (idx is 0-based),
+// from start to end (both are 0-based and included).
+// It also return the actual end position (0-based).
+// Please call RecycleGenome() after using the result.
+func (r *MmapReader) SubSeq2(idx int, seqid []byte, start int, end int) (*Genome, int, error) {
+	if idx < 0 || idx >= int(r.nSeqs) {
+		return nil, -1, fmt.Errorf("genome index (%d) out of range: [0, %d]", idx, int(r.nSeqs)-1)
+	}
+
+	i2 := idx << 1
+	offset := int(r.Index[i2])
+	nBases := int(r.Index[i2+1])
+
+	start0, end0 := start, end // copy for checking seq len later
+	endR := end                // returned end, user might give a end longer than the seq len
+
+	if start < 0 {
+		start = 0
+	}
+	if end >= nBases-1 {
+		end = nBases - 1
+	}
+	if end < start {
+		end = start
+	}
+
+	g := PoolGenome.Get().(*Genome)
+
+	offset0 := offset
+	offset, err := r.genomeInfo(g, offset, nBases)
+	if err != nil {
+		RecycleGenome(g)
+		return nil, -1, newFileError(r.file, util.GenomeRecord(idx), int64(offset0), err)
+	}
+
+	// locate the sequence in the concatenated sequence
+	var interval int
+	if g.NumSeqs > 1 {
+		interval = (g.Len - g.GenomeSize) / (g.NumSeqs - 1)
+	}
+	var foundSeqID bool
+	var seqLen, lenSum, endS int
+	for i, id := range g.SeqIDs {
+		if bytes.Equal(*id, seqid) { // found it!
+			foundSeqID = true
+			seqLen = g.SeqSizes[i]
+			start += lenSum
+			end += lenSum
+
+			endS = lenSum + seqLen - 1 // for end positions > seq len
+			// can't break, to be consistent with Reader.SubSeq2
+		} else {
+			lenSum += g.SeqSizes[i]
+			lenSum += interval
+		}
+	}
+	if !foundSeqID {
+		RecycleGenome(g)
+		return nil, -1, fmt.Errorf("seqid not found: %s", seqid)
+	}
+
+	if end0 >= seqLen {
+		end = endS
+		endR = seqLen - 1
+	}
+	if start0 > seqLen {
+		g.Seq = g.Seq[:0]
+		return g, endR, nil
+	}
+
+	err = r.decode(g, offset, start, end)
+	if err != nil {
+		RecycleGenome(g)
+		return nil, -1, newFileError(r.file, util.GenomeRecord(idx), int64(offset), err)
+	}
+	return g, endR, nil
+}
+
+// decode decodes bases in [start, end] from the 2-bit data starting at offset.
+func (r *MmapReader) decode(g *Genome, offset int, start int, end int) error {
+	l := end - start + 1
+
+	s := &g.Seq
+	*s = (*s)[:0]
+	if l <= 0 {
+		g.Len = 0
+		return nil
+	}
+
+	b0 := offset + start>>2
+	b1 := offset + end>>2 + 1
+	if start < 0 || b1 > len(r.data) {
+		return ErrBrokenFile
+	}
+	buf := r.data[b0:b1]
+	nBytes := len(buf)
+
+	// -- first byte --
+	b := buf[0]
+	j := start & 3
+	for ; j < 4; j++ {
+		*s = append(*s, bit2base[b>>(6-(j<<1))&3])
+	}
+	if len(*s) >= l {
+		*s = (*s)[:l]
+		g.Len = len(g.Seq)
+		return nil
+	}
+
+	// -- middle byte --
+	if nBytes > 2 {
+		for _, b = range buf[1 : nBytes-1] {
+			*s = append(*s, bit2base[b>>6&3])
+			*s = append(*s, bit2base[b>>4&3])
+			*s = append(*s, bit2base[b>>2&3])
+			*s = append(*s, bit2base[b&3])
+		}
+	}
+
+	// -- last byte --
+	if nBytes > 1 {
+		b = buf[nBytes-1]
+		for j = 0; j <= end&3; j++ {
+			*s = append(*s, bit2base[b>>(6-(j<<1))&3])
+		}
+	}
+
+	*s = (*s)[:l]
+	g.Len = len(g.Seq)
+	return nil
+}
+
+// SeqReader is the common interface of Reader and MmapReader.
+type SeqReader interface {
+	Seq(idx int) (*Genome, error)
+	GenomeInfo(idx int) (*Genome, error)
+	SubSeq(idx int, start int, end int) (*Genome, error)
+	SubSeq2(idx int, seqid []byte, start int, end int) (*Genome, int, error)
+	Close() error
+}
+
+// NewSeqReader returns a MmapReader if mmap is supported on this platform,
+// or a Reader otherwise.
+func NewSeqReader(file string) (SeqReader, error) {
+	if MmapSupported {
+		r, err := NewMmapReader(file)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	r, err := NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,50 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build unix
+
+package genome
+
+import (
+	"os"
+	"syscall"
+)
+
+// MmapSupported tells if memory-mapped files are supported on this platform.
+const MmapSupported = true
+
+// mmapFile maps size bytes starting at the offset of the file into memory in read-only mode.
+// As the offset of mmap should be a multiple of the page size,
+// the mapped region might start before the offset,
+// so both the mapped region (for unmapping) and the data are returned.
+func mmapFile(fh *os.File, offset int64, size int) ([]byte, []byte, error) {
+	start := offset - offset%int64(os.Getpagesize())
+	pad := int(offset - start)
+	mapped, err := syscall.Mmap(int(fh.Fd()), start, pad+size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mapped, mapped[pad:], nil
+}
+
+// munmapFile unmaps the data.
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -33,6 +33,9 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
 )
 
 var be = binary.BigEndian
@@ -84,6 +87,8 @@ type Genome struct {
 	// only used in index building
 	Kmers     *[]uint64 // lexichash mask result
 	Locses    *[][]int  // lexichash mask result
+	Kmers2    *[]uint64 // lexichash mask result of the optional second mask set
+	Locses2   *[][]int  // lexichash mask result of the optional second mask set
 	TwoBit    *[]byte   // bit-packed sequence
 	StartTime time.Time
 
@@ -129,6 +134,8 @@ func (r *Genome) Reset() {
 	// for safety
 	r.Kmers = nil
 	r.Locses = nil
+	r.Kmers2 = nil
+	r.Locses2 = nil
 	r.TwoBit = nil
 
 }
@@ -348,7 +355,9 @@ type Reader struct {
 
 	buf []byte
 
-	fhData    *os.File
+	file      string // path of the genome data file
+	dataSize  int64  // size of the genome data file
+	fhData    *bundle.File
 	bufReader *bufio.Reader
 }
 
@@ -365,27 +374,37 @@ func NewReader(file string) (*Reader, error) {
 		return nil, fmt.Errorf("genome file, not the index file should be given")
 	}
 
+	r := poolReader.Get().(*Reader)
+	err := r.open(file)
+	if err != nil {
+		poolReader.Put(r)
+		return nil, err
+	}
+	return r, nil
+}
+
+// open reads the index file and opens the genome data file.
+func (r *Reader) open(file string) error {
 	// ------------ genome index file ----------------
 
 	fileIndex := filepath.Clean(file) + GenomeIndexFileExt
-	var err error
-	r := poolReader.Get().(*Reader)
 
-	fh, err := os.Open(fileIndex)
+	fh, err := bundle.Open(fileIndex)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer fh.Close()
+
+	sizeIndex := fh.Size()
+
 	bfh := bufio.NewReader(fh)
 
 	buf := r.buf
 
 	// check the magic number
-	n, err := io.ReadFull(bfh, buf[:8])
+	_, err = io.ReadFull(bfh, buf[:8])
 	if err != nil {
-		return nil, err
-	}
-	if n < 8 {
-		return nil, ErrBrokenFile
+		return newFileError(fileIndex, "", 0, err)
 	}
 	same := true
 	for i := 0; i < 8; i++ {
@@ -395,66 +414,96 @@ func NewReader(file string) (*Reader, error) {
 		}
 	}
 	if !same {
-		return nil, ErrInvalidFileFormat
+		return newFileError(fileIndex, "", 0, ErrInvalidFileFormat)
 	}
 
 	// read metadata
-	n, err = io.ReadFull(bfh, buf[:8])
+	_, err = io.ReadFull(bfh, buf[:8])
 	if err != nil {
-		return nil, err
-	}
-	if n < 8 {
-		return nil, ErrBrokenFile
+		return newFileError(fileIndex, "", 8, err)
 	}
 
 	// check compatibility
 	if MainVersion != buf[0] {
-		return nil, ErrVersionMismatch
+		return newFileError(fileIndex, "", 8, ErrVersionMismatch)
 	}
 
 	// batch number and the number seqs
-	n, err = io.ReadFull(bfh, buf[:8])
+	_, err = io.ReadFull(bfh, buf[:8])
 	if err != nil {
-		return nil, err
-	}
-	if n < 8 {
-		return nil, ErrBrokenFile
+		return newFileError(fileIndex, "", 16, err)
 	}
 
 	r.batch = be.Uint32(buf[:4])
 	r.nSeqs = be.Uint32(buf[4:8])
 
+	// each record takes 12 bytes
+	if sizeIndex < 24+int64(r.nSeqs)*12 {
+		return newFileError(fileIndex, "", 20, ErrBrokenFile)
+	}
+
+	// ------------ genome data file ----------------
+
+	r.fhData, err = bundle.Open(file)
+	if err != nil {
+		return err
+	}
+	r.dataSize = r.fhData.Size()
+
 	// read all index data, because it's small
 	r.Index = make([]uint64, r.nSeqs<<1)
 	var i2 int
+	var offset uint64
 	for i := 0; i < int(r.nSeqs); i++ {
 		// offset in the data file and bases
-		n, err = io.ReadFull(bfh, buf[:12])
+		_, err = io.ReadFull(bfh, buf[:12])
 		if err != nil {
-			return nil, err
-		}
-		if n < 12 {
-			return nil, ErrBrokenFile
+			r.fhData.Close()
+			return newFileError(fileIndex, util.GenomeRecord(i), 24+int64(i)*12, err)
 		}
 		i2 = i << 1
-		r.Index[i2] = be.Uint64(buf[:8])
+		offset = be.Uint64(buf[:8])
+		// a genome record takes at least 22 bytes
+		if offset < 16 || offset+22 > uint64(r.dataSize) {
+			r.fhData.Close()
+			return newFileError(fileIndex, util.GenomeRecord(i), 24+int64(i)*12,
+				fmt.Errorf("%w: offset %d out of the range of data file size %d", ErrBrokenFile, offset, r.dataSize))
+		}
+		r.Index[i2] = offset
 		r.Index[i2+1] = uint64(be.Uint32(buf[8:12]))
 	}
-	err = fh.Close()
-	if err != nil {
-		return r, err
-	}
 
-	// ------------ genome data file ----------------
+	r.file = file
 
-	r.fhData, err = os.Open(file)
-	if err != nil {
-		return nil, err
+	r.bufReader = bufio.NewReaderSize(nil, 1024)
+
+	return nil
+}
+
+// checkTwoBitSize checks the number of bytes and bases of the 2-bit sequence
+// starting at offset+8, with the number of bases in the index and the end position to read.
+func checkTwoBitSize(nBytes, nBases uint32, nBasesIdx int, end int, offset int64, dataSize int64) error {
+	if int(nBases) != nBasesIdx || int64(nBytes) != (int64(nBases)+3)>>2 {
+		return fmt.Errorf("%w: unmatched sequence size: %d bytes, %d bases, %d bases in the index",
+			ErrBrokenFile, nBytes, nBases, nBasesIdx)
 	}
+	if offset+8+int64(nBytes) > dataSize || (nBases > 0 && end>>2 >= int(nBytes)) {
+		return ErrBrokenFile
+	}
+	return nil
+}
 
-	r.bufReader = bufio.NewReaderSize(nil, 1024)
+// grow makes sure the buffer has at least n bytes, and returns the first n bytes.
+func (r *Reader) grow(n int) []byte {
+	if n > len(r.buf) {
+		r.buf = append(r.buf, make([]byte, n-len(r.buf))...)
+	}
+	return r.buf[:n]
+}
 
-	return r, nil
+// NumGenomes returns the number of genomes in the data file.
+func (r *Reader) NumGenomes() int {
+	return int(r.nSeqs)
 }
 
 // Close closes and recycles the reader.
@@ -482,7 +531,7 @@ func (r *Reader) Seq(idx int) (*Genome, error) {
 
 // GenomeInfo returns the genome information of a genome (idx is 0-based),
 // Please call RecycleGenome() after using the result.
-func (r *Reader) GenomeInfo(idx int) (*Genome, error) {
+func (r *Reader) GenomeInfo(idx int) (_ *Genome, err error) {
 	if idx < 0 || idx >= int(r.nSeqs) {
 		return nil, fmt.Errorf("sequence index (%d) out of range: [0, %d]", idx, int(r.nSeqs)-1)
 	}
@@ -506,9 +555,13 @@ func (r *Reader) GenomeInfo(idx int) (*Genome, error) {
 	// nBases := int(be.Uint32(buf[8:12])) // for check end
 
 	var n int
-	var err error
 	i2 := idx << 1
 	offset := int64(r.Index[i2])
+	defer func() {
+		if err != nil {
+			err = newFileError(r.file, util.GenomeRecord(idx), offset, err)
+		}
+	}()
 
 	// -----------------------------------------------------------
 	// get sequence information
@@ -529,7 +582,7 @@ func (r *Reader) GenomeInfo(idx int) (*Genome, error) {
 	offset += 2
 
 	// ID
-	n, err = io.ReadFull(r.fhData, buf[:idLen])
+	n, err = io.ReadFull(r.fhData, r.grow(int(idLen)))
 	if err != nil {
 		return nil, err
 	}
@@ -537,7 +590,7 @@ func (r *Reader) GenomeInfo(idx int) (*Genome, error) {
 		return nil, ErrBrokenFile
 	}
 	g.ID = g.ID[:0]
-	g.ID = append(g.ID, buf[:idLen]...)
+	g.ID = append(g.ID, r.buf[:idLen]...)
 	offset += int64(idLen)
 
 	// genome size, Len of concatenated seqs, NumSeqs
@@ -605,7 +658,7 @@ func (r *Reader) GenomeInfo(idx int) (*Genome, error) {
 // SubSeq returns the subsequence of a genome (idx is 0-based),
 // from start to end (both are 0-based and included).
 // Please call RecycleGenome() after using the result.
-func (r *Reader) SubSeq(idx int, start int, end int) (*Genome, error) {
+func (r *Reader) SubSeq(idx int, start int, end int) (_ *Genome, err error) {
 	if idx < 0 || idx >= int(r.nSeqs) {
 		return nil, fmt.Errorf("sequence index (%d) out of range: [0, %d]", idx, int(r.nSeqs)-1)
 	}
@@ -629,9 +682,13 @@ func (r *Reader) SubSeq(idx int, start int, end int) (*Genome, error) {
 	// nBases := int(be.Uint32(buf[8:12])) // for check end
 
 	var n int
-	var err error
 	i2 := idx << 1
 	offset := int64(r.Index[i2])
+	defer func() {
+		if err != nil {
+			err = newFileError(r.file, util.GenomeRecord(idx), offset, err)
+		}
+	}()
 	nBases := int(r.Index[i2+1])
 
 	// -----------------------------------------------------------
@@ -668,7 +725,7 @@ func (r *Reader) SubSeq(idx int, start int, end int) (*Genome, error) {
 	offset += 2
 
 	// ID
-	n, err = io.ReadFull(br, buf[:idLen])
+	n, err = io.ReadFull(br, r.grow(int(idLen)))
 	if err != nil {
 		return nil, err
 	}
@@ -676,7 +733,7 @@ func (r *Reader) SubSeq(idx int, start int, end int) (*Genome, error) {
 		return nil, ErrBrokenFile
 	}
 	g.ID = g.ID[:0]
-	g.ID = append(g.ID, buf[:idLen]...)
+	g.ID = append(g.ID, r.buf[:idLen]...)
 	offset += int64(idLen)
 
 	// genome size, Len of concatenated seqs, NumSeqs
@@ -740,6 +797,16 @@ func (r *Reader) SubSeq(idx int, start int, end int) (*Genome, error) {
 
 	// get sequence
 
+	// #bytes+#bases
+	_, err = io.ReadFull(br, buf[:8])
+	if err != nil {
+		return nil, err
+	}
+	err = checkTwoBitSize(be.Uint32(buf[:4]), be.Uint32(buf[4:8]), nBases, end, offset, r.dataSize)
+	if err != nil {
+		return nil, err
+	}
+
 	// start of byte, 8 is #bytes+#bases
 	offset += 8 + int64(start>>2)
 	_, err = r.fhData.Seek(offset, 0)
@@ -849,7 +916,7 @@ func (r *Reader) SubSeq(idx int, start int, end int) (*Genome, error) {
 // from start to end (both are 0-based and included).
 // It also return the actual end position (0-based).
 // Please call RecycleGenome() after using the result.
-func (r *Reader) SubSeq2(idx int, seqid []byte, start int, end int) (*Genome, int, error) {
+func (r *Reader) SubSeq2(idx int, seqid []byte, start int, end int) (_ *Genome, _ int, err error) {
 	if idx < 0 || idx >= int(r.nSeqs) {
 		return nil, -1, fmt.Errorf("genome index (%d) out of range: [0, %d]", idx, int(r.nSeqs)-1)
 	}
@@ -873,9 +940,13 @@ func (r *Reader) SubSeq2(idx int, seqid []byte, start int, end int) (*Genome, in
 	// nBases := int(be.Uint32(buf[8:12])) // for check end
 
 	var n int
-	var err error
 	i2 := idx << 1
 	offset := int64(r.Index[i2])
+	defer func() {
+		if err != nil {
+			err = newFileError(r.file, util.GenomeRecord(idx), offset, err)
+		}
+	}()
 	nBases := int(r.Index[i2+1])
 
 	// -----------------------------------------------------------
@@ -912,7 +983,7 @@ func (r *Reader) SubSeq2(idx int, seqid []byte, start int, end int) (*Genome, in
 	offset += 2
 
 	// ID
-	n, err = io.ReadFull(r.fhData, buf[:idLen])
+	n, err = io.ReadFull(r.fhData, r.grow(int(idLen)))
 	if err != nil {
 		return nil, -1, err
 	}
@@ -920,7 +991,7 @@ func (r *Reader) SubSeq2(idx int, seqid []byte, start int, end int) (*Genome, in
 		return nil, -1, ErrBrokenFile
 	}
 	g.ID = g.ID[:0]
-	g.ID = append(g.ID, buf[:idLen]...)
+	g.ID = append(g.ID, r.buf[:idLen]...)
 	offset += int64(idLen)
 
 	// genome size, Len of concatenated seqs, NumSeqs
@@ -1027,6 +1098,16 @@ func (r *Reader) SubSeq2(idx int, seqid []byte, start int, end int) (*Genome, in
 		return g, endR, nil
 	}
 
+	// #bytes+#bases
+	_, err = io.ReadFull(r.fhData, buf[:8])
+	if err != nil {
+		return nil, -1, err
+	}
+	err = checkTwoBitSize(be.Uint32(buf[:4]), be.Uint32(buf[4:8]), nBases, end, offset, r.dataSize)
+	if err != nil {
+		return nil, -1, err
+	}
+
 	// start of byte, 8 is #bytes+#bases
 	offset += 8 + int64(start>>2)
 	_, err = r.fhData.Seek(offset, 0)
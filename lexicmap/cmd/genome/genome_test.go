@@ -22,9 +22,14 @@ package genome
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
 )
 
 func TestGenomeWritingAndSeqExtraction(t *testing.T) {
@@ -162,3 +167,270 @@ func TestReadAndWrite(t *testing.T) {
 		return
 	}
 }
+
+func TestMmapReader(t *testing.T) {
+	file := "t.mmap.2bit"
+
+	// ----------------------- write --------------
+
+	w, err := NewWriter(file, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_seqs := [][][]byte{
+		{[]byte("A")},
+		{[]byte("CATGC"), []byte("CA")},
+		{[]byte("ACCCTCGAGCGACTAG"), []byte("ACTAGACGACGTACGCGTACGTAGTACGATGCTCGA"), []byte("GCA")},
+	}
+	interval := 4
+	for i, seqs := range _seqs {
+		g := PoolGenome.Get().(*Genome)
+		g.Reset()
+		g.ID = append(g.ID, []byte(fmt.Sprintf("genome_%d", i+1))...)
+		for j, s := range seqs {
+			if j > 0 {
+				g.Seq = append(g.Seq, bytes.Repeat([]byte{'A'}, interval)...)
+			}
+			g.Seq = append(g.Seq, s...)
+			g.GenomeSize += len(s)
+			g.SeqSizes = append(g.SeqSizes, len(s))
+			seqid := []byte(fmt.Sprintf("seq_%d", j+1))
+			g.SeqIDs = append(g.SeqIDs, &seqid)
+		}
+		g.Len = len(g.Seq)
+		g.NumSeqs = len(seqs)
+
+		err = w.Write(g)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer func() {
+		os.RemoveAll(file)
+		os.RemoveAll(file + GenomeIndexFileExt)
+	}()
+
+	// ----------------------- read --------------
+
+	r, err := NewReader(file)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer r.Close()
+
+	m, err := NewMmapReader(file)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer m.Close()
+
+	// the mmap reader is shared by all goroutines
+	var wg sync.WaitGroup
+	errs := make(chan error, len(_seqs))
+	for i := range _seqs {
+		g, err := r.Seq(i)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		n := g.Len
+		RecycleGenome(g)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for start := 0; start < n; start++ {
+				for end := start; end < n+2; end++ {
+					g, err := m.SubSeq(i, start, end)
+					if err != nil {
+						errs <- err
+						return
+					}
+					e := end
+					if e >= n {
+						e = n - 1
+					}
+					s := _concat(_seqs[i], interval)[start : e+1]
+					if !bytes.Equal(s, g.Seq) {
+						errs <- fmt.Errorf("idx: %d:%d-%d, expected: %s, results: %s", i, start, end, s, g.Seq)
+						RecycleGenome(g)
+						return
+					}
+					RecycleGenome(g)
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// SubSeq2 should be the same as Reader.SubSeq2
+	for i, seqs := range _seqs {
+		for j, s := range seqs {
+			seqid := []byte(fmt.Sprintf("seq_%d", j+1))
+			for start := 0; start < len(s); start++ {
+				for end := start; end < len(s)+2; end++ {
+					g1, end1, err := r.SubSeq2(i, seqid, start, end)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					g2, end2, err := m.SubSeq2(i, seqid, start, end)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if end1 != end2 || !bytes.Equal(g1.Seq, g2.Seq) || !bytes.Equal(g2.Seq, s[start:end2+1]) {
+						t.Errorf("idx: %d, %s:%d-%d, expected: %s (%d), results: %s (%d)",
+							i, seqid, start, end, g1.Seq, end1, g2.Seq, end2)
+						return
+					}
+					RecycleGenome(g1)
+					RecycleGenome(g2)
+				}
+			}
+		}
+	}
+
+	// genome information
+	g, err := m.GenomeInfo(2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(g.ID) != "genome_3" || g.NumSeqs != 3 || len(g.SeqIDs) != 3 || string(*g.SeqIDs[2]) != "seq_3" {
+		t.Errorf("unexpected genome information: %s", g)
+	}
+	RecycleGenome(g)
+}
+
+func _concat(seqs [][]byte, interval int) []byte {
+	s := make([]byte, 0, 128)
+	for j, seq := range seqs {
+		if j > 0 {
+			s = append(s, bytes.Repeat([]byte{'A'}, interval)...)
+		}
+		s = append(s, seq...)
+	}
+	return s
+}
+
+func FuzzGenomeReader(f *testing.F) {
+	file := filepath.Join(f.TempDir(), "t.2bit")
+	w, err := NewWriter(file, 1)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for i, seqs := range [][][]byte{
+		{[]byte("ACGTACGTAC")},
+		{[]byte("CATGC"), []byte("CA")},
+	} {
+		g := PoolGenome.Get().(*Genome)
+		g.Reset()
+		g.ID = append(g.ID, []byte(fmt.Sprintf("genome_%d", i+1))...)
+		for j, s := range seqs {
+			if j > 0 {
+				g.Seq = append(g.Seq, 'A', 'A')
+			}
+			g.Seq = append(g.Seq, s...)
+			g.GenomeSize += len(s)
+			g.SeqSizes = append(g.SeqSizes, len(s))
+			seqid := []byte(fmt.Sprintf("seq_%d", j+1))
+			g.SeqIDs = append(g.SeqIDs, &seqid)
+		}
+		g.Len = len(g.Seq)
+		g.NumSeqs = len(seqs)
+		if err = w.Write(g); err != nil {
+			f.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		f.Fatal(err)
+	}
+
+	bData, err := os.ReadFile(file)
+	if err != nil {
+		f.Fatal(err)
+	}
+	bIndex, err := os.ReadFile(file + GenomeIndexFileExt)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	// a truncated file should return an error with details
+	err = os.WriteFile(file, bData[:len(bData)-1], 0644)
+	if err != nil {
+		f.Fatal(err)
+	}
+	r, err := NewReader(file)
+	if err != nil {
+		f.Fatal(err)
+	}
+	_, err = r.SubSeq(1, 0, 100)
+	var fe *util.FileError
+	if !errors.Is(err, ErrBrokenFile) || !errors.As(err, &fe) || fe.Record != "genome 1" {
+		f.Fatalf("expected a FileError of genome 1 for the truncated file, got: %v", err)
+	}
+	r.Close()
+
+	f.Add(bData, bIndex)
+	f.Add(bData[:len(bData)/2], bIndex)
+	f.Add(bData, bIndex[:len(bIndex)-3])
+	bData2 := append([]byte{}, bData...)
+	bData2[16] ^= 0xff // length of genome ID
+	f.Add(bData2, bIndex)
+	bIndex2 := append([]byte{}, bIndex...)
+	bIndex2[len(bIndex2)-1] ^= 0xff // number of bases
+	f.Add(bData, bIndex2)
+
+	f.Fuzz(func(t *testing.T, bData []byte, bIndex []byte) {
+		file := filepath.Join(t.TempDir(), "t.2bit")
+		if err := os.WriteFile(file, bData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file+GenomeIndexFileExt, bIndex, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// errors are allowed, but panics are not
+		var rdrs []SeqReader
+		if r, err := NewReader(file); err == nil {
+			rdrs = append(rdrs, r)
+		}
+		if r, err := NewMmapReader(file); err == nil {
+			rdrs = append(rdrs, r)
+		}
+		for _, r := range rdrs {
+			for i := 0; i < 4; i++ {
+				if g, err := r.GenomeInfo(i); err == nil {
+					RecycleGenome(g)
+				}
+				if g, err := r.SubSeq(i, 1, 8); err == nil {
+					RecycleGenome(g)
+				}
+				if g, _, err := r.SubSeq2(i, []byte("seq_2"), 0, 3); err == nil {
+					RecycleGenome(g)
+				}
+			}
+			r.Close()
+		}
+	})
+}
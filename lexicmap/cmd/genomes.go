@@ -28,6 +28,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/shenwei356/LexicMap/lexicmap/index"
 	"github.com/shenwei356/bio/seq"
 	"github.com/spf13/cobra"
 )
@@ -64,7 +65,7 @@ var genomesCmd = &cobra.Command{
 
 		// -----------------------------------------------------
 		// read genome chunks data if existed
-		genomeChunks, err := readGenomeChunksMapBig2Small(filepath.Join(dbDir, FileGenomeChunks))
+		genomeChunks, err := index.ReadGenomeChunksMapBig2Small(filepath.Join(dbDir, index.FileGenomeChunks))
 		if err != nil {
 			checkError(fmt.Errorf("failed to read genome chunk file: %s", err))
 		}
@@ -76,7 +77,7 @@ var genomesCmd = &cobra.Command{
 		// ---------------------------------------------------------------
 
 		// genomes.map file for mapping index to genome id
-		fh, err := os.Open(filepath.Join(dbDir, FileGenomeIndex))
+		fh, err := os.Open(filepath.Join(dbDir, index.FileGenomeIndex))
 		if err != nil {
 			checkError(fmt.Errorf("failed to read genome index mapping file: %s", err))
 		}
@@ -0,0 +1,715 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/seedposition"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+	"github.com/shenwei356/bio/seq"
+	"github.com/spf13/cobra"
+	"gonum.org/v1/gonum/stat"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+)
+
+var indexStatsCmd = &cobra.Command{
+	Use:   "index-stats",
+	Short: "Summarize seeds, genomes, and file sizes of an index",
+	Long: `Summarize seeds, genomes, and file sizes of an index
+
+Summary (TSV format with three columns: category, item, value) includes:
+  - files:   sizes (bytes) of each component.
+  - seeds:   numbers of k-mers, seeds (k-mer positions), and reversed seeds (for suffix matching),
+             and their distributions per mask and per seed chunk.
+  - second_seeds: numbers of k-mers and seeds of the second mask set with a smaller k, if existed.
+  - genomes: numbers of genomes and chunked genomes, and distributions of genome sizes
+             and contig numbers.
+
+Using -O/--out-dir will write detailed tables and histograms into the given directory:
+  - files.tsv:   size of each file.
+  - masks.tsv:   numbers of k-mers, seeds, and reversed seeds of each mask.
+  - chunks.tsv:  numbers of masks, k-mers, seeds, and reversed seeds, and file size of each seed chunk.
+  - second_masks.tsv, second_chunks.tsv: the same tables for the second mask set, if existed.
+  - genomes.tsv: genome size, the number of contigs, and the number of genome chunks of each genome.
+  - Histograms of k-mers per mask, seeds per mask, genome sizes, and contigs per genome.
+
+Attention:
+  1. All seed data are read, it would take a while for a large index.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		// ------------------------------
+
+		dbDir := getFlagString(cmd, "index")
+		if dbDir == "" {
+			checkError(fmt.Errorf("flag -d/--index needed"))
+		}
+
+		outFile := getFlagString(cmd, "out-file")
+		outDir := getFlagString(cmd, "out-dir")
+		force := getFlagBool(cmd, "force")
+
+		bins := getFlagPositiveInt(cmd, "bins")
+		width := vg.Length(getFlagPositiveFloat64(cmd, "width"))
+		height := vg.Length(getFlagPositiveFloat64(cmd, "height"))
+		plotExt := getFlagString(cmd, "plot-ext")
+		if plotExt == "" {
+			checkError(fmt.Errorf("the value of --plot-ext should not be empty"))
+		}
+
+		outputDir := outDir != ""
+		if outputDir {
+			makeOutDir(outDir, force, "out-dir", opt.Verbose)
+		}
+
+		// ---------------------------------------------------------------
+
+		timeStart := time.Now()
+		defer func() {
+			if opt.Verbose {
+				log.Info()
+				log.Infof("elapsed time: %s", time.Since(timeStart))
+				log.Info()
+			}
+		}()
+
+		fileInfo := filepath.Join(dbDir, index.FileInfo)
+		info, err := index.ReadIndexInfo(fileInfo)
+		if err != nil {
+			checkError(fmt.Errorf("failed to read info file: %s", err))
+		}
+
+		if opt.Verbose {
+			log.Infof("checking file sizes...")
+		}
+		files, err := indexFileSizes(dbDir, int(info.K2))
+		checkError(err)
+
+		if opt.Verbose {
+			log.Infof("reading seeds data of %d chunks...", info.Chunks)
+		}
+		chunks, err := indexSeedStats(filepath.Join(dbDir, index.DirSeeds), info.Chunks, opt.NumCPUs)
+		checkError(err)
+
+		// seeds of the second mask set
+		var chunks2 []*seedChunkStats
+		nChunks2, err := secondSeedsChunks(dbDir, info)
+		checkError(err)
+		if nChunks2 > 0 {
+			if opt.Verbose {
+				log.Infof("reading seeds data of %d chunks of the second mask set (k=%d)...", nChunks2, info.K2)
+			}
+			chunks2, err = indexSeedStats(filepath.Join(dbDir, index.DirSeedsK(int(info.K2))), nChunks2, opt.NumCPUs)
+			checkError(err)
+		}
+
+		if opt.Verbose {
+			log.Infof("reading genome information of %d batches...", info.GenomeBatches)
+		}
+		genomes, err := indexGenomeStats(dbDir, info.GenomeBatches, opt.NumCPUs)
+		checkError(err)
+
+		// ---------------------------------------------------------------
+		// summary
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(outFile, ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		outfh.WriteString("category\titem\tvalue\n")
+
+		// files
+		sizes := make(map[string]int64, len(indexFileComponents))
+		var total int64
+		for _, f := range files {
+			sizes[f.component] += f.size
+			total += f.size
+		}
+		for _, c := range indexFileComponents {
+			fmt.Fprintf(outfh, "files\t%s\t%d\n", c, sizes[c])
+		}
+		fmt.Fprintf(outfh, "files\ttotal\t%d\n", total)
+
+		// seeds
+		var nMasks, nKmers, nSeeds, nReversed int
+		vKmers := make(plotter.Values, 0, info.Masks)
+		vSeeds := make(plotter.Values, 0, info.Masks)
+		vReversed := make(plotter.Values, 0, info.Masks)
+		vChunkKmers := make(plotter.Values, 0, len(chunks))
+		vChunkSeeds := make(plotter.Values, 0, len(chunks))
+		for _, c := range chunks {
+			for _, m := range c.masks {
+				vKmers = append(vKmers, float64(m.kmers))
+				vSeeds = append(vSeeds, float64(m.seeds))
+				vReversed = append(vReversed, float64(m.reversed))
+			}
+			nMasks += len(c.masks)
+			nKmers += c.kmers
+			nSeeds += c.seeds
+			nReversed += c.reversed
+			vChunkKmers = append(vChunkKmers, float64(c.kmers))
+			vChunkSeeds = append(vChunkSeeds, float64(c.seeds))
+		}
+		fmt.Fprintf(outfh, "seeds\tk\t%d\n", info.K)
+		fmt.Fprintf(outfh, "seeds\tmasks\t%d\n", nMasks)
+		fmt.Fprintf(outfh, "seeds\tchunks\t%d\n", len(chunks))
+		fmt.Fprintf(outfh, "seeds\tpartitions\t%d\n", info.Partitions)
+		fmt.Fprintf(outfh, "seeds\tkmers\t%d\n", nKmers)
+		fmt.Fprintf(outfh, "seeds\tseeds\t%d\n", nSeeds)
+		fmt.Fprintf(outfh, "seeds\treversed_seeds\t%d\n", nReversed)
+		writeDistribution(outfh, "seeds", "kmers_per_mask", vKmers)
+		writeDistribution(outfh, "seeds", "seeds_per_mask", vSeeds)
+		writeDistribution(outfh, "seeds", "reversed_seeds_per_mask", vReversed)
+		writeDistribution(outfh, "seeds", "kmers_per_chunk", vChunkKmers)
+		writeDistribution(outfh, "seeds", "seeds_per_chunk", vChunkSeeds)
+
+		// seeds of the second mask set, which has no reversed seeds
+		var vKmers2, vSeeds2 plotter.Values
+		if nChunks2 > 0 {
+			var nMasks2, nKmers2, nSeeds2 int
+			vKmers2 = make(plotter.Values, 0, info.Masks2)
+			vSeeds2 = make(plotter.Values, 0, info.Masks2)
+			for _, c := range chunks2 {
+				for _, m := range c.masks {
+					vKmers2 = append(vKmers2, float64(m.kmers))
+					vSeeds2 = append(vSeeds2, float64(m.seeds))
+				}
+				nMasks2 += len(c.masks)
+				nKmers2 += c.kmers
+				nSeeds2 += c.seeds
+			}
+			fmt.Fprintf(outfh, "second_seeds\tk\t%d\n", info.K2)
+			fmt.Fprintf(outfh, "second_seeds\tmasks\t%d\n", nMasks2)
+			fmt.Fprintf(outfh, "second_seeds\tchunks\t%d\n", len(chunks2))
+			fmt.Fprintf(outfh, "second_seeds\tkmers\t%d\n", nKmers2)
+			fmt.Fprintf(outfh, "second_seeds\tseeds\t%d\n", nSeeds2)
+			writeDistribution(outfh, "second_seeds", "kmers_per_mask", vKmers2)
+			writeDistribution(outfh, "second_seeds", "seeds_per_mask", vSeeds2)
+		}
+
+		// genomes
+		var nChunked, nBases int
+		vSizes := make(plotter.Values, 0, len(genomes))
+		vContigs := make(plotter.Values, 0, len(genomes))
+		for _, g := range genomes {
+			if g.chunks > 1 {
+				nChunked++
+			}
+			nBases += g.size
+			vSizes = append(vSizes, float64(g.size))
+			vContigs = append(vContigs, float64(g.contigs))
+		}
+		fmt.Fprintf(outfh, "genomes\tgenomes\t%d\n", len(genomes))
+		fmt.Fprintf(outfh, "genomes\tchunked_genomes\t%d\n", nChunked)
+		fmt.Fprintf(outfh, "genomes\tgenome_records\t%d\n", info.Genomes)
+		fmt.Fprintf(outfh, "genomes\tgenome_batches\t%d\n", info.GenomeBatches)
+		fmt.Fprintf(outfh, "genomes\tbases\t%d\n", nBases)
+		writeDistribution(outfh, "genomes", "genome_size", vSizes)
+		writeDistribution(outfh, "genomes", "contigs_per_genome", vContigs)
+
+		if !outputDir {
+			return
+		}
+
+		// ---------------------------------------------------------------
+		// detailed tables
+
+		checkError(writeTSV(filepath.Join(outDir, "files.tsv"), "file\tcomponent\tsize\n",
+			func(fh *os.File) {
+				for _, f := range files {
+					fmt.Fprintf(fh, "%s\t%s\t%d\n", f.file, f.component, f.size)
+				}
+			}))
+
+		checkError(writeTSV(filepath.Join(outDir, "masks.tsv"), "mask\tchunk\tkmers\tseeds\treversed_seeds\n",
+			func(fh *os.File) {
+				for _, c := range chunks {
+					for i, m := range c.masks {
+						fmt.Fprintf(fh, "%d\t%d\t%d\t%d\t%d\n", c.firstMask+i+1, c.chunk, m.kmers, m.seeds, m.reversed)
+					}
+				}
+			}))
+
+		checkError(writeTSV(filepath.Join(outDir, "chunks.tsv"), "chunk\tmasks\tkmers\tseeds\treversed_seeds\tsize\n",
+			func(fh *os.File) {
+				for _, c := range chunks {
+					fmt.Fprintf(fh, "%d\t%d\t%d\t%d\t%d\t%d\n", c.chunk, len(c.masks), c.kmers, c.seeds, c.reversed, c.size)
+				}
+			}))
+
+		if nChunks2 > 0 {
+			checkError(writeTSV(filepath.Join(outDir, "second_masks.tsv"), "mask\tchunk\tkmers\tseeds\n",
+				func(fh *os.File) {
+					for _, c := range chunks2 {
+						for i, m := range c.masks {
+							fmt.Fprintf(fh, "%d\t%d\t%d\t%d\n", c.firstMask+i+1, c.chunk, m.kmers, m.seeds)
+						}
+					}
+				}))
+
+			checkError(writeTSV(filepath.Join(outDir, "second_chunks.tsv"), "chunk\tmasks\tkmers\tseeds\tsize\n",
+				func(fh *os.File) {
+					for _, c := range chunks2 {
+						fmt.Fprintf(fh, "%d\t%d\t%d\t%d\t%d\n", c.chunk, len(c.masks), c.kmers, c.seeds, c.size)
+					}
+				}))
+		}
+
+		checkError(writeTSV(filepath.Join(outDir, "genomes.tsv"), "ref\tgenome_size\tcontigs\tchunks\n",
+			func(fh *os.File) {
+				for _, g := range genomes {
+					fmt.Fprintf(fh, "%s\t%d\t%d\t%d\n", g.id, g.size, g.contigs, g.chunks)
+				}
+			}))
+
+		// ---------------------------------------------------------------
+		// histograms
+
+		hists := []struct {
+			name, title, xLabel string
+			values              plotter.Values
+		}{
+			{"kmers_per_mask", "K-mers per mask", "Number of k-mers", vKmers},
+			{"seeds_per_mask", "Seeds per mask", "Number of seeds", vSeeds},
+			{"second_kmers_per_mask", "K-mers per mask of the second mask set", "Number of k-mers", vKmers2},
+			{"second_seeds_per_mask", "Seeds per mask of the second mask set", "Number of seeds", vSeeds2},
+			{"genome_size", "Genome sizes", "Genome size (bp)", vSizes},
+			{"contigs_per_genome", "Contigs per genome", "Number of contigs", vContigs},
+		}
+		for _, h := range hists {
+			if len(h.values) == 0 {
+				continue
+			}
+			checkError(plotHistogram(h.values, bins, h.title, h.xLabel,
+				filepath.Join(outDir, h.name+plotExt), width, height))
+		}
+
+		if opt.Verbose {
+			log.Infof("tables and histograms saved to %s", outDir)
+		}
+	},
+}
+
+func init() {
+	utilsCmd.AddCommand(indexStatsCmd)
+
+	indexStatsCmd.Flags().StringP("index", "d", "",
+		formatFlagUsage(`Index directory created by "lexicmap index".`))
+	indexStatsCmd.Flags().StringP("out-file", "o", "-",
+		formatFlagUsage(`Out file of the summary, supports the ".gz" suffix ("-" for stdout).`))
+	indexStatsCmd.Flags().StringP("out-dir", "O", "",
+		formatFlagUsage(`Output directory for detailed tables and histograms.`))
+	indexStatsCmd.Flags().BoolP("force", "", false,
+		formatFlagUsage(`Overwrite existing output directory.`))
+
+	// for histogram
+	indexStatsCmd.Flags().IntP("bins", "b", 100,
+		formatFlagUsage(`Number of bins in histograms.`))
+	indexStatsCmd.Flags().Float64P("width", "", 6,
+		formatFlagUsage(`Histogram width (unit: inch).`))
+	indexStatsCmd.Flags().Float64P("height", "", 4,
+		formatFlagUsage(`Histogram height (unit: inch).`))
+	indexStatsCmd.Flags().StringP("plot-ext", "", ".png",
+		formatFlagUsage(`Histogram plot file extention.`))
+
+	indexStatsCmd.SetUsageTemplate(usageTemplate(""))
+}
+
+// indexFileComponents lists components of an index, in the output order.
+var indexFileComponents = []string{
+	"masks", "seeds_data", "seeds_index", "seeds_filter",
+	"second_masks", "second_seeds_data", "second_seeds_index",
+	"genome_data", "genome_index", "seed_positions", "genome_map", "genome_chunks",
+	"info", "others",
+}
+
+// indexFile is a file in the index.
+type indexFile struct {
+	file      string // path relative to the index directory
+	component string
+	size      int64
+}
+
+// indexFileComponent returns the component of a file in the index.
+// k2 is the k-mer size of the second mask set, 0 for none.
+func indexFileComponent(file string, k2 int) string {
+	switch file {
+	case index.FileMasks:
+		return "masks"
+	case index.FileInfo:
+		return "info"
+	case index.FileGenomeIndex:
+		return "genome_map"
+	case index.FileGenomeChunks:
+		return "genome_chunks"
+	}
+
+	base := filepath.Base(file)
+	if strings.HasPrefix(file, index.DirSeeds+string(filepath.Separator)) {
+		switch {
+		case strings.HasSuffix(base, index.ExtSeeds):
+			return "seeds_data"
+		case strings.HasSuffix(base, index.ExtSeeds+kv.KVIndexFileExt):
+			return "seeds_index"
+		case strings.HasSuffix(base, index.ExtSeeds+kv.KVFilterFileExt):
+			return "seeds_filter"
+		}
+	} else if k2 > 0 && strings.HasPrefix(file, index.DirSeedsK(k2)+string(filepath.Separator)) {
+		switch {
+		case strings.HasSuffix(base, index.ExtSeeds):
+			return "second_seeds_data"
+		case strings.HasSuffix(base, index.ExtSeeds+kv.KVIndexFileExt):
+			return "second_seeds_index"
+		}
+	} else if strings.HasPrefix(file, index.DirGenomes+string(filepath.Separator)) {
+		switch base {
+		case index.FileGenomes:
+			return "genome_data"
+		case index.FileGenomes + genome.GenomeIndexFileExt:
+			return "genome_index"
+		case index.FileSeedPositions, index.FileSeedPositions + seedposition.PositionsIndexFileExt:
+			return "seed_positions"
+		}
+	}
+	if k2 > 0 && file == index.FileMasksK(k2) {
+		return "second_masks"
+	}
+	return "others"
+}
+
+// indexFileSizes returns sizes of all files in the index.
+// k2 is the k-mer size of the second mask set, 0 for none.
+func indexFileSizes(dbDir string, k2 int) ([]*indexFile, error) {
+	files := make([]*indexFile, 0, 1024)
+	err := filepath.WalkDir(dbDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dbDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &indexFile{file: rel, component: indexFileComponent(rel, k2), size: fi.Size()})
+		return nil
+	})
+	return files, err
+}
+
+// seedMaskStats contains numbers of k-mers, seeds, and reversed seeds of a mask.
+type seedMaskStats struct {
+	kmers    int
+	seeds    int
+	reversed int
+}
+
+// seedChunkStats contains statistics of a seed chunk.
+type seedChunkStats struct {
+	chunk     int
+	firstMask int
+	size      int64 // size of the data file
+
+	kmers    int
+	seeds    int
+	reversed int
+
+	masks []seedMaskStats
+}
+
+// indexSeedStats reads all seed data in a seeds directory and counts k-mers and seeds of each mask.
+func indexSeedStats(dirSeeds string, nChunks int, threads int) ([]*seedChunkStats, error) {
+	chunks := make([]*seedChunkStats, nChunks)
+
+	var wg sync.WaitGroup
+	tokens := make(chan int, threads)
+	var _err error
+	var mu sync.Mutex
+	for chunk := 0; chunk < nChunks; chunk++ {
+		wg.Add(1)
+		tokens <- 1
+		go func(chunk int) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+
+			c, err := seedChunkStatsOf(filepath.Join(dirSeeds, index.ChunkFile(chunk)))
+			if err != nil {
+				mu.Lock()
+				_err = err
+				mu.Unlock()
+				return
+			}
+			c.chunk = chunk
+			chunks[chunk] = c
+		}(chunk)
+	}
+	wg.Wait()
+
+	return chunks, _err
+}
+
+// secondSeedsChunks returns the number of seed chunk files of the second mask set,
+// 0 is returned for an index without it.
+func secondSeedsChunks(dbDir string, info *index.IndexInfo) (int, error) {
+	if info.K2 == 0 {
+		return 0, nil
+	}
+	dirSeeds := filepath.Join(dbDir, index.DirSeedsK(int(info.K2)))
+	var n int
+	for {
+		_, err := os.Stat(filepath.Join(dirSeeds, index.ChunkFile(n)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return 0, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("seeds of the second mask set not found in: %s", dirSeeds)
+	}
+	return n, nil
+}
+
+// seedChunkStatsOf counts k-mers and seeds of each mask in a seed chunk file.
+func seedChunkStatsOf(file string) (*seedChunkStats, error) {
+	rdr, err := kv.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &seedChunkStats{
+		firstMask: rdr.ChunkIndex,
+		size:      fi.Size(),
+		masks:     make([]seedMaskStats, rdr.ChunkSize),
+	}
+
+	var i int
+	var kmer, pre uint64
+	for j := range c.masks {
+		data, err := rdr.ReadDataOfAMaskAsList()
+		if err != nil {
+			return nil, err
+		}
+
+		m := &c.masks[j]
+		for i = 0; i < len(data); i += 2 {
+			kmer = data[i]
+			if i == 0 || kmer != pre { // k-mers are sorted
+				m.kmers++
+				pre = kmer
+			}
+			if data[i+1]&index.MASK_REVERSE > 0 {
+				m.reversed++
+			}
+		}
+		m.seeds = len(data) >> 1
+
+		c.kmers += m.kmers
+		c.seeds += m.seeds
+		c.reversed += m.reversed
+	}
+
+	return c, nil
+}
+
+// genomeStats contains statistics of a reference genome,
+// which might be split into multiple chunks in the index.
+type genomeStats struct {
+	id      string
+	size    int
+	contigs int
+	chunks  int
+}
+
+// indexGenomeStats reads genome information of all genomes,
+// where genome chunks are merged. Genomes are sorted by ids.
+func indexGenomeStats(dbDir string, nBatches int, threads int) ([]*genomeStats, error) {
+	// size and the number of contigs of each genome in each batch
+	batches := make([][][2]int, nBatches)
+
+	var wg sync.WaitGroup
+	tokens := make(chan int, threads)
+	var _err error
+	var mu sync.Mutex
+	for batch := 0; batch < nBatches; batch++ {
+		wg.Add(1)
+		tokens <- 1
+		go func(batch int) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+
+			rdr, err := genome.NewReader(filepath.Join(dbDir, index.DirGenomes, index.BatchDir(batch), index.FileGenomes))
+			if err == nil {
+				defer rdr.Close()
+
+				stats := make([][2]int, rdr.NumGenomes())
+				var g *genome.Genome
+				for i := range stats {
+					g, err = rdr.GenomeInfo(i)
+					if err != nil {
+						break
+					}
+					stats[i] = [2]int{g.GenomeSize, g.NumSeqs}
+					genome.RecycleGenome(g)
+				}
+				batches[batch] = stats
+			}
+			if err != nil {
+				mu.Lock()
+				_err = err
+				mu.Unlock()
+			}
+		}(batch)
+	}
+	wg.Wait()
+	if _err != nil {
+		return nil, _err
+	}
+
+	// genome chunks are merged
+	m, err := index.ReadGenomeMapName2Idx(filepath.Join(dbDir, index.FileGenomeIndex))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read genome index mapping file: %s", err)
+	}
+	genomes := make([]*genomeStats, 0, len(m))
+	var batch, idx int
+	for id, list := range m {
+		g := &genomeStats{id: id, chunks: len(*list)}
+		for _, batchIDAndRefID := range *list {
+			batch = int(batchIDAndRefID >> index.BITS_GENOME_IDX)
+			idx = int(batchIDAndRefID & index.MASK_GENOME_IDX)
+			if batch >= nBatches || idx >= len(batches[batch]) {
+				return nil, fmt.Errorf("genome index out of range in the genome index mapping file: %s, batch %d, genome %d", id, batch, idx)
+			}
+			g.size += batches[batch][idx][0]
+			g.contigs += batches[batch][idx][1]
+		}
+		genomes = append(genomes, g)
+	}
+	sort.Slice(genomes, func(i, j int) bool { return genomes[i].id < genomes[j].id })
+
+	return genomes, nil
+}
+
+// writeDistribution writes the minimum, median, mean, and maximum values.
+func writeDistribution(w io.StringWriter, category string, name string, values plotter.Values) {
+	var min, median, mean, max float64
+	if len(values) > 0 {
+		v := make([]float64, len(values))
+		copy(v, values)
+		sort.Float64s(v)
+		min, max = v[0], v[len(v)-1]
+		median = getPercentile(0.5, v)
+		mean = stat.Mean(v, nil)
+	}
+	w.WriteString(fmt.Sprintf("%s\t%s_min\t%.0f\n", category, name, min))
+	w.WriteString(fmt.Sprintf("%s\t%s_median\t%.0f\n", category, name, median))
+	w.WriteString(fmt.Sprintf("%s\t%s_mean\t%.2f\n", category, name, mean))
+	w.WriteString(fmt.Sprintf("%s\t%s_max\t%.0f\n", category, name, max))
+}
+
+// writeTSV writes a table with a header line.
+func writeTSV(file string, header string, write func(fh *os.File)) error {
+	fh, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	_, err = fh.WriteString(header)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	write(fh)
+	return fh.Close()
+}
+
+// plotHistogram plots a histogram in the same style of "lexicmap utils seed-pos".
+func plotHistogram(v plotter.Values, bins int, title string, xLabel string,
+	file string, width, height vg.Length) error {
+	p := plot.New()
+
+	h, err := plotter.NewHist(v, bins)
+	if err != nil {
+		return err
+	}
+	h.FillColor = plotutil.Color(0)
+	p.Add(h)
+
+	vals := make([]float64, len(v))
+	copy(vals, v)
+	sort.Float64s(vals)
+
+	p.Title.Text = title
+	p.Title.TextStyle.Font.Size = 16
+	p.X.Label.Text = fmt.Sprintf("%s\n99th pctl=%.0f, median=%.0f, max=%.0f\n",
+		xLabel, getPercentile(0.99, vals), getPercentile(0.5, vals), vals[len(vals)-1])
+	p.Y.Label.Text = "Frequency"
+	p.X.Label.TextStyle.Font.Size = 14
+	p.Y.Label.TextStyle.Font.Size = 14
+	p.X.Width = 1.5
+	p.Y.Width = 1.5
+	p.X.Tick.Width = 1.5
+	p.Y.Tick.Width = 1.5
+	p.X.Tick.Label.Font.Size = 12
+	p.Y.Tick.Label.Font.Size = 12
+
+	return p.Save(width*vg.Inch, height*vg.Inch, file)
+}
@@ -29,6 +29,8 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
 	"github.com/shenwei356/bio/seq"
 	"github.com/shenwei356/util/pathutil"
 	"github.com/spf13/cobra"
@@ -155,8 +157,8 @@ Important parameters:
 		// basic flags
 
 		k := getFlagPositiveInt(cmd, "kmer")
-		if k < minK || k > 32 {
-			checkError(fmt.Errorf("the value of flag -k/--kmer should be in range of [%d, 32]", minK))
+		if k < index.MinK || k > 32 {
+			checkError(fmt.Errorf("the value of flag -k/--kmer should be in range of [%d, 32]", index.MinK))
 		}
 		minSeqLen := getFlagInt(cmd, "min-seq-len")
 		if minSeqLen < k {
@@ -190,8 +192,8 @@ Important parameters:
 		maxOpenFiles := getFlagPositiveInt(cmd, "max-open-files")
 
 		maxGenomeSize := getFlagNonNegativeInt(cmd, "max-genome")
-		if maxGenomeSize > MAX_GENOME_SIZE {
-			checkError(fmt.Errorf("value of -g/--max-genome (%d) should not be greater than the maximum supported genome size (%d)", maxGenomeSize, MAX_GENOME_SIZE))
+		if maxGenomeSize > index.MAX_GENOME_SIZE {
+			checkError(fmt.Errorf("value of -g/--max-genome (%d) should not be greater than the maximum supported genome size (%d)", maxGenomeSize, index.MAX_GENOME_SIZE))
 		}
 		fileBigGenomes := getFlagString(cmd, "big-genomes")
 
@@ -288,11 +290,12 @@ Important parameters:
 
 		// ---------------------------------------------------------------
 		// options for building index
-		bopt := &IndexBuildingOptions{
+		bopt := &index.IndexBuildingOptions{
 			// general
 			NumCPUs:      opt.NumCPUs,
 			Verbose:      opt.Verbose,
 			Log2File:     opt.Log2File,
+			Logger:       log,
 			Force:        force,
 			MaxOpenFiles: maxOpenFiles,
 			MergeThreads: mergeThreads,
@@ -326,6 +329,11 @@ Important parameters:
 			Chunks:     chunks,
 			Partitions: partitions,
 
+			NoReversedSeeds: getFlagBool(cmd, "no-reversed-seeds"),
+
+			K2:     getFlagNonNegativeInt(cmd, "second-kmer"),
+			Masks2: getFlagPositiveInt(cmd, "second-masks"),
+
 			// genome batches
 			GenomeBatchSize: batchSize,
 
@@ -336,8 +344,12 @@ Important parameters:
 			ContigInterval: contigInterval,
 
 			SaveSeedPositions: getFlagBool(cmd, "save-seed-pos"),
+
+			SeedFilter:       getFlagBool(cmd, "seed-filter"),
+			SeedFilterPrefix: uint8(getFlagPositiveInt(cmd, "seed-filter-prefix")),
+			SeedFilterBits:   getFlagPositiveInt(cmd, "seed-filter-bits"),
 		}
-		err = CheckIndexBuildingOptions(bopt)
+		err = index.CheckIndexBuildingOptions(bopt)
 		checkError(err)
 
 		// ---------------------------------------------------------------
@@ -389,8 +401,8 @@ Important parameters:
 		}
 		if len(files) < 1 {
 			checkError(fmt.Errorf("FASTA/Q files needed"))
-		} else if len(files) > 1<<BITS_IDX { // 1<< 34
-			checkError(fmt.Errorf("at most %d files supported, given: %d", 1<<BITS_IDX, len(files)))
+		} else if len(files) > 1<<index.BITS_IDX { // 1<< 34
+			checkError(fmt.Errorf("at most %d files supported, given: %d", 1<<index.BITS_IDX, len(files)))
 		} else if opt.Verbose || opt.Log2File {
 			log.Infof("  %d input file(s) given", len(files))
 		}
@@ -479,7 +491,7 @@ Important parameters:
 		// ---------------------------------------------------------------
 
 		// index
-		err = BuildIndex(outDir, files, bopt)
+		err = index.BuildIndex(outDir, files, bopt)
 		if err != nil {
 			checkError(fmt.Errorf("failed to create a new index: %s", err))
 		}
@@ -517,7 +529,7 @@ func init() {
 		formatFlagUsage(`Maximum sequence length to index. The value would be k for values <= 0`))
 
 	indexCmd.Flags().IntP("max-genome", "g", 15000000,
-		formatFlagUsage(fmt.Sprintf(`Maximum genome size. Extremely large genomes (e.g., non-isolate assemblies from Genbank) will be skipped. Need to be smaller than the maximum supported genome size: %d`, MAX_GENOME_SIZE)))
+		formatFlagUsage(fmt.Sprintf(`Maximum genome size. Extremely large genomes (e.g., non-isolate assemblies from Genbank) will be skipped. Need to be smaller than the maximum supported genome size: %d`, index.MAX_GENOME_SIZE)))
 
 	// indexCmd.Flags().StringP("ref-name-info", "", ``,
 	// 	formatFlagUsage(`A two-column tab-delimted file for mapping reference names (extracted by --ref-name-regexp) to taxonomic information such as species names. It helps to reduce memory usage.`))
@@ -580,13 +592,31 @@ func init() {
 	indexCmd.Flags().IntP("max-open-files", "", 512,
 		formatFlagUsage(`Maximum opened files, used in merging indexes.`))
 
+	indexCmd.Flags().BoolP("no-reversed-seeds", "", false,
+		formatFlagUsage(`Do not save seeds of reversed k-mers, which are used for suffix matching. `+
+			`It nearly halves the size of seed data and speeds up searching, at the cost of lower sensitivity for divergent queries. `+
+			`Suitable for fast screening of closely related genomes.`))
+
+	indexCmd.Flags().IntP("second-kmer", "", 0,
+		formatFlagUsage(`K-mer size of an optional second mask set, e.g., 21, which should be smaller than -k/--kmer. `+
+			`Seeds captured by it are saved in a separate directory (seeds_k<k>), and they help to find anchors for divergent queries. 0 for none.`))
+	indexCmd.Flags().IntP("second-masks", "", 20000,
+		formatFlagUsage(`Number of masks of the second mask set.`))
+
+	indexCmd.Flags().BoolP("seed-filter", "", false,
+		formatFlagUsage(`Create presence filters of seed prefixes, which help to skip disk access for absent seeds in searching, especially for queries from novel organisms.`))
+	indexCmd.Flags().IntP("seed-filter-prefix", "", int(kv.DefaultFilterPrefix),
+		formatFlagUsage(`Prefix length of seeds in the presence filters. Filters are only used when -p/--seed-min-prefix in "lexicmap search" is >= this value.`))
+	indexCmd.Flags().IntP("seed-filter-bits", "", kv.DefaultFilterBitsPerKey,
+		formatFlagUsage(`Bits for each distinct seed prefix in the presence filters. Bigger values bring fewer false positives and bigger files.`))
+
 	indexCmd.Flags().BoolP("save-seed-pos", "", false,
 		formatFlagUsage(`Save seed positions, which can be inspected with "lexicmap utils seed-pos".`))
 
 	// -----------------------------  genome batches   -----------------------------
 
 	indexCmd.Flags().IntP("batch-size", "b", 5000,
-		formatFlagUsage(fmt.Sprintf(`Maximum number of genomes in each batch (maximum value: %d)`, 1<<BITS_GENOME_IDX)))
+		formatFlagUsage(fmt.Sprintf(`Maximum number of genomes in each batch (maximum value: %d)`, 1<<index.BITS_GENOME_IDX)))
 
 	indexCmd.Flags().IntP("seed-data-threads", "J", 8,
 		formatFlagUsage(`Number of threads for writing seed data and merging seed chunks from all batches, the value should be in range of [1, -c/--chunks]`))
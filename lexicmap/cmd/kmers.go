@@ -30,6 +30,7 @@ import (
 
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
 	"github.com/shenwei356/bio/seq"
 	"github.com/shenwei356/lexichash"
 	"github.com/spf13/cobra"
@@ -97,7 +98,7 @@ Attention:
 		}
 
 		// Mask file
-		fileMask := filepath.Join(dbDir, FileMasks)
+		fileMask := filepath.Join(dbDir, index.FileMasks)
 		lh, err := lexichash.NewFromFile(fileMask)
 		if err != nil {
 			checkError(err)
@@ -108,8 +109,8 @@ Attention:
 		}
 
 		// info file
-		fileInfo := filepath.Join(dbDir, FileInfo)
-		info, err := readIndexInfo(fileInfo)
+		fileInfo := filepath.Join(dbDir, index.FileInfo)
+		info, err := index.ReadIndexInfo(fileInfo)
 		if err != nil {
 			checkError(fmt.Errorf("failed to read info file: %s", err))
 		}
@@ -119,7 +120,7 @@ Attention:
 		}
 
 		// genomes.map file for mapping index to genome id
-		m, err := readGenomeMapIdx2Name(filepath.Join(dbDir, FileGenomeIndex))
+		m, err := index.ReadGenomeMapIdx2Name(filepath.Join(dbDir, index.FileGenomeIndex))
 		if err != nil {
 			checkError(fmt.Errorf("failed to read genomes index mapping file: %s", err))
 		}
@@ -220,7 +221,7 @@ Attention:
 			chunk = (mask - 1) / chunkSize
 			iMask = (mask - 1) % chunkSize
 
-			fileSeeds = filepath.Join(dbDir, DirSeeds, chunkFile(chunk))
+			fileSeeds = filepath.Join(dbDir, index.DirSeeds, index.ChunkFile(chunk))
 
 			// kv-data index file
 			k, _, indexes, _, _, err := kv.ReadKVIndex(filepath.Clean(fileSeeds) + kv.KVIndexFileExt)
@@ -328,12 +329,12 @@ Attention:
 					v = be.Uint64(buf8)
 					// pos, rc = int(v<<34>>35), int(v&1)
 					// batchIDAndRefID = v >> 30
-					rvFlag = int(v & BITS_REVERSE)
+					rvFlag = int(v & index.BITS_REVERSE)
 					if onlyFwd && rvFlag == 1 {
 						continue
 					}
-					pos, rc = int(v<<BITS_IDX>>BITS_NONE_POS), int(v>>BITS_REVERSE&BITS_STRAND)
-					batchIDAndRefID = v >> BITS_NONE_IDX
+					pos, rc = int(v<<index.BITS_IDX>>index.BITS_NONE_POS), int(v>>index.BITS_REVERSE&index.BITS_STRAND)
+					batchIDAndRefID = v >> index.BITS_NONE_IDX
 					fmt.Fprintf(outfh, "%d\t%s\t%d\t%d\t%s\t%d\t%c\t%s\n",
 						mask, decoder(kmer1, k), util.MustKmerLongestPrefix(kmer1, maskCode, k8, k8),
 						lenVal1, m[batchIDAndRefID], pos+1, lexichash.Strands[rc], reversedStr[rvFlag])
@@ -355,12 +356,12 @@ Attention:
 					v = be.Uint64(buf8)
 					// pos, rc = int(v<<34>>35), int(v&1)
 					// batchIDAndRefID = v >> 30
-					rvFlag = int(v & BITS_REVERSE)
+					rvFlag = int(v & index.BITS_REVERSE)
 					if onlyFwd && rvFlag == 1 {
 						continue
 					}
-					pos, rc = int(v<<BITS_IDX>>BITS_NONE_POS), int(v>>BITS_REVERSE&BITS_STRAND)
-					batchIDAndRefID = v >> BITS_NONE_IDX
+					pos, rc = int(v<<index.BITS_IDX>>index.BITS_NONE_POS), int(v>>index.BITS_REVERSE&index.BITS_STRAND)
+					batchIDAndRefID = v >> index.BITS_NONE_IDX
 					fmt.Fprintf(outfh, "%d\t%s\t%d\t%d\t%s\t%d\t%c\t%s\n",
 						mask, decoder(kmer2, k), util.MustKmerLongestPrefix(kmer2, maskCode, k8, k8),
 						lenVal2, m[batchIDAndRefID], pos+1, lexichash.Strands[rc], reversedStr[rvFlag])
@@ -0,0 +1,257 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
+)
+
+// readRecordHeader reads the header of a k-mer-value record into rdr.buf,
+// i.e., the control byte and delta values of 2 k-mers,
+// and the control byte and numbers of values of the 2 k-mers.
+//
+// Returned:
+//
+//	k-mer 1 and k-mer 2, where offset is the previous k-mer.
+//	Number of values of the record.
+//	If there's a k-mer 2.
+//	If it's the last record of the mask.
+//	Number of bytes of the header.
+func (rdr *Reader) readRecordHeader(offset uint64) (kmer1, kmer2, nVals uint64, hasKmer2, lastPair bool, n int, err error) {
+	buf := rdr.buf
+	r := rdr.r
+
+	// read the control byte
+	_, err = io.ReadFull(r, buf[:1])
+	if err != nil {
+		return
+	}
+	ctrlByte := buf[0]
+
+	lastPair = ctrlByte&128 > 0 // 1<<7
+	hasKmer2 = ctrlByte&64 == 0 // 1<<6
+
+	ctrlByte &= 63
+
+	// read encoded bytes
+	nBytes := util.CtrlByte2ByteLengthsUint64(ctrlByte)
+	_, err = io.ReadFull(r, buf[1:nBytes+1])
+	if err != nil {
+		return
+	}
+
+	v1, v2, nDecoded := util.Uint64s(ctrlByte, buf[1:nBytes+1])
+	if nDecoded == 0 {
+		err = ErrBrokenFile
+		return
+	}
+	kmer1 = v1 + offset
+	kmer2 = kmer1 + v2
+	n = nBytes + 1
+
+	// ------------------ lengths of values -------------------
+
+	// read the control byte
+	_, err = io.ReadFull(r, buf[n:n+1])
+	if err != nil {
+		return
+	}
+	ctrlByte = buf[n]
+	n++
+
+	// read encoded bytes
+	nBytes = util.CtrlByte2ByteLengthsUint64(ctrlByte)
+	_, err = io.ReadFull(r, buf[n:n+nBytes])
+	if err != nil {
+		return
+	}
+
+	lenVal1, lenVal2, nDecoded := util.Uint64s(ctrlByte, buf[n:n+nBytes])
+	if nDecoded == 0 {
+		err = ErrBrokenFile
+		return
+	}
+	n += nBytes
+
+	nVals = lenVal1
+	if hasKmer2 {
+		nVals += lenVal2
+	}
+	// values should not exceed the remaining data
+	if nVals > uint64(rdr.size-rdr.r.offset)>>3 {
+		err = ErrBrokenFile
+		return
+	}
+
+	return
+}
+
+// SkipDataOfAMask skips data of the next mask, without decoding values.
+func (rdr *Reader) SkipDataOfAMask() (err error) {
+	rdr.iMask++
+	defer func() {
+		if err != nil {
+			err = rdr.wrapError(err)
+		}
+	}()
+
+	r := rdr.r
+
+	// 8-byte the number of k-mers
+	_, err = io.ReadFull(r, rdr.buf8)
+	if err != nil {
+		return err
+	}
+	if be.Uint64(rdr.buf8) == 0 {
+		return nil
+	}
+
+	var kmer2, nVals uint64
+	var lastPair bool
+	for {
+		_, kmer2, nVals, _, lastPair, _, err = rdr.readRecordHeader(kmer2)
+		if err != nil {
+			return err
+		}
+
+		_, err = r.Discard(int(nVals << 3))
+		if err != nil {
+			return err
+		}
+
+		if lastPair {
+			break
+		}
+	}
+
+	return nil
+}
+
+// CopyDataOfAMask copies data of the next mask from a reader, without decoding values.
+// Anchors in the index file are created at the same time.
+// It's used for redistributing masks into a different number of chunks.
+func (wtr *Writer) CopyDataOfAMask(rdr *Reader) (err error) {
+	if rdr.K != wtr.K {
+		return fmt.Errorf("k-mer-value data: k-mer sizes mismatch: %d != %d", rdr.K, wtr.K)
+	}
+
+	rdr.iMask++
+	defer func() {
+		if err != nil {
+			err = rdr.wrapError(err)
+		}
+	}()
+
+	buf8 := rdr.buf8
+	r := rdr.r
+	w := wtr.w
+
+	// 8-byte the number of k-mers
+	_, err = io.ReadFull(r, buf8)
+	if err != nil {
+		return err
+	}
+	nKmers := be.Uint64(buf8)
+
+	_, err = w.Write(buf8)
+	if err != nil {
+		return err
+	}
+	wtr.N += 8
+
+	if nKmers == 0 { // this hapens when no captured k-mer for a mask
+		// 8-byte the number of anchors
+		return binary.Write(wtr.wi, be, uint64(0))
+	}
+
+	p2o := wtr.poolP2O.Get().(*[]uint64)
+	defer wtr.poolP2O.Put(p2o)
+	clear(*p2o)
+	(*p2o)[1] = uint64(wtr.N) << 1 // offset of the first k-mer
+
+	getAnchor := wtr.getAnchor
+	var prefix, prefixPre uint64
+	first := true
+	var j, n int
+	var kmer1, kmer2, nVals, _nKmers uint64
+	var hasKmer2, lastPair bool
+	for {
+		kmer1, kmer2, nVals, hasKmer2, lastPair, n, err = rdr.readRecordHeader(kmer2)
+		if err != nil {
+			return err
+		}
+
+		// ------------------------------------------------------------------------
+		// index anchor, the same as WriteDataOfAMask
+
+		// key 1
+		prefix = getAnchor(kmer1)
+		if first || prefix != prefixPre { // the first new prefix
+			first = false
+
+			j = int(prefix<<1) + 2
+			(*p2o)[j], (*p2o)[j+1] = kmer1, uint64(wtr.N)<<1
+
+			prefixPre = prefix
+		}
+		_nKmers++
+
+		// key 2
+		if hasKmer2 {
+			prefix = getAnchor(kmer2)
+			if prefix != prefixPre { // the first new prefix
+				j = int(prefix<<1) + 2
+				(*p2o)[j], (*p2o)[j+1] = kmer2, uint64(wtr.N)<<1|1 // add a flag to mark it's the second k-mer
+
+				prefixPre = prefix
+			}
+			_nKmers++
+		}
+
+		// ------------------------------------------------------------------------
+
+		_, err = w.Write(rdr.buf[:n])
+		if err != nil {
+			return err
+		}
+		wtr.N += n
+
+		_, err = io.CopyN(w, r, int64(nVals<<3))
+		if err != nil {
+			return err
+		}
+		wtr.N += int(nVals << 3)
+
+		if lastPair {
+			break
+		}
+	}
+
+	if _nKmers != nKmers {
+		return fmt.Errorf("number of k-mers mismatch. expected: %d, got: %d", nKmers, _nKmers)
+	}
+
+	return wtr.writeAnchors(p2o)
+}
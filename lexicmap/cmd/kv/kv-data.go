@@ -32,6 +32,7 @@ import (
 	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
 	"github.com/twotwotwo/sorts/sortutil"
 )
@@ -202,6 +203,9 @@ func NewWriter(k uint8, MaskOffset int, chunkSize int, file string, maskPrefix u
 	if anchorPrefix == 0 {
 		return nil, fmt.Errorf("anchorPrefix could not be 0")
 	}
+	if anchorPrefix > MaxAnchorPrefix {
+		return nil, fmt.Errorf("anchorPrefix should be <= %d", MaxAnchorPrefix)
+	}
 
 	// file handlers
 	fh, err := os.Create(file)
@@ -524,8 +528,17 @@ func (wtr *Writer) WriteDataOfAMask(m map[uint64]*[]uint64) (err error) {
 	// -----------------------------------------
 	// save index
 
-	var kmer uint64
+	return wtr.writeAnchors(p2o)
+}
+
+// writeAnchors writes anchors of a mask to the index file.
+func (wtr *Writer) writeAnchors(p2o *[]uint64) (err error) {
+	buf := wtr.buf
+	wi := wtr.wi
+
+	var kmer, offset uint64
 	var nAnchors uint64
+	var j int
 	e := len(*p2o) >> 1
 	for i := 0; i < e; i++ {
 		offset = (*p2o)[i<<1+1]
@@ -570,79 +583,45 @@ func (wtr *Writer) WriteDataOfAMask(m map[uint64]*[]uint64) (err error) {
 // A list of k-mer and offset pairs are intermittently saved in a []uint64.
 // e.g., [k1, o1, k2, o2].
 func ReadKVIndex(file string) (uint8, int, [][]uint64, uint8, uint8, error) {
-	fh, err := os.Open(file)
+	fh, err := bundle.Open(file)
 	if err != nil {
 		return 0, -1, nil, 0, 0, err
 	}
-	r := bufio.NewReader(fh)
 	defer fh.Close()
 
-	// ---------------------------------------------
+	size := fh.Size()
 
-	buf := make([]byte, 8)
+	r := newOffsetReader(fh, 0)
 
-	var n int
+	// ---------------------------------------------
 
-	// check the magic number
-	n, err = io.ReadFull(r, buf)
-	if err != nil {
-		return 0, -1, nil, 0, 0, err
-	}
-	if n < 8 {
-		return 0, -1, nil, 0, 0, ErrBrokenFile
-	}
-	same := true
-	for i := 0; i < 8; i++ {
-		if MagicIdx[i] != buf[i] {
-			same = false
-			break
-		}
-	}
-	if !same {
-		return 0, -1, nil, 0, 0, ErrInvalidFileFormat
-	}
-	// read version information
-	n, err = io.ReadFull(r, buf)
-	if err != nil {
-		return 0, -1, nil, 0, 0, err
-	}
-	if n < 8 {
-		return 0, -1, nil, 0, 0, ErrBrokenFile
-	}
-	// check compatibility
-	if MainVersion != buf[0] {
-		return 0, -1, nil, 0, 0, ErrVersionMismatch
-	}
-	k := buf[2] // k-mer size
-	maskPrefix := buf[3]
-	anchorPrefix := buf[4]
+	buf := make([]byte, 8)
 
-	// index of the first mask in current chunk.
-	var iFirstMask int
-	_, err = io.ReadFull(r, buf)
+	k, maskPrefix, anchorPrefix, iFirstMask, nMasks, err := readKVIndexHeader(r, buf)
 	if err != nil {
-		return 0, -1, nil, 0, 0, err
+		return 0, -1, nil, 0, 0, newFileError(file, "", r.offset, err)
 	}
-	iFirstMask = int(be.Uint64(buf))
 
-	// mask chunk size
-	var nMasks int
-	_, err = io.ReadFull(r, buf)
-	if err != nil {
-		return 0, -1, nil, 0, 0, err
+	// each mask needs at least 8 bytes
+	if int64(nMasks) > (size-r.offset)>>3 {
+		return 0, -1, nil, 0, 0, newFileError(file, "", 24, ErrBrokenFile)
 	}
-	nMasks = int(be.Uint64(buf))
 
 	// the number of anchors
 	var nAnchors int
 
 	// ---------------------------------------------
 
-	indexSize := 2 + int(math.Pow(4, float64(anchorPrefix)))<<1
+	nPrefixes := 1 << (anchorPrefix << 1)
+	indexSize := 2 + nPrefixes<<1
 	getAnchor := AnchorExtracter(k, maskPrefix, anchorPrefix)
 
 	data := make([][]uint64, nMasks)
 
+	// memory of the index data, which is limited by the file size
+	var mem int64
+	maxMem := maxIndexMemory(size)
+
 	var kmer, offset uint64
 	var prefix uint64
 	var j int
@@ -650,7 +629,7 @@ func ReadKVIndex(file string) (uint8, int, [][]uint64, uint8, uint8, error) {
 	for i := 0; i < nMasks; i++ {
 		_, err = io.ReadFull(r, buf)
 		if err != nil {
-			return 0, -1, nil, 0, 0, err
+			return 0, -1, nil, 0, 0, newFileError(file, util.MaskRecord(iFirstMask+i), r.offset, err)
 		}
 		nAnchors = int(be.Uint64(buf))
 
@@ -659,18 +638,28 @@ func ReadKVIndex(file string) (uint8, int, [][]uint64, uint8, uint8, error) {
 			continue
 		}
 
+		// each anchor needs 16 bytes, and there are at most 4^anchorPrefix+1 anchors
+		if nAnchors < 0 || nAnchors > nPrefixes+1 || int64(nAnchors) > (size-r.offset)>>4 {
+			return 0, -1, nil, 0, 0, newFileError(file, util.MaskRecord(iFirstMask+i), r.offset-8, ErrBrokenFile)
+		}
+
+		mem += int64(indexSize) << 3
+		if mem > maxMem {
+			return 0, -1, nil, 0, 0, newFileError(file, util.MaskRecord(iFirstMask+i), r.offset-8, ErrBrokenFile)
+		}
+
 		// index := make([]uint64, 0, nAnchors<<1)
 		index := make([]uint64, indexSize)
 		for j = 0; j < nAnchors; j++ {
 			_, err = io.ReadFull(r, buf)
 			if err != nil {
-				return 0, -1, nil, 0, 0, err
+				return 0, -1, nil, 0, 0, newFileError(file, util.MaskRecord(iFirstMask+i), r.offset, err)
 			}
 			kmer = be.Uint64(buf)
 
 			_, err = io.ReadFull(r, buf)
 			if err != nil {
-				return 0, -1, nil, 0, 0, err
+				return 0, -1, nil, 0, 0, newFileError(file, util.MaskRecord(iFirstMask+i), r.offset, err)
 			}
 			offset = be.Uint64(buf)
 
@@ -691,28 +680,12 @@ func ReadKVIndex(file string) (uint8, int, [][]uint64, uint8, uint8, error) {
 	return k, iFirstMask, data, maskPrefix, anchorPrefix, nil
 }
 
-// ReadKVIndexInfo read the information.
-func ReadKVIndexInfo(file string) (uint8, int, int, uint8, uint8, error) {
-	fh, err := os.Open(file)
-	if err != nil {
-		return 0, -1, 0, 0, 0, err
-	}
-	r := bufio.NewReader(fh)
-	defer fh.Close()
-
-	// ---------------------------------------------
-
-	buf := make([]byte, 8)
-
-	var n int
-
+// readKVIndexHeader reads and checks the header of a kv-data index file.
+func readKVIndexHeader(r io.Reader, buf []byte) (k uint8, maskPrefix uint8, anchorPrefix uint8, iFirstMask int, nMasks int, err error) {
 	// check the magic number
-	n, err = io.ReadFull(r, buf)
+	_, err = io.ReadFull(r, buf[:8])
 	if err != nil {
-		return 0, -1, 0, 0, 0, err
-	}
-	if n < 8 {
-		return 0, -1, 0, 0, 0, ErrBrokenFile
+		return
 	}
 	same := true
 	for i := 0; i < 8; i++ {
@@ -722,39 +695,65 @@ func ReadKVIndexInfo(file string) (uint8, int, int, uint8, uint8, error) {
 		}
 	}
 	if !same {
-		return 0, -1, 0, 0, 0, ErrInvalidFileFormat
+		err = ErrInvalidFileFormat
+		return
 	}
 	// read version information
-	n, err = io.ReadFull(r, buf)
+	_, err = io.ReadFull(r, buf[:8])
 	if err != nil {
-		return 0, -1, 0, 0, 0, err
-	}
-	if n < 8 {
-		return 0, -1, 0, 0, 0, ErrBrokenFile
+		return
 	}
 	// check compatibility
 	if MainVersion != buf[0] {
-		return 0, -1, 0, 0, 0, ErrVersionMismatch
+		err = ErrVersionMismatch
+		return
+	}
+	k = buf[2] // k-mer size
+	maskPrefix = buf[3]
+	anchorPrefix = buf[4]
+	err = checkIndexHeader(k, maskPrefix, anchorPrefix)
+	if err != nil {
+		return
 	}
-	k := buf[2] // k-mer size
-	maskPrefix := buf[3]
-	anchorPrefix := buf[4]
 
 	// index of the first mask in current chunk.
-	var iFirstMask int
-	_, err = io.ReadFull(r, buf)
+	_, err = io.ReadFull(r, buf[:8])
 	if err != nil {
-		return 0, -1, 0, 0, 0, err
+		return
 	}
-	iFirstMask = int(be.Uint64(buf))
+	iFirstMask = int(be.Uint64(buf[:8]))
 
 	// mask chunk size
-	var nMasks int
-	_, err = io.ReadFull(r, buf)
+	_, err = io.ReadFull(r, buf[:8])
+	if err != nil {
+		return
+	}
+	nMasks = int(be.Uint64(buf[:8]))
+	if iFirstMask < 0 || nMasks < 0 {
+		err = ErrInvalidFileFormat
+		return
+	}
+	return
+}
+
+// ReadKVIndexInfo read the information.
+func ReadKVIndexInfo(file string) (uint8, int, int, uint8, uint8, error) {
+	fh, err := bundle.Open(file)
 	if err != nil {
 		return 0, -1, 0, 0, 0, err
 	}
-	nMasks = int(be.Uint64(buf))
+	defer fh.Close()
+
+	r := newOffsetReader(fh, 0)
+
+	// ---------------------------------------------
+
+	buf := make([]byte, 8)
+
+	k, maskPrefix, anchorPrefix, iFirstMask, nMasks, err := readKVIndexHeader(r, buf)
+	if err != nil {
+		return 0, -1, 0, 0, 0, newFileError(file, "", r.offset, err)
+	}
 
 	return k, iFirstMask, nMasks, maskPrefix, anchorPrefix, nil
 }
@@ -770,10 +769,52 @@ var poolUint64s = &sync.Pool{New: func() interface{} {
 
 // CreateKVIndex recreates kv index file for the kv-data file.
 func CreateKVIndex(file string, nAnchors int) error {
+	indexFile := filepath.Clean(file) + KVIndexFileExt
+	_, _, _, maskPrefix, _, err := ReadKVIndexInfo(indexFile)
+	if err != nil {
+		return err
+	}
+
+	return CreateKVIndexWithMaskPrefix(file, nAnchors, maskPrefix)
+}
+
+// MaskPrefix returns the prefix length of masks for indexing a given number of masks,
+// it's the value used in creating kv-data files.
+func MaskPrefix(nMasks int) uint8 {
+	maskPrefix := 1
+	for 1<<(maskPrefix<<1) <= nMasks {
+		maskPrefix++
+	}
+	maskPrefix--
+	if maskPrefix < 1 {
+		maskPrefix = 1
+	}
+	return uint8(maskPrefix)
+}
+
+// AnchorPrefix returns the prefix length of anchors for a given number of partitions (anchors).
+func AnchorPrefix(nAnchors int) uint8 {
+	anchorPrefix := 0
+	for nAnchors > 0 {
+		nAnchors >>= 2
+		anchorPrefix++
+	}
+	anchorPrefix--
+	if anchorPrefix < 1 {
+		anchorPrefix = 1
+	}
+	return uint8(anchorPrefix)
+}
+
+// CreateKVIndexWithMaskPrefix creates the kv index file for the kv-data file
+// with a given mask prefix length, while the existing index file is not needed.
+// It's useful for indexes with missing, broken, or outdated kv index files.
+func CreateKVIndexWithMaskPrefix(file string, nAnchors int, maskPrefix uint8) error {
 	fh, err := os.Open(file)
 	if err != nil {
 		return errors.Wrapf(err, "reading kv-data file")
 	}
+	defer fh.Close()
 
 	r := bufio.NewReader(fh)
 
@@ -843,23 +884,10 @@ func CreateKVIndex(file string, nAnchors int) error {
 	// writer of kv-index file
 
 	indexFile := filepath.Clean(file) + KVIndexFileExt
-	_, _, _, maskPrefix, _, err := ReadKVIndexInfo(indexFile)
-	if err != nil {
-		return err
-	}
 
-	anchorPrefix := 0
-	partitions := nAnchors
-	for partitions > 0 {
-		partitions >>= 2
-		anchorPrefix++
-	}
-	anchorPrefix--
-	if anchorPrefix < 1 {
-		anchorPrefix = 1
-	}
+	anchorPrefix := AnchorPrefix(nAnchors)
 
-	getAnchor := AnchorExtracter(K, maskPrefix, uint8(anchorPrefix))
+	getAnchor := AnchorExtracter(K, maskPrefix, anchorPrefix)
 
 	fhi, err := os.Create(indexFile)
 	if err != nil {
@@ -874,7 +902,7 @@ func CreateKVIndex(file string, nAnchors int) error {
 	}
 
 	// 8-byte meta info
-	err = binary.Write(wi, be, [8]uint8{MainVersion, MinorVersion, K, maskPrefix, uint8(anchorPrefix)})
+	err = binary.Write(wi, be, [8]uint8{MainVersion, MinorVersion, K, maskPrefix, anchorPrefix})
 	if err != nil {
 		return err
 	}
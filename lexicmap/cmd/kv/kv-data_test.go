@@ -21,10 +21,13 @@
 package kv
 
 import (
+	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
 	"github.com/shenwei356/lexichash"
 )
 
@@ -311,3 +314,255 @@ func TestKVData(t *testing.T) {
 		return
 	}
 }
+
+func TestCopyDataOfAMask(t *testing.T) {
+	var lenPrefix uint8 = 2
+	var k uint8 = 5
+	var prefix uint64 = 5 << ((k - lenPrefix) << 1)
+
+	// masks with an even number of k-mers, no k-mers, and an odd number of k-mers with 2 values
+	var n uint64 = 1 << ((k - lenPrefix) << 1)
+	var i uint64
+	m0 := make(map[uint64]*[]uint64, n)
+	for i = 0; i < n; i++ {
+		m0[prefix|i] = &[]uint64{i}
+	}
+	m1 := make(map[uint64]*[]uint64)
+	m2 := make(map[uint64]*[]uint64, n)
+	for i = 1; i < n; i++ {
+		m2[prefix|i] = &[]uint64{i, i << 8}
+	}
+	data := []*map[uint64]*[]uint64{&m0, &m1, &m2}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "t.kv")
+	_, err := WriteKVData(k, 0, data, file, lenPrefix, 2)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// copying all masks gives the same files
+	file2 := filepath.Join(dir, "t2.kv")
+	rdr, err := NewReader(file)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	wtr, err := NewWriter(k, 0, len(data), file2, lenPrefix, 2)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for range data {
+		if err = wtr.CopyDataOfAMask(rdr); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	checkError(t, wtr.Close())
+	checkError(t, rdr.Close())
+
+	for _, ext := range []string{"", KVIndexFileExt} {
+		d1, _ := os.ReadFile(file + ext)
+		d2, _ := os.ReadFile(file2 + ext)
+		if !bytes.Equal(d1, d2) {
+			t.Errorf("copied file%s differs from the original one", ext)
+		}
+	}
+
+	// copying the last 2 masks
+	file3 := filepath.Join(dir, "t3.kv")
+	rdr, err = NewReader(file)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	wtr, err = NewWriter(k, 1, 2, file3, lenPrefix, 2)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	checkError(t, rdr.SkipDataOfAMask())
+	checkError(t, wtr.CopyDataOfAMask(rdr))
+	checkError(t, wtr.CopyDataOfAMask(rdr))
+	checkError(t, wtr.Close())
+	checkError(t, rdr.Close())
+
+	rdr, err = NewReader(file)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	rdr3, err := NewReader(file3)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if rdr3.ChunkIndex != 1 || rdr3.ChunkSize != 2 {
+		t.Errorf("unexpected chunk: %d, %d", rdr3.ChunkIndex, rdr3.ChunkSize)
+	}
+	checkError(t, rdr.SkipDataOfAMask())
+	for j := 1; j < len(data); j++ {
+		l1, err := rdr.ReadDataOfAMaskAsList()
+		checkError(t, err)
+		l3, err := rdr3.ReadDataOfAMaskAsList()
+		checkError(t, err)
+		if len(l1) != len(l3) {
+			t.Fatalf("mask %d: data length mismatch: %d != %d", j, len(l1), len(l3))
+		}
+		for x := range l1 {
+			if l1[x] != l3[x] {
+				t.Fatalf("mask %d: data mismatch at %d", j, x)
+			}
+		}
+	}
+	rdr.Close()
+	rdr3.Close()
+
+	// the index works
+	scr, err := NewSearcher(file3)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer scr.Close()
+	results, err := scr.Search([]uint64{0, prefix | 7}, k, false, false) // for mask 1 and 2
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(*results) != 1 || len((*results)[0].Values) != 2 || (*results)[0].Values[1] != 7<<8 {
+		t.Errorf("unexpected search result of the copied data")
+	}
+	RecycleSearchResults(results)
+}
+
+func checkError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestReadKVIndexMemoryLimit(t *testing.T) {
+	// a small index file claiming a large anchor prefix for many masks
+	nMasks := 60
+	buf := make([]byte, 0, 32+nMasks*24)
+	buf = append(buf, MagicIdx[:]...)
+	buf = append(buf, MainVersion, MinorVersion, 32, 2, MaxAnchorPrefix, 0, 0, 0)
+	buf = be.AppendUint64(buf, 0)
+	buf = be.AppendUint64(buf, uint64(nMasks))
+	for i := 0; i < nMasks; i++ {
+		buf = be.AppendUint64(buf, 1)  // the number of anchors
+		buf = be.AppendUint64(buf, 0)  // k-mer
+		buf = be.AppendUint64(buf, 32) // offset
+	}
+
+	file := filepath.Join(t.TempDir(), "t.kv"+KVIndexFileExt)
+	if err := os.WriteFile(file, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, _, _, err := ReadKVIndex(file)
+	var fe *util.FileError
+	if !errors.Is(err, ErrBrokenFile) || !errors.As(err, &fe) {
+		t.Fatalf("expected a FileError for the index file, got: %v", err)
+	}
+}
+
+func FuzzKVData(f *testing.F) {
+	var lenPrefix uint8 = 2
+	var k uint8 = 5
+	var prefix uint64 = 5 << ((k - lenPrefix) << 1)
+	nMasks := 3
+
+	data := make([]*map[uint64]*[]uint64, 0, nMasks)
+	var n uint64 = 1 << ((k - lenPrefix) << 1)
+	var i uint64
+	for j := 0; j < nMasks; j++ {
+		m := make(map[uint64]*[]uint64, n)
+		for i = 0; i < n; i += uint64(j + 1) {
+			m[prefix|i] = &[]uint64{i << 1, i<<1 | 1}
+		}
+		data = append(data, &m)
+	}
+
+	file := filepath.Join(f.TempDir(), "t.kv")
+	_, err := WriteKVData(k, 0, data, file, lenPrefix, 2)
+	if err != nil {
+		f.Fatal(err)
+	}
+	bData, err := os.ReadFile(file)
+	if err != nil {
+		f.Fatal(err)
+	}
+	bIndex, err := os.ReadFile(file + KVIndexFileExt)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	// a truncated file should return an error with details
+	err = os.WriteFile(file, bData[:len(bData)-10], 0644)
+	if err != nil {
+		f.Fatal(err)
+	}
+	_, err = NewInMemomrySearcher(file)
+	var fe *util.FileError
+	if !errors.Is(err, ErrBrokenFile) || !errors.As(err, &fe) || fe.Record != "mask 2" {
+		f.Fatalf("expected a FileError of mask 2 for the truncated file, got: %v", err)
+	}
+
+	f.Add(bData, bIndex)
+	f.Add(bData[:len(bData)/2], bIndex)
+	f.Add(bData, bIndex[:len(bIndex)-3])
+	bData2 := append([]byte{}, bData...)
+	bData2[40] ^= 0xff
+	f.Add(bData2, bIndex)
+	bIndex2 := append([]byte{}, bIndex...)
+	bIndex2[len(bIndex2)-1] ^= 0xff
+	f.Add(bData, bIndex2)
+
+	kmers := make([]uint64, nMasks)
+	for j := range kmers {
+		kmers[j] = prefix | uint64(j)
+	}
+	kmers2 := make([]*[]uint64, nMasks)
+	for j := range kmers2 {
+		kmers2[j] = &[]uint64{prefix | uint64(j)}
+	}
+
+	f.Fuzz(func(t *testing.T, bData []byte, bIndex []byte) {
+		file := filepath.Join(t.TempDir(), "t.kv")
+		if err := os.WriteFile(file, bData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file+KVIndexFileExt, bIndex, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// errors are allowed, but panics are not
+
+		if rdr, err := NewReader(file); err == nil {
+			for j := 0; j < rdr.ChunkSize; j++ {
+				if _, err = rdr.ReadDataOfAMaskAsList(); err != nil {
+					break
+				}
+			}
+			rdr.Close()
+		}
+
+		if scr, err := NewSearcher(file); err == nil {
+			if len(scr.Indexes) == nMasks {
+				if sr, err := scr.Search(kmers, 3, false, false); err == nil {
+					RecycleSearchResults(sr)
+				}
+				if sr, err := scr.Search2(kmers2, 3, false, false); err == nil {
+					RecycleSearchResults(sr)
+				}
+			}
+			scr.Close()
+		}
+
+		if scr, err := NewInMemomrySearcher(file); err == nil {
+			if scr.ChunkSize == nMasks {
+				if sr, err := scr.Search(kmers, 3, false, false); err == nil {
+					RecycleSearchResults(sr)
+				}
+				if sr, err := scr.Search2(kmers2, 3, false, false); err == nil {
+					RecycleSearchResults(sr)
+				}
+			}
+			scr.Close()
+		}
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package kv
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
+)
+
+// MaxAnchorPrefix is the maximum anchor prefix length in the index file,
+// larger values would be treated as corrupted data.
+const MaxAnchorPrefix = 12
+
+// maxIndexMemoryRatio is the maximum ratio of the memory of the parsed index data
+// to the size of the index file, and minIndexMemoryLimit is the lower bound of the limit.
+// Each mask with at least one anchor needs a table of 4^anchorPrefix+1 anchors in memory,
+// while it takes only 24 bytes in the file. So a small corrupted file claiming a large
+// anchorPrefix could request a huge amount of memory.
+// The ratio covers the worst case of sparse masks with up to 4096 partitions.
+const (
+	maxIndexMemoryRatio = 1 << 12
+	minIndexMemoryLimit = 256 << 20
+)
+
+// maxIndexMemory returns the maximum memory (bytes) for parsing an index file of a given size.
+func maxIndexMemory(size int64) int64 {
+	if size > minIndexMemoryLimit/maxIndexMemoryRatio {
+		return size * maxIndexMemoryRatio
+	}
+	return minIndexMemoryLimit
+}
+
+// newFileError creates a util.FileError, where unexpected EOFs are treated as ErrBrokenFile.
+func newFileError(file string, record string, offset int64, err error) error {
+	return util.NewFileError(file, record, offset, err, ErrBrokenFile)
+}
+
+// offsetReader is a buffered reader which tracks the offset in the file.
+type offsetReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func newOffsetReader(rd io.Reader, offset int64) *offsetReader {
+	return &offsetReader{r: bufio.NewReader(rd), offset: offset}
+}
+
+// Reset resets the underlying reader and the offset.
+func (r *offsetReader) Reset(rd io.Reader, offset int64) {
+	r.r.Reset(rd)
+	r.offset = offset
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Discard skips the next n bytes.
+func (r *offsetReader) Discard(n int) (int, error) {
+	n, err := r.r.Discard(n)
+	r.offset += int64(n)
+	return n, err
+}
+
+// checkIndexHeader checks the values in the header of a kv-data index file.
+func checkIndexHeader(k, maskPrefix, anchorPrefix uint8) error {
+	if k < 1 || k > 32 {
+		return ErrKOverflow
+	}
+	if anchorPrefix < 1 || anchorPrefix > MaxAnchorPrefix || int(maskPrefix)+int(anchorPrefix) > int(k) {
+		return ErrInvalidFileFormat
+	}
+	return nil
+}
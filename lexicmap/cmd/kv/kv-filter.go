@@ -0,0 +1,336 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
+)
+
+// MagicFilter is the magic number of the filter file
+var MagicFilter = [8]byte{'.', 'k', 'v', 'f', 'i', 'l', 't', 'r'}
+
+// KVFilterFileExt is the file extension of k-mer data filter file.
+var KVFilterFileExt = ".flt"
+
+// DefaultFilterPrefix is the default prefix length of k-mers to add into filters.
+var DefaultFilterPrefix uint8 = 15
+
+// DefaultFilterBitsPerKey is the default number of bits for each distinct prefix in the filter.
+var DefaultFilterBitsPerKey = 8
+
+// Filter is a group of per-mask Bloom filters of k-mer prefixes,
+// it tells if a query k-mer might share a prefix of at least Prefix bases
+// with any k-mer of a mask, so the disk access could be skipped for absent ones.
+//
+// Header (32 bytes):
+//
+//	Magic number, 8 bytes, ".kvfiltr".
+//	Main and minor versions, 2 bytes.
+//	K size, 1 byte.
+//	Prefix length, 1 byte.
+//	Number of hash functions, 1 byte.
+//	Blank, 3 bytes.
+//	Mask start index, 8 bytes. The index of the first index.
+//	Mask chunk size, 8 bytes. The number of masks in this file.
+//
+// For each mask:
+//
+//	Number of 64-bit words, 8 bytes. It's 0 or a power of 2.
+//	Bitmap, 8*n bytes.
+type Filter struct {
+	K          uint8 // kmer size
+	Prefix     uint8 // prefix length of k-mers in the filter
+	NHashes    uint8 // number of hash functions
+	ChunkIndex int   // index of the first mask in this chunk
+	ChunkSize  int   // the number of masks in this chunk
+
+	shift uint64     // for extracting prefixes
+	bits  [][]uint64 // bitmap of each mask
+}
+
+// hash64 is the finalizer of MurmurHash3, it's enough for prefix codes.
+func hash64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// MightContain tells if any k-mer of the i-th mask in this chunk
+// might share the first Prefix bases with the given k-mer.
+// False positives exist, but false negatives do not.
+func (f *Filter) MightContain(i int, kmer uint64) bool {
+	data := f.bits[i]
+	if len(data) == 0 { // no k-mers for this mask
+		return false
+	}
+	n := uint64(len(data)<<6) - 1
+	h := hash64(kmer >> f.shift)
+	h1, h2 := h&0xffffffff, h>>32
+	var j, pos uint64
+	for j = 0; j < uint64(f.NHashes); j++ {
+		pos = (h1 + j*h2) & n
+		if data[pos>>6]&(1<<(pos&63)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Usable tells if the filter could be used for searching with a minimum prefix of p.
+func (f *Filter) Usable(p uint8) bool {
+	return p >= f.Prefix
+}
+
+// filterWords returns the number of 64-bit words for n keys.
+func filterWords(n int, bitsPerKey int) int {
+	if n == 0 {
+		return 0
+	}
+	nBits := n * bitsPerKey
+	if nBits < 64 {
+		nBits = 64
+	}
+	nBits = 1 << bits.Len(uint(nBits-1)) // round up to the power of 2
+	return nBits >> 6
+}
+
+// filterHashes returns the optimal number of hash functions.
+func filterHashes(bitsPerKey int) uint8 {
+	n := int(float64(bitsPerKey) * 0.69) // ln(2)
+	if n < 1 {
+		n = 1
+	} else if n > 16 {
+		n = 16
+	}
+	return uint8(n)
+}
+
+// CreateKVFilter creates a filter file for the kv-data file,
+// with prefixes of `prefix` bases and `bitsPerKey` bits for each distinct prefix.
+func CreateKVFilter(file string, prefix uint8, bitsPerKey int) error {
+	if bitsPerKey < 1 {
+		return fmt.Errorf("k-mer-value data: bits per key should be > 0")
+	}
+
+	rdr, err := NewReader(file)
+	if err != nil {
+		return errors.Wrapf(err, "reading kv-data file")
+	}
+	defer rdr.Close()
+
+	k := rdr.K
+	if prefix < 1 || prefix > k {
+		return fmt.Errorf("k-mer-value data: invalid filter prefix length: %d, valid range: [1, %d]", prefix, k)
+	}
+	shift := uint64(k-prefix) << 1
+	nHashes := filterHashes(bitsPerKey)
+
+	fh, err := os.Create(filepath.Clean(file) + KVFilterFileExt)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fh)
+
+	// 8-byte magic number
+	err = binary.Write(w, be, MagicFilter)
+	if err != nil {
+		return err
+	}
+
+	// 8-byte meta info
+	err = binary.Write(w, be, [8]uint8{MainVersion, MinorVersion, k, prefix, nHashes})
+	if err != nil {
+		return err
+	}
+
+	// 16-byte the MaskOffset and the chunk size
+	err = binary.Write(w, be, [2]uint64{uint64(rdr.ChunkIndex), uint64(rdr.ChunkSize)})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8)
+	prefixes := poolUint64s.Get().(*[]uint64)
+	defer poolUint64s.Put(prefixes)
+
+	var pre, code uint64
+	var pos, h, h1, h2, j uint64
+	for i := 0; i < rdr.ChunkSize; i++ {
+		data, err := rdr.ReadDataOfAMaskAsList()
+		if err != nil {
+			return errors.Wrapf(err, "reading data of mask %d", rdr.ChunkIndex+i)
+		}
+
+		// distinct prefixes, k-mers are sorted
+		*prefixes = (*prefixes)[:0]
+		for iK := 0; iK < len(data); iK += 2 {
+			code = data[iK] >> shift
+			if len(*prefixes) == 0 || code != pre {
+				*prefixes = append(*prefixes, code)
+				pre = code
+			}
+		}
+
+		words := make([]uint64, filterWords(len(*prefixes), bitsPerKey))
+		if len(words) > 0 {
+			n := uint64(len(words)<<6) - 1
+			for _, code = range *prefixes {
+				h = hash64(code)
+				h1, h2 = h&0xffffffff, h>>32
+				for j = 0; j < uint64(nHashes); j++ {
+					pos = (h1 + j*h2) & n
+					words[pos>>6] |= 1 << (pos & 63)
+				}
+			}
+		}
+
+		// 8-byte the number of words
+		be.PutUint64(buf, uint64(len(words)))
+		_, err = w.Write(buf)
+		if err != nil {
+			return err
+		}
+		for _, v := range words {
+			be.PutUint64(buf, v)
+			_, err = w.Write(buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// ReadKVFilter reads the filter file of a kv-data file.
+// It returns nil and no error if the file does not exist.
+func ReadKVFilter(file string) (*Filter, error) {
+	file = filepath.Clean(file) + KVFilterFileExt
+	fh, err := bundle.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fh.Close()
+
+	size := fh.Size()
+
+	r := newOffsetReader(fh, 0)
+
+	buf := make([]byte, 8)
+
+	// check the magic number
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, newFileError(file, "", r.offset, err)
+	}
+	same := true
+	for i := 0; i < 8; i++ {
+		if MagicFilter[i] != buf[i] {
+			same = false
+			break
+		}
+	}
+	if !same {
+		return nil, newFileError(file, "", 0, ErrInvalidFileFormat)
+	}
+
+	// read version information
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, newFileError(file, "", r.offset, err)
+	}
+	// check compatibility
+	if MainVersion != buf[0] {
+		return nil, newFileError(file, "", 8, ErrVersionMismatch)
+	}
+	f := &Filter{K: buf[2], Prefix: buf[3], NHashes: buf[4]}
+	if f.K < 1 || f.K > 32 || f.Prefix < 1 || f.Prefix > f.K {
+		return nil, newFileError(file, "", 8, ErrInvalidFileFormat)
+	}
+	f.shift = uint64(f.K-f.Prefix) << 1
+
+	// index of the first mask in current chunk.
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, newFileError(file, "", r.offset, err)
+	}
+	f.ChunkIndex = int(be.Uint64(buf))
+
+	// mask chunk size
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, newFileError(file, "", r.offset, err)
+	}
+	f.ChunkSize = int(be.Uint64(buf))
+
+	// each mask needs at least 8 bytes
+	if f.ChunkIndex < 0 || f.ChunkSize < 0 || int64(f.ChunkSize) > (size-r.offset)>>3 {
+		return nil, newFileError(file, "", 24, ErrBrokenFile)
+	}
+
+	f.bits = make([][]uint64, f.ChunkSize)
+	var n uint64
+	for i := 0; i < f.ChunkSize; i++ {
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, newFileError(file, util.MaskRecord(f.ChunkIndex+i), r.offset, err)
+		}
+		n = be.Uint64(buf)
+		if n&(n-1) != 0 { // should be 0 or a power of 2
+			return nil, newFileError(file, util.MaskRecord(f.ChunkIndex+i), r.offset-8, ErrInvalidFileFormat)
+		}
+		if n > uint64(size-r.offset)>>3 {
+			return nil, newFileError(file, util.MaskRecord(f.ChunkIndex+i), r.offset-8, ErrBrokenFile)
+		}
+
+		words := make([]uint64, n)
+		for j := range words {
+			_, err = io.ReadFull(r, buf)
+			if err != nil {
+				return nil, newFileError(file, util.MaskRecord(f.ChunkIndex+i), r.offset, err)
+			}
+			words[j] = be.Uint64(buf)
+		}
+		f.bits[i] = words
+	}
+
+	return f, nil
+}
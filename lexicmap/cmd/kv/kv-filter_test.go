@@ -0,0 +1,120 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package kv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKVFilter(t *testing.T) {
+	var k uint8 = 11
+	var p uint8 = 5
+	nMasks := 3
+
+	// k-mers of mask i all start with a prefix of i
+	data := make([]*map[uint64]*[]uint64, 0, nMasks)
+	var i uint64
+	for j := 0; j < nMasks; j++ {
+		m := make(map[uint64]*[]uint64, 1024)
+		for i = 0; i < 1024; i++ {
+			m[uint64(j+1)<<((k-p)<<1)|i] = &[]uint64{i}
+		}
+		data = append(data, &m)
+	}
+
+	file := "t.flt.kv"
+	_, err := WriteKVData(k, 0, data, file, 2, 2)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	defer func() {
+		os.RemoveAll(file)
+		os.RemoveAll(filepath.Clean(file) + KVIndexFileExt)
+		os.RemoveAll(filepath.Clean(file) + KVFilterFileExt)
+	}()
+
+	err = CreateKVFilter(file, p, DefaultFilterBitsPerKey)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+
+	f, err := ReadKVFilter(file)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	if f.ChunkSize != nMasks || f.Prefix != p {
+		t.Errorf("unexpected filter header: chunk size: %d, prefix: %d", f.ChunkSize, f.Prefix)
+		return
+	}
+
+	// no false negatives
+	for j := 0; j < nMasks; j++ {
+		for kmer := range *data[j] {
+			if !f.MightContain(j, kmer) {
+				t.Errorf("false negative: mask: %d, k-mer: %d", j, kmer)
+				return
+			}
+		}
+	}
+
+	// absent prefixes, one prefix in each mask, false positives are very rare
+	var fp int
+	for j := 0; j < nMasks; j++ {
+		for i = uint64(nMasks + 1); i < 1<<(p<<1); i++ {
+			if f.MightContain(j, i<<((k-p)<<1)) {
+				fp++
+			}
+		}
+	}
+	if fp > nMasks*(1<<(p<<1))/10 {
+		t.Errorf("too many false positives: %d", fp)
+	}
+
+	// search results should be the same with filters
+	scr, err := NewSearcher(file)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	defer scr.Close()
+	if !scr.HasFilter() {
+		t.Errorf("filter file not detected")
+		return
+	}
+	kmers := make([]uint64, nMasks)
+	for j := 0; j < nMasks; j++ {
+		kmers[j] = uint64(j+1)<<((k-p)<<1) | 7
+	}
+	results, err := scr.Search(kmers, p, false, false)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	if len(*results) != nMasks*1024 {
+		t.Errorf("unexpected number of results: %d, expected: %d", len(*results), nMasks*1024)
+	}
+	RecycleSearchResults(results)
+}
@@ -21,15 +21,14 @@
 package kv
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"math"
-	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
 )
 
@@ -40,8 +39,11 @@ type Reader struct {
 	ChunkSize  int   // the number of masks in this chunk
 
 	file string
-	fh   *os.File // file handler of the kv-data file
-	r    *bufio.Reader
+	fh   *bundle.File // file handler of the kv-data file
+	r    *offsetReader
+	size int64 // file size
+
+	iMask int // index of the next mask to read in this chunk
 
 	buf  []byte
 	buf8 []uint8
@@ -54,34 +56,42 @@ type Reader struct {
 
 // NewReader creates a reader.
 func NewReader(file string) (*Reader, error) {
-	fh, err := os.Open(file)
+	fh, err := bundle.Open(file)
 	if err != nil {
 		return nil, errors.Wrapf(err, "reading kv-data file")
 	}
 
-	r := bufio.NewReader(fh)
+	r := newOffsetReader(fh, 0)
 
 	rdr := &Reader{
 		file: file,
 		fh:   fh,
 		r:    r,
+		size: fh.Size(),
 		buf:  make([]byte, 64),
 		buf8: make([]uint8, 8),
 	}
 
 	// ---------------------------------------------
 
-	buf := rdr.buf8
+	err = rdr.readHeader()
+	if err != nil {
+		fh.Close()
+		return nil, newFileError(file, "", r.offset, err)
+	}
 
-	var n int
+	return rdr, nil
+}
+
+// readHeader reads and checks the header of the kv-data file.
+func (rdr *Reader) readHeader() error {
+	buf := rdr.buf8
+	r := rdr.r
 
 	// check the magic number
-	n, err = io.ReadFull(r, buf)
+	_, err := io.ReadFull(r, buf)
 	if err != nil {
-		return nil, err
-	}
-	if n < 8 {
-		return nil, ErrBrokenFile
+		return err
 	}
 	same := true
 	for i := 0; i < 8; i++ {
@@ -91,37 +101,57 @@ func NewReader(file string) (*Reader, error) {
 		}
 	}
 	if !same {
-		return nil, ErrInvalidFileFormat
+		return ErrInvalidFileFormat
 	}
 	// read version information
-	n, err = io.ReadFull(r, buf)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
-		return nil, err
-	}
-	if n < 8 {
-		return nil, ErrBrokenFile
+		return err
 	}
 	// check compatibility
 	if MainVersion != buf[0] {
-		return nil, ErrVersionMismatch
+		return ErrVersionMismatch
 	}
 	rdr.K = buf[2] // k-mer size
+	if rdr.K < 1 || rdr.K > 32 {
+		return ErrKOverflow
+	}
 
 	// index of the first mask in current chunk.
 	_, err = io.ReadFull(r, buf)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	rdr.ChunkIndex = int(be.Uint64(buf))
 
 	// mask chunk size
 	_, err = io.ReadFull(r, buf)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	rdr.ChunkSize = int(be.Uint64(buf))
 
-	return rdr, nil
+	// each mask needs at least 8 bytes
+	if rdr.ChunkIndex < 0 || rdr.ChunkSize < 0 || int64(rdr.ChunkSize) > (rdr.size-r.offset)>>3 {
+		return ErrBrokenFile
+	}
+
+	return nil
+}
+
+// wrapError adds the file, mask and offset information to the error.
+func (rdr *Reader) wrapError(err error) error {
+	return newFileError(rdr.file, util.MaskRecord(rdr.ChunkIndex+rdr.iMask-1), rdr.r.offset, err)
+}
+
+// capacity returns the capacity of the k-mer-value list for n k-mers.
+// Each k-mer has at least one 8-byte value, so a negative number or one larger than
+// the size of remaining data / 8 means the file is broken.
+func (rdr *Reader) capacity(nKmers int) (int, error) {
+	if nKmers < 0 || uint64(nKmers) > uint64(rdr.size-rdr.r.offset)>>3 {
+		return 0, ErrBrokenFile
+	}
+	return nKmers << 1, nil
 }
 
 var PoolKmerData = &sync.Pool{New: func() interface{} {
@@ -141,7 +171,14 @@ func (rdr *Reader) Close() error {
 
 // ReadDataOfAMaskAsMap reads data of a mask.
 // Please remember to recycle the result.
-func (rdr *Reader) ReadDataOfAMaskAsMap() (*map[uint64]*[]uint64, error) {
+func (rdr *Reader) ReadDataOfAMaskAsMap() (_ *map[uint64]*[]uint64, err error) {
+	rdr.iMask++
+	defer func() {
+		if err != nil {
+			err = rdr.wrapError(err)
+		}
+	}()
+
 	buf := rdr.buf
 	buf8 := rdr.buf8
 	r := rdr.r
@@ -162,7 +199,6 @@ func (rdr *Reader) ReadDataOfAMaskAsMap() (*map[uint64]*[]uint64, error) {
 
 	m := PoolKmerData.Get().(*map[uint64]*[]uint64)
 	clear(*m)
-	var err error
 
 	// 8-byte the number of k-mers
 	nReaded, err = io.ReadFull(r, buf8)
@@ -177,6 +213,9 @@ func (rdr *Reader) ReadDataOfAMaskAsMap() (*map[uint64]*[]uint64, error) {
 	if nKmers == 0 {
 		return m, nil
 	}
+	if _, err = rdr.capacity(nKmers); err != nil {
+		return nil, err
+	}
 
 	for {
 		// read the control byte
@@ -298,7 +337,14 @@ func (rdr *Reader) ReadDataOfAMaskAsMap() (*map[uint64]*[]uint64, error) {
 
 // ReadDataOfAMaskAsList reads data of a mask
 // Returned: a list of k-mer and value pairs are intermittently saved in a []uint64.
-func (rdr *Reader) ReadDataOfAMaskAsList() ([]uint64, error) {
+func (rdr *Reader) ReadDataOfAMaskAsList() (_ []uint64, err error) {
+	rdr.iMask++
+	defer func() {
+		if err != nil {
+			err = rdr.wrapError(err)
+		}
+	}()
+
 	buf := rdr.buf
 	buf8 := rdr.buf8
 	r := rdr.r
@@ -315,8 +361,6 @@ func (rdr *Reader) ReadDataOfAMaskAsList() ([]uint64, error) {
 	var j uint64
 	var v uint64
 
-	var err error
-
 	// 8-byte the number of k-mers
 	nReaded, err = io.ReadFull(r, buf8)
 	if err != nil {
@@ -332,7 +376,11 @@ func (rdr *Reader) ReadDataOfAMaskAsList() ([]uint64, error) {
 	}
 
 	// A list of k-mer and value pairs are intermittently saved in a []uint64
-	m := make([]uint64, 0, nKmers<<1)
+	capacity, err := rdr.capacity(nKmers)
+	if err != nil {
+		return nil, err
+	}
+	m := make([]uint64, 0, capacity)
 	// multiping 2.2 is because that some k-mers would have more than one locations,
 	// it help to reduce slice growing, but it's slightly slower in batch querying, interesting.
 	// m := make([]uint64, 0, int(float64(nKmers)*2.2))
@@ -450,9 +498,15 @@ func (rdr *Reader) ReadDataOfAMaskAsList() ([]uint64, error) {
 // ReadDataOfAMaskAsListAndCreateIndex reads data of a mask,
 // and create a new index with n anchors.
 // Returned: a list of k-mer and value pairs are intermittently saved in a []uint64.
-func (rdr *Reader) ReadDataOfAMaskAsListAndCreateIndex() ([]uint64, []int, uint8, uint8, error) {
+func (rdr *Reader) ReadDataOfAMaskAsListAndCreateIndex() (_ []uint64, _ []int, _ uint8, _ uint8, err error) {
+	rdr.iMask++
+	defer func() {
+		if err != nil {
+			err = rdr.wrapError(err)
+		}
+	}()
+
 	if !rdr.readIndexInfo {
-		var err error
 		_, _, _, rdr.maskPrefix, rdr.anchorPrefix, err = ReadKVIndexInfo(filepath.Clean(rdr.file) + KVIndexFileExt)
 		if err != nil {
 			return nil, nil, 0, 0, errors.Wrapf(err, "reading kv-data index file")
@@ -476,8 +530,6 @@ func (rdr *Reader) ReadDataOfAMaskAsListAndCreateIndex() ([]uint64, []int, uint8
 	var j uint64
 	var v uint64
 
-	var err error
-
 	// 8-byte the number of k-mers
 	nReaded, err = io.ReadFull(r, buf8)
 	if err != nil {
@@ -493,7 +545,11 @@ func (rdr *Reader) ReadDataOfAMaskAsListAndCreateIndex() ([]uint64, []int, uint8
 	}
 
 	// A list of k-mer and value pairs are intermittently saved in a []uint64
-	m := make([]uint64, 0, nKmers<<1)
+	capacity, err := rdr.capacity(nKmers)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	m := make([]uint64, 0, capacity)
 	// multiping 2.2 is because that some k-mers would have more than one locations,
 	// it help to reduce slice growing, but it's slightly slower in batch querying, interesting.
 	// m := make([]uint64, 0, int(float64(nKmers)*2.2))
@@ -637,6 +693,11 @@ func (rdr *Reader) ReadDataOfAMaskAsListAndCreateIndex() ([]uint64, []int, uint8
 	if len(m)>>1 < nKmers {
 		return m, nil, 0, 0, fmt.Errorf("number of k-mers mismatch. expected: >=%d, got: %d", nKmers, len(m)>>1)
 	}
+	for _, i := range index { // k-mers without values
+		if i >= len(m) {
+			return m, nil, 0, 0, ErrBrokenFile
+		}
+	}
 	// if int(index[len(index)-1]) >= len(m) {
 	// 	fmt.Println(_nAnchors, len(m), len(index), index)
 	// }
@@ -653,8 +714,8 @@ type IndexReader struct {
 	ChunkSize  int   // the number of masks in this chunk
 	NAnchors   int
 
-	fh *os.File // file handler of the kv-data file
-	r  *bufio.Reader
+	fh *bundle.File // file handler of the kv-data file
+	r  *offsetReader
 
 	buf  []byte
 	buf8 []uint8
@@ -662,12 +723,12 @@ type IndexReader struct {
 
 // NewIndexReader creates a index reader
 func NewIndexReader(file string) (*IndexReader, error) {
-	fh, err := os.Open(file)
+	fh, err := bundle.Open(file)
 	if err != nil {
 		return nil, errors.Wrapf(err, "reading kv-data file")
 	}
 
-	r := bufio.NewReader(fh)
+	r := newOffsetReader(fh, 0)
 
 	rdr := &IndexReader{
 		fh:   fh,
@@ -680,58 +741,17 @@ func NewIndexReader(file string) (*IndexReader, error) {
 
 	buf := rdr.buf8
 
-	var n int
-
-	// check the magic number
-	n, err = io.ReadFull(r, buf)
-	if err != nil {
-		return nil, err
-	}
-	if n < 8 {
-		return nil, ErrBrokenFile
-	}
-	same := true
-	for i := 0; i < 8; i++ {
-		if MagicIdx[i] != buf[i] {
-			same = false
-			break
-		}
-	}
-	if !same {
-		return nil, ErrInvalidFileFormat
-	}
-	// read version information
-	n, err = io.ReadFull(r, buf)
+	rdr.K, _, _, rdr.ChunkIndex, rdr.ChunkSize, err = readKVIndexHeader(r, buf)
 	if err != nil {
-		return nil, err
+		fh.Close()
+		return nil, newFileError(file, "", r.offset, err)
 	}
-	if n < 8 {
-		return nil, ErrBrokenFile
-	}
-	// check compatibility
-	if MainVersion != buf[0] {
-		return nil, ErrVersionMismatch
-	}
-	rdr.K = buf[2] // k-mer size
-
-	// index of the first mask in current chunk.
-	_, err = io.ReadFull(r, buf)
-	if err != nil {
-		return nil, err
-	}
-	rdr.ChunkIndex = int(be.Uint64(buf))
-
-	// mask chunk size
-	_, err = io.ReadFull(r, buf)
-	if err != nil {
-		return nil, err
-	}
-	rdr.ChunkSize = int(be.Uint64(buf))
 
 	// the number of anchors
 	_, err = io.ReadFull(r, buf)
 	if err != nil {
-		return nil, err
+		fh.Close()
+		return nil, newFileError(file, util.MaskRecord(rdr.ChunkIndex), r.offset, err)
 	}
 	rdr.NAnchors = int(be.Uint64(buf))
 
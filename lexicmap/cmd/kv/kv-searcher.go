@@ -21,16 +21,16 @@
 package kv
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"math/bits"
-	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
 	// "github.com/shenwei356/lexichash"
 )
@@ -44,13 +44,17 @@ type Searcher struct {
 	ChunkIndex int   // index of the first mask in this chunk
 	ChunkSize  int   // the number of masks in this chunk
 
-	fh *os.File // file handler of the kv-data file
+	file string
+	fh   *bundle.File // file handler of the kv-data file
 
 	// indexes of the ChunkSize masks.
 	// A list of k-mer and offset pairs are intermittently saved in a []uint64
 	Indexes   [][]uint64
 	getAnchor func(uint64) uint64
 
+	// optional presence filters of k-mer prefixes, for skipping absent seeds
+	filter *Filter
+
 	maxKmer uint64
 	buf     []byte
 	buf8    []uint8
@@ -63,10 +67,39 @@ func NewSearcher(file string) (*Searcher, error) {
 		return nil, errors.Wrapf(err, "reading kv-data index file")
 	}
 
-	fh, err := os.Open(file)
+	filter, err := ReadKVFilter(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading kv-data filter file")
+	}
+
+	// the header of kv-data file should match the index file
+	rdr, err := NewReader(file)
 	if err != nil {
 		return nil, errors.Wrapf(err, "reading kv-data file")
 	}
+	if rdr.K != k || rdr.ChunkIndex != chunkIndex || rdr.ChunkSize != len(indexes) {
+		rdr.Close()
+		return nil, newFileError(file, "", 0,
+			errors.Wrapf(ErrInvalidFileFormat, "header does not match the index file"))
+	}
+	if filter != nil && (filter.K != k || filter.ChunkIndex != chunkIndex || filter.ChunkSize != len(indexes)) {
+		rdr.Close()
+		return nil, newFileError(filepath.Clean(file)+KVFilterFileExt, "", 0,
+			errors.Wrapf(ErrInvalidFileFormat, "header does not match the index file"))
+	}
+
+	// all offsets in the index file should be in the scope of the kv-data file
+	var offset uint64
+	for i, index := range indexes {
+		for j := 1; j < len(index); j += 2 {
+			offset = index[j] >> 1
+			if offset > 0 && (offset < 32 || offset >= uint64(rdr.size)) {
+				rdr.Close()
+				return nil, newFileError(filepath.Clean(file)+KVIndexFileExt, util.MaskRecord(chunkIndex+i), -1,
+					errors.Wrapf(ErrBrokenFile, "anchor offset %d out of range [32, %d)", offset, rdr.size))
+			}
+		}
+	}
 
 	scr := &Searcher{
 		K:          k,
@@ -74,7 +107,9 @@ func NewSearcher(file string) (*Searcher, error) {
 		ChunkSize:  len(indexes),
 		Indexes:    indexes,
 		getAnchor:  AnchorExtracter(k, maskPrefix, anchorPrefix),
-		fh:         fh,
+		filter:     filter,
+		file:       file,
+		fh:         rdr.fh,
 
 		maxKmer: 1<<(k<<1) - 1,
 		buf:     make([]byte, 64),
@@ -83,6 +118,11 @@ func NewSearcher(file string) (*Searcher, error) {
 	return scr, nil
 }
 
+// HasFilter tells if the presence filter file exists.
+func (scr *Searcher) HasFilter() bool {
+	return scr.filter != nil
+}
+
 // SearchResult represents a search result.
 type SearchResult struct {
 	IQuery int // index of the query kmer, i.e., index of mask
@@ -116,12 +156,18 @@ func RecycleSearchResults(sr *[]*SearchResult) {
 	poolSearchResults.Put(sr)
 }
 
-// Search queries a k-mer and returns k-mers with a minimum prefix of p,
+// Search is SearchContext with a background context.
+func (scr *Searcher) Search(kmers []uint64, p uint8, checkFlag bool, reversedKmer bool) (*[]*SearchResult, error) {
+	return scr.SearchContext(context.Background(), kmers, p, checkFlag, reversedKmer)
+}
+
+// SearchContext queries a k-mer and returns k-mers with a minimum prefix of p,
 // and maximum m mismatches.
 // For m <0 or m >= k-p, mismatch will not be checked.
+// It stops early and returns results found so far when ctx is done.
 //
 // Please remember to recycle the results object with RecycleSearchResults().
-func (scr *Searcher) Search(kmers []uint64, p uint8, checkFlag bool, reversedKmer bool) (*[]*SearchResult, error) {
+func (scr *Searcher) SearchContext(ctx context.Context, kmers []uint64, p uint8, checkFlag bool, reversedKmer bool) (_ *[]*SearchResult, err error) {
 	// func (scr *Searcher) Search(kmers []uint64, p uint8, m int) (*[]*SearchResult, error) {
 	if len(kmers) != len(scr.Indexes) {
 		return nil, fmt.Errorf("number of query kmers (%d) != number of masks (%d)", len(kmers), len(scr.Indexes))
@@ -167,8 +213,6 @@ func (scr *Searcher) Search(kmers []uint64, p uint8, checkFlag bool, reversedKme
 	buf8 := scr.buf8
 	buf := scr.buf
 
-	var err error
-
 	results := poolSearchResults.Get().(*[]*SearchResult)
 	*results = (*results)[:0]
 	var found, saveKmer bool
@@ -183,9 +227,28 @@ func (scr *Searcher) Search(kmers []uint64, p uint8, checkFlag bool, reversedKme
 	getAnchor := scr.getAnchor
 	var is2ndKmer bool
 
-	r := bufio.NewReader(nil)
+	filter := scr.filter
+	useFilter := filter != nil && filter.Usable(p)
+
+	r := newOffsetReader(nil, 0)
 
+	// add the file, mask and offset information to errors of reading
+	iMask := -1
+	defer func() {
+		if err != nil && iMask >= 0 {
+			err = newFileError(scr.file, util.MaskRecord(chunkIndex+iMask), r.offset, err)
+		}
+	}()
+
+	done := ctx.Done()
 	for iQ, index := range scr.Indexes {
+		select {
+		case <-done: // stop early and return results found so far
+			return results, nil
+		default:
+		}
+
+		iMask = iQ
 		if len(index) == 0 { // this hapens when no captured k-mer for a mask
 			continue
 		}
@@ -199,6 +262,10 @@ func (scr *Searcher) Search(kmers []uint64, p uint8, checkFlag bool, reversedKme
 			continue
 		}
 
+		if useFilter && !filter.MightContain(iQ, kmer) { // no k-mers share the prefix
+			continue
+		}
+
 		if prefixSearch {
 			suffix2 = (k - p) << 1
 			mask = (1 << suffix2) - 1                  // 1111
@@ -271,7 +338,7 @@ func (scr *Searcher) Search(kmers []uint64, p uint8, checkFlag bool, reversedKme
 
 		scr.fh.Seek(int64(offset), 0)
 
-		r.Reset(scr.fh)
+		r.Reset(scr.fh, int64(offset))
 
 		first = true
 		found = false
@@ -506,8 +573,14 @@ func (scr *Searcher) Search(kmers []uint64, p uint8, checkFlag bool, reversedKme
 	return results, nil
 }
 
-// Search2 is very similar to Search, only the data structure of input kmers is different.
+// Search2 is Search2Context with a background context.
 func (scr *Searcher) Search2(kmers []*[]uint64, p uint8, checkFlag bool, reversedKmer bool) (*[]*SearchResult, error) {
+	return scr.Search2Context(context.Background(), kmers, p, checkFlag, reversedKmer)
+}
+
+// Search2Context is very similar to SearchContext, only the data structure of input kmers is different.
+// It stops early and returns results found so far when ctx is done.
+func (scr *Searcher) Search2Context(ctx context.Context, kmers []*[]uint64, p uint8, checkFlag bool, reversedKmer bool) (_ *[]*SearchResult, err error) {
 	// func (scr *Searcher) Search(kmers []uint64, p uint8, m int) (*[]*SearchResult, error) {
 	if len(kmers) != len(scr.Indexes) {
 		return nil, fmt.Errorf("number of query kmers (%d) != number of masks (%d)", len(kmers), len(scr.Indexes))
@@ -553,8 +626,6 @@ func (scr *Searcher) Search2(kmers []*[]uint64, p uint8, checkFlag bool, reverse
 	buf8 := scr.buf8
 	buf := scr.buf
 
-	var err error
-
 	results := poolSearchResults.Get().(*[]*SearchResult)
 	*results = (*results)[:0]
 	var found, saveKmer bool
@@ -571,9 +642,28 @@ func (scr *Searcher) Search2(kmers []*[]uint64, p uint8, checkFlag bool, reverse
 	getAnchor := scr.getAnchor
 	var is2ndKmer bool
 
-	r := bufio.NewReader(nil)
+	filter := scr.filter
+	useFilter := filter != nil && filter.Usable(p)
+
+	r := newOffsetReader(nil, 0)
 
+	// add the file, mask and offset information to errors of reading
+	iMask := -1
+	defer func() {
+		if err != nil && iMask >= 0 {
+			err = newFileError(scr.file, util.MaskRecord(chunkIndex+iMask), r.offset, err)
+		}
+	}()
+
+	done := ctx.Done()
 	for iQ, index := range scr.Indexes {
+		select {
+		case <-done: // stop early and return results found so far
+			return results, nil
+		default:
+		}
+
+		iMask = iQ
 		if len(index) == 0 { // this hapens when no captured k-mer for a mask
 			continue
 		}
@@ -588,6 +678,10 @@ func (scr *Searcher) Search2(kmers []*[]uint64, p uint8, checkFlag bool, reverse
 				continue
 			}
 
+			if useFilter && !filter.MightContain(iQ, kmer) { // no k-mers share the prefix
+				continue
+			}
+
 			if prefixSearch {
 				suffix2 = (k - p) << 1
 				mask = (1 << suffix2) - 1                  // 1111
@@ -656,7 +750,7 @@ func (scr *Searcher) Search2(kmers []*[]uint64, p uint8, checkFlag bool, reverse
 
 			scr.fh.Seek(int64(offset), 0)
 
-			r.Reset(scr.fh)
+			r.Reset(scr.fh, int64(offset))
 
 			first = true
 			found = false
@@ -21,11 +21,14 @@
 package kv
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"math/bits"
+	"path/filepath"
 
 	"github.com/pkg/errors"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
 )
 
 // Searcher provides searching service of querying k-mer values in a k-mer-value file.
@@ -42,6 +45,9 @@ type InMemorySearcher struct {
 	Indexes   [][]int
 	getAnchor func(uint64) uint64
 
+	// optional presence filters of k-mer prefixes, for skipping absent seeds
+	filter *Filter
+
 	maxKmer uint64
 }
 
@@ -59,6 +65,7 @@ func NewInMemomrySearcher(file string) (*InMemorySearcher, error) {
 	for i := 0; i < rdr.ChunkSize; i++ {
 		m, index, maskPrefix, anchorPrefix, err := rdr.ReadDataOfAMaskAsListAndCreateIndex()
 		if err != nil {
+			rdr.Close()
 			return nil, errors.Wrapf(err, "reading kv-data")
 		}
 
@@ -71,6 +78,17 @@ func NewInMemomrySearcher(file string) (*InMemorySearcher, error) {
 		}
 	}
 
+	filter, err := ReadKVFilter(file)
+	if err != nil {
+		rdr.Close()
+		return nil, errors.Wrapf(err, "reading kv-data filter file")
+	}
+	if filter != nil && (filter.K != rdr.K || filter.ChunkIndex != rdr.ChunkIndex || filter.ChunkSize != rdr.ChunkSize) {
+		rdr.Close()
+		return nil, newFileError(filepath.Clean(file)+KVFilterFileExt, "", 0,
+			errors.Wrapf(ErrInvalidFileFormat, "header does not match the kv-data file"))
+	}
+
 	scr := &InMemorySearcher{
 		K:          rdr.K,
 		ChunkIndex: rdr.ChunkIndex,
@@ -79,18 +97,53 @@ func NewInMemomrySearcher(file string) (*InMemorySearcher, error) {
 		KVdata:     kvdata,
 		Indexes:    indexes,
 		getAnchor:  getAnchor,
+		filter:     filter,
 
 		maxKmer: 1<<(rdr.K<<1) - 1,
 	}
 	return scr, nil
 }
 
-// Search queries a k-mer and returns k-mers with a minimum prefix of p,
+// HasFilter tells if the presence filter file exists.
+func (scr *InMemorySearcher) HasFilter() bool {
+	return scr.filter != nil
+}
+
+// InMemorySizeUpperBound returns a rough upper bound of the memory occupied by
+// an InMemorySearcher of the given kv-data file, without reading the data.
+//
+// Each value takes 8 bytes in the file, while it's saved along with its k-mer in
+// 16 bytes in memory. So twice the file size is used for the k-mer-value lists,
+// where the encoded k-mers and control bytes in the file usually cover the spare
+// capacity of the lists. The anchor indexes, 4^anchorPrefix ints for each mask,
+// are added. The memory of the demo index is about 30% smaller than the bound.
+func InMemorySizeUpperBound(file string) (int64, error) {
+	_, _, nMasks, _, anchorPrefix, err := ReadKVIndexInfo(filepath.Clean(file) + KVIndexFileExt)
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading kv-data index file")
+	}
+
+	fh, err := bundle.Open(file)
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading kv-data file")
+	}
+	defer fh.Close()
+
+	return fh.Size()<<1 + int64(nMasks)*int64(1<<(anchorPrefix<<1))<<3, nil
+}
+
+// Search is SearchContext with a background context.
+func (scr *InMemorySearcher) Search(kmers []uint64, p uint8, checkFlag bool, reversedKmer bool) (*[]*SearchResult, error) {
+	return scr.SearchContext(context.Background(), kmers, p, checkFlag, reversedKmer)
+}
+
+// SearchContext queries a k-mer and returns k-mers with a minimum prefix of p,
 // and maximum m mismatches.
 // For m <0 or m >= k-p, mismatch will not be checked.
+// It stops early and returns results found so far when ctx is done.
 //
 // Please remember to recycle the results object with RecycleSearchResults().
-func (scr *InMemorySearcher) Search(kmers []uint64, p uint8, checkFlag bool, reversedKmer bool) (*[]*SearchResult, error) {
+func (scr *InMemorySearcher) SearchContext(ctx context.Context, kmers []uint64, p uint8, checkFlag bool, reversedKmer bool) (*[]*SearchResult, error) {
 	// func (scr *InMemorySearcher) Search(kmers []uint64, p uint8, m int) (*[]*SearchResult, error) {
 	if len(kmers) != scr.ChunkSize {
 		return nil, fmt.Errorf("number of query kmers (%d) != number of masks (%d)", len(kmers), len(scr.KVdata))
@@ -141,7 +194,17 @@ func (scr *InMemorySearcher) Search(kmers []uint64, p uint8, checkFlag bool, rev
 	var anchor, anchorNext uint64
 	var lastNext uint64
 
+	filter := scr.filter
+	useFilter := filter != nil && filter.Usable(p)
+
+	done := ctx.Done()
 	for iQ, data := range scr.KVdata {
+		select {
+		case <-done: // stop early and return results found so far
+			return results, nil
+		default:
+		}
+
 		if len(data) == 0 { // this hapens when no captured k-mer for a mask
 			continue
 		}
@@ -158,6 +221,10 @@ func (scr *InMemorySearcher) Search(kmers []uint64, p uint8, checkFlag bool, rev
 			continue
 		}
 
+		if useFilter && !filter.MightContain(iQ, kmer) { // no k-mers share the prefix
+			continue
+		}
+
 		if prefixSearch {
 			suffix2 = (k - p) << 1
 			mask = (1 << suffix2) - 1                  // 1111
@@ -300,8 +367,14 @@ func (scr *InMemorySearcher) Search(kmers []uint64, p uint8, checkFlag bool, rev
 	return results, nil
 }
 
-// Search2 is very similar to Search, only the data structure of input kmers is different.
+// Search2 is Search2Context with a background context.
 func (scr *InMemorySearcher) Search2(kmers []*[]uint64, p uint8, checkFlag bool, reversedKmer bool) (*[]*SearchResult, error) {
+	return scr.Search2Context(context.Background(), kmers, p, checkFlag, reversedKmer)
+}
+
+// Search2Context is very similar to SearchContext, only the data structure of input kmers is different.
+// It stops early and returns results found so far when ctx is done.
+func (scr *InMemorySearcher) Search2Context(ctx context.Context, kmers []*[]uint64, p uint8, checkFlag bool, reversedKmer bool) (*[]*SearchResult, error) {
 	// func (scr *InMemorySearcher) Search(kmers []uint64, p uint8, m int) (*[]*SearchResult, error) {
 	if len(kmers) != scr.ChunkSize {
 		return nil, fmt.Errorf("number of query kmers (%d) != number of masks (%d)", len(kmers), len(scr.KVdata))
@@ -354,7 +427,17 @@ func (scr *InMemorySearcher) Search2(kmers []*[]uint64, p uint8, checkFlag bool,
 	var anchor, anchorNext uint64
 	var lastNext uint64
 
+	filter := scr.filter
+	useFilter := filter != nil && filter.Usable(p)
+
+	done := ctx.Done()
 	for iQ, data := range scr.KVdata {
+		select {
+		case <-done: // stop early and return results found so far
+			return results, nil
+		default:
+		}
+
 		if len(data) == 0 { // this hapens when no captured k-mer for a mask
 			continue
 		}
@@ -372,6 +455,10 @@ func (scr *InMemorySearcher) Search2(kmers []*[]uint64, p uint8, checkFlag bool,
 				continue
 			}
 
+			if useFilter && !filter.MightContain(iQ, kmer) { // no k-mers share the prefix
+				continue
+			}
+
 			if prefixSearch {
 				suffix2 = (k - p) << 1
 				mask = (1 << suffix2) - 1                  // 1111
@@ -27,6 +27,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/shenwei356/LexicMap/lexicmap/index"
 	"github.com/shenwei356/bio/seq"
 	"github.com/shenwei356/lexichash"
 	"github.com/shenwei356/util/pathutil"
@@ -70,8 +71,8 @@ var masksCmd = &cobra.Command{
 		outFile := getFlagString(cmd, "out-file")
 
 		k := getFlagPositiveInt(cmd, "kmer")
-		if k < minK || k > 32 {
-			checkError(fmt.Errorf("the value of flag -k/--kmer should be in range of [%d, 32]", minK))
+		if k < index.MinK || k > 32 {
+			checkError(fmt.Errorf("the value of flag -k/--kmer should be in range of [%d, 32]", index.MinK))
 		}
 
 		nMasks := getFlagPositiveInt(cmd, "masks")
@@ -103,7 +104,7 @@ var masksCmd = &cobra.Command{
 			}
 
 			// Mask file
-			fileMask := filepath.Join(dbDir, FileMasks)
+			fileMask := filepath.Join(dbDir, index.FileMasks)
 			ok, err := pathutil.Exists(fileMask)
 			if err != nil || !ok {
 				checkError(fmt.Errorf("mask file not found: %s", fileMask))
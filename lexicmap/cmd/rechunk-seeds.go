@@ -0,0 +1,408 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+	"github.com/shenwei356/bio/seq"
+	"github.com/spf13/cobra"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+var rechunkSeedsCmd = &cobra.Command{
+	Use:   "rechunk-seeds",
+	Short: "Redistribute seeds (k-mer-value data) into a different number of chunk files",
+	Long: `Redistribute seeds (k-mer-value data) into a different number of chunk files
+
+The number of seeds chunk files is decided by -c/--chunks in "lexicmap index",
+while all of them are opened in searching (see --max-open-files in "lexicmap search").
+This command redistributes masks into a new number of chunk files, where data of each
+mask are copied without decoding values, and the index information file is updated.
+Seeds of the second mask set with a smaller k, if existed, are also redistributed.
+Genome data are not touched.
+
+Presence filters of seeds, if existed, are recreated.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		// ------------------------------
+
+		dbDir := getFlagString(cmd, "index")
+		if dbDir == "" {
+			checkError(fmt.Errorf("flag -d/--index needed"))
+		}
+
+		chunks := getFlagNonNegativeInt(cmd, "chunks")
+		if chunks == 0 {
+			checkError(fmt.Errorf("flag -c/--chunks needed"))
+		}
+		if chunks > 128 {
+			checkError(fmt.Errorf("the value of flag -c/--chunks (%d) should be in the range of [1, 128]", chunks))
+		}
+		partitions := getFlagNonNegativeInt(cmd, "partitions")
+
+		// ---------------------------------------------------------------
+
+		fileInfo := filepath.Join(dbDir, index.FileInfo)
+		info, err := index.ReadIndexInfo(fileInfo)
+		if err != nil {
+			checkError(fmt.Errorf("failed to read info file: %s", err))
+		}
+		if partitions == 0 {
+			partitions = info.Partitions
+		}
+
+		nMasks := info.Masks
+		chunkSize, _chunks := seedChunkSize(nMasks, chunks)
+		if _chunks != chunks {
+			if opt.Verbose {
+				log.Infof("the number of chunks is adjusted to %d to avoid empty chunks", _chunks)
+			}
+			chunks = _chunks
+		}
+
+		if chunks == info.Chunks {
+			log.Infof("the index already has %d seed chunks, please use \"lexicmap utils reindex-seeds\" for changing the partitions", chunks)
+			return
+		}
+
+		// the second mask set with a smaller k
+		nOldChunks2, err := secondSeedsChunks(dbDir, info)
+		checkError(err)
+		var chunkSize2, chunks2 int
+		if nOldChunks2 > 0 {
+			chunkSize2, chunks2 = seedChunkSize(info.Masks2, chunks)
+		}
+
+		if opt.Verbose {
+			log.Infof("redistributing seeds of %d masks from %d chunks into %d chunks for: %s", nMasks, info.Chunks, chunks, dbDir)
+			if chunks2 > 0 {
+				log.Infof("  and seeds of %d masks of the second mask set (k=%d) from %d chunks into %d chunks",
+					info.Masks2, info.K2, nOldChunks2, chunks2)
+			}
+		}
+
+		timeStart := time.Now()
+		defer func() {
+			if opt.Verbose {
+				log.Info()
+				log.Infof("elapsed time: %s", time.Since(timeStart))
+				log.Info()
+			}
+		}()
+
+		showProgressBar := opt.Verbose
+
+		// process bar
+		var pbs *mpb.Progress
+		var bar *mpb.Bar
+		var chDuration chan time.Duration
+		var doneDuration chan int
+		if showProgressBar {
+			pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(os.Stderr))
+			bar = pbs.AddBar(int64(chunks+chunks2),
+				mpb.PrependDecorators(
+					decor.Name("processed files: ", decor.WC{W: len("processed files: "), C: decor.DindentRight}),
+					decor.Name("", decor.WCSyncSpaceR),
+					decor.CountersNoUnit("%d / %d", decor.WCSyncWidth),
+				),
+				mpb.AppendDecorators(
+					decor.Name("ETA: ", decor.WC{W: len("ETA: ")}),
+					decor.EwmaETA(decor.ET_STYLE_GO, 3),
+					decor.OnComplete(decor.Name(""), ". done"),
+				),
+			)
+
+			chDuration = make(chan time.Duration, opt.NumCPUs)
+			doneDuration = make(chan int)
+			go func() {
+				for t := range chDuration {
+					bar.EwmaIncrBy(1, t)
+				}
+				doneDuration <- 1
+			}()
+		}
+
+		threadsFloat := float64(opt.NumCPUs)
+		done := func(t time.Duration) {
+			if showProgressBar {
+				chDuration <- time.Duration(float64(t) / threadsFloat)
+			}
+		}
+
+		anchorPrefix := kv.AnchorPrefix(partitions)
+
+		// new chunk files of all seeds directories are written into temporary directories first
+		dirsSeeds := []string{filepath.Join(dbDir, index.DirSeeds)}
+		err = rechunkSeedsDir(dirsSeeds[0], uint8(info.K), nMasks, info.Chunks,
+			chunkSize, anchorPrefix, opt.NumCPUs, done)
+		if err == nil && chunks2 > 0 {
+			dirsSeeds = append(dirsSeeds, filepath.Join(dbDir, index.DirSeedsK(int(info.K2))))
+			err = rechunkSeedsDir(dirsSeeds[1], info.K2, info.Masks2, nOldChunks2,
+				chunkSize2, anchorPrefix, opt.NumCPUs, done)
+		}
+
+		if showProgressBar {
+			close(chDuration)
+			<-doneDuration
+			pbs.Wait()
+		}
+		if err != nil {
+			for _, dir := range dirsSeeds {
+				os.RemoveAll(dir + index.ExtTmpDir)
+			}
+			checkError(err)
+		}
+
+		// then all the directories are replaced, and the information file is written at last,
+		// old directories are restored if any step fails, so the index is always consistent.
+		if opt.Verbose {
+			log.Infof("replace seeds directories and update index information file: %s", fileInfo)
+		}
+		rollback, err := swapSeedsDirs(dirsSeeds)
+		checkError(err)
+
+		info.Chunks = chunks
+		if chunks2 > 0 {
+			info.Chunks2 = chunks2
+		}
+		info.Partitions = partitions
+		seedFilterPrefix := info.SeedFilterPrefix
+		seedFilterBits := info.FilterBitsPerKey()
+		info.SeedFilterPrefix = 0 // it's updated after creating filters
+		err = index.WriteIndexInfo(fileInfo, info)
+		if err != nil {
+			if _err := rollback(); _err != nil {
+				checkError(fmt.Errorf("failed to write info file: %s, and failed to restore the seeds directories: %s", err, _err))
+			}
+			checkError(fmt.Errorf("failed to write info file: %s", err))
+		}
+		for _, dir := range dirsSeeds {
+			checkError(os.RemoveAll(dir + extOldDir))
+		}
+		if opt.Verbose {
+			log.Infof("  finished updating the index information file: %s", fileInfo)
+		}
+
+		if seedFilterPrefix > 0 {
+			checkError(index.CreateSeedFilters(dbDir, uint8(seedFilterPrefix), seedFilterBits, opt.NumCPUs, indexLogger(opt.Verbose)))
+		}
+	},
+}
+
+func init() {
+	utilsCmd.AddCommand(rechunkSeedsCmd)
+
+	rechunkSeedsCmd.Flags().StringP("index", "d", "",
+		formatFlagUsage(`Index directory created by "lexicmap index".`))
+	rechunkSeedsCmd.Flags().IntP("chunks", "c", 0,
+		formatFlagUsage(`Number of chunks for storing seeds (k-mer-value data) files. Max: 128.`))
+	rechunkSeedsCmd.Flags().IntP("partitions", "", 0,
+		formatFlagUsage(`Number of partitions for indexing seeds (k-mer-value data) files. The value needs to be the power of 4. `+
+			`0 for using the value in the index information file.`))
+
+	rechunkSeedsCmd.SetUsageTemplate(usageTemplate(""))
+}
+
+// seedChunkSize returns the number of masks in a chunk, and the number of chunks
+// adjusted to avoid empty chunks.
+func seedChunkSize(nMasks int, chunks int) (int, int) {
+	if chunks > nMasks {
+		chunks = nMasks
+	}
+	chunkSize := (nMasks + chunks - 1) / chunks
+	return chunkSize, (nMasks + chunkSize - 1) / chunkSize
+}
+
+// rechunkSeedsDir redistributes seeds of nMasks masks in nOldChunks chunk files of a seeds directory
+// into new chunk files with chunkSize masks. The new files are written into a temporary directory
+// (dirSeeds + index.ExtTmpDir), which is used to replace the old one with swapSeedsDirs.
+// done is called after writing each new chunk file.
+func rechunkSeedsDir(dirSeeds string, k uint8, nMasks int, nOldChunks int, chunkSize int,
+	anchorPrefix uint8, threads int, done func(time.Duration)) error {
+
+	// ranges of masks in existing chunks
+	oldChunks := make([][2]int, nOldChunks) // index of the first mask, and the number of masks
+	var next int
+	for chunk := 0; chunk < nOldChunks; chunk++ {
+		file := filepath.Join(dirSeeds, index.ChunkFile(chunk))
+		rdr, err := kv.NewReader(file)
+		if err != nil {
+			return err
+		}
+		if rdr.ChunkIndex != next {
+			rdr.Close()
+			return fmt.Errorf("masks in seed chunks are not continuous: %s", file)
+		}
+		oldChunks[chunk] = [2]int{rdr.ChunkIndex, rdr.ChunkSize}
+		next += rdr.ChunkSize
+		err = rdr.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if next != nMasks {
+		return fmt.Errorf("number of masks in seed chunks (%d) does not match that in the info file (%d): %s", next, nMasks, dirSeeds)
+	}
+
+	// write new chunks into a temporary directory
+	dirTmp := dirSeeds + index.ExtTmpDir
+	err := os.RemoveAll(dirTmp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dirTmp, 0755)
+	if err != nil {
+		return err
+	}
+
+	maskPrefix := kv.MaskPrefix(nMasks)
+
+	var wg sync.WaitGroup
+	tokens := make(chan int, threads)
+	var _err error
+	var mu sync.Mutex
+	for begin := 0; begin < nMasks; begin += chunkSize {
+		end := begin + chunkSize
+		if end > nMasks {
+			end = nMasks
+		}
+		file := filepath.Join(dirTmp, index.ChunkFile(begin/chunkSize))
+
+		wg.Add(1)
+		tokens <- 1
+		go func(file string, begin, end int) {
+			timeStart := time.Now()
+			err := rechunkSeeds(dirSeeds, oldChunks, file, k, begin, end, maskPrefix, anchorPrefix)
+			if err != nil {
+				mu.Lock()
+				if _err == nil {
+					_err = fmt.Errorf("failed to write seeds data: %s", err)
+				}
+				mu.Unlock()
+			}
+			done(time.Since(timeStart))
+			<-tokens
+			wg.Done()
+		}(file, begin, end)
+	}
+	wg.Wait()
+	return _err
+}
+
+// extOldDir is the path extension of replaced seeds directories, which are removed after all succeed.
+const extOldDir = ".old"
+
+// swapSeedsDirs replaces seeds directories with the new ones in temporary directories,
+// while the old ones are kept with the extension extOldDir.
+// If any replacement fails, the replaced ones are restored.
+// The returned function restores all of them, e.g., when the index information file can not be updated.
+func swapSeedsDirs(dirs []string) (func() error, error) {
+	var swapped []string
+	rollback := func() error {
+		var _err error
+		for i := len(swapped) - 1; i >= 0; i-- {
+			dir := swapped[i]
+			if err := os.Rename(dir, dir+index.ExtTmpDir); err != nil && _err == nil {
+				_err = err
+				continue
+			}
+			if err := os.Rename(dir+extOldDir, dir); err != nil && _err == nil {
+				_err = err
+			}
+		}
+		return _err
+	}
+
+	for _, dir := range dirs {
+		dirOld := dir + extOldDir
+		err := os.RemoveAll(dirOld)
+		if err == nil {
+			err = os.Rename(dir, dirOld)
+		}
+		if err == nil {
+			if err = os.Rename(dir+index.ExtTmpDir, dir); err != nil {
+				os.Rename(dirOld, dir)
+			}
+		}
+		if err != nil {
+			if _err := rollback(); _err != nil {
+				return nil, fmt.Errorf("failed to replace seeds directory: %s, and failed to restore others: %s", err, _err)
+			}
+			return nil, fmt.Errorf("failed to replace seeds directory: %s", err)
+		}
+		swapped = append(swapped, dir)
+	}
+	return rollback, nil
+}
+
+// rechunkSeeds copies data of masks in [begin, end) from old seed chunks to a new file.
+func rechunkSeeds(dirSeeds string, oldChunks [][2]int, file string, k uint8, begin, end int,
+	maskPrefix uint8, anchorPrefix uint8) error {
+
+	wtr, err := kv.NewWriter(k, begin, end-begin, file, maskPrefix, anchorPrefix)
+	if err != nil {
+		return err
+	}
+
+	var first, last int
+	for chunk, r := range oldChunks {
+		first, last = r[0], r[0]+r[1] // masks in [first, last)
+		if last <= begin || first >= end {
+			continue
+		}
+
+		rdr, err := kv.NewReader(filepath.Join(dirSeeds, index.ChunkFile(chunk)))
+		if err != nil {
+			return err
+		}
+
+		for i := first; i < last && i < end; i++ {
+			if i < begin {
+				err = rdr.SkipDataOfAMask()
+			} else {
+				err = wtr.CopyDataOfAMask(rdr)
+			}
+			if err != nil {
+				rdr.Close()
+				return err
+			}
+		}
+
+		err = rdr.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return wtr.Close()
+}
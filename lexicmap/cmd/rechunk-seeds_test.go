@@ -0,0 +1,88 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+)
+
+// TestSwapSeedsDirs checks that seeds directories are all replaced or all kept.
+func TestSwapSeedsDirs(t *testing.T) {
+	dir := t.TempDir()
+	dirs := []string{filepath.Join(dir, "seeds"), filepath.Join(dir, "seeds.k15")}
+	for _, d := range dirs {
+		for _, p := range []string{d, d + index.ExtTmpDir} {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(p, "x"), []byte(p), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	content := func(d string) string {
+		data, err := os.ReadFile(filepath.Join(d, "x"))
+		if err != nil {
+			return err.Error()
+		}
+		return string(data)
+	}
+
+	// the second one can not be replaced, the first one is restored
+	os.RemoveAll(dirs[1] + index.ExtTmpDir)
+	if _, err := swapSeedsDirs(dirs); err == nil {
+		t.Fatalf("an error should be returned for a missing temporary directory")
+	}
+	for _, d := range dirs {
+		if c := content(d); c != d {
+			t.Errorf("seeds directory is not restored: %s: %s", d, c)
+		}
+	}
+
+	// all are replaced, and then restored
+	if err := os.Rename(dirs[0]+index.ExtTmpDir, dirs[1]+index.ExtTmpDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dirs[0]+index.ExtTmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dirs[0]+index.ExtTmpDir, "x"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rollback, err := swapSeedsDirs(dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := content(dirs[0]); c != "new" {
+		t.Errorf("seeds directory is not replaced: %s: %s", dirs[0], c)
+	}
+	if err = rollback(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range dirs {
+		if c := content(d); c != d {
+			t.Errorf("seeds directory is not restored: %s: %s", d, c)
+		}
+	}
+}
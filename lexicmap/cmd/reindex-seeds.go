@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
 	"github.com/shenwei356/bio/seq"
 	"github.com/spf13/cobra"
 	"github.com/vbauerster/mpb/v8"
@@ -39,6 +40,9 @@ var reindexSeedsCmd = &cobra.Command{
 	Short: "Recreate indexes of k-mer-value (seeds) data",
 	Long: `Recreate indexes of k-mer-value (seeds) data
 
+Presence filters of seeds, which help to skip disk access for absent seeds in searching,
+can also be created or recreated with the flag --seed-filter.
+
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		opt := getOptions(cmd)
@@ -53,6 +57,10 @@ var reindexSeedsCmd = &cobra.Command{
 
 		partitions := getFlagPositiveInt(cmd, "partitions")
 
+		seedFilter := getFlagBool(cmd, "seed-filter")
+		seedFilterPrefix := getFlagPositiveInt(cmd, "seed-filter-prefix")
+		seedFilterBits := getFlagPositiveInt(cmd, "seed-filter-bits")
+
 		// ---------------------------------------------------------------
 
 		if opt.Verbose {
@@ -60,8 +68,8 @@ var reindexSeedsCmd = &cobra.Command{
 		}
 
 		// info file for the number of genome batches
-		fileInfo := filepath.Join(dbDir, FileInfo)
-		info, err := readIndexInfo(fileInfo)
+		fileInfo := filepath.Join(dbDir, index.FileInfo)
+		info, err := index.ReadIndexInfo(fileInfo)
 		if err != nil {
 			checkError(fmt.Errorf("failed to read info file: %s", err))
 		}
@@ -113,7 +121,7 @@ var reindexSeedsCmd = &cobra.Command{
 		tokens := make(chan int, opt.NumCPUs)
 		threadsFloat := float64(opt.NumCPUs)
 		for chunk := 0; chunk < info.Chunks; chunk++ {
-			file := filepath.Join(dbDir, DirSeeds, chunkFile(chunk))
+			file := filepath.Join(dbDir, index.DirSeeds, index.ChunkFile(chunk))
 			wg.Add(1)
 			tokens <- 1
 
@@ -140,13 +148,20 @@ var reindexSeedsCmd = &cobra.Command{
 			log.Infof("update index information file: %s", fileInfo)
 		}
 		info.Partitions = partitions
-		err = writeIndexInfo(fileInfo, info)
+		err = index.WriteIndexInfo(fileInfo, info)
 		if err != nil {
 			checkError(fmt.Errorf("failed to write info file: %s", err))
 		}
 		if opt.Verbose {
 			log.Infof("  finished updating the index information file: %s", fileInfo)
 		}
+
+		if seedFilter {
+			if seedFilterPrefix < 5 || seedFilterPrefix > int(info.K) {
+				checkError(fmt.Errorf("the value of flag --seed-filter-prefix (%d) should be in the range of [5, %d]", seedFilterPrefix, info.K))
+			}
+			checkError(index.CreateSeedFilters(dbDir, uint8(seedFilterPrefix), seedFilterBits, opt.NumCPUs, indexLogger(opt.Verbose)))
+		}
 	},
 }
 
@@ -158,5 +173,12 @@ func init() {
 	reindexSeedsCmd.Flags().IntP("partitions", "", 1024,
 		formatFlagUsage(`Number of partitions for re-indexing seeds (k-mer-value data) files. The value needs to be the power of 4.`))
 
+	reindexSeedsCmd.Flags().BoolP("seed-filter", "", false,
+		formatFlagUsage(`Create presence filters of seed prefixes.`))
+	reindexSeedsCmd.Flags().IntP("seed-filter-prefix", "", int(kv.DefaultFilterPrefix),
+		formatFlagUsage(`Prefix length of seeds in the presence filters. Filters are only used when -p/--seed-min-prefix in "lexicmap search" is >= this value.`))
+	reindexSeedsCmd.Flags().IntP("seed-filter-bits", "", kv.DefaultFilterBitsPerKey,
+		formatFlagUsage(`Bits for each distinct seed prefix in the presence filters.`))
+
 	reindexSeedsCmd.SetUsageTemplate(usageTemplate(""))
 }
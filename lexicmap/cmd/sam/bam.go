@@ -0,0 +1,152 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+var le = binary.LittleEndian
+
+// WriteBAMHeader writes the header in the BAM format, w is usually a BGZFWriter.
+func WriteBAMHeader(w io.Writer, h *Header) error {
+	text := h.Text()
+
+	buf := make([]byte, 0, 12+len(text)+len(h.Refs)*64)
+	buf = append(buf, 'B', 'A', 'M', 1)
+	buf = le.AppendUint32(buf, uint32(len(text)))
+	buf = append(buf, text...)
+	buf = le.AppendUint32(buf, uint32(len(h.Refs)))
+	for _, ref := range h.Refs {
+		buf = le.AppendUint32(buf, uint32(len(ref.Name)+1))
+		buf = append(buf, ref.Name...)
+		buf = append(buf, 0)
+		buf = le.AppendUint32(buf, uint32(ref.Len))
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// bamCigarOps is the order of CIGAR operations in BAM.
+var bamCigarOps = [256]uint32{
+	'M': 0, 'I': 1, 'D': 2, 'N': 3, 'S': 4, 'H': 5, 'P': 6, '=': 7, 'X': 8,
+}
+
+// bamSeqCodes is the 4-bit encoding of bases in BAM.
+var bamSeqCodes = func() [256]byte {
+	var codes [256]byte
+	for i := range codes {
+		codes[i] = 15 // N
+	}
+	for i, b := range []byte("=ACMGRSVTWYHKDBN") {
+		codes[b] = byte(i)
+		codes[b|0x20] = byte(i) // lower case
+	}
+	return codes
+}()
+
+// WriteBAMRecord writes a record in the BAM format, w is usually a BGZFWriter.
+func WriteBAMRecord(w io.Writer, r *Record) error {
+	if len(r.QName) > 254 {
+		return fmt.Errorf("query name too long (>254): %s", r.QName)
+	}
+	if len(r.Cigar) > math.MaxUint16 {
+		return fmt.Errorf("too many CIGAR operations (>%d) for query: %s", math.MaxUint16, r.QName)
+	}
+
+	end := r.Pos + max(1, r.RefLen())
+	lSeq := len(r.Seq)
+
+	buf := make([]byte, 4, 64+len(r.QName)+len(r.Cigar)*4+lSeq*3/2)
+	buf = le.AppendUint32(buf, uint32(int32(r.RefID)))
+	buf = le.AppendUint32(buf, uint32(int32(r.Pos)))
+	buf = append(buf, uint8(len(r.QName)+1), r.MapQ)
+	buf = le.AppendUint16(buf, reg2bin(r.Pos, end))
+	buf = le.AppendUint16(buf, uint16(len(r.Cigar)))
+	buf = le.AppendUint16(buf, r.Flag)
+	buf = le.AppendUint32(buf, uint32(lSeq))
+	buf = le.AppendUint32(buf, math.MaxUint32) // next refID: -1
+	buf = le.AppendUint32(buf, math.MaxUint32) // next pos: -1
+	buf = le.AppendUint32(buf, 0)              // tlen
+
+	buf = append(buf, r.QName...)
+	buf = append(buf, 0)
+
+	for _, op := range r.Cigar {
+		buf = le.AppendUint32(buf, op.N<<4|bamCigarOps[op.Op])
+	}
+
+	for i := 0; i < lSeq; i += 2 {
+		if i+1 < lSeq {
+			buf = append(buf, bamSeqCodes[r.Seq[i]]<<4|bamSeqCodes[r.Seq[i+1]])
+		} else {
+			buf = append(buf, bamSeqCodes[r.Seq[i]]<<4)
+		}
+	}
+	for i := 0; i < lSeq; i++ { // no quality
+		buf = append(buf, 0xff)
+	}
+
+	for _, t := range r.Tags {
+		buf = append(buf, t.Key[0], t.Key[1], t.Type)
+		switch t.Type {
+		case 'i':
+			buf = le.AppendUint32(buf, uint32(int32(t.Int)))
+		case 'f':
+			buf = le.AppendUint32(buf, math.Float32bits(float32(t.Float)))
+		case 'Z':
+			buf = append(buf, t.Str...)
+			buf = append(buf, 0)
+		default:
+			return fmt.Errorf("unsupported tag type: %c", t.Type)
+		}
+	}
+
+	le.PutUint32(buf[:4], uint32(len(buf)-4))
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// reg2bin computes the bin of a 0-based region [beg, end), from the SAM specification.
+func reg2bin(beg, end int) uint16 {
+	end--
+	if beg>>14 == end>>14 {
+		return uint16(((1<<15)-1)/7 + (beg >> 14))
+	}
+	if beg>>17 == end>>17 {
+		return uint16(((1<<12)-1)/7 + (beg >> 17))
+	}
+	if beg>>20 == end>>20 {
+		return uint16(((1<<9)-1)/7 + (beg >> 20))
+	}
+	if beg>>23 == end>>23 {
+		return uint16(((1<<6)-1)/7 + (beg >> 23))
+	}
+	if beg>>26 == end>>26 {
+		return uint16(((1<<3)-1)/7 + (beg >> 26))
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sam
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// BGZFBlockSize is the maximum size of uncompressed data in a BGZF block,
+// which makes sure the compressed block is not larger than 64 KiB.
+const BGZFBlockSize = 0xff00
+
+// bgzfEOF is the empty block marking the end of a BGZF file.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// BGZFWriter writes data in the BGZF format, i.e., concatenated gzip members
+// with the block size in the extra field, which is used by BAM files.
+type BGZFWriter struct {
+	w     io.Writer
+	level int
+
+	buf  []byte // uncompressed data
+	zbuf bytes.Buffer
+	zw   *flate.Writer
+
+	err error
+}
+
+// NewBGZFWriter creates a BGZFWriter with a compression level of compress/flate.
+func NewBGZFWriter(w io.Writer, level int) (*BGZFWriter, error) {
+	zw, err := flate.NewWriter(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	return &BGZFWriter{
+		w:     w,
+		level: level,
+		buf:   make([]byte, 0, BGZFBlockSize),
+		zw:    zw,
+	}, nil
+}
+
+// Write writes data, blocks are compressed and written when they are full.
+func (bw *BGZFWriter) Write(p []byte) (int, error) {
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	var n, m int
+	for len(p) > 0 {
+		m = min(BGZFBlockSize-len(bw.buf), len(p))
+		bw.buf = append(bw.buf, p[:m]...)
+		p = p[m:]
+		n += m
+
+		if len(bw.buf) == BGZFBlockSize {
+			if bw.err = bw.flush(); bw.err != nil {
+				return n, bw.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush compresses and writes the data in the buffer as a block.
+func (bw *BGZFWriter) flush() error {
+	if len(bw.buf) == 0 {
+		return nil
+	}
+
+	bw.zbuf.Reset()
+	bw.zw.Reset(&bw.zbuf)
+	if _, err := bw.zw.Write(bw.buf); err != nil {
+		return err
+	}
+	if err := bw.zw.Close(); err != nil {
+		return err
+	}
+
+	// header (18 bytes) + compressed data + CRC32 (4 bytes) + ISIZE (4 bytes)
+	header := [18]byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff, 0x06, 0x00, 'B', 'C', 0x02, 0x00}
+	binary.LittleEndian.PutUint16(header[16:], uint16(18+bw.zbuf.Len()+8-1))
+
+	var tail [8]byte
+	binary.LittleEndian.PutUint32(tail[:4], crc32.ChecksumIEEE(bw.buf))
+	binary.LittleEndian.PutUint32(tail[4:], uint32(len(bw.buf)))
+
+	if _, err := bw.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(bw.zbuf.Bytes()); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(tail[:]); err != nil {
+		return err
+	}
+
+	bw.buf = bw.buf[:0]
+	return nil
+}
+
+// Flush compresses and writes the buffered data as a block.
+func (bw *BGZFWriter) Flush() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	bw.err = bw.flush()
+	return bw.err
+}
+
+// Close writes the buffered data and the EOF marker block.
+// The underlying writer is not closed.
+func (bw *BGZFWriter) Close() error {
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := bw.w.Write(bgzfEOF)
+	return err
+}
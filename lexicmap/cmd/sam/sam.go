@@ -0,0 +1,171 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package sam writes alignments in the SAM and BAM formats.
+package sam
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Flags of alignments.
+const (
+	FlagUnmapped      uint16 = 0x4
+	FlagReverse       uint16 = 0x10
+	FlagSecondary     uint16 = 0x100
+	FlagSupplementary uint16 = 0x800
+)
+
+// Reference is a reference sequence in the header.
+type Reference struct {
+	Name string
+	Len  int
+}
+
+// Header is the header of a SAM/BAM file.
+type Header struct {
+	Refs []Reference
+	// Lines are other header lines, e.g., "@PG\tID:lexicmap\tPN:lexicmap".
+	Lines []string
+}
+
+// Text returns the header in the SAM text format.
+func (h *Header) Text() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("@HD\tVN:1.6\tSO:unsorted\tGO:query\n")
+	for _, ref := range h.Refs {
+		fmt.Fprintf(&buf, "@SQ\tSN:%s\tLN:%d\n", ref.Name, ref.Len)
+	}
+	for _, line := range h.Lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// CigarOp is a CIGAR operation.
+type CigarOp struct {
+	Op byte // one of "MIDNSHP=X"
+	N  uint32
+}
+
+// consumesRef tells if the operation consumes the reference.
+func (op CigarOp) consumesRef() bool {
+	switch op.Op {
+	case 'M', 'D', 'N', '=', 'X':
+		return true
+	}
+	return false
+}
+
+// AppendCigar appends the text form of CIGAR operations to buf.
+func AppendCigar(buf []byte, ops []CigarOp) []byte {
+	for _, op := range ops {
+		buf = strconv.AppendUint(buf, uint64(op.N), 10)
+		buf = append(buf, op.Op)
+	}
+	return buf
+}
+
+// Tag is an optional field, only integer ('i'), float ('f'), and string ('Z') types are supported.
+type Tag struct {
+	Key   [2]byte
+	Type  byte
+	Int   int
+	Float float64
+	Str   []byte
+}
+
+// Record is an alignment record.
+type Record struct {
+	QName []byte
+	Flag  uint16
+	RefID int // index of the reference in the header
+	Pos   int // 0-based leftmost position
+	MapQ  uint8
+	Cigar []CigarOp
+	Seq   []byte // empty for "*"
+	Tags  []Tag
+}
+
+// RefLen returns the length of the reference region covered by the alignment.
+func (r *Record) RefLen() int {
+	var n int
+	for _, op := range r.Cigar {
+		if op.consumesRef() {
+			n += int(op.N)
+		}
+	}
+	return n
+}
+
+// WriteSAMHeader writes the header in the SAM format.
+func WriteSAMHeader(w io.Writer, h *Header) error {
+	_, err := w.Write(h.Text())
+	return err
+}
+
+// WriteSAMRecord writes a record in the SAM format, refName is the name of the reference.
+func WriteSAMRecord(w io.Writer, refName string, r *Record) error {
+	buf := make([]byte, 0, 256+len(r.Seq))
+	buf = append(buf, r.QName...)
+	buf = append(buf, '\t')
+	buf = strconv.AppendUint(buf, uint64(r.Flag), 10)
+	buf = append(buf, '\t')
+	buf = append(buf, refName...)
+	buf = append(buf, '\t')
+	buf = strconv.AppendInt(buf, int64(r.Pos+1), 10)
+	buf = append(buf, '\t')
+	buf = strconv.AppendUint(buf, uint64(r.MapQ), 10)
+	buf = append(buf, '\t')
+	if len(r.Cigar) == 0 {
+		buf = append(buf, '*')
+	} else {
+		buf = AppendCigar(buf, r.Cigar)
+	}
+	buf = append(buf, "\t*\t0\t0\t"...) // RNEXT, PNEXT, TLEN
+	if len(r.Seq) == 0 {
+		buf = append(buf, '*')
+	} else {
+		buf = append(buf, r.Seq...)
+	}
+	buf = append(buf, "\t*"...) // QUAL
+
+	for _, t := range r.Tags {
+		buf = append(buf, '\t', t.Key[0], t.Key[1], ':', t.Type, ':')
+		switch t.Type {
+		case 'i':
+			buf = strconv.AppendInt(buf, int64(t.Int), 10)
+		case 'f':
+			buf = strconv.AppendFloat(buf, t.Float, 'g', -1, 32)
+		case 'Z':
+			buf = append(buf, t.Str...)
+		default:
+			return fmt.Errorf("unsupported tag type: %c", t.Type)
+		}
+	}
+	buf = append(buf, '\n')
+
+	_, err := w.Write(buf)
+	return err
+}
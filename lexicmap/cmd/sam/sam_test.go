@@ -0,0 +1,106 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sam
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestBGZF(t *testing.T) {
+	data := bytes.Repeat([]byte("ACGTTGCA"), BGZFBlockSize/4) // two blocks
+
+	var buf bytes.Buffer
+	bw, err := NewBGZFWriter(&buf, gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasSuffix(buf.Bytes(), bgzfEOF) {
+		t.Errorf("EOF marker block missing")
+	}
+
+	// BGZF files are valid multi-member gzip files
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data2, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Errorf("data mismatch after decompression: %d vs %d bytes", len(data2), len(data))
+	}
+}
+
+func TestRecord(t *testing.T) {
+	r := &Record{
+		QName: []byte("q1"),
+		Flag:  FlagReverse,
+		RefID: 0,
+		Pos:   99,
+		MapQ:  255,
+		Cigar: []CigarOp{{'S', 2}, {'M', 5}, {'D', 1}, {'M', 3}},
+		Seq:   []byte("ACGTACGTAC"),
+		Tags:  []Tag{{Key: [2]byte{'N', 'M'}, Type: 'i', Int: 1}},
+	}
+	if n := r.RefLen(); n != 9 {
+		t.Errorf("unexpected reference length: %d", n)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSAMRecord(&buf, "g1|s1", r); err != nil {
+		t.Fatal(err)
+	}
+	expected := "q1\t16\tg1|s1\t100\t255\t2S5M1D3M\t*\t0\t0\tACGTACGTAC\t*\tNM:i:1\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected SAM record: %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteBAMRecord(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// block_size + 32 bytes of fixed fields + read name + cigar + seq + qual + tags
+	size := 32 + 3 + 4*4 + 5 + 10 + 7
+	if int(le.Uint32(data[:4])) != size || len(data) != size+4 {
+		t.Errorf("unexpected BAM record size: %d", le.Uint32(data[:4]))
+	}
+	if bin := le.Uint16(data[14:16]); bin != reg2bin(99, 108) || bin != 4681 {
+		t.Errorf("unexpected bin: %d", bin)
+	}
+	if !bytes.Equal(data[36:39], []byte("q1\x00")) || le.Uint32(data[39:43]) != 2<<4|4 {
+		t.Errorf("unexpected read name or CIGAR")
+	}
+	if seq := data[39+16 : 39+16+5]; !bytes.Equal(seq, []byte{0x12, 0x48, 0x12, 0x48, 0x12}) {
+		t.Errorf("unexpected encoded sequence: %v", seq)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+)
+
+// hspRow contains the data of a HSP, i.e., a row in the tabular format.
+type hspRow struct {
+	queryID []byte
+	qseq    []byte
+	hits    int // the number of subject genomes
+	hsp     int // Nth HSP in the genome
+
+	r  *index.SearchResult
+	sd *index.SimilarityDetail
+	c  *index.Chain2Result
+
+	onlyPseudoAlign bool
+	truncated       string
+	sdesc           map[string]string
+}
+
+// searchColumn is a column of search results in the tabular format.
+type searchColumn struct {
+	name  string
+	desc  string
+	align bool // needing the alignment detail, i.e., -a/--all
+	query bool // the value only depends on the query, which is available for queries without hits
+	value func(buf []byte, h *hspRow) []byte
+}
+
+func appendInt(buf []byte, v int) []byte {
+	return strconv.AppendInt(buf, int64(v), 10)
+}
+
+func appendFloat3(buf []byte, v float64) []byte {
+	return strconv.AppendFloat(buf, v, 'f', 3, 64)
+}
+
+// searchColumns is the registry of all columns, the first 17 ones are default columns.
+var searchColumns = []*searchColumn{
+	{name: "query", desc: "Query sequence ID.", query: true,
+		value: func(buf []byte, h *hspRow) []byte { return append(buf, h.queryID...) }},
+	{name: "qlen", desc: "Query sequence length.", query: true,
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, len(h.qseq)) }},
+	{name: "hits", desc: "Number of subject genomes.", query: true,
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.hits) }},
+	{name: "sgenome", desc: "Subject genome ID.",
+		value: func(buf []byte, h *hspRow) []byte { return append(buf, h.r.ID...) }},
+	{name: "sseqid", desc: "Subject sequence ID.",
+		value: func(buf []byte, h *hspRow) []byte { return append(buf, h.sd.SeqID...) }},
+	{name: "qcovGnm", desc: "Query coverage (percentage) per genome: $(aligned bases in the genome)/$qlen.",
+		value: func(buf []byte, h *hspRow) []byte { return appendFloat3(buf, h.r.AlignedFraction) }},
+	{name: "hsp", desc: "Nth HSP in the genome. (just for improving readability)",
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.hsp) }},
+	{name: "qcovHSP", desc: "Query coverage (percentage) per HSP: $(aligned bases in a HSP)/$qlen.",
+		value: func(buf []byte, h *hspRow) []byte { return appendFloat3(buf, h.c.AlignedFraction) }},
+	{name: "alenHSP", desc: "Aligned length in the current HSP.",
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.c.AlignedLength) }},
+	{name: "pident", desc: "Percentage of identical matches in the current HSP.",
+		value: func(buf []byte, h *hspRow) []byte { return appendFloat3(buf, h.c.PIdent) }},
+	{name: "gaps", desc: "Gaps in the current HSP.",
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.c.Gaps) }},
+	{name: "qstart", desc: "Start of alignment in query sequence.",
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.c.QBegin+1) }},
+	{name: "qend", desc: "End of alignment in query sequence.",
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.c.QEnd+1) }},
+	{name: "sstart", desc: "Start of alignment in subject sequence.",
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.c.TBegin+1) }},
+	{name: "send", desc: "End of alignment in subject sequence.",
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.c.TEnd+1) }},
+	{name: "sstr", desc: "Subject strand.",
+		value: func(buf []byte, h *hspRow) []byte {
+			if h.sd.RC {
+				return append(buf, '-')
+			}
+			return append(buf, '+')
+		}},
+	{name: "slen", desc: "Subject sequence length.",
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.sd.SeqLen) }},
+
+	// alignment detail
+	{name: "cigar", desc: "CIGAR string of the alignment.", align: true,
+		value: func(buf []byte, h *hspRow) []byte { return append(buf, h.c.CIGAR...) }},
+	{name: "qseq", desc: "Aligned part of query sequence.", align: true,
+		value: func(buf []byte, h *hspRow) []byte {
+			if h.onlyPseudoAlign {
+				return append(buf, h.qseq[h.c.QBegin:h.c.QEnd+1]...)
+			}
+			return append(buf, h.c.QSeq...)
+		}},
+	{name: "sseq", desc: "Aligned part of subject sequence.", align: true,
+		value: func(buf []byte, h *hspRow) []byte { return append(buf, h.c.TSeq...) }},
+	{name: "align", desc: `Alignment text ("|" and " ") between qseq and sseq.`, align: true,
+		value: func(buf []byte, h *hspRow) []byte { return append(buf, h.c.Alignment...) }},
+
+	// others
+	{name: "matches", desc: "Number of identical matches in the current HSP.",
+		value: func(buf []byte, h *hspRow) []byte { return appendInt(buf, h.c.MatchedBases) }},
+	{name: "mismatches", desc: "Number of mismatches in the current HSP.",
+		value: func(buf []byte, h *hspRow) []byte {
+			return appendInt(buf, h.c.AlignedLength-h.c.MatchedBases-max(h.c.Gaps, 0)) // gaps is -1 for pseudo alignment
+		}},
+	{name: "score", desc: "Alignment score of the current HSP under the scoring scheme of --score-* flags.",
+		value: func(buf []byte, h *hspRow) []byte { return strconv.AppendFloat(buf, h.c.Score, 'f', -1, 64) }},
+	{name: "bitscore", desc: "Bit score of the current HSP.",
+		value: func(buf []byte, h *hspRow) []byte { return strconv.AppendFloat(buf, h.c.BitScore, 'f', 1, 64) }},
+	{name: "evalue", desc: "Expect value of the current HSP.",
+		value: func(buf []byte, h *hspRow) []byte { return strconv.AppendFloat(buf, h.c.Evalue, 'g', 3, 64) }},
+	{name: "sdesc", desc: `Subject sequence description from --kv-file-seq, or "-" if not available.`,
+		value: func(buf []byte, h *hspRow) []byte {
+			if desc, ok := h.sdesc[string(h.sd.SeqID)]; ok {
+				return append(buf, desc...)
+			}
+			return append(buf, '-')
+		}},
+	{name: "truncated", desc: `Reasons if results are truncated by per-query limits: time, genomes, and anchors, or "-" for complete results.`, query: true,
+		value: func(buf []byte, h *hspRow) []byte {
+			if h.truncated == "" {
+				return append(buf, '-')
+			}
+			return append(buf, h.truncated...)
+		}},
+}
+
+// searchColumnsMap maps column names to columns.
+var searchColumnsMap map[string]*searchColumn
+
+func init() {
+	searchColumnsMap = make(map[string]*searchColumn, len(searchColumns))
+	for _, col := range searchColumns {
+		searchColumnsMap[col.name] = col
+	}
+}
+
+// defaultSearchColumns returns the default columns: 17 ones, 4 more with -a/--all,
+// and the column "truncated" when any per-query limit is set.
+func defaultSearchColumns(moreColumns, truncatedColumn bool) []*searchColumn {
+	columns := make([]*searchColumn, 0, 22)
+	columns = append(columns, searchColumns[:17]...)
+	if moreColumns {
+		columns = append(columns, searchColumns[17:21]...)
+	}
+	if truncatedColumn {
+		columns = append(columns, searchColumnsMap["truncated"])
+	}
+	return columns
+}
+
+// parseSearchColumns parses a comma-separated list of column names.
+// If the list starts with "+", the columns are appended to the default ones.
+func parseSearchColumns(s string, moreColumns, truncatedColumn bool) ([]*searchColumn, error) {
+	var columns []*searchColumn
+	if strings.HasPrefix(s, "+") {
+		s = s[1:]
+		columns = defaultSearchColumns(moreColumns, truncatedColumn)
+	}
+	names := strings.Split(s, ",")
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		col, ok := searchColumnsMap[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown column: %s, available columns: %s", name, strings.Join(searchColumnNames(), ", "))
+		}
+		columns = append(columns, col)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns given")
+	}
+	return columns, nil
+}
+
+// searchColumnNames returns names of all columns.
+func searchColumnNames() []string {
+	names := make([]string, len(searchColumns))
+	for i, col := range searchColumns {
+		names[i] = col.name
+	}
+	return names
+}
+
+// columnsNeedAlignment tells if any column needs the alignment detail.
+func columnsNeedAlignment(columns []*searchColumn) bool {
+	for _, col := range columns {
+		if col.align {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSearchColumn tells if the column is in the list.
+func hasSearchColumn(columns []*searchColumn, name string) bool {
+	for _, col := range columns {
+		if col.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// searchResultHeader returns the header line of search results in the tabular format.
+func searchResultHeader(columns []*searchColumn) string {
+	var sb strings.Builder
+	for i, col := range columns {
+		if i > 0 {
+			sb.WriteByte('\t')
+		}
+		sb.WriteString(col.name)
+	}
+	return sb.String()
+}
+
+// writeSearchResult writes search results of a query in the tabular format.
+// truncated is the value of the column "truncated", and sdesc maps sequence IDs to descriptions.
+func writeSearchResult(w io.Writer, columns []*searchColumn, queryID, qseq []byte, results *[]*index.SearchResult,
+	onlyPseudoAlign bool, truncated string, sdesc map[string]string) {
+
+	h := &hspRow{
+		queryID:         queryID,
+		qseq:            qseq,
+		hits:            len(*results),
+		onlyPseudoAlign: onlyPseudoAlign,
+		truncated:       truncated,
+		sdesc:           sdesc,
+	}
+	buf := make([]byte, 0, 1024)
+
+	for _, h.r = range *results { // each genome
+		h.hsp = 1
+		for _, h.sd = range *h.r.SimilarityDetails { // each chain
+			for _, h.c = range *h.sd.Similarity.Chains { // each match
+				if h.c == nil {
+					continue
+				}
+
+				buf = buf[:0]
+				for i, col := range columns {
+					if i > 0 {
+						buf = append(buf, '\t')
+					}
+					buf = col.value(buf, h)
+				}
+				buf = append(buf, '\n')
+				w.Write(buf)
+
+				h.hsp++
+			}
+		}
+	}
+}
+
+// writeTruncatedQuery writes a row for a query without hits because of per-query limits,
+// where columns of subjects and HSPs are "-", and truncated is the reasons.
+func writeTruncatedQuery(w io.Writer, columns []*searchColumn, queryID, qseq []byte, truncated string) {
+	h := &hspRow{
+		queryID:   queryID,
+		qseq:      qseq,
+		truncated: truncated,
+	}
+	buf := make([]byte, 0, 256)
+	for i, col := range columns {
+		if i > 0 {
+			buf = append(buf, '\t')
+		}
+		if col.query {
+			buf = col.value(buf, h)
+		} else {
+			buf = append(buf, '-')
+		}
+	}
+	buf = append(buf, '\n')
+	w.Write(buf)
+}
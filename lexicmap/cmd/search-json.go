@@ -0,0 +1,201 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+)
+
+// jsonQuery is the search result of a query in the JSON Lines format,
+// with the hierarchy of Query → Subject genome → Subject sequence → HSP.
+// Positions are 1-based, the same as the tabular format.
+type jsonQuery struct {
+	Query     string        `json:"query"`
+	QLen      int           `json:"qlen"`
+	Hits      int           `json:"hits"`
+	Truncated string        `json:"truncated,omitempty"` // reasons if truncated by per-query limits
+	Genomes   []*jsonGenome `json:"genomes"`
+}
+
+// jsonGenome is the search result in a subject genome.
+type jsonGenome struct {
+	SGenome     string          `json:"sgenome"`
+	GenomeBatch int             `json:"genomeBatch"`
+	GenomeIndex int             `json:"genomeIndex"`
+	GenomeSize  int             `json:"genomeSize"`
+	Score       float64         `json:"score"` // chaining score
+	QcovGnm     float64         `json:"qcovGnm"`
+	Sequences   []*jsonSequence `json:"sequences"`
+}
+
+// jsonSequence is the search result in a subject sequence.
+// Aligned bases, matched bases, qcov, and pident are computed in the sequence comparison phase.
+type jsonSequence struct {
+	SSeqID          string     `json:"sseqid"`
+	SLen            int        `json:"slen"`
+	SStr            string     `json:"sstr"`
+	Seeds           int        `json:"seeds"`
+	SimilarityScore float64    `json:"similarityScore"`
+	AlignedBases    int        `json:"alignedBases"`
+	MatchedBases    int        `json:"matchedBases"`
+	Qcov            float64    `json:"qcov"`
+	Pident          float64    `json:"pident"`
+	HSPs            []*jsonHSP `json:"hsps"`
+}
+
+// jsonHSP is a HSP.
+type jsonHSP struct {
+	HSP           int     `json:"hsp"` // Nth HSP in the genome
+	Anchors       int     `json:"anchors"`
+	QcovHSP       float64 `json:"qcovHSP"`
+	AlenHSP       int     `json:"alenHSP"`
+	MatchedBases  int     `json:"matchedBases"`
+	AlignedBasesQ int     `json:"alignedBasesQ"`
+	AlignedBasesS int     `json:"alignedBasesS"`
+	Pident        float64 `json:"pident"`
+	Gaps          int     `json:"gaps"`
+	Score         float64 `json:"score"`
+	BitScore      float64 `json:"bitscore"`
+	Evalue        float64 `json:"evalue"`
+	QStart        int     `json:"qstart"`
+	QEnd          int     `json:"qend"`
+	SStart        int     `json:"sstart"`
+	SEnd          int     `json:"send"`
+
+	CIGAR string `json:"cigar,omitempty"`
+	QSeq  string `json:"qseq,omitempty"`
+	SSeq  string `json:"sseq,omitempty"`
+	Align string `json:"align,omitempty"`
+}
+
+// newJSONQuery converts search results of a query to the JSON Lines format.
+// results could be nil for queries without matches.
+func newJSONQuery(queryID, qseq []byte, results *[]*index.SearchResult,
+	moreColumns, onlyPseudoAlign bool) *jsonQuery {
+
+	jq := &jsonQuery{
+		Query:   string(queryID),
+		QLen:    len(qseq),
+		Genomes: []*jsonGenome{},
+	}
+	if results == nil {
+		return jq
+	}
+	jq.Hits = len(*results)
+
+	var j int
+	for _, r := range *results { // each genome
+		g := &jsonGenome{
+			SGenome:     string(r.ID),
+			GenomeBatch: r.GenomeBatch,
+			GenomeIndex: r.GenomeIndex,
+			GenomeSize:  r.GenomeSize,
+			Score:       round3(r.Score),
+			QcovGnm:     round3(r.AlignedFraction),
+			Sequences:   make([]*jsonSequence, 0, len(*r.SimilarityDetails)),
+		}
+
+		j = 1
+		for _, sd := range *r.SimilarityDetails { // each sequence
+			sim := sd.Similarity
+			s := &jsonSequence{
+				SSeqID:          string(sd.SeqID),
+				SLen:            sd.SeqLen,
+				SStr:            "+",
+				Seeds:           sd.NSeeds,
+				SimilarityScore: round3(sd.SimilarityScore),
+				AlignedBases:    sim.AlignedBases,
+				MatchedBases:    sim.MatchedBases,
+				Qcov:            round3(sim.AlignedFraction),
+				Pident:          round3(sim.PIdent),
+				HSPs:            make([]*jsonHSP, 0, len(*sim.Chains)),
+			}
+			if sd.RC {
+				s.SStr = "-"
+			}
+
+			for _, c := range *sim.Chains { // each HSP
+				if c == nil {
+					continue
+				}
+
+				h := &jsonHSP{
+					HSP:           j,
+					Anchors:       c.NAnchors,
+					QcovHSP:       round3(c.AlignedFraction),
+					AlenHSP:       c.AlignedLength,
+					MatchedBases:  c.MatchedBases,
+					AlignedBasesQ: c.AlignedBasesQ,
+					AlignedBasesS: c.AlignedBasesT,
+					Pident:        round3(c.PIdent),
+					Gaps:          c.Gaps,
+					Score:         c.Score,
+					BitScore:      round1(c.BitScore),
+					Evalue:        c.Evalue,
+					QStart:        c.QBegin + 1,
+					QEnd:          c.QEnd + 1,
+					SStart:        c.TBegin + 1,
+					SEnd:          c.TEnd + 1,
+				}
+				if moreColumns {
+					h.CIGAR = string(c.CIGAR)
+					if onlyPseudoAlign {
+						h.QSeq = string(qseq[c.QBegin : c.QEnd+1])
+					} else {
+						h.QSeq = string(c.QSeq)
+					}
+					h.SSeq = string(c.TSeq)
+					h.Align = string(c.Alignment)
+				}
+				s.HSPs = append(s.HSPs, h)
+
+				j++
+			}
+
+			g.Sequences = append(g.Sequences, s)
+		}
+
+		jq.Genomes = append(jq.Genomes, g)
+	}
+
+	return jq
+}
+
+// writeJSONQuery writes the search result of a query as a line of JSON.
+func writeJSONQuery(w io.Writer, jq *jsonQuery) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(jq)
+}
+
+// round3 rounds a float to 3 decimal places, the same as the tabular format.
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// round1 rounds a float to 1 decimal place, the same as bit scores in the tabular format.
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
@@ -0,0 +1,148 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/sam"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+)
+
+// pafWriter writes search results in the PAF format.
+//
+// Target names are in the format of "genome|seqid", the same as reference names in SAM/BAM,
+// as sequence IDs might be duplicated in different genomes.
+// The 12 mandatory columns are followed by these tags:
+//
+//	cg:Z  CIGAR, only available when --pseudo-align is not given.
+//	gn:Z  Subject genome ID.
+//	qg:f  Query coverage (percentage) per genome, i.e., qcovGnm.
+//	qh:f  Query coverage (percentage) per HSP, i.e., qcovHSP.
+//	tr:Z  Reasons if results are truncated by per-query limits, only for truncated queries.
+//
+// For a query without hits because of per-query limits, a line with empty target fields
+// and the tag tr:Z is written, like "--paf-no-hit" of minimap2.
+type pafWriter struct {
+	cigar bool // output CIGAR
+
+	buf []byte
+	ops []sam.CigarOp
+}
+
+// newPAFWriter creates a pafWriter. CIGAR is not available for pseudo alignment.
+func newPAFWriter(onlyPseudoAlign bool) *pafWriter {
+	return &pafWriter{
+		cigar: !onlyPseudoAlign,
+
+		buf: make([]byte, 0, 1024),
+		ops: make([]sam.CigarOp, 0, 64),
+	}
+}
+
+// write writes search results of a query.
+// Residue matches and alignment block length are the numbers of matched bases and aligned length of a HSP.
+// The mapping quality is 255 (missing).
+func (pw *pafWriter) write(w io.Writer, queryID, qseq []byte, results *[]*index.SearchResult, truncated string) error {
+	var err error
+	for _, r := range *results { // each genome
+		for _, sd := range *r.SimilarityDetails { // each sequence
+			for _, c := range *sd.Similarity.Chains { // each HSP
+				if c == nil {
+					continue
+				}
+
+				buf := pw.buf[:0]
+				buf = append(buf, queryID...)
+				buf = append(buf, '\t')
+				buf = strconv.AppendInt(buf, int64(len(qseq)), 10)
+				buf = append(buf, '\t')
+				buf = strconv.AppendInt(buf, int64(c.QBegin), 10)
+				buf = append(buf, '\t')
+				buf = strconv.AppendInt(buf, int64(c.QEnd+1), 10)
+				buf = append(buf, '\t')
+				if sd.RC {
+					buf = append(buf, '-')
+				} else {
+					buf = append(buf, '+')
+				}
+				buf = append(buf, '\t')
+				buf = append(buf, r.ID...)
+				buf = append(buf, '|')
+				buf = append(buf, sd.SeqID...)
+				buf = append(buf, '\t')
+				buf = strconv.AppendInt(buf, int64(sd.SeqLen), 10)
+				buf = append(buf, '\t')
+				buf = strconv.AppendInt(buf, int64(c.TBegin), 10)
+				buf = append(buf, '\t')
+				buf = strconv.AppendInt(buf, int64(c.TEnd+1), 10)
+				buf = append(buf, '\t')
+				buf = strconv.AppendInt(buf, int64(c.MatchedBases), 10)
+				buf = append(buf, '\t')
+				buf = strconv.AppendInt(buf, int64(c.AlignedLength), 10)
+				buf = append(buf, "\t255"...)
+
+				if pw.cigar {
+					pw.ops, err = convertCIGAR(pw.ops[:0], c, sd.RC, nil)
+					if err != nil {
+						return err
+					}
+					buf = append(buf, "\tcg:Z:"...)
+					buf = sam.AppendCigar(buf, pw.ops)
+				}
+
+				buf = append(buf, "\tgn:Z:"...)
+				buf = append(buf, r.ID...)
+				buf = append(buf, "\tqg:f:"...)
+				buf = strconv.AppendFloat(buf, r.AlignedFraction, 'f', 3, 64)
+				buf = append(buf, "\tqh:f:"...)
+				buf = strconv.AppendFloat(buf, c.AlignedFraction, 'f', 3, 64)
+				if truncated != "" {
+					buf = append(buf, "\ttr:Z:"...)
+					buf = append(buf, truncated...)
+				}
+				buf = append(buf, '\n')
+
+				if _, err = w.Write(buf); err != nil {
+					return err
+				}
+				pw.buf = buf
+			}
+		}
+	}
+	return nil
+}
+
+// writeNoHit writes a line for a query without hits because of per-query limits.
+func (pw *pafWriter) writeNoHit(w io.Writer, queryID, qseq []byte, truncated string) error {
+	buf := pw.buf[:0]
+	buf = append(buf, queryID...)
+	buf = append(buf, '\t')
+	buf = strconv.AppendInt(buf, int64(len(qseq)), 10)
+	buf = append(buf, "\t0\t0\t*\t*\t0\t0\t0\t0\t0\t0\ttr:Z:"...)
+	buf = append(buf, truncated...)
+	buf = append(buf, '\n')
+
+	_, err := w.Write(buf)
+	pw.buf = buf
+	return err
+}
@@ -0,0 +1,412 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/sam"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+)
+
+// samWriter writes search results in the SAM or BAM format.
+//
+// Reference names are in the format of "genome|seqid".
+// If only subject sequences with hits are included in the header,
+// records are written to a temporary file first, as the header must go first.
+type samWriter struct {
+	bam bool
+
+	outfh *bufio.Writer
+	bgzf  *sam.BGZFWriter
+	w     io.Writer // for records
+
+	header *sam.Header
+	refIDs map[string]int
+	hits   bool // only subject sequences with hits are included in the header
+
+	tmpFile *os.File
+	tmpW    *bufio.Writer
+
+	rec     sam.Record
+	ops     []sam.CigarOp
+	seq     []byte
+	covered [][2]int // query regions of the primary and supplementary alignments
+}
+
+// newSAMWriter creates a samWriter. If allRefs is true, all sequences
+// in the genome data are included in the header, otherwise only ones with hits.
+// Alignment scores (AS) are the ones in the column "score", computed with the scoring scheme.
+func newSAMWriter(outfh *bufio.Writer, bam, allRefs bool, dbDir, tmpDir string, level int) (*samWriter, error) {
+	sw := &samWriter{
+		bam:    bam,
+		outfh:  outfh,
+		header: &sam.Header{},
+		refIDs: make(map[string]int, 1024),
+		hits:   !allRefs,
+		rec:    sam.Record{MapQ: 255},
+		ops:    make([]sam.CigarOp, 0, 64),
+		seq:    make([]byte, 0, 1024),
+	}
+	sw.header.Lines = append(sw.header.Lines,
+		fmt.Sprintf("@PG\tID:lexicmap\tPN:lexicmap\tVN:%s\tCL:%s", VERSION, strings.Join(os.Args, " ")))
+
+	var err error
+	if bam {
+		sw.bgzf, err = sam.NewBGZFWriter(outfh, level)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if sw.hits {
+		sw.tmpFile, err = os.CreateTemp(tmpDir, "lexicmap-sam-*.tmp")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temporary file for SAM/BAM records: %s", err)
+		}
+		sw.tmpW = bufio.NewWriterSize(sw.tmpFile, os.Getpagesize()*64)
+		sw.w = sw.tmpW
+		return sw, nil
+	}
+
+	if err = sw.readRefs(dbDir); err != nil {
+		return nil, err
+	}
+	if bam {
+		err = sam.WriteBAMHeader(sw.bgzf, sw.header)
+		sw.w = sw.bgzf
+	} else {
+		err = sam.WriteSAMHeader(outfh, sw.header)
+		sw.w = outfh
+	}
+	return sw, err
+}
+
+// readRefs reads all sequences from the genome data of an index.
+func (sw *samWriter) readRefs(dbDir string) error {
+	info, err := index.ReadIndexInfo(filepath.Join(dbDir, index.FileInfo))
+	if err != nil {
+		return fmt.Errorf("failed to read info file: %s", err)
+	}
+
+	var g *genome.Genome
+	var name string
+	for batch := 0; batch < info.GenomeBatches; batch++ {
+		rdr, err := genome.NewReader(filepath.Join(dbDir, index.DirGenomes, index.BatchDir(batch), index.FileGenomes))
+		if err != nil {
+			return fmt.Errorf("failed to read genome data file: %s", err)
+		}
+		for i := 0; i < rdr.NumGenomes(); i++ {
+			g, err = rdr.GenomeInfo(i)
+			if err != nil {
+				rdr.Close()
+				return fmt.Errorf("failed to read genome data file: %s", err)
+			}
+			for j, id := range g.SeqIDs {
+				name = string(g.ID) + "|" + string(*id)
+				sw.refIDs[name] = len(sw.header.Refs)
+				sw.header.Refs = append(sw.header.Refs, sam.Reference{Name: name, Len: g.SeqSizes[j]})
+			}
+			genome.RecycleGenome(g)
+		}
+		if err = rdr.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refID returns the index of a subject sequence in the header.
+func (sw *samWriter) refID(genomeID, seqID []byte, seqLen int) (int, error) {
+	name := string(genomeID) + "|" + string(seqID)
+	if id, ok := sw.refIDs[name]; ok {
+		return id, nil
+	}
+	if !sw.hits {
+		return -1, fmt.Errorf("subject sequence not found in the genome data: %s", name)
+	}
+	id := len(sw.header.Refs)
+	sw.refIDs[name] = id
+	sw.header.Refs = append(sw.header.Refs, sam.Reference{Name: name, Len: seqLen})
+	return id, nil
+}
+
+// write writes search results of a query.
+//
+// The best alignment is the primary one. Other alignments in the same genome are supplementary
+// if they do not overlap the primary or supplementary ones by >= 50% in the query,
+// and others are secondary ones. Sequences of non-primary alignments are hard clipped.
+// If the results are truncated by per-query limits, the reasons are saved in the tag "tr:Z".
+func (sw *samWriter) write(queryID, qseq []byte, results *[]*index.SearchResult, truncated string) error {
+	rec := &sw.rec
+	rec.QName = queryID
+	rec.MapQ = 255 // missing, it might be changed in writeUnmapped
+	sw.covered = sw.covered[:0]
+
+	var err error
+	var flag uint16
+	var primary bool
+	for i, r := range *results { // each genome
+		for _, sd := range *r.SimilarityDetails { // each sequence
+			for _, c := range *sd.Similarity.Chains { // each HSP
+				if c == nil {
+					continue
+				}
+
+				primary = false
+				if i > 0 {
+					flag = sam.FlagSecondary
+				} else if len(sw.covered) == 0 {
+					primary = true
+					flag = 0
+				} else if sw.overlapped(c.QBegin, c.QEnd) {
+					flag = sam.FlagSecondary
+				} else {
+					flag = sam.FlagSupplementary
+				}
+				if flag&sam.FlagSecondary == 0 {
+					sw.covered = append(sw.covered, [2]int{c.QBegin, c.QEnd})
+				}
+				if sd.RC {
+					flag |= sam.FlagReverse
+				}
+				rec.Flag = flag
+
+				if rec.RefID, err = sw.refID(r.ID, sd.SeqID, sd.SeqLen); err != nil {
+					return err
+				}
+				rec.Pos = c.TBegin
+
+				if err = sw.setAlignment(rec, c, qseq, sd.RC, primary); err != nil {
+					return fmt.Errorf("query %s, subject %s|%s: %s", queryID, r.ID, sd.SeqID, err)
+				}
+				if truncated != "" {
+					rec.Tags = append(rec.Tags, sam.Tag{Key: [2]byte{'t', 'r'}, Type: 'Z', Str: []byte(truncated)})
+				}
+
+				if sw.bam {
+					err = sam.WriteBAMRecord(sw.w, rec)
+				} else {
+					err = sam.WriteSAMRecord(sw.w, sw.header.Refs[rec.RefID].Name, rec)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// writeUnmapped writes an unmapped record for a query without hits because of per-query limits,
+// with the reasons in the tag "tr:Z".
+func (sw *samWriter) writeUnmapped(queryID, qseq []byte, truncated string) error {
+	rec := &sw.rec
+	rec.QName = queryID
+	rec.Flag = sam.FlagUnmapped
+	rec.RefID = -1
+	rec.Pos = -1
+	rec.MapQ = 0
+	rec.Cigar = rec.Cigar[:0]
+	rec.Seq = qseq
+	rec.Tags = append(rec.Tags[:0], sam.Tag{Key: [2]byte{'t', 'r'}, Type: 'Z', Str: []byte(truncated)})
+
+	if sw.bam {
+		return sam.WriteBAMRecord(sw.w, rec)
+	}
+	return sam.WriteSAMRecord(sw.w, "*", rec)
+}
+
+// overlapped tells if a query region overlaps any primary or supplementary alignment by >= 50%.
+func (sw *samWriter) overlapped(begin, end int) bool {
+	var b, e int
+	for _, region := range sw.covered {
+		b, e = max(begin, region[0]), min(end, region[1])
+		if e >= b && (e-b+1)*2 >= min(end-begin+1, region[1]-region[0]+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// setAlignment sets the CIGAR, sequence, and tags of a record from a HSP.
+// For alignments on the negative strand, the query sequence is reverse complemented.
+func (sw *samWriter) setAlignment(rec *sam.Record, c *index.Chain2Result, qseq []byte, rc, primary bool) error {
+	var st cigarStats
+	ops, err := convertCIGAR(sw.ops[:0], c, rc, &st)
+	if err != nil {
+		return err
+	}
+
+	// clipping
+	left, right := c.QBegin, len(qseq)-1-c.QEnd
+	if rc {
+		left, right = right, left
+	}
+	clip := byte('H')
+	seq := sw.seq[:0]
+	if primary {
+		clip = 'S'
+		seq = append(seq, qseq...)
+	} else {
+		seq = append(seq, qseq[c.QBegin:c.QEnd+1]...)
+	}
+	if rc {
+		index.RC(seq)
+	}
+
+	rec.Cigar = rec.Cigar[:0]
+	if left > 0 {
+		rec.Cigar = append(rec.Cigar, sam.CigarOp{Op: clip, N: uint32(left)})
+	}
+	rec.Cigar = append(rec.Cigar, ops...)
+	if right > 0 {
+		rec.Cigar = append(rec.Cigar, sam.CigarOp{Op: clip, N: uint32(right)})
+	}
+	rec.Seq = seq
+
+	// tags
+	rec.Tags = append(rec.Tags[:0],
+		sam.Tag{Key: [2]byte{'N', 'M'}, Type: 'i', Int: st.mismatches + st.gapBases},
+		sam.Tag{Key: [2]byte{'A', 'S'}, Type: 'i', Int: int(c.Score)},
+	)
+
+	sw.ops, sw.seq = ops, seq
+	return nil
+}
+
+// close writes the header and records if needed, and removes the temporary file.
+func (sw *samWriter) close() error {
+	if sw.hits {
+		defer func() {
+			sw.tmpFile.Close()
+			os.Remove(sw.tmpFile.Name())
+		}()
+
+		if err := sw.tmpW.Flush(); err != nil {
+			return err
+		}
+		if _, err := sw.tmpFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		var w io.Writer = sw.outfh
+		var err error
+		if sw.bam {
+			w = sw.bgzf
+			err = sam.WriteBAMHeader(w, sw.header)
+		} else {
+			err = sam.WriteSAMHeader(w, sw.header)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, bufio.NewReaderSize(sw.tmpFile, os.Getpagesize()*64)); err != nil {
+			return err
+		}
+	}
+
+	if sw.bam {
+		return sw.bgzf.Close()
+	}
+	return nil
+}
+
+// cigarStats contains the numbers of bases counted from a CIGAR.
+type cigarStats struct {
+	matches    int
+	mismatches int
+	gapBases   int
+	gapOpens   int
+}
+
+// convertCIGAR converts the CIGAR of a HSP from WFA to the one in SAM, and appends the operations to ops.
+//
+// CIGAR operations from WFA are converted: "X" (mismatch) to "M", "I" (only in the subject) to "D",
+// and "D" (only in the query) to "I". For alignments on the negative strand (rc is true),
+// the operations are reversed, as the query is reverse complemented in SAM.
+// Numbers of bases are counted into st if it is not nil.
+func convertCIGAR(ops []sam.CigarOp, c *index.Chain2Result, rc bool, st *cigarStats) ([]sam.CigarOp, error) {
+	if st == nil {
+		st = &cigarStats{}
+	}
+	i0 := len(ops)
+	var n uint32
+	var op byte
+	var qLen, tLen int
+	for _, b := range c.CIGAR {
+		if b >= '0' && b <= '9' {
+			n = n*10 + uint32(b-'0')
+			continue
+		}
+
+		switch b {
+		case 'M':
+			op = 'M'
+			st.matches += int(n)
+			qLen += int(n)
+			tLen += int(n)
+		case 'X':
+			op = 'M'
+			st.mismatches += int(n)
+			qLen += int(n)
+			tLen += int(n)
+		case 'I':
+			op = 'D'
+			st.gapBases += int(n)
+			st.gapOpens++
+			tLen += int(n)
+		case 'D', 'H':
+			op = 'I'
+			st.gapBases += int(n)
+			st.gapOpens++
+			qLen += int(n)
+		default:
+			return ops, fmt.Errorf("unsupported CIGAR operation: %c", b)
+		}
+
+		if len(ops) > i0 && ops[len(ops)-1].Op == op {
+			ops[len(ops)-1].N += n
+		} else {
+			ops = append(ops, sam.CigarOp{Op: op, N: n})
+		}
+		n = 0
+	}
+	if len(ops) == i0 {
+		return ops, fmt.Errorf("no CIGAR, which is not available for pseudo alignment")
+	}
+	if qLen != c.QEnd-c.QBegin+1 || tLen != c.TEnd-c.TBegin+1 {
+		return ops, fmt.Errorf("CIGAR does not match the alignment region")
+	}
+
+	if rc {
+		for i, j := i0, len(ops)-1; i < j; i, j = i+1, j-1 {
+			ops[i], ops[j] = ops[j], ops[i]
+		}
+	}
+	return ops, nil
+}
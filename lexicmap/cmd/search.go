@@ -22,6 +22,7 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -31,6 +32,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/shenwei356/LexicMap/lexicmap/index"
 	"github.com/shenwei356/bio/seq"
 	"github.com/shenwei356/bio/seqio/fastx"
 	"github.com/spf13/cobra"
@@ -43,7 +45,8 @@ var mapCmd = &cobra.Command{
 
 Attention:
   1. Input should be (gzipped) FASTA or FASTQ records from files or stdin.
-  2. For multiple queries, the order of queries might be different from the input.
+  2. For multiple queries, the order of queries might be different from the input,
+     unless --keep-order is given.
 
 Tips:
   1. When using -a/--all, the search result would be formatted to Blast-style format
@@ -89,10 +92,28 @@ Output format:
     19. qseq,     Aligned part of query sequence.                     (optional with -a/--all)
     20. sseq,     Aligned part of subject sequence.                   (optional with -a/--all)
     21. align,    Alignment text ("|" and " ") between qseq and sseq. (optional with -a/--all)
+    *.  truncated, Reasons if results are truncated by per-query limits: time, genomes, and anchors,
+                   or "-" for complete results. (optional with --max-query-time, --max-candidate-genomes, or --max-anchors)
+
+  Columns could be selected with --columns, which also supports these ones:
+
+    matches,      Number of identical matches in the current HSP.
+    mismatches,   Number of mismatches in the current HSP.
+    score,        Alignment score of the current HSP under the scoring scheme of --score-* flags.
+    bitscore,     Bit score of the current HSP.
+    evalue,       Expect value of the current HSP.
+    sdesc,        Subject sequence description from --kv-file-seq, or "-" if not available.
+
+  Other formats are available via --out-format: SAM, BAM, PAF (with 0-based positions),
+  and JSON Lines (one object per query, including queries without matches).
 
 Result ordering:
-  1. Within each subject genome, alignments (HSP) are sorted by qcovHSP*pident.
-  2. Results of multiple subject genomes are sorted by qcovHSP*pident of the best alignment.
+  1. Within each subject genome, alignments (HSP) are sorted by qcovHSP*pident,
+     then the subject sequence ID, positions, and strand.
+  2. Results of multiple subject genomes are sorted by qcovHSP*pident of the best alignment,
+     then qcovGnm, and the genome order in the index.
+  3. Ties are broken deterministically, so repeated runs produce identical output,
+     and -n/--top-n-genomes always selects the same genomes.
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -119,82 +140,59 @@ Result ordering:
 			}
 		}()
 
-		var err error
-
 		// ---------------------------------------------------------------
 
-		dbDir := getFlagString(cmd, "index")
-		if dbDir == "" {
-			checkError(fmt.Errorf("flag -d/--index needed"))
-		}
+		sf := getSearchFlags(cmd)
 		outFile := getFlagString(cmd, "out-file")
-		minPrefix := getFlagPositiveInt(cmd, "seed-min-prefix")
-		if minPrefix > 32 || minPrefix < 5 {
-			checkError(fmt.Errorf("the value of flag -p/--seed-min-prefix (%d) should be in the range of [5, 32]", minPrefix))
-		}
-		moreColumns := getFlagBool(cmd, "all")
+		keepOrder := getFlagBool(cmd, "keep-order")
 
-		// maxMismatch := getFlagInt(cmd, "seed-max-mismatch")
-		minSinglePrefix := getFlagPositiveInt(cmd, "seed-min-single-prefix")
-		if minSinglePrefix > 32 {
-			checkError(fmt.Errorf("the value of flag -P/--seed-min-single-prefix (%d) should be <= 32", minSinglePrefix))
+		outFormat := getFlagString(cmd, "out-format")
+		switch outFormat {
+		case "tsv", "sam", "bam", "paf", "jsonl":
+		default:
+			checkError(fmt.Errorf("invalid value of flag --out-format: %s, available values: tsv, sam, bam, paf, jsonl", outFormat))
 		}
-		if minSinglePrefix < minPrefix {
-			checkError(fmt.Errorf("the value of flag -P/--seed-min-single-prefix (%d) should be >= that of -p/--seed-min-prefix (%d)", minSinglePrefix, minPrefix))
+		outSAM := outFormat == "sam" || outFormat == "bam"
+		outPAF := outFormat == "paf"
+		outJSONL := outFormat == "jsonl"
+		var allRefs bool
+		switch samRefs := getFlagString(cmd, "sam-refs"); samRefs {
+		case "hits":
+		case "all":
+			allRefs = true
+		default:
+			checkError(fmt.Errorf("invalid value of flag --sam-refs: %s, available values: hits, all", samRefs))
 		}
-
-		// minMatches := getFlagPositiveInt(cmd, "seed-min-matches")
-		// if minMatches > 32 {
-		// 	checkError(fmt.Errorf("the value of flag -m/--seed-min-matches (%d) should be <= 32", minMatches))
-		// }
-		// if minMatches < minPrefix {
-		// 	checkError(fmt.Errorf("the value of flag -m/--seed-min-matches (%d) should be >= that of -P/--seed-min-single-prefix (%d)", minMatches, minSinglePrefix))
-		// }
-
-		maxGap := getFlagPositiveInt(cmd, "seed-max-gap")
-		maxDist := getFlagPositiveInt(cmd, "seed-max-dist")
-		extLen := getFlagNonNegativeInt(cmd, "align-ext-len")
-		// if extLen < 1000 {
-		// 	checkError(fmt.Errorf("the value of flag --align-ext-len should be >= 1000"))
-		// }
-		topn := getFlagNonNegativeInt(cmd, "top-n-genomes")
-		inMemorySearch := getFlagBool(cmd, "load-whole-seeds")
-
-		onlyPseudoAlign := getFlagBool(cmd, "pseudo-align")
-
-		minAlignLen := getFlagPositiveInt(cmd, "align-min-match-len")
-		if minAlignLen < minSinglePrefix {
-			checkError(fmt.Errorf("the value of flag -l/--align-min-match-len (%d) should be >= that of -M/--seed-min-single-prefix (%d)", minAlignLen, minSinglePrefix))
+		if outSAM {
+			if sf.onlyPseudoAlign {
+				checkError(fmt.Errorf("flag --pseudo-align is not supported for the output format %s, which needs CIGAR", outFormat))
+			}
+			sf.moreColumns = true // for CIGAR
 		}
-		maxAlignMaxGap := getFlagPositiveInt(cmd, "align-max-gap")
-		// maxAlignMismatch := getFlagPositiveInt(cmd, "align-max-kmer-dist")
-		alignBand := getFlagPositiveInt(cmd, "align-band")
-		if alignBand < maxAlignMaxGap {
-			checkError(fmt.Errorf("the value of flag --align-band should not be smaller thant the value of --align-max-gap"))
+		if outPAF {
+			sf.moreColumns = !sf.onlyPseudoAlign // for CIGAR
 		}
 
-		minQcovGenome := getFlagNonNegativeFloat64(cmd, "min-qcov-per-genome")
-		if minQcovGenome > 100 {
-			checkError(fmt.Errorf("the value of flag -Q/--min-qcov-per-genome (%f) should be in range of [0, 100]", minQcovGenome))
-		}
-		// } else if minQcovGenome < 1 {
-		// 	log.Warningf("the value of flag -Q/--min-qcov-per-genome is percentage in a range of [0, 100], you set: %f", minQcovGenome)
-		// }
-		minIdent := getFlagNonNegativeFloat64(cmd, "align-min-match-pident")
-		if minIdent < 60 || minIdent > 100 {
-			checkError(fmt.Errorf("the value of flag -i/--align-min-match-pident (%f) should be in range of [60, 100]", minIdent))
+		var err error
+		var columns []*searchColumn
+		if v := getFlagString(cmd, "columns"); v != "" {
+			if outFormat != "tsv" {
+				checkError(fmt.Errorf("flag --columns is only supported for the output format tsv"))
+			}
+			columns, err = parseSearchColumns(v, sf.moreColumns, sf.hasLimits())
+			checkError(err)
+			if columnsNeedAlignment(columns) {
+				sf.moreColumns = true
+			}
+		} else {
+			columns = defaultSearchColumns(sf.moreColumns, sf.hasLimits())
 		}
-
-		// } else if minIdent < 1 {
-		// 	log.Warningf("the value of flag -i/--align-min-match-pident is percentage in a range of [0, 100], you set: %f", minIdent)
-		// }
-		minQcovChain := getFlagNonNegativeFloat64(cmd, "min-qcov-per-hsp")
-		if minQcovChain > 100 {
-			checkError(fmt.Errorf("the value of flag -q/--min-qcov-per-hsp (%f) should be in range of [0, 100]", minIdent))
+		var sdesc map[string]string
+		if kvFileSeq := getFlagString(cmd, "kv-file-seq"); kvFileSeq != "" {
+			sdesc, err = readKVs(kvFileSeq, false)
+			checkError(err)
 		}
 
-		maxOpenFiles := getFlagPositiveInt(cmd, "max-open-files")
-
 		// ---------------------------------------------------------------
 
 		if outputLog {
@@ -231,53 +229,17 @@ Result ordering:
 			}
 		}
 
-		maxQueryConcurrency := getFlagNonNegativeInt(cmd, "max-query-conc")
-		if maxQueryConcurrency == 0 {
-			maxQueryConcurrency = runtime.NumCPU()
-		}
-
 		// ---------------------------------------------------------------
 		// loading index
 
 		if outputLog {
 			log.Info()
-			log.Infof("loading index: %s", dbDir)
+			log.Infof("loading index: %s", sf.dbDir)
 		}
 
-		sopt := &IndexSearchingOptions{
-			NumCPUs:      opt.NumCPUs,
-			Verbose:      opt.Verbose,
-			Log2File:     opt.Log2File,
-			MaxOpenFiles: maxOpenFiles,
-
-			MinPrefix: uint8(minPrefix),
-			// MaxMismatch:     maxMismatch,
-			MinSinglePrefix: uint8(minSinglePrefix),
-			// MinMatchedBases: uint8(minMatches),
-			TopN:           topn,
-			InMemorySearch: inMemorySearch,
-
-			MaxGap:      float64(maxGap),
-			MaxDistance: float64(maxDist),
-
-			ExtendLength: extLen,
-
-			MinQueryAlignedFractionInAGenome: minQcovGenome,
-
-			MoreAccurateAlignment: !onlyPseudoAlign,
-
-			OutputSeq: moreColumns,
-		}
-
-		idx, err := NewIndexSearcher(dbDir, sopt)
+		idx, err := index.NewIndexSearcher(sf.dbDir, sf.indexSearchingOptions(opt))
 		checkError(err)
-
-		if extLen > idx.contigInterval {
-			checkError(fmt.Errorf("the value of flag --align-ext-len (%d) should be <= contig interval length in database (%d)", extLen, idx.contigInterval))
-		}
-		if maxDist > idx.contigInterval {
-			checkError(fmt.Errorf("the value of flag --seed-max-dist (%d) should be <= contig interval length in database (%d)", maxDist, idx.contigInterval))
-		}
+		checkError(sf.checkIndex(idx))
 
 		if outputLog {
 			log.Infof("index loaded in %s", time.Since(timeStart))
@@ -293,8 +255,19 @@ Result ordering:
 
 		timeStart1 := time.Now()
 
-		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(outFile, ".gz"), opt.CompressionLevel)
+		// BAM files are compressed in BGZF blocks.
+		gzipped := outFormat != "bam" && strings.HasSuffix(outFile, ".gz")
+		outfh, gw, w, err := outStream(outFile, gzipped, opt.CompressionLevel)
 		checkError(err)
+		var sw *samWriter
+		if outSAM {
+			sw, err = newSAMWriter(outfh, outFormat == "bam", allRefs, sf.dbDir, sf.tmpDir, opt.CompressionLevel)
+			checkError(err)
+		}
+		var pw *pafWriter
+		if outPAF {
+			pw = newPAFWriter(sf.onlyPseudoAlign)
+		}
 		defer func() {
 			outfh.Flush()
 			if gw != nil {
@@ -307,15 +280,39 @@ Result ordering:
 		var speed float64 // k reads/second
 
 		// fmt.Fprintf(outfh, "query\tqlen\tqstart\tqend\thits\tsgenome\tsseqid\tqcovGnm\thsp\tqcovHSP\talenHSP\talenSeg\tpident\tslen\tsstart\tsend\tsstr\tseeds\n")
-		fmt.Fprintf(outfh, "query\tqlen\thits\tsgenome\tsseqid\tqcovGnm\thsp\tqcovHSP\talenHSP\tpident\tgaps\tqstart\tqend\tsstart\tsend\tsstr\tslen")
-		if moreColumns {
-			fmt.Fprintf(outfh, "\tcigar\tqseq\tsseq\talign")
+		if outFormat == "tsv" {
+			fmt.Fprintln(outfh, searchResultHeader(columns))
 		}
-		fmt.Fprintln(outfh)
+		truncatedColumn := hasSearchColumn(columns, "truncated")
+
+		var truncated uint64
 
 		printResult := func(q *Query) {
 			total++
+			if q.truncation > 0 {
+				truncated++
+			}
+			if q.truncation > 0 && outputLog {
+				log.Warningf("search result of query %s is truncated, reason: %s", q.seqID, q.truncation)
+			}
 			if q.result == nil { // seqs shorter than K or queries without matches.
+				if outJSONL { // one object per query
+					jq := newJSONQuery(q.seqID, q.seq, nil, sf.moreColumns, sf.onlyPseudoAlign)
+					jq.Truncated = q.truncation.String()
+					checkError(writeJSONQuery(outfh, jq))
+				} else if q.truncation > 0 { // truncated queries are still outputted, with the reasons
+					switch {
+					case outSAM:
+						checkError(sw.writeUnmapped(q.seqID, q.seq, q.truncation.String()))
+					case outPAF:
+						checkError(pw.writeNoHit(outfh, q.seqID, q.seq, q.truncation.String()))
+					default:
+						writeTruncatedQuery(outfh, columns, q.seqID, q.seq, q.truncation.String())
+					}
+				}
+				if !outSAM {
+					outfh.Flush()
+				}
 				poolQuery.Put(q)
 				return
 			}
@@ -327,108 +324,79 @@ Result ordering:
 				}
 			}
 
-			queryID := q.seqID
-			// var c int
-			// var v *index.SubstrPair
-			// var i int
-			// var subs *[]*index.SubstrPair
-			var sd *SimilarityDetail
-			var cr *SeqComparatorResult
-			var c *Chain2Result
-			var targets = len(*q.result)
 			matched++
 
-			var strand byte
-			var j int
-			for _, r := range *q.result { // each genome
-				j = 1
-				for _, sd = range *r.SimilarityDetails { // each chain
-					cr = sd.Similarity
-
-					if sd.RC {
-						strand = '-'
-					} else {
-						strand = '+'
-					}
-
-					for _, c = range *cr.Chains { // each match
-						if c == nil {
-							continue
-						}
-
-						if sd.RC {
-							strand = '-'
-						} else {
-							strand = '+'
-						}
-
-						fmt.Fprintf(outfh, "%s\t%d\t%d\t%s\t%s\t%.3f\t%d\t%.3f\t%d\t%.3f\t%d\t%d\t%d\t%d\t%d\t%c\t%d",
-							queryID, len(q.seq),
-							targets, r.ID, sd.SeqID, r.AlignedFraction,
-							j, c.AlignedFraction, c.AlignedLength, c.PIdent, c.Gaps,
-							c.QBegin+1, c.QEnd+1,
-							c.TBegin+1, c.TEnd+1,
-							strand, sd.SeqLen,
-						)
-						if moreColumns {
-							if onlyPseudoAlign {
-								fmt.Fprintf(outfh, "\t%s\t%s\t%s\t%s", c.CIGAR, q.seq[c.QBegin:c.QEnd+1], c.TSeq, c.Alignment)
-							} else {
-								fmt.Fprintf(outfh, "\t%s\t%s\t%s\t%s", c.CIGAR, c.QSeq, c.TSeq, c.Alignment)
-							}
-						}
-
-						fmt.Fprintln(outfh)
-
-						j++
-					}
+			switch {
+			case outSAM:
+				checkError(sw.write(q.seqID, q.seq, q.result, q.truncation.String()))
+			case outPAF:
+				checkError(pw.write(outfh, q.seqID, q.seq, q.result, q.truncation.String()))
+			case outJSONL:
+				jq := newJSONQuery(q.seqID, q.seq, q.result, sf.moreColumns, sf.onlyPseudoAlign)
+				jq.Truncated = q.truncation.String()
+				checkError(writeJSONQuery(outfh, jq))
+			default:
+				var _truncated string
+				if truncatedColumn {
+					_truncated = q.truncatedColumn()
 				}
-				outfh.Flush()
+				writeSearchResult(outfh, columns, q.seqID, q.seq, q.result, sf.onlyPseudoAlign, _truncated, sdesc)
 			}
 			idx.RecycleSearchResults(q.result)
 
 			poolQuery.Put(q)
-			outfh.Flush()
+			if !outSAM {
+				outfh.Flush()
+			}
 		}
 
 		// outputter
-		ch := make(chan *Query, maxQueryConcurrency)
+		ch := make(chan *Query, sf.maxQueryConcurrency)
 		done := make(chan int)
+
+		// With --keep-order, each query takes a slot before being searched, and frees it after being outputted.
+		// So the reorder buffer holds at most cap(slots) queries, even when an early query is slow.
+		var slots chan int
+		if keepOrder {
+			slots = make(chan int, keepOrderBufferFactor*sf.maxQueryConcurrency)
+		}
 		go func() {
+			if !keepOrder {
+				for r := range ch {
+					printResult(r)
+				}
+				done <- 1
+				return
+			}
 
+			buf := make(map[uint64]*Query, cap(slots))
+			var next uint64
+			var q *Query
+			var ok bool
 			for r := range ch {
-				printResult(r)
+				buf[r.id] = r
+				for {
+					if q, ok = buf[next]; !ok {
+						break
+					}
+					delete(buf, next)
+					printResult(q)
+					<-slots
+					next++
+				}
 			}
 
 			done <- 1
 		}()
 
 		var wg sync.WaitGroup
-		tokens := make(chan int, maxQueryConcurrency)
+		tokens := make(chan int, sf.maxQueryConcurrency)
 
 		var record *fastx.Record
-		K := idx.k
-
-		idx.SetSeqCompareOptions(&SeqComparatorOptions{
-			K:         uint8(K),
-			MinPrefix: 11, // can not be too small, or there will be a large number of anchors.
-
-			Chaining2Options: Chaining2Options{
-				// should be relative small
-				MaxGap: maxAlignMaxGap,
-				// better be larger than MinPrefix
-				MinScore:    minAlignLen,
-				MinAlignLen: minAlignLen,
-				MinIdentity: minIdent,
-				// can not be < k
-				// MaxDistance: maxAlignMismatch,
-				// can not be two small
-				Band: alignBand,
-			},
-
-			MinAlignedFraction: minQcovChain,
-			MinIdentity:        minIdent,
-		})
+		var id uint64 // index of the query in the input
+		K := idx.K()
+
+		idx.SetSeqCompareOptions(sf.seqCompareOptions(K))
 
 		for _, file := range files {
 			fastxReader, err := fastx.NewReader(nil, file, "")
@@ -447,6 +415,15 @@ Result ordering:
 				query := poolQuery.Get().(*Query)
 				query.Reset()
 
+				query.seqID = append(query.seqID, record.ID...)
+				query.seq = append(query.seq, bytes.ToUpper(record.Seq.Seq)...)
+				query.id = id
+				id++
+
+				if keepOrder {
+					slots <- 1
+				}
+
 				if len(record.Seq.Seq) < K {
 					query.result = nil
 					ch <- query
@@ -456,9 +433,6 @@ Result ordering:
 				tokens <- 1
 				wg.Add(1)
 
-				query.seqID = append(query.seqID, record.ID...)
-				query.seq = append(query.seq, bytes.ToUpper(record.Seq.Seq)...)
-
 				go func(query *Query) {
 					defer func() {
 						<-tokens
@@ -466,7 +440,7 @@ Result ordering:
 					}()
 
 					var err error
-					query.result, err = idx.Search(query.seq)
+					query.result, query.truncation, err = idx.SearchContext(context.Background(), query.seq, nil)
 					if err != nil {
 						checkError(err)
 					}
@@ -480,6 +454,10 @@ Result ordering:
 		close(ch)
 		<-done
 
+		if outSAM {
+			checkError(sw.close())
+		}
+
 		if outputLog {
 			fmt.Fprintf(os.Stderr, "\n")
 
@@ -487,6 +465,9 @@ Result ordering:
 			log.Infof("")
 			log.Infof("processed queries: %d, speed: %.3f queries per minute\n", total, speed)
 			log.Infof("%.4f%% (%d/%d) queries matched", float64(matched)/float64(total)*100, matched, total)
+			if truncated > 0 {
+				log.Infof("%d queries are truncated by per-query limits", truncated)
+			}
 			log.Infof("done searching")
 			if outFile != "-" {
 				log.Infof("search results saved to: %s", outFile)
@@ -501,85 +482,481 @@ Result ordering:
 func init() {
 	RootCmd.AddCommand(mapCmd)
 
-	mapCmd.Flags().StringP("index", "d", "",
-		formatFlagUsage(`Index directory created by "lexicmap index".`))
-
 	mapCmd.Flags().StringP("out-file", "o", "-",
 		formatFlagUsage(`Out file, supports a ".gz" suffix ("-" for stdout).`))
 
-	mapCmd.Flags().IntP("max-open-files", "", 512,
+	mapCmd.Flags().StringP("columns", "", "",
+		formatFlagUsage(`Comma-separated output columns of the tabular format, e.g., "query,sgenome,sseqid,pident,qstart,qend,sstart,send". `+
+			`All columns are listed in the help message, and -a/--all is not needed for alignment columns. `+
+			`A value starting with "+" appends columns to the default ones, e.g., "+evalue,bitscore".`))
+
+	mapCmd.Flags().StringP("kv-file-seq", "", "",
+		formatFlagUsage(`Two-column tabular file for mapping the subject sequence ID (sseqid) to the description, for the column sdesc.`))
+
+	mapCmd.Flags().StringP("out-format", "", "tsv",
+		formatFlagUsage(`Output format. Available values: "tsv", "sam", "bam", "paf", "jsonl". `+
+			`SAM/BAM records use reference names in the format of "genome|seqid", and flag --pseudo-align is not supported. `+
+			`PAF records use target names in the same format, and have tags of CIGAR (cg:Z, not available for --pseudo-align), genome ID (gn:Z), qcovGnm (qg:f), and qcovHSP (qh:f). `+
+			`JSON Lines (jsonl) output has one object per query, with nested genomes, sequences, and HSPs.`))
+
+	mapCmd.Flags().StringP("sam-refs", "", "hits",
+		formatFlagUsage(`Reference sequences in the SAM/BAM header. Available values: `+
+			`"hits" (only subject sequences with hits, records are written to a temporary file in --tmp-dir first), "all" (all sequences in the genome data).`))
+
+	mapCmd.Flags().BoolP("keep-order", "", false,
+		formatFlagUsage(fmt.Sprintf(`Keep the order of queries in the input. Finished queries wait in a reorder buffer for earlier ones, `+
+			`and at most %d times of -J/--max-query-conc queries are held in searching and the buffer, to limit the memory.`, keepOrderBufferFactor)))
+
+	addSearchFlags(mapCmd)
+
+	mapCmd.SetUsageTemplate(usageTemplate("-d <index path> [query.fasta.gz ...] [-o query.tsv.gz]"))
+
+}
+
+// searchFlags contains values of flags shared by "lexicmap search" and "lexicmap serve".
+type searchFlags struct {
+	dbDir string
+
+	maxOpenFiles        int
+	maxQueryConcurrency int
+	moreColumns         bool
+
+	// seed searching
+	minPrefix       int
+	minSinglePrefix int
+	maxGap          int
+	maxDist         int
+	topn            int
+	inMemorySearch  bool
+	seedMemBudget   int64
+	anchorMemBudget int64
+	tmpDir          string
+	mmapGenomes     bool
+	secondSeedsMode int
+
+	// alignment
+	onlyPseudoAlign bool
+	extLen          int
+	maxAlignMaxGap  int
+	alignBand       int
+	minAlignLen     int
+	alignMode       index.AlignMode
+	alignPenalties  index.AlignPenalties
+
+	// filtering
+	minIdent      float64
+	minQcovChain  float64
+	minQcovGenome float64
+	maxEvalue     float64
+
+	// scoring scheme for E-values
+	scoringScheme index.ScoringScheme
+
+	// per-query limits
+	maxQueryTime        time.Duration
+	maxCandidateGenomes int
+	maxAnchors          int
+}
+
+// hasLimits tells if any per-query limit is set.
+func (sf *searchFlags) hasLimits() bool {
+	return sf.maxQueryTime > 0 || sf.maxCandidateGenomes > 0 || sf.maxAnchors > 0
+}
+
+// addSearchFlags adds flags shared by "lexicmap search" and "lexicmap serve".
+func addSearchFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("index", "d", "",
+		formatFlagUsage(`Index directory created by "lexicmap index", or an index bundle file created by "lexicmap utils bundle-index".`))
+
+	cmd.Flags().IntP("max-open-files", "", 512,
 		formatFlagUsage(`Maximum opened files.`))
 
-	mapCmd.Flags().BoolP("all", "a", false,
+	cmd.Flags().BoolP("all", "a", false,
 		formatFlagUsage(`Output more columns, e.g., matched sequences. Use this if you want to output blast-style format with "lexicmap utils 2blast".`))
 
-	mapCmd.Flags().IntP("max-query-conc", "J", 12,
+	cmd.Flags().IntP("max-query-conc", "J", 12,
 		formatFlagUsage(`Maximum number of concurrent queries. Bigger values do not improve the batch searching speed and consume much memory.`))
 
 	// seed searching
 
-	mapCmd.Flags().IntP("seed-min-prefix", "p", 15,
+	cmd.Flags().IntP("seed-min-prefix", "p", 15,
 		formatFlagUsage(`Minimum (prefix) length of matched seeds.`))
 
-	mapCmd.Flags().IntP("seed-min-single-prefix", "P", 17,
+	cmd.Flags().IntP("seed-min-single-prefix", "P", 17,
 		formatFlagUsage(`Minimum (prefix) length of matched seeds if there's only one pair of seeds matched.`))
 
-	// mapCmd.Flags().IntP("seed-min-matches", "m", 20,
+	// cmd.Flags().IntP("seed-min-matches", "m", 20,
 	// 	formatFlagUsage(`Minimum matched bases in the only one pair of seeds.`))
 
-	// mapCmd.Flags().IntP("seed-max-mismatch", "m", -1,
+	// cmd.Flags().IntP("seed-max-mismatch", "m", -1,
 	// 	formatFlagUsage(`Maximum mismatch between non-prefix regions of shared substrings.`))
 
-	mapCmd.Flags().IntP("seed-max-gap", "", 200,
+	cmd.Flags().IntP("seed-max-gap", "", 200,
 		formatFlagUsage(`Max gap in seed chaining.`))
-	mapCmd.Flags().IntP("seed-max-dist", "", 1000,
+	cmd.Flags().IntP("seed-max-dist", "", 1000,
 		formatFlagUsage(`Max distance between seeds in seed chaining. It should be <= contig interval length in database.`))
 
-	mapCmd.Flags().IntP("top-n-genomes", "n", 0,
+	cmd.Flags().IntP("top-n-genomes", "n", 0,
 		formatFlagUsage(`Keep top N genome matches for a query (0 for all) in chaining phase. Value 1 is not recommended as the best chaining result does not always bring the best alignment, so it better be >= 5.`))
 
-	mapCmd.Flags().BoolP("load-whole-seeds", "w", false,
+	cmd.Flags().BoolP("load-whole-seeds", "w", false,
 		formatFlagUsage(`Load the whole seed data into memory for faster search.`))
 
+	cmd.Flags().StringP("seed-mem-budget", "", "",
+		formatFlagUsage(`Load as many seed data chunks into memory as fit in the budget, e.g., 200G, while others are searched on disk. Units supported: B, K, M, G, T.`))
+
+	cmd.Flags().StringP("anchor-mem-budget", "", "",
+		formatFlagUsage(`Spill anchors (seed matches) of a query to temporary files when their memory exceeds the budget, e.g., 4G, `+
+			`and chain and align genomes group by group. It helps queries with a huge number of genome hits, e.g., conserved genes. Units supported: B, K, M, G, T.`))
+
+	cmd.Flags().StringP("tmp-dir", "", "",
+		formatFlagUsage(`Directory for temporary files, e.g., spilled anchors. The default one of the system is used if not given.`))
+
+	cmd.Flags().BoolP("mmap-genomes", "", false,
+		formatFlagUsage(`Memory-map genome data files and share one reader for each batch among all queries, which does not consume file handlers of --max-open-files and is recommended for indexes with many batches. Not supported on Windows.`))
+
+	cmd.Flags().StringP("second-seeds", "", "fallback",
+		formatFlagUsage(`How to use seeds of the second mask set with a smaller k, if the index has one. `+
+			`Available values: "fallback" (only when no anchors are found with the main masks), "combine" (always combine anchors from both), "none".`))
+
 	// pseudo alignment
-	mapCmd.Flags().BoolP("pseudo-align", "", false,
+	cmd.Flags().BoolP("pseudo-align", "", false,
 		formatFlagUsage(`Only perform pseudo alignment, alignment metrics, including qcovGnm, qcovSHP and pident, will be less accurate.`))
 
-	mapCmd.Flags().IntP("align-ext-len", "", 1000,
+	cmd.Flags().IntP("align-ext-len", "", 1000,
 		formatFlagUsage(`Extend length of upstream and downstream of seed regions, for extracting query and target sequences for alignment. It should be <= contig interval length in database.`))
 
-	mapCmd.Flags().IntP("align-max-gap", "", 20,
+	cmd.Flags().IntP("align-max-gap", "", 20,
 		formatFlagUsage(`Maximum gap in a HSP segment.`))
-	// mapCmd.Flags().IntP("align-max-kmer-dist", "", 100,
+	// cmd.Flags().IntP("align-max-kmer-dist", "", 100,
 	// 	formatFlagUsage(`Maximum distance of (>=11bp) k-mers in a HSP segment.`))
-	mapCmd.Flags().IntP("align-band", "", 50,
+	cmd.Flags().IntP("align-band", "", 50,
 		formatFlagUsage(`Band size in backtracking the score matrix (pseduo alignment phase).`))
-	mapCmd.Flags().IntP("align-min-match-len", "l", 50,
+	cmd.Flags().IntP("align-min-match-len", "l", 50,
 		formatFlagUsage(`Minimum aligned length in a HSP segment.`))
 
+	cmd.Flags().StringP("align-mode", "", "global",
+		formatFlagUsage(`Mode of aligning query and subject sequences of HSPs with WFA. `+
+			`Available values: "global" (end to end), "semi-global" (leading and trailing gaps are free, and HSPs are trimmed to aligned regions), `+
+			`"extension" (alignments are extended from HSP ends and stop at the maximum score under the --align-* penalties, `+
+			`with a match reward of 1 if --align-match is 0, low-scoring ends are clipped).`))
+
+	cmd.Flags().IntP("align-match", "", index.DefaultAlignPenalties.Match,
+		formatFlagUsage(`Reward of a match in the WFA alignment. A positive value is converted into equivalent penalties.`))
+
+	cmd.Flags().IntP("align-mismatch", "", index.DefaultAlignPenalties.Mismatch,
+		formatFlagUsage(`Penalty of a mismatch in the WFA alignment.`))
+
+	cmd.Flags().IntP("align-gap-open", "", index.DefaultAlignPenalties.GapOpen,
+		formatFlagUsage(`Penalty of opening a gap in the WFA alignment.`))
+
+	cmd.Flags().IntP("align-gap-ext", "", index.DefaultAlignPenalties.GapExt,
+		formatFlagUsage(`Penalty of extending a gap in the WFA alignment.`))
+
 	// general filtering thresholds
 
-	mapCmd.Flags().Float64P("align-min-match-pident", "i", 70,
+	cmd.Flags().Float64P("align-min-match-pident", "i", 70,
 		formatFlagUsage(`Minimum base identity (percentage) in a HSP segment.`))
 
-	mapCmd.Flags().Float64P("min-qcov-per-hsp", "q", 0,
+	cmd.Flags().Float64P("min-qcov-per-hsp", "q", 0,
 		formatFlagUsage(`Minimum query coverage (percentage) per HSP.`))
 
-	mapCmd.Flags().Float64P("min-qcov-per-genome", "Q", 0,
+	cmd.Flags().Float64P("min-qcov-per-genome", "Q", 0,
 		formatFlagUsage(`Minimum query coverage (percentage) per genome.`))
 
-	mapCmd.SetUsageTemplate(usageTemplate("-d <index path> [query.fasta.gz ...] [-o query.tsv.gz]"))
+	cmd.Flags().Float64P("max-evalue", "e", 0,
+		formatFlagUsage(`Maximum E-value of a HSP (0 for no filtering).`))
+
+	// scoring scheme for E-values
+
+	cmd.Flags().IntP("score-match", "", index.DefaultScoringScheme.Match,
+		formatFlagUsage(`Reward of a match, for computing alignment scores, bit scores, and E-values with Karlin-Altschul statistics like BLASTN.`))
+
+	cmd.Flags().IntP("score-mismatch", "", index.DefaultScoringScheme.Mismatch,
+		formatFlagUsage(`Penalty (positive) of a mismatch, for computing alignment scores.`))
+
+	cmd.Flags().IntP("score-gap-open", "", index.DefaultScoringScheme.GapOpen,
+		formatFlagUsage(`Cost to open a gap, for computing alignment scores.`))
+
+	cmd.Flags().IntP("score-gap-ext", "", index.DefaultScoringScheme.GapExt,
+		formatFlagUsage(`Cost to extend a gap, for computing alignment scores. `+
+			`Only the combinations supported by BLASTN are available, e.g., 2/3/5/2 (default, blastn), 1/2/0/0 (megablast).`))
+
+	// per-query limits
 
+	cmd.Flags().StringP("max-query-time", "", "",
+		formatFlagUsage(`Maximum wall time for searching a query, e.g., 30s, 2m. Partial results are returned when it's reached, `+
+			`with the reason shown in an extra column "truncated". If it's reached before alignment, seed matches already found are still chained, `+
+			`and a few genomes with the best chaining scores are aligned. Queries without hits are still outputted with the reasons. Empty or 0 for no limit.`))
+
+	cmd.Flags().IntP("max-candidate-genomes", "", 0,
+		formatFlagUsage(`Maximum number of candidate genomes with seed matches for a query (0 for no limit). `+
+			`When it's reached, only the genomes with the smallest internal IDs (genome batch and index) are kept, `+
+			`so the results are reproducible.`))
+
+	cmd.Flags().IntP("max-anchors", "", 0,
+		formatFlagUsage(`Maximum number of anchors (seed matches) for a query (0 for no limit). `+
+			`Seed searching stops when it's reached, and the anchors found depend on the scheduling of threads, `+
+			`so the results might vary between runs.`))
+}
+
+// getSearchFlags reads and checks flags added by addSearchFlags.
+func getSearchFlags(cmd *cobra.Command) *searchFlags {
+	dbDir := getFlagString(cmd, "index")
+	if dbDir == "" {
+		checkError(fmt.Errorf("flag -d/--index needed"))
+	}
+	minPrefix := getFlagPositiveInt(cmd, "seed-min-prefix")
+	if minPrefix > 32 || minPrefix < index.MinMinPrefix {
+		checkError(fmt.Errorf("the value of flag -p/--seed-min-prefix (%d) should be in the range of [%d, 32]", minPrefix, index.MinMinPrefix))
+	}
+	moreColumns := getFlagBool(cmd, "all")
+
+	// maxMismatch := getFlagInt(cmd, "seed-max-mismatch")
+	minSinglePrefix := getFlagPositiveInt(cmd, "seed-min-single-prefix")
+	if minSinglePrefix > 32 {
+		checkError(fmt.Errorf("the value of flag -P/--seed-min-single-prefix (%d) should be <= 32", minSinglePrefix))
+	}
+	if minSinglePrefix < minPrefix {
+		checkError(fmt.Errorf("the value of flag -P/--seed-min-single-prefix (%d) should be >= that of -p/--seed-min-prefix (%d)", minSinglePrefix, minPrefix))
+	}
+
+	maxGap := getFlagPositiveInt(cmd, "seed-max-gap")
+	maxDist := getFlagPositiveInt(cmd, "seed-max-dist")
+	extLen := getFlagNonNegativeInt(cmd, "align-ext-len")
+	topn := getFlagNonNegativeInt(cmd, "top-n-genomes")
+	inMemorySearch := getFlagBool(cmd, "load-whole-seeds")
+	seedMemBudget, err := ParseByteSize(getFlagString(cmd, "seed-mem-budget"))
+	if err != nil {
+		checkError(fmt.Errorf("invalid value of flag --seed-mem-budget: %s", err))
+	}
+	if inMemorySearch && seedMemBudget > 0 {
+		log.Warningf("flag --seed-mem-budget is ignored when -w/--load-whole-seeds is given")
+		seedMemBudget = 0
+	}
+	anchorMemBudget, err := ParseByteSize(getFlagString(cmd, "anchor-mem-budget"))
+	if err != nil {
+		checkError(fmt.Errorf("invalid value of flag --anchor-mem-budget: %s", err))
+	}
+	tmpDir := getFlagString(cmd, "tmp-dir")
+
+	onlyPseudoAlign := getFlagBool(cmd, "pseudo-align")
+
+	minAlignLen := getFlagPositiveInt(cmd, "align-min-match-len")
+	if minAlignLen < minSinglePrefix {
+		checkError(fmt.Errorf("the value of flag -l/--align-min-match-len (%d) should be >= that of -M/--seed-min-single-prefix (%d)", minAlignLen, minSinglePrefix))
+	}
+	maxAlignMaxGap := getFlagPositiveInt(cmd, "align-max-gap")
+	alignBand := getFlagPositiveInt(cmd, "align-band")
+	if alignBand < maxAlignMaxGap {
+		checkError(fmt.Errorf("the value of flag --align-band should not be smaller thant the value of --align-max-gap"))
+	}
+	alignMode, err := index.ParseAlignMode(getFlagString(cmd, "align-mode"))
+	if err != nil {
+		checkError(fmt.Errorf("invalid value of flag --align-mode: %s", err))
+	}
+	alignPenalties := index.AlignPenalties{
+		Match:    getFlagNonNegativeInt(cmd, "align-match"),
+		Mismatch: getFlagPositiveInt(cmd, "align-mismatch"),
+		GapOpen:  getFlagNonNegativeInt(cmd, "align-gap-open"),
+		GapExt:   getFlagPositiveInt(cmd, "align-gap-ext"),
+	}
+	if err = index.CheckAlignPenalties(&alignPenalties); err != nil {
+		checkError(fmt.Errorf("invalid values of flags --align-match/--align-mismatch/--align-gap-open/--align-gap-ext: %s", err))
+	}
+
+	minQcovGenome := getFlagNonNegativeFloat64(cmd, "min-qcov-per-genome")
+	if minQcovGenome > 100 {
+		checkError(fmt.Errorf("the value of flag -Q/--min-qcov-per-genome (%f) should be in range of [0, 100]", minQcovGenome))
+	}
+	minIdent := getFlagNonNegativeFloat64(cmd, "align-min-match-pident")
+	if minIdent < 60 || minIdent > 100 {
+		checkError(fmt.Errorf("the value of flag -i/--align-min-match-pident (%f) should be in range of [60, 100]", minIdent))
+	}
+	minQcovChain := getFlagNonNegativeFloat64(cmd, "min-qcov-per-hsp")
+	if minQcovChain > 100 {
+		checkError(fmt.Errorf("the value of flag -q/--min-qcov-per-hsp (%f) should be in range of [0, 100]", minIdent))
+	}
+
+	maxOpenFiles := getFlagPositiveInt(cmd, "max-open-files")
+	mmapGenomes := getFlagBool(cmd, "mmap-genomes")
+
+	var secondSeedsMode int
+	switch secondSeeds := getFlagString(cmd, "second-seeds"); secondSeeds {
+	case "fallback":
+		secondSeedsMode = index.SecondSeedsFallback
+	case "combine":
+		secondSeedsMode = index.SecondSeedsCombine
+	case "none":
+		secondSeedsMode = index.SecondSeedsNone
+	default:
+		checkError(fmt.Errorf("invalid value of flag --second-seeds: %s, available values: fallback, combine, none", secondSeeds))
+	}
+
+	maxQueryConcurrency := getFlagNonNegativeInt(cmd, "max-query-conc")
+	if maxQueryConcurrency == 0 {
+		maxQueryConcurrency = runtime.NumCPU()
+	}
+
+	var maxQueryTime time.Duration
+	if v := getFlagString(cmd, "max-query-time"); v != "" {
+		maxQueryTime, err = time.ParseDuration(v)
+		if err != nil {
+			checkError(fmt.Errorf("invalid value of flag --max-query-time: %s", err))
+		}
+		if maxQueryTime < 0 {
+			checkError(fmt.Errorf("the value of flag --max-query-time (%s) should not be negative", v))
+		}
+	}
+	maxCandidateGenomes := getFlagNonNegativeInt(cmd, "max-candidate-genomes")
+	maxAnchors := getFlagNonNegativeInt(cmd, "max-anchors")
+
+	maxEvalue := getFlagNonNegativeFloat64(cmd, "max-evalue")
+	scoringScheme := index.ScoringScheme{
+		Match:    getFlagPositiveInt(cmd, "score-match"),
+		Mismatch: getFlagPositiveInt(cmd, "score-mismatch"),
+		GapOpen:  getFlagNonNegativeInt(cmd, "score-gap-open"),
+		GapExt:   getFlagNonNegativeInt(cmd, "score-gap-ext"),
+	}
+	if err = index.CheckScoringScheme(&scoringScheme); err != nil {
+		checkError(fmt.Errorf("invalid values of flags --score-match/--score-mismatch/--score-gap-open/--score-gap-ext: %s", err))
+	}
+
+	return &searchFlags{
+		dbDir: dbDir,
+
+		maxOpenFiles:        maxOpenFiles,
+		maxQueryConcurrency: maxQueryConcurrency,
+		moreColumns:         moreColumns,
+
+		minPrefix:       minPrefix,
+		minSinglePrefix: minSinglePrefix,
+		maxGap:          maxGap,
+		maxDist:         maxDist,
+		topn:            topn,
+		inMemorySearch:  inMemorySearch,
+		seedMemBudget:   seedMemBudget,
+		anchorMemBudget: anchorMemBudget,
+		tmpDir:          tmpDir,
+		mmapGenomes:     mmapGenomes,
+		secondSeedsMode: secondSeedsMode,
+
+		onlyPseudoAlign: onlyPseudoAlign,
+		extLen:          extLen,
+		maxAlignMaxGap:  maxAlignMaxGap,
+		alignBand:       alignBand,
+		minAlignLen:     minAlignLen,
+		alignMode:       alignMode,
+		alignPenalties:  alignPenalties,
+
+		minIdent:      minIdent,
+		minQcovChain:  minQcovChain,
+		minQcovGenome: minQcovGenome,
+		maxEvalue:     maxEvalue,
+
+		scoringScheme: scoringScheme,
+
+		maxQueryTime:        maxQueryTime,
+		maxCandidateGenomes: maxCandidateGenomes,
+		maxAnchors:          maxAnchors,
+	}
+}
+
+// indexSearchingOptions returns options for loading and searching the index.
+func (sf *searchFlags) indexSearchingOptions(opt *Options) *index.IndexSearchingOptions {
+	return &index.IndexSearchingOptions{
+		NumCPUs:      opt.NumCPUs,
+		Verbose:      opt.Verbose,
+		Log2File:     opt.Log2File,
+		Logger:       log,
+		MaxOpenFiles: sf.maxOpenFiles,
+
+		MinPrefix: uint8(sf.minPrefix),
+		// MaxMismatch:     maxMismatch,
+		MinSinglePrefix: uint8(sf.minSinglePrefix),
+		// MinMatchedBases: uint8(minMatches),
+		TopN:           sf.topn,
+		InMemorySearch: sf.inMemorySearch,
+		SeedMemBudget:  sf.seedMemBudget,
+
+		AnchorMemBudget: sf.anchorMemBudget,
+		TmpDir:          sf.tmpDir,
+
+		MaxGap:      float64(sf.maxGap),
+		MaxDistance: float64(sf.maxDist),
+
+		ExtendLength: sf.extLen,
+
+		MinQueryAlignedFractionInAGenome: sf.minQcovGenome,
+		MaxEvalue:                        sf.maxEvalue,
+		ScoringScheme:                    &sf.scoringScheme,
+
+		MmapGenomes: sf.mmapGenomes,
+
+		SecondSeedsMode: sf.secondSeedsMode,
+
+		MoreAccurateAlignment: !sf.onlyPseudoAlign,
+
+		MaxTime:             sf.maxQueryTime,
+		MaxCandidateGenomes: sf.maxCandidateGenomes,
+		MaxAnchors:          sf.maxAnchors,
+
+		OutputSeq: sf.moreColumns,
+	}
+}
+
+// checkIndex checks flag values which depend on the index.
+func (sf *searchFlags) checkIndex(idx *index.Index) error {
+	if sf.extLen > idx.ContigInterval() {
+		return fmt.Errorf("the value of flag --align-ext-len (%d) should be <= contig interval length in database (%d)", sf.extLen, idx.ContigInterval())
+	}
+	if sf.maxDist > idx.ContigInterval() {
+		return fmt.Errorf("the value of flag --seed-max-dist (%d) should be <= contig interval length in database (%d)", sf.maxDist, idx.ContigInterval())
+	}
+	return nil
+}
+
+// seqCompareOptions returns options for sequence comparison.
+func (sf *searchFlags) seqCompareOptions(k int) *index.SeqComparatorOptions {
+	return &index.SeqComparatorOptions{
+		K:         uint8(k),
+		MinPrefix: 11, // can not be too small, or there will be a large number of anchors.
+
+		Chaining2Options: index.Chaining2Options{
+			// should be relative small
+			MaxGap: sf.maxAlignMaxGap,
+			// better be larger than MinPrefix
+			MinScore:    sf.minAlignLen,
+			MinAlignLen: sf.minAlignLen,
+			MinIdentity: sf.minIdent,
+			// can not be < k
+			// MaxDistance: maxAlignMismatch,
+			// can not be two small
+			Band: sf.alignBand,
+		},
+
+		MinAlignedFraction: sf.minQcovChain,
+		MinIdentity:        sf.minIdent,
+
+		AlignPenalties: sf.alignPenalties,
+		AlignMode:      sf.alignMode,
+	}
 }
 
 // Strands could be used to output strand for a reverse complement flag
 var Strands = [2]byte{'+', '-'}
 
+// keepOrderBufferFactor is the ratio of the reorder buffer size to the maximum number
+// of concurrent queries, for --keep-order.
+const keepOrderBufferFactor = 4
+
 // Query is an object for each query sequence, it also contains the query result.
 type Query struct {
-	seqID  []byte
-	seq    []byte
-	result *[]*SearchResult
+	id         uint64 // index in the input, for keeping the order
+	seqID      []byte
+	seq        []byte
+	result     *[]*index.SearchResult
+	truncation index.Truncation // reasons if the result is truncated by per-query limits
 }
 
 // Reset reset the data for next round of using
@@ -587,6 +964,15 @@ func (q *Query) Reset() {
 	q.seqID = q.seqID[:0]
 	q.seq = q.seq[:0]
 	q.result = nil
+	q.truncation = 0
+}
+
+// truncatedColumn returns the value of the column "truncated".
+func (q *Query) truncatedColumn() string {
+	if q.truncation == 0 {
+		return "-"
+	}
+	return q.truncation.String()
 }
 
 var poolQuery = &sync.Pool{New: func() interface{} {
@@ -33,6 +33,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/seedposition"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
 	"github.com/shenwei356/bio/seq"
 	"github.com/shenwei356/lexichash"
 	"github.com/shenwei356/util/pathutil"
@@ -128,13 +129,13 @@ Figures:
 		// ---------------------------------------------------------------
 
 		// info file for the number of genome batches
-		fileInfo := filepath.Join(dbDir, FileInfo)
-		info, err := readIndexInfo(fileInfo)
+		fileInfo := filepath.Join(dbDir, index.FileInfo)
+		info, err := index.ReadIndexInfo(fileInfo)
 		if err != nil {
 			checkError(fmt.Errorf("failed to read info file: %s", err))
 		}
 
-		fileSeedLoc := filepath.Join(dbDir, DirGenomes, batchDir(0), FileSeedPositions)
+		fileSeedLoc := filepath.Join(dbDir, index.DirGenomes, index.BatchDir(0), index.FileSeedPositions)
 		ok, err := pathutil.Exists(fileSeedLoc)
 		if err != nil {
 			checkError(fmt.Errorf("check index file structure: %s", err))
@@ -145,7 +146,7 @@ Figures:
 		}
 
 		// genomes.map file for mapping index to genome id
-		m, err := readGenomeMapName2Idx(filepath.Join(dbDir, FileGenomeIndex))
+		m, err := index.ReadGenomeMapName2Idx(filepath.Join(dbDir, index.FileGenomeIndex))
 		if err != nil {
 			checkError(fmt.Errorf("failed to read genomes index mapping file: %s", err))
 		}
@@ -192,7 +193,7 @@ Figures:
 					tokens <- 1
 					wg.Add(1)
 					go func(i int) {
-						fileGenomes := filepath.Join(dbDir, DirGenomes, batchDir(i), FileGenomes)
+						fileGenomes := filepath.Join(dbDir, index.DirGenomes, index.BatchDir(i), index.FileGenomes)
 						rdr, err := genome.NewReader(fileGenomes)
 						if err != nil {
 							checkError(fmt.Errorf("failed to create genome reader: %s", err))
@@ -284,7 +285,7 @@ Figures:
 		for batch := 0; batch < info.GenomeBatches; batch++ {
 			_batch := batch
 			readerPools[batch] = &sync.Pool{New: func() interface{} {
-				fileSeedLoc := filepath.Join(dbDir, DirGenomes, batchDir(_batch), FileSeedPositions)
+				fileSeedLoc := filepath.Join(dbDir, index.DirGenomes, index.BatchDir(_batch), index.FileSeedPositions)
 				rdr, err := seedposition.NewReader(fileSeedLoc)
 				if err != nil {
 					checkError(fmt.Errorf("failed to read seed position data file: %s", err))
@@ -362,7 +363,7 @@ Figures:
 				if hasGenomeRdrs {
 					rdr = <-poolGenomeRdrs[ref2locs.GenomeBatch]
 				} else {
-					fileGenome := filepath.Join(dbDir, DirGenomes, batchDir(ref2locs.GenomeBatch), FileGenomes)
+					fileGenome := filepath.Join(dbDir, index.DirGenomes, index.BatchDir(ref2locs.GenomeBatch), index.FileGenomes)
 					rdr, err = genome.NewReader(fileGenome)
 					if err != nil {
 						checkError(fmt.Errorf("failed to read genome data file: %s", err))
@@ -712,7 +713,7 @@ Figures:
 					if hasGenomeRdrs {
 						gRdr = <-poolGenomeRdrs[ref2locs.GenomeBatch]
 					} else {
-						fileGenome := filepath.Join(dbDir, DirGenomes, batchDir(ref2locs.GenomeBatch), FileGenomes)
+						fileGenome := filepath.Join(dbDir, index.DirGenomes, index.BatchDir(ref2locs.GenomeBatch), index.FileGenomes)
 						gRdr, err = genome.NewReader(fileGenome)
 						if err != nil {
 							checkError(fmt.Errorf("failed to read genome data file: %s", err))
@@ -874,3 +875,8 @@ func minAndMax(vals []float64) (m, M float64) {
 	}
 	return m, M
 }
+
+var poolSkipRegions = &sync.Pool{New: func() interface{} {
+	tmp := make([][2]int, 0, 128)
+	return &tmp
+}}
@@ -259,7 +259,9 @@ type Reader struct {
 
 	buf []byte
 
-	fhData *os.File
+	file     string // path of the data file
+	dataSize int64  // size of the data file
+	fhData   *os.File
 }
 
 var poolReader = &sync.Pool{New: func() interface{} {
@@ -275,26 +277,43 @@ func NewReader(file string) (*Reader, error) {
 		return nil, fmt.Errorf("seed position file, not the index file should be given")
 	}
 
+	r := poolReader.Get().(*Reader)
+	err := r.open(file)
+	if err != nil {
+		if r.fh != nil {
+			r.fh.Close()
+			r.fh = nil
+		}
+		poolReader.Put(r)
+		return nil, err
+	}
+	return r, nil
+}
+
+// open reads the header of the index file and opens the data file.
+func (r *Reader) open(file string) error {
 	// ------------  index file ----------------
 
 	fileIndex := filepath.Clean(file) + PositionsIndexFileExt
 	var err error
-	r := poolReader.Get().(*Reader)
 
 	r.fh, err = os.Open(fileIndex)
 	if err != nil {
-		return nil, err
+		r.fh = nil
+		return err
 	}
+	fi, err := r.fh.Stat()
+	if err != nil {
+		return err
+	}
+	sizeIndex := fi.Size()
 
 	buf := r.buf
 
 	// check the magic number
-	n, err := io.ReadFull(r.fh, buf[:8])
+	_, err = io.ReadFull(r.fh, buf[:8])
 	if err != nil {
-		return nil, err
-	}
-	if n < 8 {
-		return nil, ErrBrokenFile
+		return newFileError(fileIndex, "", 0, err)
 	}
 	same := true
 	for i := 0; i < 8; i++ {
@@ -304,46 +323,50 @@ func NewReader(file string) (*Reader, error) {
 		}
 	}
 	if !same {
-		return nil, ErrInvalidFileFormat
+		return newFileError(fileIndex, "", 0, ErrInvalidFileFormat)
 	}
-	r.offset += 8
 
 	// read metadata
-	n, err = io.ReadFull(r.fh, buf[:8])
+	_, err = io.ReadFull(r.fh, buf[:8])
 	if err != nil {
-		return nil, err
-	}
-	if n < 8 {
-		return nil, ErrBrokenFile
+		return newFileError(fileIndex, "", 8, err)
 	}
-	r.offset += 8
 
 	// check compatibility
 	if MainVersion != buf[0] {
-		return nil, ErrVersionMismatch
+		return newFileError(fileIndex, "", 8, ErrVersionMismatch)
 	}
 
 	// batch number and the number seqs
-	n, err = io.ReadFull(r.fh, buf[:8])
+	_, err = io.ReadFull(r.fh, buf[:8])
 	if err != nil {
-		return nil, err
-	}
-	if n < 8 {
-		return nil, ErrBrokenFile
+		return newFileError(fileIndex, "", 16, err)
 	}
-	r.offset += 8
+	r.offset = 24
 
 	r.batch = be.Uint32(buf[:4])
 	r.nRecords = be.Uint32(buf[4:8])
 
+	// each record takes 12 bytes
+	if sizeIndex < int64(r.offset)+int64(r.nRecords)*12 {
+		return newFileError(fileIndex, "", 20, ErrBrokenFile)
+	}
+
 	// ------------ data file ----------------
 
 	r.fhData, err = os.Open(file)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	fi, err = r.fhData.Stat()
+	if err != nil {
+		r.fhData.Close()
+		return err
+	}
+	r.dataSize = fi.Size()
+	r.file = file
 
-	return r, nil
+	return nil
 }
 
 // Close closes and recycles the reader.
@@ -365,7 +388,7 @@ func (r *Reader) Close() error {
 }
 
 // SeedPositions returns the seed positions with an index of idx (0-based).
-func (r *Reader) SeedPositions(idx int, locs *[]uint32) error {
+func (r *Reader) SeedPositions(idx int, locs *[]uint32) (err error) {
 	if idx < 0 || idx >= int(r.nRecords) {
 		return fmt.Errorf("genome index (%d) out of range: [0, %d]", idx, int(r.nRecords)-1)
 	}
@@ -375,19 +398,30 @@ func (r *Reader) SeedPositions(idx int, locs *[]uint32) error {
 	// -----------------------------------------------------------
 	// read index information
 	// 24 + 12 * idx
-	r.fh.Seek(int64(r.offset)+int64(idx)<<3+int64(idx)<<2, 0)
+	offsetIdx := int64(r.offset) + int64(idx)<<3 + int64(idx)<<2
+	r.fh.Seek(offsetIdx, 0)
 
 	// offset in the data file and bases
-	n, err := io.ReadFull(r.fh, buf[:12])
+	_, err = io.ReadFull(r.fh, buf[:12])
 	if err != nil {
-		return err
-	}
-	if n < 12 {
-		return ErrBrokenFile
+		return newFileError(r.file+PositionsIndexFileExt, util.GenomeRecord(idx), offsetIdx, err)
 	}
 	offset := int64(be.Uint64(buf[:8]))
 	nRecords := int(be.Uint32(buf[8:12])) // for check end
 
+	defer func() {
+		if err != nil {
+			err = newFileError(r.file, util.GenomeRecord(idx), offset, err)
+		}
+	}()
+
+	// each record needs 4 bytes for the number of positions,
+	// and every 4 positions take at least 5 bytes.
+	if offset < 16 || offset+4+int64((nRecords+3)>>2)*5 > r.dataSize {
+		return fmt.Errorf("%w: %d positions at offset %d out of the range of data file size %d",
+			ErrBrokenFile, nRecords, offset, r.dataSize)
+	}
+
 	if locs == nil {
 		tmp := make([]uint32, 0, nRecords)
 		locs = &tmp
@@ -400,7 +434,17 @@ func (r *Reader) SeedPositions(idx int, locs *[]uint32) error {
 	var ctrlByte byte
 	var nBytes, nReaded, nDecoded int
 
-	r.fhData.Seek(offset+4, 0) // 4 is the 4 bytes for storing length of records
+	r.fhData.Seek(offset, 0)
+
+	// the number of positions
+	_, err = io.ReadFull(r.fhData, buf[:4])
+	if err != nil {
+		return err
+	}
+	if int(be.Uint32(buf[:4])) != nRecords {
+		return fmt.Errorf("%w: unmatched number of positions: %d, %d in the index",
+			ErrBrokenFile, be.Uint32(buf[:4]), nRecords)
+	}
 
 	rounds := (nRecords + 3) >> 2
 
@@ -21,9 +21,13 @@
 package seedposition
 
 import (
+	"errors"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/util"
 )
 
 func TestSeedPositions(t *testing.T) {
@@ -117,3 +121,78 @@ func TestSeedPositions(t *testing.T) {
 		return
 	}
 }
+
+func FuzzSeedPositions(f *testing.F) {
+	tests := [][]uint32{
+		{},
+		{1, 15, 300},
+		{1, 15, 300, 301, 2500, 3100, 3111, 5000, 10000},
+	}
+
+	file := filepath.Join(f.TempDir(), "test.bin")
+	wtr, err := NewWriter(file, 0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, test := range tests {
+		if err = wtr.Write(test); err != nil {
+			f.Fatal(err)
+		}
+	}
+	if err = wtr.Close(); err != nil {
+		f.Fatal(err)
+	}
+
+	bData, err := os.ReadFile(file)
+	if err != nil {
+		f.Fatal(err)
+	}
+	bIndex, err := os.ReadFile(file + PositionsIndexFileExt)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	// a truncated file should return an error with details
+	err = os.WriteFile(file, bData[:len(bData)-2], 0644)
+	if err != nil {
+		f.Fatal(err)
+	}
+	rdr, err := NewReader(file)
+	if err != nil {
+		f.Fatal(err)
+	}
+	err = rdr.SeedPositions(2, nil)
+	var fe *util.FileError
+	if !errors.Is(err, ErrBrokenFile) || !errors.As(err, &fe) || fe.Record != "genome 2" {
+		f.Fatalf("expected a FileError of genome 2 for the truncated file, got: %v", err)
+	}
+	rdr.Close()
+
+	f.Add(bData, bIndex)
+	f.Add(bData[:len(bData)/2], bIndex)
+	f.Add(bData, bIndex[:len(bIndex)-3])
+	bIndex2 := append([]byte{}, bIndex...)
+	bIndex2[len(bIndex2)-1] ^= 0xff // number of positions
+	f.Add(bData, bIndex2)
+
+	f.Fuzz(func(t *testing.T, bData []byte, bIndex []byte) {
+		file := filepath.Join(t.TempDir(), "test.bin")
+		if err := os.WriteFile(file, bData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file+PositionsIndexFileExt, bIndex, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// errors are allowed, but panics are not
+		rdr, err := NewReader(file)
+		if err != nil {
+			return
+		}
+		locs := make([]uint32, 0, 64)
+		for i := 0; i < int(rdr.nRecords) && i < 16; i++ {
+			rdr.SeedPositions(i, &locs)
+		}
+		rdr.Close()
+	})
+}
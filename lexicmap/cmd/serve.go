@@ -0,0 +1,586 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve an index for searching via an HTTP/JSON API",
+	Long: `Serve an index for searching via an HTTP/JSON API
+
+The index is loaded once and kept open, which saves the time of loading
+the index for each search, e.g., for many small interactive queries.
+
+Endpoints:
+
+  GET  /health    Health check, returning a JSON object with the status.
+  POST /search    Search (gzipped) FASTA/FASTQ records in the request body.
+
+Query parameters of /search:
+
+  format                    Output format: "json" (default) or "tsv". Queries in JSON are
+                            in the field "queries", with the same schema as the JSON Lines
+                            format (--out-format jsonl) of "lexicmap search". TSV is the
+                            same as the tabular output of "lexicmap search".
+
+  Other parameters override values of the flags with the same names for a request:
+
+  all                       Output more columns (true or false), e.g., matched sequences.
+  pseudo-align              Only perform pseudo alignment (true or false).
+  seed-min-prefix           Minimum (prefix) length of matched seeds.
+  seed-max-gap              Max gap in seed chaining.
+  top-n-genomes             Keep top N genome matches for a query (0 for all) in chaining phase.
+  min-qcov-per-genome       Minimum query coverage (percentage) per genome.
+  min-qcov-per-hsp          Minimum query coverage (percentage) per HSP.
+  align-min-match-pident    Minimum base identity (percentage) in a HSP segment.
+  max-evalue                Maximum E-value of a HSP (0 for no filtering).
+  max-query-time            Maximum wall time for searching a query, e.g., 30s.
+  max-candidate-genomes     Maximum number of candidate genomes for a query.
+  max-anchors               Maximum number of anchors (seed matches) for a query.
+
+  When any per-query limit is reached, partial results are returned, with the reasons
+  in the field "truncated" (JSON) or the extra column "truncated" (TSV).
+
+Concurrency:
+  Queries of all requests share the limit of -J/--max-query-conc,
+  queries beyond the limit wait until others are finished.
+
+Examples:
+  lexicmap serve -d db.lmi --listen :8080
+
+  curl --data-binary @q.fasta http://localhost:8080/search
+  curl --data-binary @q.fasta.gz "http://localhost:8080/search?format=tsv&min-qcov-per-hsp=50"
+
+  # listen on a Unix socket for local pipelines
+  lexicmap serve -d db.lmi --unix-socket /tmp/lexicmap.sock
+
+  curl --unix-socket /tmp/lexicmap.sock --data-binary @q.fasta http://localhost/search
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		var fhLog *os.File
+		if opt.Log2File {
+			fhLog = addLog(opt.LogFile, opt.Verbose)
+		}
+
+		outputLog := opt.Verbose || opt.Log2File
+
+		timeStart := time.Now()
+		defer func() {
+			if outputLog {
+				log.Info()
+				log.Infof("elapsed time: %s", time.Since(timeStart))
+				log.Info()
+			}
+			if opt.Log2File {
+				fhLog.Close()
+			}
+		}()
+
+		// ---------------------------------------------------------------
+
+		sf := getSearchFlags(cmd)
+		listen := getFlagString(cmd, "listen")
+		socket := getFlagString(cmd, "unix-socket")
+		if listen == "" && socket == "" {
+			checkError(fmt.Errorf("flag --listen or --unix-socket needed"))
+		}
+		maxRequestSize, err := ParseByteSize(getFlagString(cmd, "max-request-size"))
+		if err != nil {
+			checkError(fmt.Errorf("invalid value of flag --max-request-size: %s", err))
+		}
+
+		// ---------------------------------------------------------------
+
+		if outputLog {
+			log.Infof("LexicMap v%s (%s)", VERSION, COMMIT)
+			log.Info("  https://github.com/shenwei356/LexicMap")
+			log.Info()
+			log.Infof("loading index: %s", sf.dbDir)
+		}
+
+		idx, err := index.NewIndexSearcher(sf.dbDir, sf.indexSearchingOptions(opt))
+		checkError(err)
+		checkError(sf.checkIndex(idx))
+		idx.SetSeqCompareOptions(sf.seqCompareOptions(idx.K()))
+
+		if outputLog {
+			log.Infof("index loaded in %s", time.Since(timeStart))
+			log.Info()
+		}
+
+		// ---------------------------------------------------------------
+
+		var ln net.Listener
+		if socket != "" {
+			if fi, err := os.Stat(socket); err == nil {
+				if fi.Mode()&os.ModeSocket == 0 {
+					checkError(fmt.Errorf("file exists and it's not a socket: %s", socket))
+				}
+				checkError(os.Remove(socket)) // stale socket
+			}
+			ln, err = net.Listen("unix", socket)
+			checkError(err)
+			defer os.Remove(socket)
+		} else {
+			ln, err = net.Listen("tcp", listen)
+			checkError(err)
+		}
+
+		srv := &searchServer{
+			idx:            idx,
+			sf:             sf,
+			maxRequestSize: maxRequestSize,
+			tokens:         make(chan int, sf.maxQueryConcurrency),
+			outputLog:      outputLog,
+			timeStart:      time.Now(),
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", srv.handleHealth)
+		mux.HandleFunc("/search", srv.handleSearch)
+		server := &http.Server{Handler: mux}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		chErr := make(chan error, 1)
+		go func() {
+			chErr <- server.Serve(ln)
+		}()
+
+		if outputLog {
+			log.Infof("listening on %s", ln.Addr())
+		}
+
+		select {
+		case err = <-chErr:
+			if !errors.Is(err, http.ErrServerClosed) {
+				checkError(err)
+			}
+		case <-ctx.Done():
+			if outputLog {
+				log.Info("shutting down ...")
+			}
+			ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Minute)
+			err = server.Shutdown(ctxTimeout)
+			cancel()
+			if err != nil {
+				log.Warningf("failed to shut down the server: %s", err)
+			}
+		}
+
+		if outputLog {
+			log.Infof("served %d requests with %d queries", srv.requests.Load(), srv.queries.Load())
+		}
+
+		checkError(idx.Close())
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+
+	addSearchFlags(serveCmd)
+
+	serveCmd.Flags().StringP("listen", "", ":8080",
+		formatFlagUsage(`TCP address to listen on.`))
+
+	serveCmd.Flags().StringP("unix-socket", "", "",
+		formatFlagUsage(`Listen on a Unix socket file instead of the TCP address.`))
+
+	serveCmd.Flags().StringP("max-request-size", "", "100M",
+		formatFlagUsage(`Maximum size of a request body. Units supported: B, K, M, G, T.`))
+
+	serveCmd.SetUsageTemplate(usageTemplate("-d <index path> [--listen :8080 | --unix-socket file.sock]"))
+}
+
+// searchServer serves an index via HTTP.
+type searchServer struct {
+	idx *index.Index
+	sf  *searchFlags
+
+	maxRequestSize int64
+	tokens         chan int // limiting concurrent queries of all requests
+
+	outputLog bool
+	timeStart time.Time
+
+	running  atomic.Int64 // running queries
+	requests atomic.Uint64
+	queries  atomic.Uint64
+}
+
+func (s *searchServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeHTTPError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":          "ok",
+		"version":         VERSION,
+		"index":           s.sf.dbDir,
+		"uptime":          time.Since(s.timeStart).Round(time.Second).String(),
+		"running_queries": s.running.Load(),
+		"max_query_conc":  s.sf.maxQueryConcurrency,
+		"requests":        s.requests.Load(),
+		"queries":         s.queries.Load(),
+	})
+}
+
+// searchRequestOptions contains per-request options.
+type searchRequestOptions struct {
+	json bool
+	so   *index.SearchOptions
+}
+
+// parseSearchRequestOptions parses and checks per-request options from query parameters,
+// which are named after the flags.
+func (s *searchServer) parseSearchRequestOptions(values url.Values) (*searchRequestOptions, error) {
+	ro := &searchRequestOptions{json: true, so: s.idx.SearchOptions()}
+	so := ro.so
+
+	switch format := values.Get("format"); format {
+	case "", "json":
+	case "tsv":
+		ro.json = false
+	default:
+		return nil, fmt.Errorf("invalid value of parameter format: %s, available values: json, tsv", format)
+	}
+
+	var v string
+	var err error
+
+	// bool
+	for _, p := range []struct {
+		name   string
+		v      *bool
+		invert bool
+	}{
+		{"all", &so.OutputSeq, false},
+		{"pseudo-align", &so.MoreAccurateAlignment, true},
+	} {
+		if v = values.Get(p.name); v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of parameter %s: %s", p.name, v)
+		}
+		*p.v = b != p.invert
+	}
+
+	// int
+	if v = values.Get("seed-min-prefix"); v != "" {
+		x, err := strconv.Atoi(v)
+		if err != nil || x < index.MinMinPrefix || x > s.idx.K() {
+			return nil, fmt.Errorf("invalid value of parameter seed-min-prefix: %s, it should be in the range of [%d, %d] (k of the index)", v, index.MinMinPrefix, s.idx.K())
+		}
+		if x > s.sf.minSinglePrefix {
+			return nil, fmt.Errorf("the value of parameter seed-min-prefix (%d) should be <= that of -P/--seed-min-single-prefix (%d)", x, s.sf.minSinglePrefix)
+		}
+		so.MinPrefix = uint8(x)
+	}
+	if v = values.Get("top-n-genomes"); v != "" {
+		so.TopN, err = strconv.Atoi(v)
+		if err != nil || so.TopN < 0 {
+			return nil, fmt.Errorf("invalid value of parameter top-n-genomes: %s, it should be >= 0", v)
+		}
+	}
+	if v = values.Get("seed-max-gap"); v != "" {
+		x, err := strconv.Atoi(v)
+		if err != nil || x <= 0 {
+			return nil, fmt.Errorf("invalid value of parameter seed-max-gap: %s, it should be > 0", v)
+		}
+		so.MaxGap = float64(x)
+	}
+	if v = values.Get("max-query-time"); v != "" {
+		so.MaxTime, err = time.ParseDuration(v)
+		if err != nil || so.MaxTime < 0 {
+			return nil, fmt.Errorf("invalid value of parameter max-query-time: %s, it should be a non-negative duration, e.g., 30s", v)
+		}
+	}
+	if v = values.Get("max-candidate-genomes"); v != "" {
+		so.MaxCandidateGenomes, err = strconv.Atoi(v)
+		if err != nil || so.MaxCandidateGenomes < 0 {
+			return nil, fmt.Errorf("invalid value of parameter max-candidate-genomes: %s, it should be >= 0", v)
+		}
+	}
+	if v = values.Get("max-anchors"); v != "" {
+		so.MaxAnchors, err = strconv.Atoi(v)
+		if err != nil || so.MaxAnchors < 0 {
+			return nil, fmt.Errorf("invalid value of parameter max-anchors: %s, it should be >= 0", v)
+		}
+	}
+	if v = values.Get("max-evalue"); v != "" {
+		so.MaxEvalue, err = strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(so.MaxEvalue) || so.MaxEvalue < 0 {
+			return nil, fmt.Errorf("invalid value of parameter max-evalue: %s, it should be >= 0", v)
+		}
+	}
+
+	// float
+	for _, p := range []struct {
+		name string
+		min  float64
+		v    *float64
+	}{
+		{"min-qcov-per-genome", 0, &so.MinQueryAlignedFractionInAGenome},
+		{"min-qcov-per-hsp", 0, &so.MinAlignedFraction},
+		{"align-min-match-pident", 60, &so.MinIdentity},
+	} {
+		if v = values.Get(p.name); v == "" {
+			continue
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(x) || x < p.min || x > 100 {
+			return nil, fmt.Errorf("invalid value of parameter %s: %s, it should be in range of [%v, 100]", p.name, v, p.min)
+		}
+		*p.v = x
+	}
+
+	// other constraints of the index, so that invalid values are reported as bad requests
+	if err = s.idx.CheckSearchOptions(so); err != nil {
+		return nil, err
+	}
+
+	return ro, nil
+}
+
+func (s *searchServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeHTTPError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s, please use POST", r.Method))
+		return
+	}
+	timeStart := time.Now()
+	s.requests.Add(1)
+
+	ro, err := s.parseSearchRequestOptions(r.URL.Query())
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// ---------------------------------------------------------------
+	// read queries
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxRequestSize))
+	if err != nil {
+		var e *http.MaxBytesError
+		if errors.As(err, &e) {
+			writeHTTPError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body larger than %d bytes", e.Limit))
+		} else {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("failed to read request body: %s", err))
+		}
+		return
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("no query sequences given"))
+		return
+	}
+
+	queries, err := readQueries(data)
+	if err != nil {
+		for _, q := range queries {
+			poolQuery.Put(q)
+		}
+		writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("failed to parse query sequences: %s", err))
+		return
+	}
+	s.queries.Add(uint64(len(queries)))
+
+	idx := s.idx
+	defer func() {
+		for _, q := range queries {
+			if q.result != nil {
+				idx.RecycleSearchResults(q.result)
+			}
+			poolQuery.Put(q)
+		}
+	}()
+
+	// ---------------------------------------------------------------
+	// search
+
+	ctx := r.Context()
+	K := idx.K()
+
+	// errors from goroutines, only the first one is kept
+	var _err error
+	var muErr sync.Mutex
+	setErr := func(err error) {
+		muErr.Lock()
+		if _err == nil {
+			_err = err
+		}
+		muErr.Unlock()
+	}
+
+	var wg sync.WaitGroup
+QUERIES:
+	for _, q := range queries {
+		if len(q.seq) < K {
+			continue
+		}
+
+		select {
+		case s.tokens <- 1:
+		case <-ctx.Done(): // the client is gone
+			break QUERIES
+		}
+		wg.Add(1)
+		s.running.Add(1)
+		go func(q *Query) {
+			defer func() {
+				s.running.Add(-1)
+				<-s.tokens
+				wg.Done()
+			}()
+
+			var err error
+			q.result, q.truncation, err = idx.SearchContext(ctx, q.seq, ro.so)
+			if err != nil {
+				setErr(err)
+			}
+		}(q)
+	}
+	wg.Wait()
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if _err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, _err)
+		return
+	}
+
+	// ---------------------------------------------------------------
+	// output
+
+	if ro.json {
+		results := make([]*jsonQuery, len(queries))
+		for i, q := range queries {
+			results[i] = newJSONQuery(q.seqID, q.seq, q.result, ro.so.OutputSeq, !ro.so.MoreAccurateAlignment)
+			results[i].Truncated = q.truncation.String()
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"queries": results})
+	} else {
+		w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		bw := bufio.NewWriter(w)
+		truncatedColumn := ro.so.MaxTime > 0 || ro.so.MaxCandidateGenomes > 0 || ro.so.MaxAnchors > 0
+		columns := defaultSearchColumns(ro.so.OutputSeq, truncatedColumn)
+		fmt.Fprintln(bw, searchResultHeader(columns))
+		var truncated string
+		for _, q := range queries {
+			if q.result != nil {
+				if truncatedColumn {
+					truncated = q.truncatedColumn()
+				}
+				writeSearchResult(bw, columns, q.seqID, q.seq, q.result, !ro.so.MoreAccurateAlignment, truncated, nil)
+			} else if q.truncation > 0 {
+				writeTruncatedQuery(bw, columns, q.seqID, q.seq, q.truncation.String())
+			}
+		}
+		bw.Flush()
+	}
+
+	if s.outputLog {
+		log.Infof("%s: %d queries searched in %s", r.RemoteAddr, len(queries), time.Since(timeStart))
+	}
+}
+
+// muReadQueries serializes parsing queries, as the fastx reader
+// uses a package-level variable for the ID regular expression.
+var muReadQueries sync.Mutex
+
+// readQueries reads FASTA/FASTQ records from data.
+func readQueries(data []byte) ([]*Query, error) {
+	muReadQueries.Lock()
+	defer muReadQueries.Unlock()
+
+	fastxReader, err := fastx.NewReaderFromIO(nil, bytes.NewReader(data), "")
+	if err != nil {
+		return nil, err
+	}
+	defer fastxReader.Close()
+
+	queries := make([]*Query, 0, 8)
+	var record *fastx.Record
+	for {
+		record, err = fastxReader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return queries, err
+		}
+
+		query := poolQuery.Get().(*Query)
+		query.Reset()
+		query.seqID = append(query.seqID, record.ID...)
+		query.seq = append(query.seq, bytes.ToUpper(record.Seq.Seq)...)
+		queries = append(queries, query)
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no valid FASTA/FASTQ records")
+	}
+	return queries, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,284 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+	"github.com/shenwei356/bio/seq"
+	"github.com/spf13/cobra"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+var stripReversedSeedsCmd = &cobra.Command{
+	Use:   "strip-reversed-seeds",
+	Short: "Remove reversed seeds (for suffix matching) from an index",
+	Long: `Remove reversed seeds (for suffix matching) from an index
+
+By default, "lexicmap index" also saves seeds of reversed k-mers, which are used
+for suffix matching in searching. They nearly double the size of seed data.
+This command removes these reversed seeds from an existing index, which is the same as
+an index created with the flag --no-reversed-seeds in "lexicmap index".
+The index information file is updated, and "lexicmap search" skips suffix matching
+for this index.
+
+A lite index is smaller and faster to search, which is suitable for fast screening
+of closely related genomes, at the cost of lower sensitivity for divergent queries.
+
+Presence filters of seeds, if existed, are recreated.
+Seeds of the second mask set with a smaller k, if existed, are not touched,
+as they have no reversed seeds.
+
+Attention:
+  1. The reversed seeds can not be restored, please re-create the index if needed.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		// ------------------------------
+
+		dbDir := getFlagString(cmd, "index")
+		if dbDir == "" {
+			checkError(fmt.Errorf("flag -d/--index needed"))
+		}
+
+		// ---------------------------------------------------------------
+
+		fileInfo := filepath.Join(dbDir, index.FileInfo)
+		info, err := index.ReadIndexInfo(fileInfo)
+		if err != nil {
+			checkError(fmt.Errorf("failed to read info file: %s", err))
+		}
+		if info.MainVersion != index.MainVersion {
+			checkError(fmt.Errorf("index main versions do not match: %d (index) != %d (tool). please upgrade it with \"lexicmap utils upgrade-index\" first", info.MainVersion, index.MainVersion))
+		}
+
+		if info.NoReversedSeeds {
+			log.Infof("the index does not have reversed seeds: %s", dbDir)
+			return
+		}
+
+		if opt.Verbose {
+			log.Infof("removing reversed seeds from %d chunks for: %s", info.Chunks, dbDir)
+			if info.K2 > 0 {
+				log.Infof("  seeds of the second mask set (k=%d) have no reversed seeds and are kept", info.K2)
+			}
+		}
+
+		timeStart := time.Now()
+		defer func() {
+			if opt.Verbose {
+				log.Info()
+				log.Infof("elapsed time: %s", time.Since(timeStart))
+				log.Info()
+			}
+		}()
+
+		// ---------------------------------------------------------------
+		// write new chunks into a temporary directory
+
+		dirSeeds := filepath.Join(dbDir, index.DirSeeds)
+		dirTmp := dirSeeds + index.ExtTmpDir
+		checkError(os.RemoveAll(dirTmp))
+		checkError(os.MkdirAll(dirTmp, 0755))
+
+		showProgressBar := opt.Verbose
+
+		// process bar
+		var pbs *mpb.Progress
+		var bar *mpb.Bar
+		var chDuration chan time.Duration
+		var doneDuration chan int
+		if showProgressBar {
+			pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(os.Stderr))
+			bar = pbs.AddBar(int64(info.Chunks),
+				mpb.PrependDecorators(
+					decor.Name("processed files: ", decor.WC{W: len("processed files: "), C: decor.DindentRight}),
+					decor.Name("", decor.WCSyncSpaceR),
+					decor.CountersNoUnit("%d / %d", decor.WCSyncWidth),
+				),
+				mpb.AppendDecorators(
+					decor.Name("ETA: ", decor.WC{W: len("ETA: ")}),
+					decor.EwmaETA(decor.ET_STYLE_GO, 3),
+					decor.OnComplete(decor.Name(""), ". done"),
+				),
+			)
+
+			chDuration = make(chan time.Duration, opt.NumCPUs)
+			doneDuration = make(chan int)
+			go func() {
+				for t := range chDuration {
+					bar.EwmaIncrBy(1, t)
+				}
+				doneDuration <- 1
+			}()
+		}
+
+		var nSeeds, nKmers int64 // removed seeds and k-mers
+		var mu sync.Mutex
+
+		var wg sync.WaitGroup
+		tokens := make(chan int, opt.NumCPUs)
+		threadsFloat := float64(opt.NumCPUs)
+		for chunk := 0; chunk < info.Chunks; chunk++ {
+			wg.Add(1)
+			tokens <- 1
+			go func(chunk int) {
+				timeStart := time.Now()
+				file := filepath.Join(dirSeeds, index.ChunkFile(chunk))
+				seeds, kmers, err := stripReversedSeeds(file, filepath.Join(dirTmp, index.ChunkFile(chunk)))
+				if err != nil {
+					checkError(fmt.Errorf("failed to remove reversed seeds from %s: %s", file, err))
+				}
+
+				mu.Lock()
+				nSeeds += seeds
+				nKmers += kmers
+				mu.Unlock()
+
+				if showProgressBar {
+					chDuration <- time.Duration(float64(time.Since(timeStart)) / threadsFloat)
+				}
+				<-tokens
+				wg.Done()
+			}(chunk)
+		}
+		wg.Wait()
+
+		if showProgressBar {
+			close(chDuration)
+			<-doneDuration
+			pbs.Wait()
+		}
+
+		if opt.Verbose {
+			log.Infof("  %s reversed seeds of %s k-mers are removed",
+				humanize.Comma(nSeeds), humanize.Comma(nKmers))
+		}
+
+		// ---------------------------------------------------------------
+		// replace the old seeds directory
+
+		rollback, err := swapSeedsDirs([]string{dirSeeds})
+		checkError(err)
+
+		if opt.Verbose {
+			log.Infof("update index information file: %s", fileInfo)
+		}
+		info.NoReversedSeeds = true
+		seedFilterPrefix := info.SeedFilterPrefix
+		seedFilterBits := info.FilterBitsPerKey()
+		info.SeedFilterPrefix = 0 // it's updated after creating filters
+		err = index.WriteIndexInfo(fileInfo, info)
+		if err != nil {
+			if _err := rollback(); _err != nil {
+				checkError(fmt.Errorf("failed to write info file: %s, and failed to restore the seeds directory: %s", err, _err))
+			}
+			checkError(fmt.Errorf("failed to write info file: %s", err))
+		}
+		checkError(os.RemoveAll(dirSeeds + extOldDir))
+		if opt.Verbose {
+			log.Infof("  finished updating the index information file: %s", fileInfo)
+		}
+
+		if seedFilterPrefix > 0 {
+			checkError(index.CreateSeedFilters(dbDir, uint8(seedFilterPrefix), seedFilterBits, opt.NumCPUs, indexLogger(opt.Verbose)))
+		}
+	},
+}
+
+func init() {
+	utilsCmd.AddCommand(stripReversedSeedsCmd)
+
+	stripReversedSeedsCmd.Flags().StringP("index", "d", "",
+		formatFlagUsage(`Index directory created by "lexicmap index".`))
+
+	stripReversedSeedsCmd.SetUsageTemplate(usageTemplate(""))
+}
+
+// stripReversedSeeds writes seeds of a kv-data file to a new file, with reversed seeds removed.
+// K-mers with only reversed seeds are also removed.
+// It returns the numbers of removed seeds and k-mers.
+func stripReversedSeeds(file string, outFile string) (int64, int64, error) {
+	_, _, _, maskPrefix, anchorPrefix, err := kv.ReadKVIndexInfo(filepath.Clean(file) + kv.KVIndexFileExt)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rdr, err := kv.NewReader(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rdr.Close()
+
+	wtr, err := kv.NewWriter(rdr.K, rdr.ChunkIndex, rdr.ChunkSize, outFile, maskPrefix, anchorPrefix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var nSeeds, nKmers int64
+	var m *map[uint64]*[]uint64
+	var v uint64
+	var j int
+	for i := 0; i < rdr.ChunkSize; i++ {
+		m, err = rdr.ReadDataOfAMaskAsMap()
+		if err != nil {
+			wtr.Close()
+			return 0, 0, err
+		}
+
+		for kmer, values := range *m {
+			j = 0
+			for _, v = range *values {
+				if v&index.MASK_REVERSE == 0 {
+					(*values)[j] = v
+					j++
+				}
+			}
+			nSeeds += int64(len(*values) - j)
+			*values = (*values)[:j]
+
+			if j == 0 {
+				delete(*m, kmer)
+				nKmers++
+			}
+		}
+
+		err = wtr.WriteDataOfAMask(*m)
+		kv.RecycleKmerData(m)
+		if err != nil {
+			wtr.Close()
+			return 0, 0, err
+		}
+	}
+
+	return nSeeds, nKmers, wtr.Close()
+}
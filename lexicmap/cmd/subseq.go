@@ -28,6 +28,7 @@ import (
 	"strings"
 
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
 	"github.com/shenwei356/bio/seq"
 	"github.com/spf13/cobra"
 )
@@ -67,32 +68,35 @@ Attention:
 			concatenatedPositions = true
 		}
 
-		var reRegion = regexp.MustCompile(`\-?\d+:\-?\d+`)
+		var reRegion = regexp.MustCompile(`^\-?\d+:\-?\d+$`)
 
-		region := getFlagString(cmd, "region")
-		if region == "" {
+		regions := getFlagStringSlice(cmd, "region")
+		if len(regions) == 0 {
 			checkError(fmt.Errorf("flag -r/--region needed"))
 		}
 		revcom := getFlagBool(cmd, "revcom")
 
 		lineWidth := getFlagNonNegativeInt(cmd, "line-width")
 
-		if !reRegion.MatchString(region) {
-			checkError(fmt.Errorf(`invalid region: %s. type "lexicmap utils subseq -h" for more examples`, region))
-		}
-		var start, end int
 		var err error
+		starts := make([]int, len(regions))
+		ends := make([]int, len(regions))
+		for i, region := range regions {
+			if !reRegion.MatchString(region) {
+				checkError(fmt.Errorf(`invalid region: %s. type "lexicmap utils subseq -h" for more examples`, region))
+			}
 
-		r := strings.Split(region, ":")
-		start, err = strconv.Atoi(r[0])
-		checkError(err)
-		end, err = strconv.Atoi(r[1])
-		checkError(err)
-		if start <= 0 || end <= 0 {
-			checkError(fmt.Errorf("both begin and end position should not be <= 0"))
-		}
-		if start > end {
-			checkError(fmt.Errorf("begin position should be < end position"))
+			r := strings.Split(region, ":")
+			starts[i], err = strconv.Atoi(r[0])
+			checkError(err)
+			ends[i], err = strconv.Atoi(r[1])
+			checkError(err)
+			if starts[i] <= 0 || ends[i] <= 0 {
+				checkError(fmt.Errorf("both begin and end position should not be <= 0: %s", region))
+			}
+			if starts[i] > ends[i] {
+				checkError(fmt.Errorf("begin position should be < end position: %s", region))
+			}
 		}
 
 		outFile := getFlagString(cmd, "out-file")
@@ -100,7 +104,7 @@ Attention:
 		// ---------------------------------------------------------------
 
 		// genomes.map file for mapping index to genome id
-		m, err := readGenomeMapName2Idx(filepath.Join(dbDir, FileGenomeIndex))
+		m, err := index.ReadGenomeMapName2Idx(filepath.Join(dbDir, index.FileGenomeIndex))
 		if err != nil {
 			checkError(fmt.Errorf("failed to read genomes index mapping file: %s", err))
 		}
@@ -112,39 +116,6 @@ Attention:
 			checkError(fmt.Errorf("reference name not found: %s", refname))
 		}
 
-		var tSeq *genome.Genome
-		var genomeBatch, genomeIdx int
-		var rdr *genome.Reader
-
-		var _end int
-
-		for _, batchIDAndRefID := range *batchIDAndRefIDs {
-			genomeBatch = int(batchIDAndRefID >> BITS_GENOME_IDX)
-			genomeIdx = int(batchIDAndRefID & MASK_GENOME_IDX)
-
-			fileGenome := filepath.Join(dbDir, DirGenomes, batchDir(genomeBatch), FileGenomes)
-			rdr, err = genome.NewReader(fileGenome)
-			if err != nil {
-				checkError(fmt.Errorf("failed to read genome data file: %s", err))
-			}
-
-			if concatenatedPositions {
-				tSeq, err = rdr.SubSeq(genomeIdx, start-1, end-1)
-			} else {
-				tSeq, _end, err = rdr.SubSeq2(genomeIdx, []byte(seqid), start-1, end-1)
-				_end++ // returned end is 0-based.
-			}
-			if err == nil {
-				break
-				// checkError(fmt.Errorf("failed to read subsequence: %s", err))
-			}
-		}
-		if err != nil {
-			checkError(fmt.Errorf("failed to read subsequence: %s", err))
-		}
-
-		end = _end // update end
-
 		// output file handler
 		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(outFile, ".gz"), opt.CompressionLevel)
 		checkError(err)
@@ -156,25 +127,76 @@ Attention:
 			w.Close()
 		}()
 
-		s, err := seq.NewSeq(seq.DNAredundant, tSeq.Seq)
-		checkError(err)
+		// genome readers of batches, which are reused for all regions
+		rdrs := make(map[int]genome.SeqReader, len(*batchIDAndRefIDs))
+		defer func() {
+			for _, rdr := range rdrs {
+				checkError(rdr.Close())
+			}
+		}()
 
+		var tSeq *genome.Genome
+		var genomeBatch, genomeIdx int
+		var rdr genome.SeqReader
+		var start, end, _end int
 		strand := "+"
 		if revcom {
 			strand = "-"
-			s.RevComInplace()
 		}
 
-		if concatenatedPositions {
-			fmt.Fprintf(outfh, ">%s:%d-%d:%s\n", refname, start, end, strand)
-		} else {
-			fmt.Fprintf(outfh, ">%s:%d-%d:%s\n", seqid, start, end, strand)
-		}
-		outfh.Write(s.FormatSeq(lineWidth))
-		outfh.WriteByte('\n')
+		for i := range regions {
+			start, end = starts[i], ends[i]
+
+			for _, batchIDAndRefID := range *batchIDAndRefIDs {
+				genomeBatch = int(batchIDAndRefID >> index.BITS_GENOME_IDX)
+				genomeIdx = int(batchIDAndRefID & index.MASK_GENOME_IDX)
+
+				if rdr, ok = rdrs[genomeBatch]; !ok {
+					fileGenome := filepath.Join(dbDir, index.DirGenomes, index.BatchDir(genomeBatch), index.FileGenomes)
+					rdr, err = genome.NewSeqReader(fileGenome)
+					if err != nil {
+						checkError(fmt.Errorf("failed to read genome data file: %s", err))
+					}
+					rdrs[genomeBatch] = rdr
+				}
+
+				if concatenatedPositions {
+					tSeq, err = rdr.SubSeq(genomeIdx, start-1, end-1)
+					if err == nil {
+						_end = start - 1 + len(tSeq.Seq) // end might be longer than the seq len
+					}
+				} else {
+					tSeq, _end, err = rdr.SubSeq2(genomeIdx, []byte(seqid), start-1, end-1)
+					_end++ // returned end is 0-based.
+				}
+				if err == nil {
+					break
+					// checkError(fmt.Errorf("failed to read subsequence: %s", err))
+				}
+			}
+			if err != nil {
+				checkError(fmt.Errorf("failed to read subsequence: %s", err))
+			}
+
+			end = _end // update end
+
+			s, err := seq.NewSeq(seq.DNAredundant, tSeq.Seq)
+			checkError(err)
+
+			if revcom {
+				s.RevComInplace()
+			}
 
-		genome.RecycleGenome(tSeq)
-		checkError(rdr.Close())
+			if concatenatedPositions {
+				fmt.Fprintf(outfh, ">%s:%d-%d:%s\n", refname, start, end, strand)
+			} else {
+				fmt.Fprintf(outfh, ">%s:%d-%d:%s\n", seqid, start, end, strand)
+			}
+			outfh.Write(s.FormatSeq(lineWidth))
+			outfh.WriteByte('\n')
+
+			genome.RecycleGenome(tSeq)
+		}
 	},
 }
 
@@ -193,8 +215,8 @@ func init() {
 	subseqCmd.Flags().StringP("out-file", "o", "-",
 		formatFlagUsage(`Out file, supports the ".gz" suffix ("-" for stdout).`))
 
-	subseqCmd.Flags().StringP("region", "r", "",
-		formatFlagUsage(`Region of the subsequence (1-based).`))
+	subseqCmd.Flags().StringSliceP("region", "r", []string{},
+		formatFlagUsage(`Region of the subsequence (1-based). Multiple values are supported, e.g., -r 1:100 -r 2001:2100, or -r 1:100,2001:2100.`))
 
 	subseqCmd.Flags().BoolP("revcom", "R", false,
 		formatFlagUsage("Extract subsequence on the negative strand."))
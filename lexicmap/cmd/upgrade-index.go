@@ -0,0 +1,459 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/seedposition"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/lexichash"
+	"github.com/spf13/cobra"
+)
+
+var upgradeIndexCmd = &cobra.Command{
+	Use:   "upgrade-index",
+	Short: "Upgrade an index created by an older version of LexicMap",
+	Long: `Upgrade an index created by an older version of LexicMap
+
+Attention:
+  1. Files are converted in place by default, please use -O/--out-dir to
+     write the upgraded index into a new directory.
+  2. Only parts with compatible data layouts are converted:
+       - headers of seeds, genome, and seed position data files,
+       - indexes of seeds (k-mer-value) data files, which are recreated,
+       - presence filters of seeds, which are recreated,
+       - the genome chunk file (genomes.chunks.bin), which is created if absent,
+       - the index information file (info.toml).
+  3. If any part can not be converted, nothing is changed, and these parts
+     are listed. Then the index needs to be rebuilt with "lexicmap index".
+  4. Use -n/--dry-run to only check the index and list what would be done.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		// ------------------------------
+
+		dbDir := getFlagString(cmd, "index")
+		if dbDir == "" {
+			checkError(fmt.Errorf("flag -d/--index needed"))
+		}
+		outDir := getFlagString(cmd, "out-dir")
+		force := getFlagBool(cmd, "force")
+		dryRun := getFlagBool(cmd, "dry-run")
+		partitions := getFlagNonNegativeInt(cmd, "partitions")
+
+		if outDir != "" && filepath.Clean(outDir) == filepath.Clean(dbDir) {
+			checkError(fmt.Errorf("the values of -O/--out-dir and -d/--index should be different"))
+		}
+		if outDir != "" {
+			absDir, err := filepath.Abs(dbDir)
+			checkError(err)
+			absOutDir, err := filepath.Abs(outDir)
+			checkError(err)
+			if strings.HasPrefix(absOutDir, absDir+string(filepath.Separator)) {
+				checkError(fmt.Errorf("the output directory should not be in the index directory: %s", outDir))
+			}
+		}
+
+		// ---------------------------------------------------------------
+
+		timeStart := time.Now()
+		defer func() {
+			if opt.Verbose {
+				log.Info()
+				log.Infof("elapsed time: %s", time.Since(timeStart))
+				log.Info()
+			}
+		}()
+
+		fileInfo := filepath.Join(dbDir, index.FileInfo)
+		info, err := index.ReadIndexInfo(fileInfo)
+		if err != nil {
+			checkError(fmt.Errorf("failed to read info file: %s", err))
+		}
+		if partitions == 0 {
+			partitions = info.Partitions
+			if partitions == 0 {
+				partitions = 1024 // the default value of lexicmap index
+			}
+		}
+
+		if opt.Verbose {
+			log.Infof("checking index: %s", dbDir)
+		}
+		plan, err := checkIndexForUpgrade(dbDir, info, partitions)
+		checkError(err)
+
+		if len(plan.rebuild) > 0 {
+			log.Warningf("%d part(s) of the index can not be converted and need rebuilding:", len(plan.rebuild))
+			for _, s := range plan.rebuild {
+				log.Warningf("  %s", s)
+			}
+			checkError(fmt.Errorf(`nothing is changed, please rebuild the index with "lexicmap index"`))
+		}
+
+		updateInfo := info.MainVersion != index.MainVersion || info.MinorVersion != index.MinorVersion ||
+			info.Partitions != partitions
+		if len(plan.tasks) == 0 && !updateInfo {
+			log.Infof("the index is up to date: %s", dbDir)
+			return
+		}
+
+		if dryRun || opt.Verbose {
+			log.Infof("steps to upgrade the index:")
+			for _, t := range plan.tasks {
+				log.Infof("  %s: %s", t.part, t.desc)
+			}
+			if info.MainVersion != index.MainVersion || info.MinorVersion != index.MinorVersion {
+				log.Infof("  %s: update the index format from %d.%d to %d.%d",
+					index.FileInfo, info.MainVersion, info.MinorVersion, index.MainVersion, index.MinorVersion)
+			} else {
+				log.Infof("  %s: update the index information", index.FileInfo)
+			}
+		}
+		if dryRun {
+			return
+		}
+
+		// ---------------------------------------------------------------
+
+		if outDir != "" {
+			makeOutDir(outDir, force, "out-dir", opt.Verbose)
+			if opt.Verbose {
+				log.Infof("copying the index to: %s", outDir)
+			}
+			checkError(copyDir(dbDir, outDir))
+			dbDir = outDir
+		}
+
+		if opt.Verbose {
+			log.Infof("upgrading the index: %s", dbDir)
+		}
+		checkError(plan.apply(dbDir, info, partitions, opt.NumCPUs))
+
+		if opt.Verbose {
+			log.Infof("  finished upgrading the index: %s", dbDir)
+		}
+	},
+}
+
+func init() {
+	utilsCmd.AddCommand(upgradeIndexCmd)
+
+	upgradeIndexCmd.Flags().StringP("index", "d", "",
+		formatFlagUsage(`Index directory created by "lexicmap index".`))
+	upgradeIndexCmd.Flags().StringP("out-dir", "O", "",
+		formatFlagUsage(`Output directory for the upgraded index. By default, the index is upgraded in place.`))
+	upgradeIndexCmd.Flags().BoolP("force", "", false,
+		formatFlagUsage(`Overwrite existing output directory.`))
+	upgradeIndexCmd.Flags().BoolP("dry-run", "n", false,
+		formatFlagUsage(`Only check the index and list what would be done.`))
+	upgradeIndexCmd.Flags().IntP("partitions", "", 0,
+		formatFlagUsage(`Number of partitions for re-indexing seeds (k-mer-value data) files. The value needs to be the power of 4. `+
+			`0 for using the value in the index information file.`))
+
+	upgradeIndexCmd.SetUsageTemplate(usageTemplate(""))
+}
+
+// incompatibleIndexChanges records the changes of the index format (MainVersion),
+// which can not be converted from indexes of older versions.
+var incompatibleIndexChanges = map[uint8]string{
+	3: "seeds for suffix matching are added since LexicMap v0.4.0, they can only be created from genome sequences",
+}
+
+// upgradeTask is a step of upgrading an index.
+type upgradeTask struct {
+	part string                   // a file or directory of the index
+	desc string                   // what to do
+	run  func(dbDir string) error // dbDir is the directory of the index to upgrade
+}
+
+// upgradePlan contains steps of upgrading an index,
+// and the parts which can not be converted.
+type upgradePlan struct {
+	tasks   []*upgradeTask
+	rebuild []string
+}
+
+func (p *upgradePlan) add(part string, desc string, run func(dbDir string) error) {
+	p.tasks = append(p.tasks, &upgradeTask{part: part, desc: desc, run: run})
+}
+
+func (p *upgradePlan) needRebuild(part string, format string, a ...interface{}) {
+	p.rebuild = append(p.rebuild, part+": "+fmt.Sprintf(format, a...))
+}
+
+// apply executes all the steps, and updates the index information file.
+func (p *upgradePlan) apply(dbDir string, info *index.IndexInfo, partitions int, threads int) error {
+	err := p.run(dbDir, threads)
+	if err != nil {
+		return err
+	}
+
+	info.MainVersion = index.MainVersion
+	info.MinorVersion = index.MinorVersion
+	info.Partitions = partitions
+	err = index.WriteIndexInfo(filepath.Join(dbDir, index.FileInfo), info)
+	if err != nil {
+		return fmt.Errorf("failed to write info file: %s", err)
+	}
+	return nil
+}
+
+// run executes all the steps in parallel.
+func (p *upgradePlan) run(dbDir string, threads int) error {
+	var wg sync.WaitGroup
+	tokens := make(chan int, threads)
+	var _err error
+	var mu sync.Mutex
+	for _, t := range p.tasks {
+		wg.Add(1)
+		tokens <- 1
+		go func(t *upgradeTask) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+
+			err := t.run(dbDir)
+			if err != nil {
+				mu.Lock()
+				_err = fmt.Errorf("failed to upgrade %s: %s", t.part, err)
+				mu.Unlock()
+			}
+		}(t)
+	}
+	wg.Wait()
+	return _err
+}
+
+// checkIndexForUpgrade checks all parts of an index, and returns the steps to
+// upgrade it or the parts which can not be converted.
+func checkIndexForUpgrade(dbDir string, info *index.IndexInfo, partitions int) (*upgradePlan, error) {
+	if info.MainVersion > index.MainVersion {
+		return nil, fmt.Errorf("the index is created by a newer version of LexicMap (index format: %d > %d), please update LexicMap",
+			info.MainVersion, index.MainVersion)
+	}
+
+	plan := &upgradePlan{}
+
+	for v := info.MainVersion + 1; v <= index.MainVersion; v++ {
+		if change, ok := incompatibleIndexChanges[v]; ok {
+			plan.needRebuild(index.DirSeeds, "index format %d -> %d: %s", info.MainVersion, v, change)
+		}
+	}
+
+	// masks
+	lh, err := lexichash.NewFromFile(filepath.Join(dbDir, index.FileMasks))
+	if err != nil {
+		plan.needRebuild(index.FileMasks, "%s", err)
+		return plan, nil // the seed data can not be checked
+	}
+	maskPrefix := kv.MaskPrefix(len(lh.Masks))
+	anchorPrefix := kv.AnchorPrefix(partitions)
+
+	// seeds
+	for chunk := 0; chunk < info.Chunks; chunk++ {
+		part := filepath.Join(index.DirSeeds, index.ChunkFile(chunk))
+		if !plan.checkHeader(dbDir, part, kv.Magic, kv.MainVersion, kv.MinorVersion, false) {
+			continue
+		}
+
+		// the index is recreated if it's broken, outdated, or has a different number of partitions
+		partIdx := part + kv.KVIndexFileExt
+		mainV, minorV, err := readFileVersion(filepath.Join(dbDir, partIdx), kv.MagicIdx)
+		if err == nil && mainV == kv.MainVersion {
+			var _anchorPrefix uint8
+			_, _, _, _, _anchorPrefix, err = kv.ReadKVIndexInfo(filepath.Join(dbDir, partIdx))
+			if err == nil && _anchorPrefix != anchorPrefix {
+				err = fmt.Errorf("different number of partitions")
+			}
+		}
+		if err != nil || mainV != kv.MainVersion {
+			plan.add(partIdx, "recreate the index", func(dbDir string) error {
+				return kv.CreateKVIndexWithMaskPrefix(filepath.Join(dbDir, part), partitions, maskPrefix)
+			})
+		} else if minorV != kv.MinorVersion {
+			plan.addHeaderRewriting(partIdx, kv.MainVersion, kv.MinorVersion)
+		}
+
+		if info.SeedFilterPrefix > 0 {
+			partFlt := part + kv.KVFilterFileExt
+			mainV, minorV, err = readFileVersion(filepath.Join(dbDir, partFlt), kv.MagicFilter)
+			if err != nil || mainV != kv.MainVersion {
+				prefix := uint8(info.SeedFilterPrefix)
+				bitsPerKey := info.FilterBitsPerKey()
+				plan.add(partFlt, "recreate the presence filter", func(dbDir string) error {
+					return kv.CreateKVFilter(filepath.Join(dbDir, part), prefix, bitsPerKey)
+				})
+			} else if minorV != kv.MinorVersion {
+				plan.addHeaderRewriting(partFlt, kv.MainVersion, kv.MinorVersion)
+			}
+		}
+	}
+
+	// genomes and seed positions
+	for batch := 0; batch < info.GenomeBatches; batch++ {
+		part := filepath.Join(index.DirGenomes, index.BatchDir(batch), index.FileGenomes)
+		plan.checkHeader(dbDir, part, genome.Magic, genome.MainVersion, genome.MinorVersion, false)
+		plan.checkHeader(dbDir, part+genome.GenomeIndexFileExt, genome.MagicIdx, genome.MainVersion, genome.MinorVersion, false)
+
+		part = filepath.Join(index.DirGenomes, index.BatchDir(batch), index.FileSeedPositions)
+		if plan.checkHeader(dbDir, part, seedposition.Magic, seedposition.MainVersion, seedposition.MinorVersion, true) {
+			plan.checkHeader(dbDir, part+seedposition.PositionsIndexFileExt, seedposition.MagicIdx,
+				seedposition.MainVersion, seedposition.MinorVersion, false)
+		}
+	}
+
+	// genome id mapping
+	if _, err = os.Stat(filepath.Join(dbDir, index.FileGenomeIndex)); err != nil {
+		plan.needRebuild(index.FileGenomeIndex, "%s", err)
+	}
+
+	// genome chunks, which are added in LexicMap v0.4.1
+	_, err = os.Stat(filepath.Join(dbDir, index.FileGenomeChunks))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		plan.add(index.FileGenomeChunks, "create an empty genome chunk file", func(dbDir string) error {
+			return os.WriteFile(filepath.Join(dbDir, index.FileGenomeChunks), nil, 0644)
+		})
+	}
+
+	return plan, nil
+}
+
+// checkHeader checks the header of a binary file in the index. It returns true
+// if the file exists and its data layout is compatible, where a header rewriting
+// step is added for a different minor version.
+func (p *upgradePlan) checkHeader(dbDir string, part string, magic [8]byte, mainVersion uint8, minorVersion uint8, optional bool) bool {
+	mainV, minorV, err := readFileVersion(filepath.Join(dbDir, part), magic)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return false
+		}
+		p.needRebuild(part, "%s", err)
+		return false
+	}
+	if mainV != mainVersion {
+		p.needRebuild(part, "data format %d.%d is not compatible with the current one %d.%d",
+			mainV, minorV, mainVersion, minorVersion)
+		return false
+	}
+	if minorV != minorVersion {
+		p.addHeaderRewriting(part, mainVersion, minorVersion)
+	}
+	return true
+}
+
+func (p *upgradePlan) addHeaderRewriting(part string, mainVersion uint8, minorVersion uint8) {
+	p.add(part, fmt.Sprintf("rewrite the version in the header to %d.%d", mainVersion, minorVersion),
+		func(dbDir string) error {
+			return writeFileVersion(filepath.Join(dbDir, part), mainVersion, minorVersion)
+		})
+}
+
+// readFileVersion reads the main and minor versions of a binary file in the index.
+// All these files start with an 8-byte magic number, followed by a 1-byte
+// main version and a 1-byte minor version.
+func readFileVersion(file string, magic [8]byte) (uint8, uint8, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fh.Close()
+
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(fh, buf)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, 0, fmt.Errorf("broken file")
+		}
+		return 0, 0, err
+	}
+	if !bytes.Equal(buf[:8], magic[:]) {
+		return 0, 0, fmt.Errorf("invalid file format")
+	}
+	return buf[8], buf[9], nil
+}
+
+// writeFileVersion overwrites the main and minor versions of a binary file in the index.
+func writeFileVersion(file string, mainVersion uint8, minorVersion uint8) error {
+	fh, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fh.WriteAt([]byte{mainVersion, minorVersion}, 8)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// copyDir copies all files in a directory to another one.
+func copyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
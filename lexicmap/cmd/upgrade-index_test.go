@@ -0,0 +1,53 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shenwei356/LexicMap/lexicmap/index"
+)
+
+// TestUpgradeIndexV2 checks that an index of format 2 (LexicMap v0.3.x),
+// which has no seeds for suffix matching, is reported to be rebuilt.
+func TestUpgradeIndexV2(t *testing.T) {
+	info := &index.IndexInfo{MainVersion: 2, K: 31, Chunks: 1, Partitions: 1024}
+	plan, err := checkIndexForUpgrade(t.TempDir(), info, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, s := range plan.rebuild {
+		if strings.HasPrefix(s, index.DirSeeds+": index format 2 -> 3") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("seeds of an index of format 2 should be rebuilt, parts to rebuild: %v", plan.rebuild)
+	}
+
+	// newer indexes are not supported
+	info.MainVersion = index.MainVersion + 1
+	if _, err = checkIndexForUpgrade(t.TempDir(), info, 1024); err == nil {
+		t.Errorf("an index of a newer format should be reported")
+	}
+}
@@ -23,6 +23,7 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"math/rand"
@@ -35,6 +36,7 @@ import (
 
 	"github.com/iafan/cwalk"
 	"github.com/pkg/errors"
+	"github.com/shenwei356/LexicMap/lexicmap/index"
 	"github.com/shenwei356/util/pathutil"
 	"github.com/shenwei356/xopen"
 	"github.com/spf13/cobra"
@@ -43,8 +45,7 @@ import (
 
 var mapInitSize = 1 << 20 // 1M
 
-// the minimum k value
-var minK = 10
+var be = binary.BigEndian
 
 // Options contains the global flags
 type Options struct {
@@ -58,6 +59,14 @@ type Options struct {
 	CompressionLevel int
 }
 
+// indexLogger returns the logger passed to the index package, nil for no logs.
+func indexLogger(verbose bool) index.Logger {
+	if verbose {
+		return log
+	}
+	return nil
+}
+
 func getOptions(cmd *cobra.Command) *Options {
 	threads := getFlagNonNegativeInt(cmd, "threads")
 	if threads == 0 {
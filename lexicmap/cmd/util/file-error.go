@@ -0,0 +1,80 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FileError describes an error in reading a broken or invalid file,
+// with the file, the record and the byte offset.
+// It's returned by readers of seed data, genome data, and seed position data,
+// so all of them could be recognised with one errors.As().
+// The original error, e.g., ErrBrokenFile of these packages, could be checked with errors.Is().
+type FileError struct {
+	File   string // path of the file
+	Record string // the record being read, e.g., "mask 1024" or "genome 12", empty for the header
+	Offset int64  // byte offset in the file, -1 for unknown
+	Err    error  // the underlying error
+}
+
+func (e *FileError) Error() string {
+	s := fmt.Sprintf("%s: %s", e.Err, e.File)
+	if e.Record != "" {
+		s += ", " + e.Record
+	}
+	if e.Offset >= 0 {
+		s += fmt.Sprintf(", offset %d", e.Offset)
+	}
+	return s
+}
+
+// Unwrap returns the underlying error.
+func (e *FileError) Unwrap() error { return e.Err }
+
+// NewFileError creates a FileError, where unexpected EOFs are replaced with errBroken,
+// i.e., the ErrBrokenFile of the caller's package.
+// If the error already contains a FileError, it is returned as it is.
+func NewFileError(file string, record string, offset int64, err error, errBroken error) error {
+	if err == nil {
+		return nil
+	}
+	var fe *FileError
+	if errors.As(err, &fe) {
+		return err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errBroken
+	}
+	return &FileError{File: file, Record: record, Offset: offset, Err: err}
+}
+
+// MaskRecord returns the record name of a mask.
+func MaskRecord(i int) string {
+	return fmt.Sprintf("mask %d", i)
+}
+
+// GenomeRecord returns the record name of a genome.
+func GenomeRecord(i int) string {
+	return fmt.Sprintf("genome %d", i)
+}
@@ -0,0 +1,242 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/shenwei356/wfa"
+)
+
+// AlignMode is the mode of aligning the query and target sequences of a HSP with WFA.
+type AlignMode uint8
+
+const (
+	// AlignGlobal aligns the whole query and target regions of a HSP end to end.
+	AlignGlobal AlignMode = iota
+	// AlignSemiGlobal performs ends-free alignment, where leading and trailing gaps are not penalized,
+	// and the HSP is trimmed to the aligned region.
+	AlignSemiGlobal
+	// AlignExtension extends the alignment from the first matched bases of a HSP,
+	// and stops at the position with the maximum score under the AlignPenalties, like seed extension,
+	// then the start position is found in the same way from the other end. Low-scoring ends are clipped.
+	AlignExtension
+)
+
+var alignModeNames = []string{"global", "semi-global", "extension"}
+
+func (m AlignMode) String() string {
+	if int(m) < len(alignModeNames) {
+		return alignModeNames[m]
+	}
+	return fmt.Sprintf("AlignMode(%d)", m)
+}
+
+// ParseAlignMode parses the name of an alignment mode: global, semi-global, or extension.
+func ParseAlignMode(s string) (AlignMode, error) {
+	for i, name := range alignModeNames {
+		if s == name {
+			return AlignMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid alignment mode: %s, available values: global, semi-global, extension", s)
+}
+
+// AlignPenalties contains the gap-affine penalties of the WFA alignment.
+// A gap of length k costs GapOpen + GapExt*k.
+//
+// WFA computes the minimum edit cost with no cost of matches.
+// A positive Match (a reward) is converted into equivalent penalties,
+// i.e., mismatch: 2*(Mismatch+Match), gap open: 2*GapOpen, gap extension: 2*GapExt+Match,
+// which is exact for global alignment (Eizenga and Paten, 2022).
+type AlignPenalties struct {
+	Match    int // reward of a match, 0 by default
+	Mismatch int // penalty of a mismatch
+	GapOpen  int // penalty of opening a gap
+	GapExt   int // penalty of extending a gap
+}
+
+// DefaultAlignPenalties is the default penalties, from the WFA paper.
+// Zero-valued AlignPenalties in SeqComparatorOptions are treated as the default ones.
+var DefaultAlignPenalties = AlignPenalties{
+	Match:    0,
+	Mismatch: int(wfa.DefaultPenalties.Mismatch),
+	GapOpen:  int(wfa.DefaultPenalties.GapOpen),
+	GapExt:   int(wfa.DefaultPenalties.GapExt),
+}
+
+// CheckAlignPenalties checks the alignment penalties.
+func CheckAlignPenalties(p *AlignPenalties) error {
+	if p.Match < 0 || p.GapOpen < 0 {
+		return fmt.Errorf("the match reward and gap open penalty should not be negative")
+	}
+	if p.Mismatch <= 0 || p.GapExt <= 0 {
+		return fmt.Errorf("the mismatch and gap extension penalties should be positive")
+	}
+	if 2*(p.Mismatch+p.Match) > math.MaxUint16 || 2*p.GapOpen > math.MaxUint16 || 2*p.GapExt+p.Match > math.MaxUint16 {
+		return fmt.Errorf("alignment penalties are too large")
+	}
+	return nil
+}
+
+// orDefault returns the default penalties for the zero value.
+func (p AlignPenalties) orDefault() AlignPenalties {
+	if p == (AlignPenalties{}) {
+		return DefaultAlignPenalties
+	}
+	return p
+}
+
+// wfaPenalties returns the penalties for WFA, where the match reward is converted.
+func (p AlignPenalties) wfaPenalties() *wfa.Penalties {
+	p = p.orDefault()
+	if p.Match == 0 {
+		return &wfa.Penalties{
+			Mismatch: uint32(p.Mismatch),
+			GapOpen:  uint32(p.GapOpen),
+			GapExt:   uint32(p.GapExt),
+		}
+	}
+	return &wfa.Penalties{
+		Mismatch: uint32(2 * (p.Mismatch + p.Match)),
+		GapOpen:  uint32(2 * p.GapOpen),
+		GapExt:   uint32(2*p.GapExt + p.Match),
+	}
+}
+
+// opScore returns the score of a CIGAR operation in finding the ends of an extension.
+// Matches are rewarded with Match, or 1 if it's 0, as scores would never increase without a reward.
+func (p AlignPenalties) opScore(op *wfa.CIGARRecord) float64 {
+	switch op.Op {
+	case 'M':
+		return float64(max(p.Match, 1)) * float64(op.N)
+	case 'X':
+		return -float64(p.Mismatch) * float64(op.N)
+	default: // gaps
+		return -float64(p.GapOpen) - float64(p.GapExt)*float64(op.N)
+	}
+}
+
+func (p AlignPenalties) String() string {
+	return fmt.Sprintf("%d/%d/%d/%d", p.Match, p.Mismatch, p.GapOpen, p.GapExt)
+}
+
+// alignedRange returns the range of CIGAR operations kept in the alignment mode,
+// -1 is returned if there are no matches. p is only used in the extension mode.
+func (m AlignMode) alignedRange(ops []*wfa.CIGARRecord, p AlignPenalties) (int, int) {
+	begin, end := -1, -1
+	switch m {
+	case AlignExtension:
+		p = p.orDefault()
+		var s float64
+		best := math.Inf(-1)
+		for i, op := range ops { // extending from the start
+			s += p.opScore(op)
+			if op.Op == 'M' && s > best {
+				best, end = s, i
+			}
+		}
+		s, best = 0, math.Inf(-1)
+		for i := end; i >= 0; i-- { // and from the end
+			s += p.opScore(ops[i])
+			if ops[i].Op == 'M' && s > best {
+				best, begin = s, i
+			}
+		}
+	default:
+		for i, op := range ops {
+			if op.Op == 'M' {
+				if begin < 0 {
+					begin = i
+				}
+				end = i
+			}
+		}
+	}
+	return begin, end
+}
+
+// clipAlignment clips the alignment of a HSP according to the alignment mode.
+// CIGAR operations and statistics, positions of the HSP,
+// and the aligned query and target sequences are updated.
+// rc tells if the target sequence is the reverse complement one.
+func clipAlignment(m AlignMode, p AlignPenalties, cigar *wfa.AlignmentResult,
+	c *Chain2Result, rc bool, qseq, tseq *[]byte) {
+	if m == AlignGlobal {
+		return
+	}
+	ops := cigar.Ops
+	begin, end := m.alignedRange(ops, p)
+	if begin < 0 || (begin == 0 && end == len(ops)-1) {
+		return
+	}
+
+	// clipped bases on the two ends
+	var qb, qe, tb, te int
+	for i, op := range ops {
+		if i >= begin && i <= end {
+			continue
+		}
+		var q, t int
+		switch op.Op {
+		case 'M', 'X':
+			q, t = int(op.N), int(op.N)
+		case 'I':
+			t = int(op.N)
+		default: // 'D', 'H'
+			q = int(op.N)
+		}
+		if i < begin {
+			qb += q
+			tb += t
+		} else {
+			qe += q
+			te += t
+		}
+	}
+
+	n := copy(ops, ops[begin:end+1])
+	cigar.Ops = ops[:n]
+	cigar.AlignLen, cigar.Matches, cigar.Gaps, cigar.GapRegions = 0, 0, 0, 0
+	for _, op := range cigar.Ops {
+		cigar.AlignLen += op.N
+		switch op.Op {
+		case 'M':
+			cigar.Matches += op.N
+		case 'I', 'D':
+			cigar.Gaps += op.N
+			cigar.GapRegions++
+		}
+	}
+
+	c.QBegin += qb
+	c.QEnd -= qe
+	if rc {
+		c.TEnd -= tb
+		c.TBegin += te
+	} else {
+		c.TBegin += tb
+		c.TEnd -= te
+	}
+	*qseq = (*qseq)[qb : len(*qseq)-qe]
+	*tseq = (*tseq)[tb : len(*tseq)-te]
+}
@@ -0,0 +1,112 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"testing"
+
+	"github.com/shenwei356/wfa"
+)
+
+func TestClipAlignment(t *testing.T) {
+	p := DefaultAlignPenalties
+
+	newCigar := func(ops ...*wfa.CIGARRecord) *wfa.AlignmentResult {
+		return &wfa.AlignmentResult{Ops: ops}
+	}
+	seq := func(n int) []byte {
+		return make([]byte, n)
+	}
+
+	// semi-global: flanking gaps are removed
+	cigar := newCigar(&wfa.CIGARRecord{N: 2, Op: 'I'}, &wfa.CIGARRecord{N: 10, Op: 'M'},
+		&wfa.CIGARRecord{N: 1, Op: 'X'}, &wfa.CIGARRecord{N: 20, Op: 'M'}, &wfa.CIGARRecord{N: 3, Op: 'D'})
+	c := &Chain2Result{QBegin: 100, QEnd: 133, TBegin: 200, TEnd: 232}
+	qseq, tseq := seq(34), seq(33)
+	clipAlignment(AlignSemiGlobal, p, cigar, c, false, &qseq, &tseq)
+	if len(cigar.Ops) != 3 || cigar.AlignLen != 31 || cigar.Matches != 30 || cigar.Gaps != 0 {
+		t.Errorf("unexpected clipped alignment: %d ops, alen: %d, matches: %d, gaps: %d",
+			len(cigar.Ops), cigar.AlignLen, cigar.Matches, cigar.Gaps)
+	}
+	if c.QBegin != 100 || c.QEnd != 130 || c.TBegin != 202 || c.TEnd != 232 {
+		t.Errorf("unexpected positions: (%d, %d) vs (%d, %d)", c.QBegin, c.QEnd, c.TBegin, c.TEnd)
+	}
+	if len(qseq) != 31 || len(tseq) != 31 {
+		t.Errorf("unexpected sequence lengths: %d, %d", len(qseq), len(tseq))
+	}
+
+	// extension: the low-scoring end is clipped, on the negative strand
+	cigar = newCigar(&wfa.CIGARRecord{N: 10, Op: 'M'}, &wfa.CIGARRecord{N: 1, Op: 'X'},
+		&wfa.CIGARRecord{N: 1, Op: 'M'}, &wfa.CIGARRecord{N: 4, Op: 'X'}, &wfa.CIGARRecord{N: 1, Op: 'M'})
+	c = &Chain2Result{QBegin: 0, QEnd: 16, TBegin: 200, TEnd: 216}
+	qseq, tseq = seq(17), seq(17)
+	clipAlignment(AlignExtension, p, cigar, c, true, &qseq, &tseq)
+	if len(cigar.Ops) != 1 || cigar.AlignLen != 10 || cigar.Matches != 10 {
+		t.Errorf("unexpected clipped alignment: %d ops, alen: %d, matches: %d",
+			len(cigar.Ops), cigar.AlignLen, cigar.Matches)
+	}
+	if c.QBegin != 0 || c.QEnd != 9 || c.TBegin != 207 || c.TEnd != 216 {
+		t.Errorf("unexpected positions: (%d, %d) vs (%d, %d)", c.QBegin, c.QEnd, c.TBegin, c.TEnd)
+	}
+
+	// extension: the end is decided by the alignment penalties,
+	// the mismatches are kept with a low mismatch penalty.
+	cigar = newCigar(&wfa.CIGARRecord{N: 10, Op: 'M'}, &wfa.CIGARRecord{N: 1, Op: 'X'},
+		&wfa.CIGARRecord{N: 4, Op: 'M'}, &wfa.CIGARRecord{N: 2, Op: 'X'})
+	c = &Chain2Result{QBegin: 0, QEnd: 16, TBegin: 200, TEnd: 216}
+	qseq, tseq = seq(17), seq(17)
+	clipAlignment(AlignExtension, AlignPenalties{Match: 2, Mismatch: 1, GapOpen: 2, GapExt: 1}, cigar, c, false, &qseq, &tseq)
+	if len(cigar.Ops) != 3 || cigar.AlignLen != 15 || cigar.Matches != 14 {
+		t.Errorf("unexpected clipped alignment: %d ops, alen: %d, matches: %d",
+			len(cigar.Ops), cigar.AlignLen, cigar.Matches)
+	}
+
+	// global: nothing changes
+	cigar = newCigar(&wfa.CIGARRecord{N: 2, Op: 'I'}, &wfa.CIGARRecord{N: 10, Op: 'M'})
+	c = &Chain2Result{QBegin: 0, QEnd: 9, TBegin: 0, TEnd: 11}
+	clipAlignment(AlignGlobal, p, cigar, c, false, &qseq, &tseq)
+	if len(cigar.Ops) != 2 || c.TBegin != 0 {
+		t.Errorf("alignments should not be clipped in the global mode")
+	}
+}
+
+func TestAlignPenalties(t *testing.T) {
+	p := AlignPenalties{}.wfaPenalties()
+	if *p != *wfa.DefaultPenalties {
+		t.Errorf("zero-valued penalties should be the default ones: %v", *p)
+	}
+
+	p = AlignPenalties{Match: 1, Mismatch: 4, GapOpen: 6, GapExt: 2}.wfaPenalties()
+	if p.Mismatch != 10 || p.GapOpen != 12 || p.GapExt != 5 {
+		t.Errorf("unexpected converted penalties: %v", *p)
+	}
+
+	if err := CheckAlignPenalties(&AlignPenalties{Mismatch: 4, GapOpen: 6}); err == nil {
+		t.Errorf("zero gap extension penalty should be reported")
+	}
+
+	for _, name := range []string{"global", "semi-global", "extension"} {
+		m, err := ParseAlignMode(name)
+		if err != nil || m.String() != name {
+			t.Errorf("failed to parse alignment mode: %s", name)
+		}
+	}
+}
@@ -18,7 +18,7 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package cmd
+package index
 
 import (
 	"bufio"
@@ -35,6 +35,7 @@ import (
 	"time"
 
 	"github.com/pelletier/go-toml/v2"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/seedposition"
@@ -87,25 +88,36 @@ const FileGenomeIndex = "genomes.map.bin"
 // FileGenomeChunks store lists of batch+genome index of genome chunks
 const FileGenomeChunks = "genomes.chunks.bin"
 
-// batchDir returns the direcotry name of a genome batch
-func batchDir(batch int) string {
+// BatchDir returns the direcotry name of a genome batch
+func BatchDir(batch int) string {
 	return fmt.Sprintf("batch_%04d", batch)
 }
 
-// chunkFile returns the file name of a k-mer-value file
-func chunkFile(chunk int) string {
+// ChunkFile returns the file name of a k-mer-value file
+func ChunkFile(chunk int) string {
 	return fmt.Sprintf("chunk_%03d%s", chunk, ExtSeeds)
 }
 
+// FileMasksK returns the file name of the second mask set with a smaller k
+func FileMasksK(k int) string {
+	return fmt.Sprintf("masks_k%d.bin", k)
+}
+
+// DirSeedsK returns the directory name of seeds of the second mask set with a smaller k
+func DirSeedsK(k int) string {
+	return fmt.Sprintf("%s_k%d", DirSeeds, k)
+}
+
 // IndexBuildingOptions contains all options for building an LexicMap index.
 type IndexBuildingOptions struct {
 	// general
 	NumCPUs      int
-	Verbose      bool // show log
-	Log2File     bool // log file
-	Force        bool // force overwrite existed index
-	MaxOpenFiles int  // maximum opened files, used in merging indexes
-	MergeThreads int  // Maximum Concurrent Merge Jobs
+	Verbose      bool   // show log
+	Log2File     bool   // log file
+	Logger       Logger // for logging, nil for no logs
+	Force        bool   // force overwrite existed index
+	MaxOpenFiles int    // maximum opened files, used in merging indexes
+	MergeThreads int    // Maximum Concurrent Merge Jobs
 
 	MinSeqLen int // minimum sequence length, should be >= k
 
@@ -138,6 +150,18 @@ type IndexBuildingOptions struct {
 	Chunks     int // the number of chunks for storing k-mer data
 	Partitions int // the number of partitions for indexing k-mer data
 
+	NoReversedSeeds bool // do not save reversed k-mers for suffix matching, for a smaller index
+
+	// a second mask set at a smaller k, for distant homologs
+	K2     int // k-mer size of the second mask set, 0 for none
+	Masks2 int // the number of masks in the second mask set
+
+	// presence filters of k-mer-value data
+
+	SeedFilter       bool  // create presence filters of seeds
+	SeedFilterPrefix uint8 // prefix length of k-mers in the filters
+	SeedFilterBits   int   // the number of bits for each distinct prefix
+
 	// genome batches
 
 	GenomeBatchSize int // the maximum number of genomes of a batch
@@ -154,8 +178,8 @@ type IndexBuildingOptions struct {
 
 // CheckIndexBuildingOptions checks some important options
 func CheckIndexBuildingOptions(opt *IndexBuildingOptions) error {
-	if opt.K < minK || opt.K > 32 {
-		return fmt.Errorf("invalid k value: %d, valid range: [%d, 32]", opt.K, minK)
+	if opt.K < MinK || opt.K > 32 {
+		return fmt.Errorf("invalid k value: %d, valid range: [%d, 32]", opt.K, MinK)
 	}
 	if opt.Masks < 64 {
 		return fmt.Errorf("invalid numer of masks: %d, should be >=64", opt.Masks)
@@ -176,6 +200,24 @@ func CheckIndexBuildingOptions(opt *IndexBuildingOptions) error {
 		return fmt.Errorf("invalid numer of partitions in indexing k-mer data: %d, should be >=1", opt.Partitions)
 	}
 
+	if opt.K2 > 0 {
+		if opt.K2 < MinK || opt.K2 >= opt.K {
+			return fmt.Errorf("invalid k value of the second mask set: %d, valid range: [%d, %d)", opt.K2, MinK, opt.K)
+		}
+		if opt.Masks2 < 64 {
+			return fmt.Errorf("invalid numer of masks in the second mask set: %d, should be >=64", opt.Masks2)
+		}
+	}
+
+	if opt.SeedFilter {
+		if opt.SeedFilterPrefix < 5 || int(opt.SeedFilterPrefix) > opt.K {
+			return fmt.Errorf("invalid prefix length of seed filters: %d, valid range: [5, %d]", opt.SeedFilterPrefix, opt.K)
+		}
+		if opt.SeedFilterBits < 1 {
+			return fmt.Errorf("invalid bits of each key in seed filters: %d, should be >=1", opt.SeedFilterBits)
+		}
+	}
+
 	if opt.GenomeBatchSize < 1 || opt.GenomeBatchSize > 1<<17 {
 		return fmt.Errorf("invalid genome batch size: %d, valid range: [1, %d]", opt.GenomeBatchSize, 1<<BITS_BATCH_IDX)
 	}
@@ -206,6 +248,8 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 	// 	return err
 	// }
 
+	log := getLogger(opt.Logger)
+
 	if opt.Verbose || opt.Log2File {
 		log.Info()
 		log.Infof("--------------------- [ generating masks ] ---------------------")
@@ -221,7 +265,9 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 			log.Infof("reading masks from file: %s", opt.MaskFile)
 		}
 		lh, err = lexichash.NewFromTextFile(opt.MaskFile)
-		checkError(err)
+		if err != nil {
+			return err
+		}
 		if len(lh.Masks) < 64 {
 			return fmt.Errorf("invalid numer of masks: %d, should be >=64", opt.Masks)
 		}
@@ -235,25 +281,9 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 
 	// ----------------------------------
 	// mask prefix length
-	maskPrefix := 1
-	for 1<<(maskPrefix<<1) <= len(lh.Masks) {
-		maskPrefix++
-	}
-	maskPrefix--
-	if maskPrefix < 1 {
-		maskPrefix = 1
-	}
+	maskPrefix := kv.MaskPrefix(len(lh.Masks))
 
-	anchorPrefix := 0
-	partitions := opt.Partitions
-	for partitions > 0 {
-		partitions >>= 2
-		anchorPrefix++
-	}
-	anchorPrefix--
-	if anchorPrefix < 1 {
-		anchorPrefix = 1
-	}
+	anchorPrefix := kv.AnchorPrefix(opt.Partitions)
 
 	// output failed genome
 	outputBigGenomes := opt.BigGenomeFile != ""
@@ -264,7 +294,7 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 	if outputBigGenomes {
 		outfhBG, err = os.Create(opt.BigGenomeFile)
 		if err != nil {
-			checkError(fmt.Errorf("failed to write file: %s", opt.BigGenomeFile))
+			return fmt.Errorf("failed to write file: %s", opt.BigGenomeFile)
 		}
 
 		chBG = make(chan string, opt.NumCPUs)
@@ -281,22 +311,28 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 	}
 
 	// create a lookup table for faster masking
-	lenPrefix := 1
-	for 1<<(lenPrefix<<1) <= len(lh.Masks) {
-		lenPrefix++
-	}
-	lenPrefix--
-	err = lh.IndexMasks(lenPrefix)
-	if err != nil {
-		checkError(fmt.Errorf("indexing masks: %s", err))
-	}
-	err = lh.IndexMasksWithDistinctPrefixes(lenPrefix + 1)
+	err = indexMasks(lh)
 	if err != nil {
-		checkError(fmt.Errorf("indexing masks for distinct prefixes: %s", err))
+		return err
 	}
 
 	// save mask later
 
+	// the second mask set at a smaller k
+	var ms2 *secondMaskSet
+	if opt.K2 > 0 {
+		if opt.K2 >= lh.K {
+			return fmt.Errorf("k value of the second mask set (%d) should be smaller than that of the masks (%d)", opt.K2, lh.K)
+		}
+		if opt.Verbose || opt.Log2File {
+			log.Infof("generating %d masks with k=%d for the second mask set", opt.Masks2, opt.K2)
+		}
+		ms2, err = newSecondMaskSet(opt.K2, opt.Masks2, opt.RandSeed, opt.Chunks)
+		if err != nil {
+			return err
+		}
+	}
+
 	if opt.Verbose || opt.Log2File {
 		log.Info()
 		log.Infof("--------------------- [ building index ] ---------------------")
@@ -322,10 +358,10 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 	if nBatches > 1 { // only used for > 1 batches
 		err = os.MkdirAll(tmpDir, 0755)
 		if err != nil {
-			checkError(fmt.Errorf("failed to create dir: %s", err))
+			return fmt.Errorf("failed to create dir: %s", err)
 		}
 	} else if nBatches > 1<<BITS_BATCH_IDX { // 1<<17
-		checkError(fmt.Errorf("at most %d batches supported. current: %d", 1<<BITS_BATCH_IDX, nBatches))
+		return fmt.Errorf("at most %d batches supported. current: %d", 1<<BITS_BATCH_IDX, nBatches)
 	}
 
 	var begin, end int
@@ -342,14 +378,17 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 		// outdir for this batch
 		var outdirB string
 		if nBatches > 1 {
-			outdirB = filepath.Join(tmpDir, batchDir(batch))
+			outdirB = filepath.Join(tmpDir, BatchDir(batch))
 			tmpIndexes = append(tmpIndexes, outdirB)
 		} else {
 			outdirB = outdir
 		}
 
 		// build index for this batch
-		kvChunks = buildAnIndex(lh, uint8(maskPrefix), uint8(anchorPrefix), opt, &datas, outdirB, files, batch, nBatches, outputBigGenomes, chBG)
+		kvChunks, err = buildAnIndex(lh, maskPrefix, anchorPrefix, opt, &datas, ms2, outdirB, files, batch, nBatches, outputBigGenomes, chBG)
+		if err != nil {
+			break
+		}
 	}
 
 	if outputBigGenomes {
@@ -364,8 +403,17 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 	for _, data := range datas {
 		kv.PoolKmerData.Put(data)
 	}
+	if ms2 != nil {
+		ms2.recycle()
+	}
+	if err != nil {
+		return err
+	}
 
 	if nBatches == 1 {
+		if opt.SeedFilter {
+			return CreateSeedFilters(outdir, opt.SeedFilterPrefix, opt.SeedFilterBits, opt.NumCPUs, filterLogger(opt, log))
+		}
 		return nil
 	}
 
@@ -374,7 +422,7 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 		log.Info()
 		log.Infof("merging %d indexes...", len(tmpIndexes))
 	}
-	err = mergeIndexes(lh, uint8(maskPrefix), uint8(anchorPrefix), opt, kvChunks, outdir, tmpIndexes, tmpDir, 1)
+	err = mergeIndexes(lh, maskPrefix, anchorPrefix, opt, kvChunks, ms2, outdir, tmpIndexes, tmpDir, 1)
 	if err != nil {
 		return fmt.Errorf("failed to merge indexes: %s", err)
 	}
@@ -382,12 +430,80 @@ func BuildIndex(outdir string, infiles []string, opt *IndexBuildingOptions) erro
 	// clean tmp dir
 	err = os.RemoveAll(tmpDir)
 	if err != nil {
-		checkError(fmt.Errorf("failed to remove tmp directory: %s", err))
+		return fmt.Errorf("failed to remove tmp directory: %s", err)
+	}
+
+	if opt.SeedFilter {
+		return CreateSeedFilters(outdir, opt.SeedFilterPrefix, opt.SeedFilterBits, opt.NumCPUs, filterLogger(opt, log))
 	}
 
 	return err
 }
 
+// filterLogger returns the logger for creating seed filters, nil for keeping quiet.
+func filterLogger(opt *IndexBuildingOptions, log Logger) Logger {
+	if opt.Verbose || opt.Log2File {
+		return log
+	}
+	return nil
+}
+
+// CreateSeedFilters creates presence filters for all seeds (k-mer-value data) files,
+// and records the prefix length and bits of each key in the index information file.
+// Progress is reported to log if it's not nil.
+func CreateSeedFilters(outdir string, prefix uint8, bitsPerKey int, threads int, log Logger) error {
+	fileInfo := filepath.Join(outdir, FileInfo)
+	info, err := ReadIndexInfo(fileInfo)
+	if err != nil {
+		return fmt.Errorf("failed to read info file: %s", err)
+	}
+
+	verbose := log != nil
+	if verbose {
+		log.Info()
+		log.Infof("creating presence filters of seeds with a prefix length of %d...", prefix)
+	}
+
+	var wg sync.WaitGroup
+	tokens := make(chan int, threads)
+	var _err error
+	var mu sync.Mutex
+	for chunk := 0; chunk < info.Chunks; chunk++ {
+		file := filepath.Join(outdir, DirSeeds, ChunkFile(chunk))
+		wg.Add(1)
+		tokens <- 1
+		go func(file string) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+
+			err := kv.CreateKVFilter(file, prefix, bitsPerKey)
+			if err != nil {
+				mu.Lock()
+				_err = fmt.Errorf("failed to create seed filter for %s: %s", file, err)
+				mu.Unlock()
+			}
+		}(file)
+	}
+	wg.Wait()
+	if _err != nil {
+		return _err
+	}
+
+	info.SeedFilterPrefix = int(prefix)
+	info.SeedFilterBits = bitsPerKey
+	err = WriteIndexInfo(fileInfo, info)
+	if err != nil {
+		return fmt.Errorf("failed to write info file: %s", err)
+	}
+
+	if verbose {
+		log.Infof("  finished creating seed filters for %d chunks", info.Chunks)
+	}
+	return nil
+}
+
 // ----------------------------------
 
 // BITS_BATCH_IDX is the number of bits to store the genome batch index.
@@ -445,8 +561,21 @@ const TOO_MANY_SEQS = "too_many_seqs"
 
 // build an index for the files of one batch
 func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8, opt *IndexBuildingOptions,
-	datas *[]*map[uint64]*[]uint64,
-	outdir string, files []string, batch int, nbatches int, outputBigGenomes bool, chBG chan string) int {
+	datas *[]*map[uint64]*[]uint64, ms2 *secondMaskSet,
+	outdir string, files []string, batch int, nbatches int, outputBigGenomes bool, chBG chan string) (int, error) {
+
+	log := getLogger(opt.Logger)
+
+	// errors from goroutines, only the first one is kept
+	var _err error
+	var muErr sync.Mutex
+	setErr := func(err error) {
+		muErr.Lock()
+		if _err == nil {
+			_err = err
+		}
+		muErr.Unlock()
+	}
 
 	var timeStart time.Time
 	if opt.Verbose || opt.Log2File {
@@ -459,63 +588,48 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 		}()
 	}
 
-	// process bar
-	var pbs *mpb.Progress
-	var bar *mpb.Bar
-	var chDuration chan time.Duration
-	var doneDuration chan int
-	if opt.Verbose {
-		pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(os.Stderr))
-		bar = pbs.AddBar(int64(len(files)),
-			mpb.PrependDecorators(
-				decor.Name("processed files: ", decor.WC{W: len("processed files: "), C: decor.DindentRight}),
-				decor.Name("", decor.WCSyncSpaceR),
-				decor.CountersNoUnit("%d / %d", decor.WCSyncWidth),
-			),
-			mpb.AppendDecorators(
-				decor.Name("ETA: ", decor.WC{W: len("ETA: ")}),
-				decor.EwmaETA(decor.ET_STYLE_GO, 10),
-				decor.OnComplete(decor.Name(""), ". done"),
-			),
-		)
-
-		chDuration = make(chan time.Duration, opt.NumCPUs)
-		doneDuration = make(chan int)
-		go func() {
-			for t := range chDuration {
-				bar.EwmaIncrBy(1, t)
-			}
-			doneDuration <- 1
-		}()
-	}
-
 	// -------------------------------------------------------------------
 	// dir structure
 
 	err := os.MkdirAll(outdir, 0755)
 	if err != nil {
-		checkError(fmt.Errorf("failed to create dir: %s", err))
+		return 0, fmt.Errorf("failed to create dir: %s", err)
 	}
 
 	// masks
 	fileMask := filepath.Join(outdir, FileMasks)
 	_, err = lh.WriteToFile(fileMask)
 	if err != nil {
-		checkError(fmt.Errorf("failed to write masks: %s", err))
+		return 0, fmt.Errorf("failed to write masks: %s", err)
 	}
 
 	// genomes
-	dirGenomes := filepath.Join(outdir, DirGenomes, batchDir(batch))
+	dirGenomes := filepath.Join(outdir, DirGenomes, BatchDir(batch))
 	err = os.MkdirAll(dirGenomes, 0755)
 	if err != nil {
-		checkError(fmt.Errorf("failed to create dir: %s", err))
+		return 0, fmt.Errorf("failed to create dir: %s", err)
 	}
 
 	// seeds
 	dirSeeds := filepath.Join(outdir, DirSeeds)
 	err = os.MkdirAll(dirSeeds, 0755)
 	if err != nil {
-		checkError(fmt.Errorf("failed to create dir: %s", err))
+		return 0, fmt.Errorf("failed to create dir: %s", err)
+	}
+
+	// the second mask set and its seeds
+	var dirSeeds2 string
+	if ms2 != nil {
+		_, err = ms2.lh.WriteToFile(filepath.Join(outdir, FileMasksK(ms2.lh.K)))
+		if err != nil {
+			return 0, fmt.Errorf("failed to write masks: %s", err)
+		}
+
+		dirSeeds2 = filepath.Join(outdir, DirSeedsK(ms2.lh.K))
+		err = os.MkdirAll(dirSeeds2, 0755)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create dir: %s", err)
+		}
 	}
 
 	// -------------------------------------------------------------------
@@ -525,6 +639,11 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 	for _, data := range *datas { // reset all maps
 		clear(*data)
 	}
+	if ms2 != nil {
+		for _, data := range ms2.datas {
+			clear(*data)
+		}
+	}
 
 	threadsFloat := float64(opt.NumCPUs) // just avoid repeated type conversion
 
@@ -536,7 +655,7 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 	fileGenomes := filepath.Join(dirGenomes, FileGenomes)
 	gw, err := genome.NewWriter(fileGenomes, uint32(batch))
 	if err != nil {
-		checkError(fmt.Errorf("failed to write genome file: %s", err))
+		return 0, fmt.Errorf("failed to write genome file: %s", err)
 	}
 	doneGW := make(chan int)
 
@@ -547,21 +666,65 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 		fileSeedLoc = filepath.Join(dirGenomes, FileSeedPositions)
 		locw, err = seedposition.NewWriter(fileSeedLoc, uint32(batch))
 		if err != nil {
-			checkError(fmt.Errorf("failed to write seed position file: %s", err))
+			gw.Close()
+			return 0, fmt.Errorf("failed to write seed position file: %s", err)
 		}
 	}
 
+	// genome-index mapping file
+	fileGenomeIndex := filepath.Join(outdir, FileGenomeIndex)
+	fhGI, err := os.Create(fileGenomeIndex)
+	if err != nil {
+		gw.Close()
+		if locw != nil {
+			locw.Close()
+		}
+		return 0, err
+	}
+
+	// process bar
+	var pbs *mpb.Progress
+	var bar *mpb.Bar
+	var chDuration chan time.Duration
+	var doneDuration chan int
+	if opt.Verbose {
+		pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(os.Stderr))
+		bar = pbs.AddBar(int64(len(files)),
+			mpb.PrependDecorators(
+				decor.Name("processed files: ", decor.WC{W: len("processed files: "), C: decor.DindentRight}),
+				decor.Name("", decor.WCSyncSpaceR),
+				decor.CountersNoUnit("%d / %d", decor.WCSyncWidth),
+			),
+			mpb.AppendDecorators(
+				decor.Name("ETA: ", decor.WC{W: len("ETA: ")}),
+				decor.EwmaETA(decor.ET_STYLE_GO, 10),
+				decor.OnComplete(decor.Name(""), ". done"),
+			),
+		)
+
+		chDuration = make(chan time.Duration, opt.NumCPUs)
+		doneDuration = make(chan int)
+		go func() {
+			for t := range chDuration {
+				bar.EwmaIncrBy(1, t)
+			}
+			doneDuration <- 1
+		}()
+	}
+
 	// 2.2) write genomes to file
-	var nFiles int // the total number of indexed files
+	var nFiles int   // the total number of indexed files
+	var nBases int64 // the total number of bases
 	go func() {
 
 		for refseq := range genomesW { // each genome
 			nFiles++
+			nBases += int64(refseq.GenomeSize)
 
 			// write the genome to file
-			err = gw.Write(refseq)
+			err := gw.Write(refseq)
 			if err != nil {
-				checkError(fmt.Errorf("failed to write genome: %s", err))
+				setErr(fmt.Errorf("failed to write genome: %s", err))
 			}
 
 			// --------------------------------
@@ -569,7 +732,7 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 			if opt.SaveSeedPositions {
 				err = locw.Write(*refseq.Locs)
 				if err != nil {
-					checkError(fmt.Errorf("failed to write seed position: %s", err))
+					setErr(fmt.Errorf("failed to write seed position: %s", err))
 				}
 			}
 
@@ -591,12 +754,6 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 		chunkSize := (nMasks + threads - 1) / threads
 		var j, begin, end int
 
-		// genome-index mapping file
-		fileGenomeIndex := filepath.Join(outdir, FileGenomeIndex)
-		fhGI, err := os.Create(fileGenomeIndex)
-		if err != nil {
-			checkError(fmt.Errorf("%s", err))
-		}
 		bw := bufio.NewWriter(fhGI)
 
 		var batchIDAndRefID, batchIDAndRefIDShift, refIdx uint64 // genome number
@@ -714,7 +871,7 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 
 			// ---------------------------------------------------------
 			// another round for reversed k-mers
-			for j = 0; j < threads; j++ { // each chunk for storing kmer-value data
+			for j = 0; j < threads && !opt.NoReversedSeeds; j++ { // each chunk for storing kmer-value data
 				begin = j * chunkSize
 				end = begin + chunkSize
 				if end > nMasks {
@@ -828,6 +985,12 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 
 			wg.Wait() // wait all mask chunks
 
+			// ---------------------------------------------------------
+			// k-mers captured by the second mask set
+			if ms2 != nil {
+				ms2.collect(refseq, batchIDAndRefIDShift, threads)
+			}
+
 			// wait the genome data being written
 			<-refseq.Done
 
@@ -835,6 +998,9 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 			if refseq.Kmers != nil {
 				lh.RecycleMaskResult(refseq.Kmers, refseq.Locses)
 			}
+			if refseq.Kmers2 != nil {
+				ms2.lh.RecycleMaskResult(refseq.Kmers2, refseq.Locses2)
+			}
 			genome.RecycleGenome(refseq)
 
 			if opt.Verbose && !refseq.StartTime.IsZero() {
@@ -846,7 +1012,9 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 
 		// genome index
 		bw.Flush()
-		checkError(fhGI.Close())
+		if err := fhGI.Close(); err != nil {
+			setErr(err)
+		}
 
 		// genome data
 		close(genomesW)
@@ -916,6 +1084,18 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 					_skipRegions = *skipRegions
 				}
 
+				// the genome is dropped on errors, which are returned by buildAnIndex
+				dropGenome := func(err error) {
+					setErr(fmt.Errorf("failed to mask genome %s: %s", refseq.ID, err))
+					if skipRegions != nil {
+						poolSkipRegions.Put(skipRegions)
+					}
+					if opt.Verbose && !refseq.StartTime.IsZero() {
+						chDuration <- time.Microsecond // important, or the progress bar will get hung
+					}
+					genome.RecycleGenome(refseq)
+				}
+
 				// skip gap regions (N's)
 				gaps := reGaps.FindAllSubmatchIndex(refseq.Seq, -1)
 				if gaps != nil {
@@ -950,11 +1130,21 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 				_kmers, locses, err = lh.MaskKnownDistinctPrefixes(refseq.Seq, _skipRegions, true)
 
 				if err != nil {
-					panic(err)
+					dropGenome(err)
+					return
 				}
 				refseq.Kmers = _kmers
 				refseq.Locses = locses
 
+				// the second mask set
+				if ms2 != nil {
+					refseq.Kmers2, refseq.Locses2, err = ms2.lh.MaskKnownDistinctPrefixes(refseq.Seq, _skipRegions, true)
+					if err != nil {
+						dropGenome(err)
+						return
+					}
+				}
+
 				// --------------------------------
 				// bit-packed sequences
 				refseq.TwoBit = genome.Seq2TwoBit(refseq.Seq)
@@ -1087,7 +1277,8 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 						// iterate k-mers
 						iter, err = iterator.NewKmerIterator(refseq.Seq[start:end], k)
 						if err != nil {
-							checkError(err)
+							dropGenome(err)
+							return
 						}
 
 						*kmerList = (*kmerList)[:0]
@@ -1398,7 +1589,11 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 
 			fastxReader, err := fastx.NewReader(nil, file, "")
 			if err != nil {
-				checkError(fmt.Errorf("failed to read seq file: %s", err))
+				setErr(fmt.Errorf("failed to read seq file: %s", err))
+				if opt.Verbose {
+					chDuration <- time.Microsecond // important, or the progress bar will get hung
+				}
+				return
 			}
 			defer fastxReader.Close()
 
@@ -1433,8 +1628,12 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 					if err == io.EOF {
 						break
 					}
-					checkError(fmt.Errorf("read seq %d in %s: %s", i, file, err))
-					break
+					setErr(fmt.Errorf("read seq %d in %s: %s", i, file, err))
+					genome.PoolGenome.Put(refseq)
+					if opt.Verbose {
+						chDuration <- time.Microsecond // important, or the progress bar will get hung
+					}
+					return
 				}
 
 				// filter out sequences shorter than k or minSeqLen
@@ -1636,16 +1835,33 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 	<-done // all k-mer data are collected
 
 	<-doneGW // all genome data are saved
-	checkError(gw.Close())
+
+	// process bar
+	if opt.Verbose {
+		close(chDuration)
+		<-doneDuration
+		pbs.Wait()
+	}
+
+	err = gw.Close()
+	if err != nil {
+		setErr(err)
+	}
 	if opt.SaveSeedPositions {
-		checkError(locw.Close())
+		err = locw.Close()
+		if err != nil {
+			setErr(err)
+		}
+	}
+	if _err != nil {
+		return 0, _err
 	}
 
 	// genome chunk lists
 	fileGenomeChunks := filepath.Join(outdir, FileGenomeChunks)
 	fhGC, err := os.Create(fileGenomeChunks)
 	if err != nil {
-		checkError(fmt.Errorf("%s", err))
+		return 0, err
 	}
 	bw := bufio.NewWriter(fhGC)
 	buf := make([]byte, 8)
@@ -1663,13 +1879,9 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 		}
 	}
 	bw.Flush()
-	checkError(fhGC.Close())
-
-	// process bar
-	if opt.Verbose {
-		close(chDuration)
-		<-doneDuration
-		pbs.Wait()
+	err = fhGC.Close()
+	if err != nil {
+		return 0, err
 	}
 
 	// --------------------------------
@@ -1691,15 +1903,23 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 			Chunks:     opt.Chunks,
 			Partitions: opt.Partitions,
 
+			NoReversedSeeds: opt.NoReversedSeeds,
+
 			InputGenomes:    len(mGenomeChunks), // original genome number. TODO
 			Genomes:         nFiles,
+			Bases:           nBases,
 			GenomeBatchSize: nFiles, // just for this batch
 			GenomeBatches:   1,      // just for this batch
 			ContigInterval:  opt.ContigInterval,
 		}
-		err = writeIndexInfo(filepath.Join(outdir, FileInfo), info)
+		if ms2 != nil {
+			info.K2 = uint8(ms2.lh.K)
+			info.Masks2 = len(ms2.lh.Masks)
+			info.Chunks2 = ms2.chunks
+		}
+		err := WriteIndexInfo(filepath.Join(outdir, FileInfo), info)
 		if err != nil {
-			checkError(fmt.Errorf("failed to write index summary: %s", err))
+			setErr(fmt.Errorf("failed to write index summary: %s", err))
 		}
 
 		doneInfo <- 1
@@ -1729,7 +1949,7 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 		wg.Add(1)
 		tokens <- 1
 		go func(chunk, begin, end int) { // a chunk of masks
-			file := filepath.Join(dirSeeds, chunkFile(chunk))
+			file := filepath.Join(dirSeeds, ChunkFile(chunk))
 
 			// for m, data := range (*datas)[begin:end] {
 			// 	for key, values := range data {
@@ -1742,7 +1962,7 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 
 			_, err := kv.WriteKVData(k8, begin, (*datas)[begin:end], file, uint8(maskPrefix), uint8(anchorPrefix))
 			if err != nil {
-				checkError(fmt.Errorf("failed to write seeds data: %s", err))
+				setErr(fmt.Errorf("failed to write seeds data: %s", err))
 			}
 
 			// if opt.Verbose || opt.Log2File {
@@ -1754,13 +1974,41 @@ func buildAnIndex(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 		}(j, begin, end)
 	}
 	wg.Wait() // all k-mer-value data are saved.
+
+	// seeds of the second mask set
+	if ms2 != nil {
+		k2 := uint8(ms2.lh.K)
+		nMasks2 := len(ms2.lh.Masks)
+		for j = 0; j < ms2.chunks; j++ { // each chunk
+			begin = j * ms2.chunkSize
+			end = begin + ms2.chunkSize
+			if end > nMasks2 {
+				end = nMasks2
+			}
+			wg.Add(1)
+			tokens <- 1
+			go func(chunk, begin, end int) { // a chunk of masks
+				file := filepath.Join(dirSeeds2, ChunkFile(chunk))
+
+				_, err := kv.WriteKVData(k2, begin, ms2.datas[begin:end], file, uint8(ms2.maskPrefix), uint8(anchorPrefix))
+				if err != nil {
+					setErr(fmt.Errorf("failed to write seeds data: %s", err))
+				}
+
+				wg.Done()
+				<-tokens
+			}(j, begin, end)
+		}
+		wg.Wait()
+	}
+
 	if opt.Verbose || opt.Log2File {
 		log.Infof("  finished writing seeds in %s", time.Since(timeStart2))
 	}
 
 	<-doneInfo // info file
 
-	return chunks
+	return chunks, _err
 }
 
 // IndexInfo contains summary of the index
@@ -1774,15 +2022,31 @@ type IndexInfo struct {
 	SeedDistInDesert int   `toml:"seed-dist-in-desert"`
 	Chunks           int   `toml:"chunks" comment:"Seeds (k-mer-value data) files"`
 	Partitions       int   `toml:"index-partitions"`
+	NoReversedSeeds  bool  `toml:"no-reversed-seeds" comment:"Reversed seeds for suffix matching are not saved"`
+	K2               uint8 `toml:"second-K" comment:"The second mask set with a smaller k, 0 for none"`
+	Masks2           int   `toml:"second-masks"`
+	Chunks2          int   `toml:"second-chunks"`
+	SeedFilterPrefix int   `toml:"seed-filter-prefix" comment:"Presence filters of seeds, 0 for no filters"`
+	SeedFilterBits   int   `toml:"seed-filter-bits" comment:"Bits for each distinct prefix, 0 for indexes created by older versions"`
 	InputGenomes     int   `toml:"input-genomes" comment:"Input genomes"`
 	Genomes          int   `toml:"genomes" comment:"Genome data. 'genomes' might be larger than 'input-genomes'."`
+	Bases            int64 `toml:"bases" comment:"The total number of bases in all genomes, 0 for indexes created by older versions"`
 	GenomeBatchSize  int   `toml:"genome-batch-size"`
 	GenomeBatches    int   `toml:"genome-batches"`
 	ContigInterval   int   `toml:"contig-interval"`
 }
 
-// writeIndexInfo writes summary of one index
-func writeIndexInfo(file string, info *IndexInfo) error {
+// FilterBitsPerKey returns the number of bits for each distinct prefix in the presence filters of seeds,
+// for indexes created by older versions, where it's not recorded, the default value is returned.
+func (info *IndexInfo) FilterBitsPerKey() int {
+	if info.SeedFilterBits > 0 {
+		return info.SeedFilterBits
+	}
+	return kv.DefaultFilterBitsPerKey
+}
+
+// WriteIndexInfo writes summary of one index
+func WriteIndexInfo(file string, info *IndexInfo) error {
 	fh, err := os.Create(file)
 	if err != nil {
 		return err
@@ -1790,7 +2054,8 @@ func writeIndexInfo(file string, info *IndexInfo) error {
 
 	data, err := toml.Marshal(info)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		fh.Close()
+		return err
 	}
 
 	fh.Write(data)
@@ -1798,9 +2063,9 @@ func writeIndexInfo(file string, info *IndexInfo) error {
 	return fh.Close()
 }
 
-// readIndexInfo reads summary frm a file
-func readIndexInfo(file string) (*IndexInfo, error) {
-	data, err := os.ReadFile(file)
+// ReadIndexInfo reads summary frm a file
+func ReadIndexInfo(file string) (*IndexInfo, error) {
+	data, err := bundle.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
@@ -1810,13 +2075,24 @@ func readIndexInfo(file string) (*IndexInfo, error) {
 	return v, err
 }
 
+// readMasks reads masks from a file, which might be in an index bundle.
+func readMasks(file string) (*lexichash.LexicHash, error) {
+	fh, err := bundle.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	return lexichash.Read(bufio.NewReader(fh))
+}
+
 var poolSkipRegions = &sync.Pool{New: func() interface{} {
 	tmp := make([][2]int, 0, 128)
 	return &tmp
 }}
 
-// readGenomeMapIdx2Name reads genome-index mapping file
-func readGenomeMapIdx2Name(file string) (map[uint64][]byte, error) {
+// ReadGenomeMapIdx2Name reads genome-index mapping file
+func ReadGenomeMapIdx2Name(file string) (map[uint64][]byte, error) {
 	fh, err := os.Open(file)
 	if err != nil {
 		return nil, err
@@ -1866,8 +2142,8 @@ func readGenomeMapIdx2Name(file string) (map[uint64][]byte, error) {
 	return m, nil
 }
 
-// readGenomeMap reads genome-index mapping file
-func readGenomeMapName2Idx(file string) (map[string]*[]uint64, error) {
+// ReadGenomeMapName2Idx reads genome-index mapping file
+func ReadGenomeMapName2Idx(file string) (map[string]*[]uint64, error) {
 	fh, err := os.Open(file)
 	if err != nil {
 		return nil, err
@@ -1924,8 +2200,8 @@ func readGenomeMapName2Idx(file string) (map[string]*[]uint64, error) {
 	return m, nil
 }
 
-// readGenomeList reads genome-index mapping file and return the list of genomes
-func readGenomeList(file string) ([]string, error) {
+// ReadGenomeList reads genome-index mapping file and return the list of genomes
+func ReadGenomeList(file string) ([]string, error) {
 	fh, err := os.Open(file)
 	if err != nil {
 		return nil, err
@@ -1972,10 +2248,10 @@ func readGenomeList(file string) ([]string, error) {
 	return m, nil
 }
 
-// readGenomeChunksMapBig2Small reads the genome chunkfile and return a map
+// ReadGenomeChunksMapBig2Small reads the genome chunkfile and return a map
 // with bigger batch+ref index to a smaller one.
-func readGenomeChunksMapBig2Small(file string) (map[uint64]map[uint64]interface{}, error) {
-	fh, err := os.Open(file)
+func ReadGenomeChunksMapBig2Small(file string) (map[uint64]map[uint64]interface{}, error) {
+	fh, err := bundle.Open(file)
 	if err != nil {
 		if os.IsNotExist(err) { // no file
 			return nil, nil
@@ -2038,9 +2314,9 @@ func readGenomeChunksMapBig2Small(file string) (map[uint64]map[uint64]interface{
 	return data, nil
 }
 
-// readGenomeChunksMap reads the genome chunkfile and return a map
+// ReadGenomeChunksMap reads the genome chunkfile and return a map
 // with batch+ref index as the key.
-func readGenomeChunksMap(file string) (map[uint64]interface{}, error) {
+func ReadGenomeChunksMap(file string) (map[uint64]interface{}, error) {
 	fh, err := os.Open(file)
 	if err != nil {
 		if os.IsNotExist(err) { // no file
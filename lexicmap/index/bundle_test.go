@@ -0,0 +1,102 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
+)
+
+// TestBundleFailedOpen checks that a failed opening of a bundled index
+// does not unmount the bundle used by another index.
+func TestBundleFailedOpen(t *testing.T) {
+	dir := t.TempDir()
+
+	r := rand.New(rand.NewSource(3))
+	var files []string
+	var seqs [][]byte
+	for i := 0; i < 3; i++ {
+		seq := make([]byte, 10000)
+		for j := range seq {
+			seq[j] = "ACGT"[r.Intn(4)]
+		}
+		file := filepath.Join(dir, fmt.Sprintf("g%d.fa", i))
+		if err := os.WriteFile(file, []byte(fmt.Sprintf(">c1\n%s\n", seq)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+		seqs = append(seqs, seq)
+	}
+	outDir := buildTestIndex(t, dir, files)
+
+	// break the genome data of the second batch, which is only read with genome reader pools
+	fileIndex := filepath.Join(outDir, DirGenomes, BatchDir(1), FileGenomes) + genome.GenomeIndexFileExt
+	data, err := os.ReadFile(fileIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	if err = os.WriteFile(fileIndex, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "db.lmi.tar")
+	if err = bundle.Create(outDir, file); err != nil {
+		t.Fatal(err)
+	}
+
+	// no genome reader pools
+	sopt := DefaultIndexSearchingOptions
+	sopt.NumCPUs = 2
+	sopt.MaxOpenFiles = 6
+	idx, err := NewIndexSearcher(file, &sopt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// genome reader pools
+	sopt2 := DefaultIndexSearchingOptions
+	sopt2.NumCPUs = 2
+	if _, err = NewIndexSearcher(file, &sopt2); err == nil {
+		t.Fatalf("broken genome data is not detected")
+	}
+
+	// the first index is still usable
+	sco := DefaultSeqComparatorOptions
+	sco.K = uint8(idx.K())
+	idx.SetSeqCompareOptions(&sco)
+
+	rs, err := idx.Search(seqs[0][2000:4000])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs == nil || len(*rs) != 1 || string((*rs)[0].ID) != "g0" {
+		t.Fatalf("unexpected results")
+	}
+	idx.RecycleSearchResults(rs)
+}
@@ -18,9 +18,10 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package cmd
+package index
 
 import (
+	"context"
 	"math"
 	"sync"
 )
@@ -87,6 +88,13 @@ var poolChain = &sync.Pool{New: func() interface{} {
 // Chain finds the possible seed paths.
 // Please remember to call RecycleChainingResult after using the results.
 func (ce *Chainer) Chain(subs *[]*SubstrPair) (*[]*[]int, float64) {
+	return ce.ChainContext(context.Background(), subs)
+}
+
+// ChainContext is the same as Chain, but it stops when the context is done,
+// and returns empty paths with a score of 0.
+// Please remember to call RecycleChainingResult after using the results.
+func (ce *Chainer) ChainContext(ctx context.Context, subs *[]*SubstrPair) (*[]*[]int, float64) {
 	n := len(*subs)
 
 	var sumMaxScore float64
@@ -148,6 +156,13 @@ func (ce *Chainer) Chain(subs *[]*SubstrPair) (*[]*[]int, float64) {
 	maxGap := ce.options.MaxGap
 	maxDistance := ce.options.MaxDistance
 	for i = 1; i < n; i++ {
+		// the time complexity is O(n^2), so we check it periodically.
+		if i&1023 == 0 && ctx.Err() != nil {
+			paths := poolChains.Get().(*[]*[]int)
+			*paths = (*paths)[:0]
+			return paths, 0
+		}
+
 		a = (*subs)[i]
 
 		// fmt.Printf("i:%d, a: %s\n", i, a)
@@ -18,7 +18,7 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package cmd
+package index
 
 import (
 	"math"
@@ -108,6 +108,10 @@ type Chain2Result struct {
 	AlignedLength int     // Aligned length, might be longer than AlignedBasesQ or AlignedBasesT
 	Gaps          int     // The number of gaps
 
+	Score    float64 // Alignment score under the scoring scheme
+	BitScore float64 // Bit score
+	Evalue   float64 // Expect value
+
 	QBegin, QEnd int // Query begin/end position (0-based)
 	TBegin, TEnd int // Target begin/end position (0-based)
 
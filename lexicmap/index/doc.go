@@ -0,0 +1,75 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+/*
+Package index builds and searches LexicMap indexes.
+
+The command line tool lexicmap is a thin wrapper of this package,
+so other Go programs can embed LexicMap without importing the CLI package.
+
+Building an index:
+
+	opt := &index.IndexBuildingOptions{ ... }
+	if err := index.CheckIndexBuildingOptions(opt); err != nil {
+		...
+	}
+	err := index.BuildIndex(outDir, files, opt)
+
+Searching an index:
+
+	idx, err := index.NewIndexSearcher(outDir, &index.IndexSearchingOptions{ ... })
+	if err != nil {
+		...
+	}
+	defer idx.Close()
+
+	idx.SetSeqCompareOptions(&index.SeqComparatorOptions{ ... })
+
+	results, err := idx.Search(seq)
+	if err != nil {
+		...
+	}
+	if results != nil {
+		// use results
+		idx.RecycleSearchResults(results)
+	}
+
+Some options could be changed for each search, e.g., for mixing sensitive and fast queries
+on a shared Index:
+
+	so := idx.SearchOptions() // a copy of the default values
+	so.MinPrefix = 19
+	so.TopN = 10
+	results, err = idx.SearchWithOptions(seq, so)
+
+For queries with many genome hits, results of each genome could be streamed
+as soon as its alignment is done, instead of being kept in memory until all are finished:
+
+	_, err = idx.SearchStream(ctx, seq, so, false, func(r *index.SearchResult) error {
+		// use r
+		idx.RecycleSearchResult(r)
+		return nil
+	})
+
+Functions of this package return errors instead of exiting the program.
+Messages are written to the Logger in the options, and nil means no logs.
+An Index is safe for concurrent searches.
+*/
+package index
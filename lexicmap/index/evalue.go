@@ -0,0 +1,210 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
+	"github.com/shenwei356/wfa"
+)
+
+// ScoringScheme contains scores for computing alignment scores of HSPs,
+// which are used to compute bit scores and E-values with Karlin-Altschul statistics, like BLASTN.
+// A gap of length k costs GapOpen + GapExt*k.
+// Non-affine gap costs (GapOpen and GapExt are both 0) are only supported for Match 1,
+// where a gapped base costs Match/2 + Mismatch, the same as the greedy alignment in megablast.
+type ScoringScheme struct {
+	Match    int // reward of a match, e.g., 2
+	Mismatch int // penalty of a mismatch (positive), e.g., 3
+	GapOpen  int // cost to open a gap, e.g., 5
+	GapExt   int // cost to extend a gap, e.g., 2
+}
+
+// DefaultScoringScheme is the default scoring scheme, the same as the one of the blastn task in BLAST+.
+var DefaultScoringScheme = ScoringScheme{Match: 2, Mismatch: 3, GapOpen: 5, GapExt: 2}
+
+// karlinAltschulParams contains the gapped Karlin-Altschul parameters, lambda and K,
+// of supported scoring schemes, from the tables of blastn in BLAST+ (blast_stat.c).
+var karlinAltschulParams = map[ScoringScheme][2]float64{
+	{1, 2, 0, 0}: {1.28, 0.46},
+	{1, 2, 2, 2}: {1.33, 0.62},
+	{1, 2, 1, 2}: {1.30, 0.52},
+	{1, 2, 0, 2}: {1.19, 0.34},
+	{1, 2, 3, 1}: {1.32, 0.57},
+	{1, 2, 2, 1}: {1.29, 0.49},
+	{1, 2, 1, 1}: {1.14, 0.26},
+
+	{1, 3, 0, 0}: {1.374, 0.711},
+	{1, 3, 2, 2}: {1.37, 0.70},
+	{1, 3, 1, 2}: {1.35, 0.64},
+	{1, 3, 0, 2}: {1.25, 0.42},
+	{1, 3, 2, 1}: {1.34, 0.60},
+	{1, 3, 1, 1}: {1.21, 0.34},
+
+	{1, 4, 0, 0}: {1.383, 0.738},
+	{1, 4, 1, 2}: {1.36, 0.67},
+	{1, 4, 0, 2}: {1.26, 0.43},
+	{1, 4, 2, 1}: {1.35, 0.61},
+	{1, 4, 1, 1}: {1.22, 0.35},
+
+	{2, 3, 4, 4}: {0.63, 0.42},
+	{2, 3, 2, 4}: {0.615, 0.37},
+	{2, 3, 0, 4}: {0.55, 0.21},
+	{2, 3, 3, 3}: {0.615, 0.37},
+	{2, 3, 6, 2}: {0.63, 0.42},
+	{2, 3, 5, 2}: {0.625, 0.41},
+	{2, 3, 4, 2}: {0.61, 0.35},
+	{2, 3, 2, 2}: {0.515, 0.14},
+}
+
+// CheckScoringScheme checks if a scoring scheme is supported.
+func CheckScoringScheme(ss *ScoringScheme) error {
+	if _, ok := karlinAltschulParams[*ss]; !ok {
+		return fmt.Errorf("unsupported scoring scheme (match: %d, mismatch: %d, gap open: %d, gap extension: %d), "+
+			"available ones (match/mismatch/gap open/gap extension): %s",
+			ss.Match, ss.Mismatch, ss.GapOpen, ss.GapExt, supportedScoringSchemes())
+	}
+	return nil
+}
+
+// supportedScoringSchemes returns supported scoring schemes in the format of match/mismatch/gap open/gap extension.
+func supportedScoringSchemes() string {
+	schemes := make([]string, 0, len(karlinAltschulParams))
+	for ss := range karlinAltschulParams {
+		schemes = append(schemes, fmt.Sprintf("%d/%d/%d/%d", ss.Match, ss.Mismatch, ss.GapOpen, ss.GapExt))
+	}
+	sort.Strings(schemes)
+	return strings.Join(schemes, ", ")
+}
+
+// scorer computes alignment scores, bit scores, and E-values of HSPs.
+type scorer struct {
+	ScoringScheme
+	gapBase float64 // cost of a gapped base for non-affine gap costs
+
+	lambda float64
+	lnK    float64
+
+	dbSize float64 // the total number of bases in the database
+}
+
+// newScorer creates a scorer, dbSize is the total number of bases in the database.
+func newScorer(ss *ScoringScheme, dbSize int64) (*scorer, error) {
+	if err := CheckScoringScheme(ss); err != nil {
+		return nil, err
+	}
+	params := karlinAltschulParams[*ss]
+	sc := &scorer{
+		ScoringScheme: *ss,
+		lambda:        params[0],
+		lnK:           math.Log(params[1]),
+		dbSize:        float64(dbSize),
+	}
+	if ss.GapOpen == 0 && ss.GapExt == 0 {
+		sc.gapBase = float64(ss.Match)/2 + float64(ss.Mismatch)
+	}
+	return sc, nil
+}
+
+// score computes the alignment score from CIGAR operations of WFA.
+// Operations outside of the first and last matches are ignored, the same as computing the aligned length.
+func (sc *scorer) score(ops []*wfa.CIGARRecord) float64 {
+	begin, end := -1, -1
+	for i, op := range ops {
+		if op.Op == 'M' {
+			if begin < 0 {
+				begin = i
+			}
+			end = i
+		}
+	}
+	if begin < 0 {
+		return 0
+	}
+
+	var s float64
+	for _, op := range ops[begin : end+1] {
+		s += sc.opScore(op)
+	}
+	return s
+}
+
+// opScore returns the score of a CIGAR operation of WFA.
+func (sc *scorer) opScore(op *wfa.CIGARRecord) float64 {
+	switch op.Op {
+	case 'M':
+		return float64(sc.Match) * float64(op.N)
+	case 'X':
+		return -float64(sc.Mismatch) * float64(op.N)
+	default: // gaps
+		if sc.gapBase > 0 {
+			return -sc.gapBase * float64(op.N)
+		}
+		return -float64(sc.GapOpen) - float64(sc.GapExt)*float64(op.N)
+	}
+}
+
+// pseudoScore estimates the alignment score of a pseudo alignment,
+// where all unmatched bases are treated as mismatches.
+func (sc *scorer) pseudoScore(matches, alen int) float64 {
+	return float64(sc.Match)*float64(matches) - float64(sc.Mismatch)*float64(alen-matches)
+}
+
+// evalue computes the bit score and E-value of an alignment score, qlen is the query length.
+// No edge-effect correction of the search space is applied.
+// The E-value is computed in log space and capped at math.MaxFloat64,
+// as it overflows for very low (negative) scores, and +Inf can not be encoded in JSON.
+func (sc *scorer) evalue(score float64, qlen int) (float64, float64) {
+	bits := (sc.lambda*score - sc.lnK) / math.Ln2
+	e := math.Exp(math.Log(float64(qlen)*sc.dbSize) - bits*math.Ln2)
+	return bits, math.Min(e, math.MaxFloat64)
+}
+
+// sumGenomeSizes computes the total number of bases in the genome data of an index,
+// for indexes created before the number was saved in the info file.
+func sumGenomeSizes(outDir string, batches int) (int64, error) {
+	var n int64
+	var g *genome.Genome
+	for batch := 0; batch < batches; batch++ {
+		rdr, err := genome.NewReader(filepath.Join(outDir, DirGenomes, BatchDir(batch), FileGenomes))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read genome data file: %s", err)
+		}
+		for i := 0; i < rdr.NumGenomes(); i++ {
+			g, err = rdr.GenomeInfo(i)
+			if err != nil {
+				rdr.Close()
+				return 0, fmt.Errorf("failed to read genome data file: %s", err)
+			}
+			n += int64(g.GenomeSize)
+			genome.RecycleGenome(g)
+		}
+		if err = rdr.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,76 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"math"
+	"testing"
+
+	"github.com/shenwei356/wfa"
+)
+
+func TestScorer(t *testing.T) {
+	sc, err := newScorer(&DefaultScoringScheme, 54142446)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flanking gaps are ignored
+	ops := []*wfa.CIGARRecord{
+		{N: 2, Op: 'D'},
+		{N: 100, Op: 'M'}, {N: 1, Op: 'X'}, {N: 50, Op: 'M'},
+		{N: 3, Op: 'I'}, {N: 20, Op: 'M'},
+		{N: 5, Op: 'H'},
+	}
+	if s := sc.score(ops); s != 2*170-3-(5+2*3) {
+		t.Errorf("unexpected score: %f", s)
+	}
+
+	if s := sc.pseudoScore(1539, 1542); s != 3069 {
+		t.Errorf("unexpected pseudo score: %f", s)
+	}
+
+	bits, evalue := sc.evalue(300, 1542)
+	if math.Abs(bits-271.79) > 0.01 {
+		t.Errorf("unexpected bit score: %f", bits)
+	}
+	if e := 1542 * 54142446 * math.Pow(2, -bits); math.Abs(evalue-e) > e*1e-9 {
+		t.Errorf("unexpected E-value: %g", evalue)
+	}
+
+	// E-values of very low scores do not overflow
+	if _, evalue = sc.evalue(-5000, 1542); math.IsInf(evalue, 0) || evalue != math.MaxFloat64 {
+		t.Errorf("unexpected E-value of a very low score: %g", evalue)
+	}
+
+	// non-affine gap costs
+	sc, err = newScorer(&ScoringScheme{Match: 1, Mismatch: 2}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := sc.score(ops); s != 170-2-2.5*3 {
+		t.Errorf("unexpected score with non-affine gap costs: %f", s)
+	}
+
+	if err = CheckScoringScheme(&ScoringScheme{Match: 3, Mismatch: 3, GapOpen: 5, GapExt: 2}); err == nil {
+		t.Errorf("unsupported scoring scheme should be reported")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"container/heap"
+	"context"
+	"strings"
+	"sync/atomic"
+)
+
+// Truncation records why the results of a query are truncated.
+type Truncation uint8
+
+const (
+	// TruncatedByTime means the context is done, e.g., the maximum wall time is reached.
+	TruncatedByTime Truncation = 1 << iota
+	// TruncatedByGenomes means the maximum number of candidate genomes is reached.
+	TruncatedByGenomes
+	// TruncatedByAnchors means the maximum number of anchors is reached.
+	TruncatedByAnchors
+)
+
+// String returns the reasons separated by commas, or an empty string for no truncation.
+func (t Truncation) String() string {
+	if t == 0 {
+		return ""
+	}
+	reasons := make([]string, 0, 3)
+	if t&TruncatedByTime > 0 {
+		reasons = append(reasons, "time")
+	}
+	if t&TruncatedByGenomes > 0 {
+		reasons = append(reasons, "genomes")
+	}
+	if t&TruncatedByAnchors > 0 {
+		reasons = append(reasons, "anchors")
+	}
+	return strings.Join(reasons, ",")
+}
+
+// searchLimits tracks the per-query limits in a search.
+type searchLimits struct {
+	maxGenomes int
+	maxAnchors int
+
+	// only used in the collector of seed matches
+	anchors    int
+	truncation Truncation
+	candidates idHeap // ids of candidate genomes, only used with maxGenomes
+
+	stop context.CancelFunc // for stopping seed searching
+
+	// the context without the maximum wall time, for chaining and aligning
+	// anchors collected before the time is up.
+	base context.Context
+
+	timesUp atomic.Bool // it's set in multiple goroutines
+}
+
+// accept returns the candidate genome (batch+refIdx) id of a new anchor in m,
+// and tells if the anchor is allowed.
+//
+// When the maximum number of candidate genomes is reached, a new genome replaces
+// the candidate with the largest id if its id is smaller, and the replaced one
+// is removed from m and returned for recycling. So the candidates are always
+// the matched genomes with the smallest ids, no matter in which order
+// the anchors are collected by goroutines.
+func (l *searchLimits) accept(m *map[int]*SearchResult, id int) (r *SearchResult, dropped *SearchResult, ok bool) {
+	if l.maxAnchors > 0 && l.anchors >= l.maxAnchors {
+		if l.truncation&TruncatedByAnchors == 0 {
+			l.truncation |= TruncatedByAnchors
+			l.stop() // there's no need to search more seeds
+		}
+		return nil, nil, false
+	}
+	if r, ok = (*m)[id]; !ok {
+		if l.maxGenomes > 0 {
+			if len(l.candidates) >= l.maxGenomes {
+				l.truncation |= TruncatedByGenomes
+				if id > l.candidates[0] {
+					return nil, nil, false
+				}
+				dropped = (*m)[l.candidates[0]]
+				delete(*m, l.candidates[0])
+				l.candidates[0] = id
+				heap.Fix(&l.candidates, 0)
+			} else {
+				heap.Push(&l.candidates, id)
+			}
+		}
+		r = newSearchResult(id)
+		(*m)[id] = r
+	}
+	l.anchors++
+	return r, dropped, true
+}
+
+// timeUp checks if the context is done, and records it.
+func (l *searchLimits) timeUp(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		l.timesUp.Store(true)
+		return true
+	}
+	return false
+}
+
+// result returns the reasons of truncation.
+func (l *searchLimits) result() Truncation {
+	if l.timesUp.Load() {
+		return l.truncation | TruncatedByTime
+	}
+	return l.truncation
+}
+
+// idHeap is a max-heap of genome ids.
+type idHeap []int
+
+func (h idHeap) Len() int           { return len(h) }
+func (h idHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h idHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *idHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+
+func (h *idHeap) Pop() interface{} {
+	n := len(*h) - 1
+	x := (*h)[n]
+	*h = (*h)[:n]
+	return x
+}
@@ -0,0 +1,74 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// TestSearchLimitsGenomes checks that candidate genomes are the ones with
+// the smallest ids, no matter in which order anchors come.
+func TestSearchLimitsGenomes(t *testing.T) {
+	ids := make([]int, 0, 200)
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 4; j++ { // 4 anchors per genome
+			ids = append(ids, i*7+3)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for run := 0; run < 10; run++ {
+		r.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+
+		limits := &searchLimits{maxGenomes: 10}
+		m := poolSearchResultsMap.Get().(*map[int]*SearchResult)
+		clear(*m)
+		for _, id := range ids {
+			sr, dropped, ok := limits.accept(m, id)
+			if dropped != nil {
+				poolSearchResult.Put(dropped)
+			}
+			if !ok {
+				continue
+			}
+			*sr.Subs = append(*sr.Subs, &SubstrPair{})
+		}
+
+		if limits.result() != TruncatedByGenomes {
+			t.Errorf("unexpected truncation: %s", limits.result())
+		}
+		keys := make([]int, 0, len(*m))
+		for id, sr := range *m {
+			keys = append(keys, id)
+			if len(*sr.Subs) != 4 {
+				t.Errorf("unexpected number of anchors of genome %d: %d", id, len(*sr.Subs))
+			}
+		}
+		sort.Ints(keys)
+		expected := []int{3, 10, 17, 24, 31, 38, 45, 52, 59, 66}
+		if !slices.Equal(keys, expected) {
+			t.Fatalf("unexpected candidate genomes: %v, expected: %v", keys, expected)
+		}
+	}
+}
@@ -18,7 +18,7 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package cmd
+package index
 
 import (
 	"bufio"
@@ -36,8 +36,10 @@ import (
 )
 
 // mergeIndexes merge multiple indexes to a big one
-func mergeIndexes(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8, opt *IndexBuildingOptions, kvChunks int,
+func mergeIndexes(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8, opt *IndexBuildingOptions, kvChunks int, ms2 *secondMaskSet,
 	outdir string, paths []string, tmpDir string, round int) error {
+	log := getLogger(opt.Logger)
+
 	timeStart := time.Now()
 	if opt.Verbose || opt.Log2File {
 		log.Infof("  [round %d]", round)
@@ -58,6 +60,28 @@ func mergeIndexes(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 
 	var pathB []string
 
+	// errors from goroutines, only the first one is kept
+	var _err error
+	var muErr sync.Mutex
+	setErr := func(err error) {
+		muErr.Lock()
+		if _err == nil {
+			_err = err
+		}
+		muErr.Unlock()
+	}
+
+	// seeds directories to merge
+	type seedsDir struct {
+		dir        string
+		chunks     int
+		maskPrefix uint8
+	}
+	seedsDirs := []seedsDir{{DirSeeds, kvChunks, maskPrefix}}
+	if ms2 != nil {
+		seedsDirs = append(seedsDirs, seedsDir{DirSeedsK(ms2.lh.K), ms2.chunks, ms2.maskPrefix})
+	}
+
 	for j = 0; j < batches; j++ { // each chunk for storing kmer-value data
 		begin = j * chunkSize
 		end = begin + chunkSize
@@ -88,110 +112,49 @@ func mergeIndexes(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 
 		err := os.MkdirAll(outdir1, 0755)
 		if err != nil {
-			checkError(fmt.Errorf("failed to create dir: %s", err))
+			return fmt.Errorf("failed to create dir: %s", err)
 		}
 
 		// seeds
-		dirSeeds := filepath.Join(outdir1, DirSeeds)
-		err = os.MkdirAll(dirSeeds, 0755)
-		if err != nil {
-			checkError(fmt.Errorf("failed to create dir: %s", err))
+		for _, sd := range seedsDirs {
+			err = os.MkdirAll(filepath.Join(outdir1, sd.dir), 0755)
+			if err != nil {
+				return fmt.Errorf("failed to create dir: %s", err)
+			}
 		}
 
 		// genomes
 		dirGenomes := filepath.Join(outdir1, DirGenomes)
 		err = os.MkdirAll(dirGenomes, 0755)
 		if err != nil {
-			checkError(fmt.Errorf("failed to create dir: %s", err))
+			return fmt.Errorf("failed to create dir: %s", err)
 		}
 
 		// --------------------------------------------------------------------
 		// kmer-value data
 
-		for chunk := 0; chunk < kvChunks; chunk++ {
-			tokens <- 1
-			wg.Add(1)
-
-			go func(chunk int) {
-				defer func() {
-					wg.Done()
-					<-tokens
-				}()
-
-				var rdr *kv.Reader
-				var i int
-				var kmer uint64
-				var values, values1 *[]uint64
-				var ok bool
-
-				// read information from an existing index file
-				fileIdx := filepath.Join(pathB[0], DirSeeds, chunkFile(chunk)+kv.KVIndexFileExt)
-				rdrIdx, err := kv.NewIndexReader(fileIdx)
-				if err != nil {
-					checkError(fmt.Errorf("failed to read info from an index file: %s", err))
-				}
+		for _, sd := range seedsDirs {
+			for chunk := 0; chunk < sd.chunks; chunk++ {
+				tokens <- 1
+				wg.Add(1)
 
-				// outfile
-				file := filepath.Join(dirSeeds, chunkFile(chunk))
-				wtr, err := kv.NewWriter(rdrIdx.K, rdrIdx.ChunkIndex, rdrIdx.ChunkSize, file, maskPrefix, anchorPrefix)
-				if err != nil {
-					checkError(fmt.Errorf("failed to write a k-mer data file: %s", err))
-				}
+				go func(sd seedsDir, chunk int) {
+					defer func() {
+						wg.Done()
+						<-tokens
+					}()
 
-				rdrs := make([]*kv.Reader, len(pathB))
-				for i, db := range pathB {
-					rdrs[i], err = kv.NewReader(filepath.Join(db, DirSeeds, chunkFile(chunk)))
+					err := mergeSeedsChunk(pathB, filepath.Join(outdir1, sd.dir), sd.dir, chunk, sd.maskPrefix, anchorPrefix)
 					if err != nil {
-						checkError(fmt.Errorf("failed to read kv-data file: %s", err))
-					}
-				}
-
-				m := kv.PoolKmerData.Get().(*map[uint64]*[]uint64)
-				for c := 0; c < rdrIdx.ChunkSize; c++ { // for all mask
-					clear(*m)
-
-					for i, rdr = range rdrs {
-						m1, err := rdr.ReadDataOfAMaskAsMap()
-						if err != nil {
-							checkError(fmt.Errorf("failed to read data of mask %d from file %s: %s",
-								c+rdr.ChunkIndex, pathB[i], err))
-						}
-
-						for kmer, values1 = range *m1 {
-							if values, ok = (*m)[kmer]; !ok {
-								tmp := make([]uint64, 0, len(*values1))
-								values = &tmp
-								(*m)[kmer] = values
-							}
-							*values = append(*values, (*values1)...)
-						}
-						kv.RecycleKmerData(m1)
+						setErr(err)
 					}
-
-					err = wtr.WriteDataOfAMask(*m)
-					if err != nil {
-						checkError(fmt.Errorf("failed to write to k-mer data file: %s", err))
-					}
-				}
-				kv.RecycleKmerData(m)
-
-				for _, rdr = range rdrs {
-					err = rdr.Close()
-					if err != nil {
-						checkError(fmt.Errorf("failed to close kv-data file: %s", err))
-					}
-				}
-
-				rdrIdx.Close()
-
-				err = wtr.Close()
-				if err != nil {
-					checkError(fmt.Errorf("failed to close kv-data file: %s", err))
-				}
-
-			}(chunk)
+				}(sd, chunk)
+			}
 		}
 		wg.Wait()
+		if _err != nil {
+			return _err
+		}
 
 		// -------------------------------------------------------------------
 		// genomes/, just move
@@ -202,14 +165,14 @@ func mergeIndexes(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 			dirGenomesIn = filepath.Join(db, DirGenomes)
 			files, err = os.ReadDir(dirGenomesIn)
 			if err != nil {
-				checkError(fmt.Errorf("failed to read genome dir: %s", err))
+				return fmt.Errorf("failed to read genome dir: %s", err)
 			}
 			for _, file = range files {
 				dirG = file.Name()
 				if file.IsDir() && strings.HasPrefix(dirG, "batch_") {
 					err = os.Rename(filepath.Join(dirGenomesIn, dirG), filepath.Join(dirGenomes, dirG))
 					if err != nil {
-						checkError(fmt.Errorf("failed to move genome data"))
+						return fmt.Errorf("failed to move genome data")
 					}
 				}
 			}
@@ -219,86 +182,97 @@ func mergeIndexes(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 		// genomes.map.bin, just concatenate them
 		fh, err := os.Create(filepath.Join(outdir1, FileGenomeIndex))
 		if err != nil {
-			checkError(fmt.Errorf("failed to write genome index mapping file: %s", err))
+			return fmt.Errorf("failed to write genome index mapping file: %s", err)
 		}
 		bw := bufio.NewWriter(fh)
 		for _, db := range pathB {
 			fh1, err := os.Open(filepath.Join(db, FileGenomeIndex))
 			if err != nil {
-				checkError(fmt.Errorf("failed to open genome index mapping file: %s", err))
+				return fmt.Errorf("failed to open genome index mapping file: %s", err)
 			}
 			br := bufio.NewReader(fh1)
 			_, err = io.Copy(bw, br)
 			if err != nil {
-				checkError(fmt.Errorf("failed to copy genome index mapping data: %s", err))
+				return fmt.Errorf("failed to copy genome index mapping data: %s", err)
 			}
 			err = fh1.Close()
 			if err != nil {
-				checkError(fmt.Errorf("failed to close genome index mapping file: %s", err))
+				return fmt.Errorf("failed to close genome index mapping file: %s", err)
 			}
 		}
 		bw.Flush()
 		err = fh.Close()
 		if err != nil {
-			checkError(fmt.Errorf("failed to close genome index mapping file: %s", err))
+			return fmt.Errorf("failed to close genome index mapping file: %s", err)
 		}
 
 		// -------------------------------------------------------------------
 		// genomes.chunks.bin, just concatenate them
 		fh, err = os.Create(filepath.Join(outdir1, FileGenomeChunks))
 		if err != nil {
-			checkError(fmt.Errorf("failed to write genome chunk list file: %s", err))
+			return fmt.Errorf("failed to write genome chunk list file: %s", err)
 		}
 		bw.Reset(fh)
 		for _, db := range pathB {
 			fh1, err := os.Open(filepath.Join(db, FileGenomeChunks))
 			if err != nil {
-				checkError(fmt.Errorf("failed to open genome chunk list file: %s", err))
+				return fmt.Errorf("failed to open genome chunk list file: %s", err)
 			}
 			br := bufio.NewReader(fh1)
 			_, err = io.Copy(bw, br)
 			if err != nil {
-				checkError(fmt.Errorf("failed to copy genome chunk list data: %s", err))
+				return fmt.Errorf("failed to copy genome chunk list data: %s", err)
 			}
 			err = fh1.Close()
 			if err != nil {
-				checkError(fmt.Errorf("failed to close genome chunk list file: %s", err))
+				return fmt.Errorf("failed to close genome chunk list file: %s", err)
 			}
 		}
 		bw.Flush()
 		err = fh.Close()
 		if err != nil {
-			checkError(fmt.Errorf("failed to close genome chunk list file: %s", err))
+			return fmt.Errorf("failed to close genome chunk list file: %s", err)
 		}
 
 		// -------------------------------------------------------------------
 		// info.toml, copy one and update the genome number
-		info, err := readIndexInfo(filepath.Join(pathB[0], FileInfo))
+		info, err := ReadIndexInfo(filepath.Join(pathB[0], FileInfo))
 		if err != nil {
-			checkError(fmt.Errorf("failed to open info file: %s", err))
+			return fmt.Errorf("failed to open info file: %s", err)
 		}
 
 		for _, db := range pathB[1:] {
-			info2, err := readIndexInfo(filepath.Join(db, FileInfo))
+			info2, err := ReadIndexInfo(filepath.Join(db, FileInfo))
 			if err != nil {
-				checkError(fmt.Errorf("failed to open info file: %s", err))
+				return fmt.Errorf("failed to open info file: %s", err)
 			}
 
 			info.InputGenomes += info2.InputGenomes
 			info.Genomes += info2.Genomes
+			if info.Bases > 0 && info2.Bases > 0 {
+				info.Bases += info2.Bases
+			} else { // unknown for indexes created by older versions
+				info.Bases = 0
+			}
 			info.GenomeBatches += info2.GenomeBatches
 		}
 
-		err = writeIndexInfo(filepath.Join(outdir1, FileInfo), info)
+		err = WriteIndexInfo(filepath.Join(outdir1, FileInfo), info)
 		if err != nil {
-			checkError(fmt.Errorf("failed to write info file: %s", err))
+			return fmt.Errorf("failed to write info file: %s", err)
 		}
 
 		// -------------------------------------------------------------------
 		// masks.bin, just copy one
 		err = os.Rename(filepath.Join(pathB[0], FileMasks), filepath.Join(outdir1, FileMasks))
 		if err != nil {
-			checkError(fmt.Errorf("failed to move genome data"))
+			return fmt.Errorf("failed to move genome data")
+		}
+		if ms2 != nil {
+			err = os.Rename(filepath.Join(pathB[0], FileMasksK(ms2.lh.K)), filepath.Join(outdir1, FileMasksK(ms2.lh.K)))
+			if err != nil {
+				return fmt.Errorf("failed to move masks file")
+			}
 		}
 
 	}
@@ -316,17 +290,92 @@ func mergeIndexes(lh *lexichash.LexicHash, maskPrefix uint8, anchorPrefix uint8,
 		// delete old one, actually it's empty
 		err := os.RemoveAll(outdir)
 		if err != nil {
-			checkError(fmt.Errorf("failed to remove empty directory: %s", err))
+			return fmt.Errorf("failed to remove empty directory: %s", err)
 		}
 
 		err = os.Rename(tmpIndexes[0], outdir)
 		if err != nil {
-			checkError(fmt.Errorf("failed to move index directory: %s", err))
+			return fmt.Errorf("failed to move index directory: %s", err)
 		}
 
 		return nil
 	}
 
-	mergeIndexes(lh, maskPrefix, anchorPrefix, opt, kvChunks, outdir, tmpIndexes, tmpDir, round+1)
+	return mergeIndexes(lh, maskPrefix, anchorPrefix, opt, kvChunks, ms2, outdir, tmpIndexes, tmpDir, round+1)
+}
+
+// mergeSeedsChunk merges a seeds (k-mer-value data) chunk file of multiple indexes.
+func mergeSeedsChunk(paths []string, outDir string, dirSeeds string, chunk int, maskPrefix uint8, anchorPrefix uint8) error {
+	var rdr *kv.Reader
+	var i int
+	var kmer uint64
+	var values, values1 *[]uint64
+	var ok bool
+
+	// read information from an existing index file
+	fileIdx := filepath.Join(paths[0], dirSeeds, ChunkFile(chunk)+kv.KVIndexFileExt)
+	rdrIdx, err := kv.NewIndexReader(fileIdx)
+	if err != nil {
+		return fmt.Errorf("failed to read info from an index file: %s", err)
+	}
+	defer rdrIdx.Close()
+
+	// outfile
+	file := filepath.Join(outDir, ChunkFile(chunk))
+	wtr, err := kv.NewWriter(rdrIdx.K, rdrIdx.ChunkIndex, rdrIdx.ChunkSize, file, maskPrefix, anchorPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to write a k-mer data file: %s", err)
+	}
+
+	rdrs := make([]*kv.Reader, 0, len(paths))
+	defer func() {
+		for _, rdr := range rdrs {
+			rdr.Close()
+		}
+	}()
+	for _, db := range paths {
+		rdr, err = kv.NewReader(filepath.Join(db, dirSeeds, ChunkFile(chunk)))
+		if err != nil {
+			wtr.Close()
+			return fmt.Errorf("failed to read kv-data file: %s", err)
+		}
+		rdrs = append(rdrs, rdr)
+	}
+
+	m := kv.PoolKmerData.Get().(*map[uint64]*[]uint64)
+	defer kv.RecycleKmerData(m)
+	for c := 0; c < rdrIdx.ChunkSize; c++ { // for all mask
+		clear(*m)
+
+		for i, rdr = range rdrs {
+			m1, err := rdr.ReadDataOfAMaskAsMap()
+			if err != nil {
+				wtr.Close()
+				return fmt.Errorf("failed to read data of mask %d from file %s: %s",
+					c+rdr.ChunkIndex, paths[i], err)
+			}
+
+			for kmer, values1 = range *m1 {
+				if values, ok = (*m)[kmer]; !ok {
+					tmp := make([]uint64, 0, len(*values1))
+					values = &tmp
+					(*m)[kmer] = values
+				}
+				*values = append(*values, (*values1)...)
+			}
+			kv.RecycleKmerData(m1)
+		}
+
+		err = wtr.WriteDataOfAMask(*m)
+		if err != nil {
+			wtr.Close()
+			return fmt.Errorf("failed to write to k-mer data file: %s", err)
+		}
+	}
+
+	err = wtr.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close kv-data file: %s", err)
+	}
 	return nil
 }
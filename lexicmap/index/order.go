@@ -0,0 +1,109 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import "bytes"
+
+// Genome hits and HSPs are collected from concurrent goroutines and map iteration,
+// so their orders are not stable between runs. The functions below define deterministic
+// total orders, which are used for both choosing the top N genomes and ordering the output.
+
+// lessChainedGenome tells if a genome hit ranks before another one after seed chaining,
+// which is used to choose the top N genomes: a higher chaining score goes first,
+// then the genome batch and the genome index.
+func lessChainedGenome(a, b *SearchResult) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return lessGenomeIndex(a, b)
+}
+
+// lessGenomeIndex compares the genome batch and then the genome index, which are unique for each genome (chunk).
+func lessGenomeIndex(a, b *SearchResult) bool {
+	if a.GenomeBatch != b.GenomeBatch {
+		return a.GenomeBatch < b.GenomeBatch
+	}
+	return a.GenomeIndex < b.GenomeIndex
+}
+
+// lessSearchResult tells if a genome hit ranks before another one in the final result:
+// a higher score (qcovHSP*pident) of the best alignment goes first,
+// then a higher query coverage per genome, then the genome batch and the genome index,
+// then the positions of the best alignment.
+// HSPs of the two results should have been sorted with lessSimilarityDetail.
+func lessSearchResult(a, b *SearchResult) bool {
+	sa, sb := (*a.SimilarityDetails)[0], (*b.SimilarityDetails)[0]
+	if sa.SimilarityScore != sb.SimilarityScore {
+		return sa.SimilarityScore > sb.SimilarityScore
+	}
+	if a.AlignedFraction != b.AlignedFraction {
+		return a.AlignedFraction > b.AlignedFraction
+	}
+	if a.GenomeBatch != b.GenomeBatch || a.GenomeIndex != b.GenomeIndex {
+		return lessGenomeIndex(a, b)
+	}
+	return lessSimilarityDetail(sa, sb)
+}
+
+// lessSimilarityDetail tells if HSPs in a subject sequence rank before other ones in the same genome:
+// a higher score (qcovHSP*pident) goes first, then the subject sequence ID,
+// the positions of the first HSP, and the strand (+ first).
+func lessSimilarityDetail(a, b *SimilarityDetail) bool {
+	if a.SimilarityScore != b.SimilarityScore {
+		return a.SimilarityScore > b.SimilarityScore
+	}
+	if c := bytes.Compare(a.SeqID, b.SeqID); c != 0 {
+		return c < 0
+	}
+	ca, cb := firstChain2Result(a), firstChain2Result(b)
+	if ca == nil || cb == nil {
+		if ca != cb {
+			return ca != nil
+		}
+		return !a.RC && b.RC
+	}
+	if ca.TBegin != cb.TBegin {
+		return ca.TBegin < cb.TBegin
+	}
+	if ca.TEnd != cb.TEnd {
+		return ca.TEnd < cb.TEnd
+	}
+	if ca.QBegin != cb.QBegin {
+		return ca.QBegin < cb.QBegin
+	}
+	if ca.QEnd != cb.QEnd {
+		return ca.QEnd < cb.QEnd
+	}
+	return !a.RC && b.RC
+}
+
+// firstChain2Result returns the first HSP of a subject sequence, nil for none.
+func firstChain2Result(sd *SimilarityDetail) *Chain2Result {
+	if sd.Similarity == nil || sd.Similarity.Chains == nil {
+		return nil
+	}
+	for _, c := range *sd.Similarity.Chains {
+		if c != nil {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// TestSearchOrder checks that repeated searches produce identical results,
+// where all genomes are identical and each genome has multiple identical HSPs,
+// so the order only depends on tie-breaking.
+func TestSearchOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	r := rand.New(rand.NewSource(1))
+	seq := make([]byte, 30000)
+	for i := range seq {
+		seq[i] = "ACGT"[r.Intn(4)]
+	}
+	query := seq[5000:7000]
+
+	// contig 1 has two copies of the query, and contig 2 has one on the negative strand
+	contig1 := append(append(append([]byte{}, seq[:20000]...), query...), seq[20000:]...)
+	contig2 := append(append(append([]byte{}, seq[10000:15000]...), RC(append([]byte{}, query...))...), seq[15000:18000]...)
+
+	var files []string
+	for i := 0; i < 7; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("g%d.fa", i))
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, ">c1\n%s\n>c2\n%s\n", contig1, contig2)
+		if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	outDir := buildTestIndex(t, dir, files)
+
+	sopt := DefaultIndexSearchingOptions
+	sopt.NumCPUs = 4
+	sopt.TopN = 3
+	sopt.MoreAccurateAlignment = true
+	idx, err := NewIndexSearcher(outDir, &sopt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	idx.SetSeqCompareOptions(testSeqCompareOptions(idx.K()))
+
+	var expected string
+	for i := 0; i < 20; i++ {
+		rs, err := idx.Search(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs == nil {
+			t.Fatalf("no hits found")
+		}
+
+		var buf bytes.Buffer
+		for _, r := range *rs {
+			fmt.Fprintf(&buf, "%s %d %d %.3f\n", r.ID, r.GenomeBatch, r.GenomeIndex, r.AlignedFraction)
+			for _, sd := range *r.SimilarityDetails {
+				for _, c := range *sd.Similarity.Chains {
+					if c != nil {
+						fmt.Fprintf(&buf, "  %s %v %d-%d %d-%d %.3f\n", sd.SeqID, sd.RC,
+							c.QBegin, c.QEnd, c.TBegin, c.TEnd, c.PIdent)
+					}
+				}
+			}
+		}
+		if len(*rs) != 3 {
+			t.Errorf("unexpected number of genomes: %d", len(*rs))
+		}
+		idx.RecycleSearchResults(rs)
+
+		if i == 0 {
+			expected = buf.String()
+			t.Logf("result:\n%s", expected)
+			continue
+		}
+		if buf.String() != expected {
+			t.Fatalf("results of run %d differ from the first one:\n%s\nvs\n%s", i+1, buf.String(), expected)
+		}
+	}
+}
+
+// testSeqCompareOptions returns options of sequence comparison for searching
+// indexes built by buildTestIndex.
+func testSeqCompareOptions(k int) *SeqComparatorOptions {
+	sco := DefaultSeqComparatorOptions
+	sco.K = uint8(k)
+	sco.Chaining2Options = Chaining2Options{MaxGap: 20, MinScore: 50, MinAlignLen: 50, MinIdentity: 70, Band: 50}
+	sco.MinIdentity = 70
+	return &sco
+}
+
+// buildTestIndex builds an index of small genomes in dir, and returns the index directory.
+func buildTestIndex(t *testing.T, dir string, files []string) string {
+	outDir := filepath.Join(dir, "db.lmi")
+	bopt := &IndexBuildingOptions{
+		NumCPUs:      4,
+		MaxOpenFiles: 64,
+		MergeThreads: 1,
+
+		MinSeqLen:     31,
+		MaxGenomeSize: MAX_GENOME_SIZE,
+
+		K:        31,
+		Masks:    1000,
+		RandSeed: 1,
+
+		DesertMaxLen:           200,
+		DesertExpectedSeedDist: 50,
+		DesertSeedPosRange:     25,
+
+		Chunks:     4,
+		Partitions: 16,
+
+		GenomeBatchSize: 2,
+
+		ReRefName:      regexp.MustCompile(`(.+)\.fa$`),
+		ContigInterval: 1000,
+	}
+	if err := CheckIndexBuildingOptions(bopt); err != nil {
+		t.Fatal(err)
+	}
+	if err := BuildIndex(outDir, files, bopt); err != nil {
+		t.Fatal(err)
+	}
+	return outDir
+}
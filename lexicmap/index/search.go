@@ -18,12 +18,12 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package cmd
+package index
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
@@ -31,7 +31,10 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
 	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
 	"github.com/shenwei356/kmers"
@@ -45,12 +48,14 @@ import (
 type IndexSearchingOptions struct {
 	// general
 	NumCPUs      int
-	Verbose      bool // show log
-	Log2File     bool // log file
-	MaxOpenFiles int  // maximum opened files, used in merging indexes
+	Verbose      bool   // show log
+	Log2File     bool   // log file
+	Logger       Logger // for logging, nil for no logs
+	MaxOpenFiles int    // maximum opened files, used in merging indexes
 
 	// seed searching
 	InMemorySearch bool  // load the seed/kv data into memory
+	SeedMemBudget  int64 // load as many seed chunks into memory as the budget allows, 0 for disabling it
 	MinPrefix      uint8 // minimum prefix length, e.g., 15
 	// MaxMismatch     int   // maximum mismatch, e.g., 3
 	MinSinglePrefix uint8 // minimum prefix length of the single seed, e.g., 20
@@ -66,9 +71,28 @@ type IndexSearchingOptions struct {
 	// seq similarity
 	MinQueryAlignedFractionInAGenome float64 // minimum query aligned fraction in the target genome
 
+	// genome data
+	MmapGenomes bool // memory-map genome data files, and share one reader for each batch
+
 	// WFA alignment
 	MoreAccurateAlignment bool
 
+	// scoring scheme for computing alignment scores, bit scores, and E-values, nil for DefaultScoringScheme
+	ScoringScheme *ScoringScheme
+	MaxEvalue     float64 // maximum E-value of a HSP, 0 for no filtering
+
+	// how to use seeds of the second mask set, if the index has one
+	SecondSeedsMode int
+
+	// spill anchors of a query to temporary files when their memory exceeds the budget, 0 for disabling it
+	AnchorMemBudget int64
+	TmpDir          string // directory for temporary files, empty for the default one of the system
+
+	// per-query limits, 0 for no limits
+	MaxTime             time.Duration // maximum wall time
+	MaxCandidateGenomes int           // maximum candidate genomes
+	MaxAnchors          int           // maximum anchors (seed matches)
+
 	// Output
 	OutputSeq bool
 }
@@ -80,15 +104,116 @@ func CheckIndexSearchingOptions(opt *IndexSearchingOptions) error {
 	if opt.MaxOpenFiles < 2 {
 		return fmt.Errorf("invalid max open files: %d, should be >= 2", opt.MaxOpenFiles)
 	}
+	if opt.SeedMemBudget < 0 {
+		return fmt.Errorf("invalid seed memory budget: %d, should be >= 0", opt.SeedMemBudget)
+	}
+	if opt.AnchorMemBudget < 0 {
+		return fmt.Errorf("invalid anchor memory budget: %d, should be >= 0", opt.AnchorMemBudget)
+	}
 
 	// ------------------------
-	if opt.MinPrefix < 3 || opt.MinPrefix > 32 {
-		return fmt.Errorf("invalid MinPrefix: %d, valid range: [3, 32]", opt.MinPrefix)
+	if opt.MinPrefix < MinMinPrefix || opt.MinPrefix > 32 {
+		return fmt.Errorf("invalid MinPrefix: %d, valid range: [%d, 32]", opt.MinPrefix, MinMinPrefix)
+	}
+
+	if opt.SecondSeedsMode < SecondSeedsFallback || opt.SecondSeedsMode > SecondSeedsNone {
+		return fmt.Errorf("invalid mode of using seeds of the second mask set: %d", opt.SecondSeedsMode)
+	}
+
+	if opt.MaxTime < 0 {
+		return fmt.Errorf("invalid MaxTime: %s, should be >= 0", opt.MaxTime)
+	}
+	if opt.MaxCandidateGenomes < 0 {
+		return fmt.Errorf("invalid MaxCandidateGenomes: %d, should be >= 0", opt.MaxCandidateGenomes)
+	}
+	if opt.MaxAnchors < 0 {
+		return fmt.Errorf("invalid MaxAnchors: %d, should be >= 0", opt.MaxAnchors)
+	}
+
+	if opt.ScoringScheme != nil {
+		if err := CheckScoringScheme(opt.ScoringScheme); err != nil {
+			return err
+		}
+	}
+	if opt.MaxEvalue < 0 {
+		return fmt.Errorf("invalid MaxEvalue: %f, should be >= 0", opt.MaxEvalue)
 	}
 
 	return nil
 }
 
+// SearchOptions contains options which could be different in each search on a shared Index.
+// The default values come from IndexSearchingOptions and SeqComparatorOptions.
+type SearchOptions struct {
+	// seed searching
+	MinPrefix uint8 // minimum prefix length of matched seeds, e.g., 15
+	TopN      int   // keep the topN scores, 0 for all
+
+	// seeds chaining
+	MaxGap float64 // maximum gap in seed chaining, e.g., 5000
+
+	// alignment
+	MoreAccurateAlignment bool // false for only performing pseudo alignment
+	OutputSeq             bool // output aligned sequences
+
+	// filtering
+	MinQueryAlignedFractionInAGenome float64 // minimum query aligned fraction (percentage) in the target genome
+	MinAlignedFraction               float64 // minimum query aligned fraction (percentage) in a HSP
+	MinIdentity                      float64 // minimum percentage of identity in a HSP
+	MaxEvalue                        float64 // maximum E-value of a HSP, 0 for no filtering
+
+	// limits, 0 for no limits. Partial results are returned when any is reached.
+	// Candidate genomes are cut by genome batch and index, so results truncated by
+	// MaxCandidateGenomes are reproducible, while the ones truncated by MaxTime
+	// and MaxAnchors depend on the scheduling of goroutines.
+	MaxTime             time.Duration // maximum wall time
+	MaxCandidateGenomes int           // maximum candidate genomes
+	MaxAnchors          int           // maximum anchors (seed matches)
+}
+
+// SearchOptions returns a copy of the default per-call options.
+func (idx *Index) SearchOptions() *SearchOptions {
+	idx.muPools.Lock()
+	so := idx.searchOptions
+	idx.muPools.Unlock()
+	return &so
+}
+
+// CheckSearchOptions checks per-call options.
+func (idx *Index) CheckSearchOptions(so *SearchOptions) error {
+	if so.MinPrefix < MinMinPrefix || so.MinPrefix > idx.k8 {
+		return fmt.Errorf("invalid MinPrefix: %d, valid range: [%d, %d] (k)", so.MinPrefix, MinMinPrefix, idx.k8)
+	}
+	if so.TopN < 0 {
+		return fmt.Errorf("invalid TopN: %d, should be >= 0", so.TopN)
+	}
+	if so.MaxGap <= 0 {
+		return fmt.Errorf("invalid MaxGap: %f, should be > 0", so.MaxGap)
+	}
+	if so.MinQueryAlignedFractionInAGenome < 0 || so.MinQueryAlignedFractionInAGenome > 100 {
+		return fmt.Errorf("invalid MinQueryAlignedFractionInAGenome: %f, valid range: [0, 100]", so.MinQueryAlignedFractionInAGenome)
+	}
+	if so.MinAlignedFraction < 0 || so.MinAlignedFraction > 100 {
+		return fmt.Errorf("invalid MinAlignedFraction: %f, valid range: [0, 100]", so.MinAlignedFraction)
+	}
+	if so.MinIdentity < 0 || so.MinIdentity > 100 {
+		return fmt.Errorf("invalid MinIdentity: %f, valid range: [0, 100]", so.MinIdentity)
+	}
+	if so.MaxTime < 0 {
+		return fmt.Errorf("invalid MaxTime: %s, should be >= 0", so.MaxTime)
+	}
+	if so.MaxCandidateGenomes < 0 {
+		return fmt.Errorf("invalid MaxCandidateGenomes: %d, should be >= 0", so.MaxCandidateGenomes)
+	}
+	if so.MaxAnchors < 0 {
+		return fmt.Errorf("invalid MaxAnchors: %d, should be >= 0", so.MaxAnchors)
+	}
+	if so.MaxEvalue < 0 {
+		return fmt.Errorf("invalid MaxEvalue: %f, should be >= 0", so.MaxEvalue)
+	}
+	return nil
+}
+
 var DefaultIndexSearchingOptions = IndexSearchingOptions{
 	NumCPUs:      runtime.NumCPU(),
 	MaxOpenFiles: 512,
@@ -109,7 +234,8 @@ var DefaultIndexSearchingOptions = IndexSearchingOptions{
 // Index creates a LexicMap index from a path
 // and supports searching with query sequences.
 type Index struct {
-	path string
+	path    string
+	bundled bool // the index is a mounted bundle
 
 	openFileTokens chan int // control the max open files
 
@@ -118,10 +244,12 @@ type Index struct {
 	k  int
 	k8 uint8
 
-	// k-mer-value searchers
+	// k-mer-value searchers.
+	// With a seed memory budget, some chunks are loaded into memory,
+	// while others are still searched on disk.
 	Searchers         []*kv.Searcher
 	InMemorySearchers []*kv.InMemorySearcher
-	searcherTokens    []chan int // make sure one seachers is only used by one query
+	searcherTokens    []chan int // make sure one seachers is only used by one query, in-memory ones go first
 	poolKmers         *sync.Pool // for suffix index
 	poolLocses        *sync.Pool // for suffix index
 
@@ -130,55 +258,162 @@ type Index struct {
 
 	// for seed chaining
 	chainingOptions *ChainingOptions
-	poolChainers    *sync.Pool
 
 	// for sequence comparing
-	contigInterval    int // read from info file
-	seqCompareOption  *SeqComparatorOptions
-	poolSeqComparator *sync.Pool
-	poolChainers2     *sync.Pool
+	contigInterval   int // read from info file
+	seqCompareOption *SeqComparatorOptions
+
+	// for computing alignment scores, bit scores, and E-values
+	scorer *scorer
+
+	// default values of per-call options
+	searchOptions SearchOptions
+
+	// pools of chainers and sequence comparators, keyed by option sets,
+	// so searches with different options could share the index.
+	muPools             sync.Mutex
+	poolsChainers       map[ChainingOptions]*sync.Pool
+	poolsSeqComparators map[SeqComparatorOptions]*sync.Pool
 
 	// genome data reader
 	poolGenomeRdrs []chan *genome.Reader
 	hasGenomeRdrs  bool
 
+	// memory-mapped genome data readers, one for each batch, safe for concurrent use
+	genomeMmapRdrs    []*genome.MmapReader
+	hasGenomeMmapRdrs bool
+
+	// reversed seeds for suffix matching, which are optional
+	hasReversedSeeds bool
+
+	// the optional second mask set with a smaller k
+	hasSecondMasks     bool
+	lh2                *lexichash.LexicHash
+	k2                 int
+	Searchers2         []*kv.Searcher
+	InMemorySearchers2 []*kv.InMemorySearcher
+	searcherTokens2    []chan int
+
 	// genome chunks
 	hasGenomeChunks bool // file FileGenomeChunks exists and it's not empty
 	genomeChunks    map[uint64]map[uint64]interface{}
 }
 
-// SetSeqCompareOptions sets the sequence comparing options
+// K returns the k-mer size of the index.
+func (idx *Index) K() int {
+	return idx.k
+}
+
+// ContigInterval returns the length of intervals between contigs in the index.
+func (idx *Index) ContigInterval() int {
+	return idx.contigInterval
+}
+
+// SetSeqCompareOptions sets the sequence comparing options,
+// which are also the default values of MinAlignedFraction and MinIdentity in SearchOptions.
+// The alignment mode and penalties are logged.
+// It should be called before searching.
 func (idx *Index) SetSeqCompareOptions(sco *SeqComparatorOptions) {
+	if idx.opt.Verbose || idx.opt.Log2File {
+		getLogger(idx.opt.Logger).Infof("  alignment mode: %s, penalties (match/mismatch/gap-open/gap-ext): %s",
+			sco.AlignMode, sco.AlignPenalties.orDefault())
+	}
+
+	idx.muPools.Lock()
 	idx.seqCompareOption = sco
-	idx.poolChainers2 = &sync.Pool{New: func() interface{} {
-		return NewChainer2(&sco.Chaining2Options)
-	}}
-	idx.poolSeqComparator = &sync.Pool{New: func() interface{} {
-		return NewSeqComparator(sco, idx.poolChainers2)
-	}}
+	clear(idx.poolsSeqComparators)
+	idx.searchOptions.MinAlignedFraction = sco.MinAlignedFraction
+	idx.searchOptions.MinIdentity = sco.MinIdentity
+	idx.muPools.Unlock()
+}
+
+// maxPoolsPerOptionType limits the number of pools for distinct option sets.
+const maxPoolsPerOptionType = 64
+
+// chainerPool returns the pool of chainers for an option set.
+func (idx *Index) chainerPool(co ChainingOptions) *sync.Pool {
+	idx.muPools.Lock()
+	defer idx.muPools.Unlock()
+
+	pool, ok := idx.poolsChainers[co]
+	if !ok {
+		if len(idx.poolsChainers) >= maxPoolsPerOptionType {
+			clear(idx.poolsChainers)
+		}
+		pool = &sync.Pool{New: func() interface{} {
+			return NewChainer(&co)
+		}}
+		idx.poolsChainers[co] = pool
+	}
+	return pool
+}
+
+// seqComparatorPool returns the pool of sequence comparators for an option set.
+func (idx *Index) seqComparatorPool(sco SeqComparatorOptions) *sync.Pool {
+	idx.muPools.Lock()
+	defer idx.muPools.Unlock()
+
+	pool, ok := idx.poolsSeqComparators[sco]
+	if !ok {
+		if len(idx.poolsSeqComparators) >= maxPoolsPerOptionType {
+			clear(idx.poolsSeqComparators)
+		}
+		poolChainers2 := &sync.Pool{New: func() interface{} {
+			return NewChainer2(&sco.Chaining2Options)
+		}}
+		pool = &sync.Pool{New: func() interface{} {
+			return NewSeqComparator(&sco, poolChainers2)
+		}}
+		idx.poolsSeqComparators[sco] = pool
+	}
+	return pool
 }
 
 // NewIndexSearcher creates a new searcher
-func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (*Index, error) {
+func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (_ *Index, err error) {
+	log := getLogger(opt.Logger)
+
 	ok, err := pathutil.DirExists(outDir)
 	if err != nil {
 		return nil, err
 	}
-	if !ok {
-		return nil, fmt.Errorf("index path not found: %s", outDir)
+	var idx *Index
+	bundled := !ok
+	if bundled {
+		// a single-file index bundle, all files are read from offsets inside it
+		ok, err = bundle.IsBundle(outDir)
+		if err != nil {
+			return nil, fmt.Errorf("index path not found: %s", outDir)
+		}
+		if !ok {
+			return nil, fmt.Errorf("index path is neither a directory nor an index bundle: %s", outDir)
+		}
+		if opt.Verbose || opt.Log2File {
+			log.Infof("  mounting the index bundle...")
+		}
+		_, err = bundle.Mount(outDir)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			// the bundle is unmounted by idx.Close() if it has been called
+			if err != nil && (idx == nil || idx.bundled) {
+				bundle.Unmount(outDir)
+			}
+		}()
 	}
 
-	idx := &Index{path: outDir, opt: opt}
+	idx = &Index{path: outDir, opt: opt, bundled: bundled}
 
 	// -----------------------------------------------------
 	// info file
 	fileInfo := filepath.Join(outDir, FileInfo)
-	info, err := readIndexInfo(fileInfo)
+	info, err := ReadIndexInfo(fileInfo)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read info file: %s", err)
 	}
 	if info.MainVersion != MainVersion {
-		checkError(fmt.Errorf("index main versions do not match: %d (index) != %d (tool). please re-create the index", info.MainVersion, MainVersion))
+		return nil, fmt.Errorf("index main versions do not match: %d (index) != %d (tool). please upgrade it with \"lexicmap utils upgrade-index\" or re-create the index", info.MainVersion, MainVersion)
 	}
 
 	if idx.opt.MaxOpenFiles < info.Chunks+2 {
@@ -187,6 +422,27 @@ func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (*Index, error)
 	}
 
 	idx.contigInterval = info.ContigInterval
+	idx.hasReversedSeeds = !info.NoReversedSeeds
+
+	// database size for computing E-values
+	dbSize := info.Bases
+	if dbSize == 0 {
+		if opt.Verbose || opt.Log2File {
+			log.Infof("  computing the total number of bases for an index created by an older version...")
+		}
+		dbSize, err = sumGenomeSizes(outDir, info.GenomeBatches)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ss := opt.ScoringScheme
+	if ss == nil {
+		ss = &DefaultScoringScheme
+	}
+	idx.scorer, err = newScorer(ss, dbSize)
+	if err != nil {
+		return nil, err
+	}
 
 	// -----------------------------------------------------
 	// read masks
@@ -194,22 +450,13 @@ func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (*Index, error)
 	if opt.Verbose || opt.Log2File {
 		log.Infof("  reading masks...")
 	}
-	idx.lh, err = lexichash.NewFromFile(fileMask)
+	idx.lh, err = readMasks(fileMask)
 	if err != nil {
 		return nil, err
 	}
 
 	// create a lookup table for faster masking
-	lenPrefix := 1
-	for 1<<(lenPrefix<<1) <= len(idx.lh.Masks) {
-		lenPrefix++
-	}
-	lenPrefix--
-	err = idx.lh.IndexMasks(lenPrefix)
-	if err != nil {
-		return nil, err
-	}
-	err = idx.lh.IndexMasksWithDistinctPrefixes(lenPrefix + 1)
+	err = indexMasks(idx.lh)
 	if err != nil {
 		return nil, err
 	}
@@ -224,7 +471,7 @@ func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (*Index, error)
 	// -----------------------------------------------------
 	// read genome chunks data if existed
 	fileGenomeChunks := filepath.Join(outDir, FileGenomeChunks)
-	idx.genomeChunks, err = readGenomeChunksMapBig2Small(fileGenomeChunks)
+	idx.genomeChunks, err = ReadGenomeChunksMapBig2Small(fileGenomeChunks)
 	if err != nil {
 		return nil, err
 	}
@@ -234,26 +481,45 @@ func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (*Index, error)
 	// -----------------------------------------------------
 	// read index of seeds
 
-	inMemorySearch := idx.opt.InMemorySearch
-
 	threads := opt.NumCPUs
 	dirSeeds := filepath.Join(outDir, DirSeeds)
 	fileSeeds := make([]string, 0, 64)
-	fs.WalkDir(os.DirFS(dirSeeds), ".", func(p string, d fs.DirEntry, err error) error {
-		if filepath.Ext(p) == ExtSeeds {
-			fileSeeds = append(fileSeeds, filepath.Join(dirSeeds, p))
+	files, err := bundle.List(dirSeeds)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		if filepath.Ext(file) == ExtSeeds {
+			fileSeeds = append(fileSeeds, file)
 		}
-		return nil
-	})
+	}
 
 	if len(fileSeeds) == 0 {
 		return nil, fmt.Errorf("seeds file not found in: %s", dirSeeds)
 	}
-	if inMemorySearch {
-		idx.InMemorySearchers = make([]*kv.InMemorySearcher, 0, len(fileSeeds))
-	} else {
-		idx.Searchers = make([]*kv.Searcher, 0, len(fileSeeds))
+
+	// which seed chunks to load into memory
+	inMemory := make([]bool, len(fileSeeds))
+	var nInMemory int
+	if idx.opt.InMemorySearch {
+		for i := range inMemory {
+			inMemory[i] = true
+		}
+		nInMemory = len(fileSeeds)
+	} else if idx.opt.SeedMemBudget > 0 {
+		var memSeeds int64
+		nInMemory, memSeeds, err = selectSeedChunksForMemory(fileSeeds, idx.opt.SeedMemBudget, inMemory)
+		if err != nil {
+			return nil, err
+		}
+		if opt.Verbose || opt.Log2File {
+			log.Infof("  %d/%d seed chunks (~%s) fit in the memory budget (%s)",
+				nInMemory, len(fileSeeds), humanize.IBytes(uint64(memSeeds)), humanize.IBytes(uint64(idx.opt.SeedMemBudget)))
+		}
 	}
+
+	idx.InMemorySearchers = make([]*kv.InMemorySearcher, 0, nInMemory)
+	idx.Searchers = make([]*kv.Searcher, 0, len(fileSeeds)-nInMemory)
 	idx.searcherTokens = make([]chan int, len(fileSeeds))
 	for i := range idx.searcherTokens {
 		idx.searcherTokens[i] = make(chan int, 1)
@@ -283,72 +549,141 @@ func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (*Index, error)
 	// read indexes
 
 	if opt.Verbose || opt.Log2File {
-		if inMemorySearch {
+		if nInMemory == len(fileSeeds) {
 			log.Infof("  reading seeds (k-mer-value) data into memory...")
+		} else if nInMemory > 0 {
+			log.Infof("  reading seeds (k-mer-value) data of %d chunks into memory, and indexes of the others...", nInMemory)
 		} else {
 			log.Infof("  reading indexes of seeds (k-mer-value) data...")
 		}
 	}
 	done := make(chan int)
-	var ch chan *kv.Searcher
-	var chIM chan *kv.InMemorySearcher
+	doneIM := make(chan int)
+	ch := make(chan *kv.Searcher, threads)
+	chIM := make(chan *kv.InMemorySearcher, threads)
 
-	if inMemorySearch {
-		chIM = make(chan *kv.InMemorySearcher, threads)
-		go func() {
-			for scr := range chIM {
-				idx.InMemorySearchers = append(idx.InMemorySearchers, scr)
-			}
-			done <- 1
-		}()
-	} else {
-		ch = make(chan *kv.Searcher, threads)
-		go func() {
-			for scr := range ch {
-				idx.Searchers = append(idx.Searchers, scr)
+	go func() {
+		for scr := range chIM {
+			idx.InMemorySearchers = append(idx.InMemorySearchers, scr)
+		}
+		doneIM <- 1
+	}()
+	go func() {
+		for scr := range ch {
+			idx.Searchers = append(idx.Searchers, scr)
 
-				idx.openFileTokens <- 1 // increase the number of open files
-			}
-			done <- 1
-		}()
+			idx.openFileTokens <- 1 // increase the number of open files
+		}
+		done <- 1
+	}()
+
+	// errors from goroutines, only the first one is kept
+	var _err error
+	var muErr sync.Mutex
+	setErr := func(err error) {
+		muErr.Lock()
+		if _err == nil {
+			_err = err
+		}
+		muErr.Unlock()
 	}
+
 	var wg sync.WaitGroup
 	tokens := make(chan int, threads)
-	for _, file := range fileSeeds {
+	for i, file := range fileSeeds {
 		wg.Add(1)
 		tokens <- 1
-		go func(file string) {
+		go func(file string, inMemorySearch bool) {
+			defer func() {
+				wg.Done()
+				<-tokens
+			}()
+
 			if inMemorySearch { // read all the k-mer-value data into memory
 				scr, err := kv.NewInMemomrySearcher(file)
 				if err != nil {
-					checkError(fmt.Errorf("failed to create a in-memory searcher from file: %s: %s", file, err))
+					setErr(fmt.Errorf("failed to create a in-memory searcher from file: %s: %s", file, err))
+					return
 				}
 
 				chIM <- scr
 			} else { // just read the index data
 				scr, err := kv.NewSearcher(file)
 				if err != nil {
-					checkError(fmt.Errorf("failed to create a searcher from file: %s: %s", file, err))
+					setErr(fmt.Errorf("failed to create a searcher from file: %s: %s", file, err))
+					return
 				}
 
 				ch <- scr
 			}
-
-			wg.Done()
-			<-tokens
-		}(file)
+		}(file, inMemory[i])
 	}
 	wg.Wait()
-	if inMemorySearch {
-		close(chIM)
-	} else {
-		close(ch)
-	}
+	close(chIM)
+	close(ch)
+	<-doneIM
 	<-done
+	if _err != nil {
+		idx.Close()
+		return nil, _err
+	}
+
+	if info.SeedFilterPrefix > 0 && (opt.Verbose || opt.Log2File) {
+		if int(opt.MinPrefix) >= info.SeedFilterPrefix {
+			log.Infof("  presence filters of seeds are used")
+		} else {
+			log.Infof("  presence filters of seeds are not used, as the minimum prefix (%d) < prefix length in filters (%d)",
+				opt.MinPrefix, info.SeedFilterPrefix)
+		}
+	}
+
+	// seeds of the second mask set
+	if info.K2 > 0 && opt.SecondSeedsMode != SecondSeedsNone {
+		err = idx.readSecondMaskSet(outDir, info, len(fileSeeds)-nInMemory)
+		if err != nil {
+			idx.Close()
+			return nil, err
+		}
+	}
+
+	// we can create genome reader pools.
+	// one slot is kept for short-lived files, i.e., genome files opened without pools
+	// and temporary files of spilled anchors, which would wait forever if pools take all the slots.
+	n := (idx.opt.MaxOpenFiles - len(fileSeeds) - len(idx.Searchers2) - 1) / info.GenomeBatches
+	if opt.MmapGenomes && !genome.MmapSupported {
+		log.Warningf("  memory-mapped genome data files are not supported on this platform, flag --mmap-genomes is ignored")
+	}
+	if opt.MmapGenomes && genome.MmapSupported {
+		if opt.Verbose || opt.Log2File {
+			log.Infof("  memory-mapping genome data files of %d batches...", info.GenomeBatches)
+		}
+		idx.genomeMmapRdrs = make([]*genome.MmapReader, info.GenomeBatches)
+
+		// parallelize it
+		var wg sync.WaitGroup
+		tokens := make(chan int, opt.NumCPUs)
+		for i := 0; i < info.GenomeBatches; i++ {
+			tokens <- 1
+			wg.Add(1)
+			go func(i int) {
+				defer func() {
+					wg.Done()
+					<-tokens
+				}()
+
+				fileGenomes := filepath.Join(outDir, DirGenomes, BatchDir(i), FileGenomes)
+				rdr, err := genome.NewMmapReader(fileGenomes)
+				if err != nil {
+					setErr(fmt.Errorf("failed to create genome reader: %s", err))
+					return
+				}
+				idx.genomeMmapRdrs[i] = rdr
+			}(i)
+		}
+		wg.Wait()
 
-	// we can create genome reader pools
-	n := (idx.opt.MaxOpenFiles - len(fileSeeds)) / info.GenomeBatches
-	if n < 2 {
+		idx.hasGenomeMmapRdrs = true
+	} else if n < 2 {
 	} else {
 		if n > opt.NumCPUs {
 			n = opt.NumCPUs
@@ -369,17 +704,20 @@ func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (*Index, error)
 				tokens <- 1
 				wg.Add(1)
 				go func(i int) {
-					fileGenomes := filepath.Join(outDir, DirGenomes, batchDir(i), FileGenomes)
+					defer func() {
+						wg.Done()
+						<-tokens
+					}()
+
+					fileGenomes := filepath.Join(outDir, DirGenomes, BatchDir(i), FileGenomes)
 					rdr, err := genome.NewReader(fileGenomes)
 					if err != nil {
-						checkError(fmt.Errorf("failed to create genome reader: %s", err))
+						setErr(fmt.Errorf("failed to create genome reader: %s", err))
+						return
 					}
 					idx.poolGenomeRdrs[i] <- rdr
 
 					idx.openFileTokens <- 1 // genome file
-
-					wg.Done()
-					<-tokens
 				}(i)
 			}
 		}
@@ -387,6 +725,10 @@ func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (*Index, error)
 
 		idx.hasGenomeRdrs = true
 	}
+	if _err != nil {
+		idx.Close()
+		return nil, _err
+	}
 
 	// other resources
 	co := &ChainingOptions{
@@ -397,35 +739,104 @@ func NewIndexSearcher(outDir string, opt *IndexSearchingOptions) (*Index, error)
 		MaxDistance: opt.MaxDistance,
 	}
 	idx.chainingOptions = co
-	idx.poolChainers = &sync.Pool{New: func() interface{} {
-		return NewChainer(co)
-	}}
+	idx.poolsChainers = make(map[ChainingOptions]*sync.Pool, 4)
+	idx.poolsSeqComparators = make(map[SeqComparatorOptions]*sync.Pool, 4)
+
+	idx.searchOptions = SearchOptions{
+		MinPrefix: opt.MinPrefix,
+		TopN:      opt.TopN,
+		MaxGap:    opt.MaxGap,
+
+		MoreAccurateAlignment: opt.MoreAccurateAlignment,
+		OutputSeq:             opt.OutputSeq,
+
+		MinQueryAlignedFractionInAGenome: opt.MinQueryAlignedFractionInAGenome,
+		MaxEvalue:                        opt.MaxEvalue,
+
+		MaxTime:             opt.MaxTime,
+		MaxCandidateGenomes: opt.MaxCandidateGenomes,
+		MaxAnchors:          opt.MaxAnchors,
+	}
 
 	return idx, nil
 }
 
+// selectSeedChunksForMemory marks seed chunks which could be loaded into memory
+// within the memory budget. Smaller chunks are chosen first to load as many chunks as possible.
+// It returns the number of chosen chunks and the estimated memory.
+func selectSeedChunksForMemory(fileSeeds []string, budget int64, inMemory []bool) (int, int64, error) {
+	sizes := make([]int64, len(fileSeeds))
+	orders := make([]int, len(fileSeeds))
+	for i, file := range fileSeeds {
+		size, err := kv.InMemorySizeUpperBound(file)
+		if err != nil {
+			return 0, 0, err
+		}
+		sizes[i] = size
+		orders[i] = i
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if sizes[orders[i]] == sizes[orders[j]] {
+			return orders[i] < orders[j]
+		}
+		return sizes[orders[i]] < sizes[orders[j]]
+	})
+
+	var n int
+	var mem int64
+	for _, i := range orders {
+		if mem+sizes[i] > budget {
+			break
+		}
+		mem += sizes[i]
+		inMemory[i] = true
+		n++
+	}
+	return n, mem, nil
+}
+
 // Close closes the searcher.
 func (idx *Index) Close() error {
 	var _err error
 
 	// seed data
-	if idx.opt.InMemorySearch {
-		for _, scr := range idx.InMemorySearchers {
-			err := scr.Close()
-			if err != nil {
-				_err = err
-			}
+	for _, scr := range idx.InMemorySearchers {
+		err := scr.Close()
+		if err != nil {
+			_err = err
 		}
-	} else {
-		for _, scr := range idx.Searchers {
-			err := scr.Close()
+	}
+	for _, scr := range idx.Searchers {
+		err := scr.Close()
+		if err != nil {
+			_err = err
+		}
+	}
+	for _, scr := range idx.InMemorySearchers2 {
+		err := scr.Close()
+		if err != nil {
+			_err = err
+		}
+	}
+	for _, scr := range idx.Searchers2 {
+		err := scr.Close()
+		if err != nil {
+			_err = err
+		}
+	}
+
+	// genome reader
+	if idx.hasGenomeMmapRdrs {
+		for _, rdr := range idx.genomeMmapRdrs {
+			if rdr == nil { // failed to create
+				continue
+			}
+			err := rdr.Close()
 			if err != nil {
 				_err = err
 			}
 		}
 	}
-
-	// genome reader
 	if idx.hasGenomeRdrs {
 		var wg sync.WaitGroup
 		for _, pool := range idx.poolGenomeRdrs {
@@ -443,9 +854,35 @@ func (idx *Index) Close() error {
 		}
 		wg.Wait()
 	}
+
+	if idx.bundled {
+		idx.bundled = false // only unmount once
+		err := bundle.Unmount(idx.path)
+		if err != nil {
+			_err = err
+		}
+	}
 	return _err
 }
 
+// recycleGenomeReader returns a genome reader to the pool or closes it.
+// Memory-mapped readers are shared and need no recycling, where rdr is nil.
+func (idx *Index) recycleGenomeReader(batch int, rdr *genome.Reader) error {
+	if rdr == nil {
+		return nil
+	}
+	if idx.hasGenomeRdrs {
+		idx.poolGenomeRdrs[batch] <- rdr
+		return nil
+	}
+	err := rdr.Close()
+	<-idx.openFileTokens
+	if err != nil {
+		return fmt.Errorf("failed to close genome data file: %s", err)
+	}
+	return nil
+}
+
 // --------------------------------------------------------------------------
 // structs for seeding results
 
@@ -460,6 +897,8 @@ type SubstrPair struct {
 	TRC bool // is the substring from the reference seq on the negative strand.
 	QRC bool // is the substring from the query seq on the negative strand.
 
+	K uint8 // k of the mask set which produced the anchor, i.e., the seed resolution
+
 	// QCode uint64 // k-mer, for computing matched k-mers
 	// TCode uint64
 }
@@ -543,7 +982,6 @@ func ClearSubstrPairs(subs *[]*SubstrPair, k int) {
 			// same or nested region
 			if vQEnd <= p.QBegin+int32(p.Len) &&
 				v.TBegin >= p.TBegin && vTEnd <= p.TBegin+int32(p.Len) {
-				poolSub.Put(v)         // do not forget to recycle the object
 				(*markers)[i+1] = true // because of: range (*subs)[1:]
 				break
 			}
@@ -557,6 +995,10 @@ func ClearSubstrPairs(subs *[]*SubstrPair, k int) {
 		if !embedded {
 			(*subs)[j] = (*subs)[i]
 			j++
+		} else {
+			// do not forget to recycle the object.
+			// it's done here because embedded anchors might still be compared with following ones.
+			poolSub.Put((*subs)[i])
 		}
 	}
 	if j > 0 {
@@ -591,6 +1033,25 @@ var poolSearchResult = &sync.Pool{New: func() interface{} {
 	}
 }}
 
+// newSearchResult returns a reset SearchResult from the object pool.
+func newSearchResult(refBatchAndIdx int) *SearchResult {
+	subs := poolSubs.Get().(*[]*SubstrPair)
+	*subs = (*subs)[:0]
+
+	r := poolSearchResult.Get().(*SearchResult)
+	r.BatchGenomeIndex = uint64(refBatchAndIdx)
+	r.GenomeBatch = refBatchAndIdx >> BITS_GENOME_IDX
+	r.GenomeIndex = refBatchAndIdx & MASK_GENOME_IDX
+	r.ID = r.ID[:0] // extract it from genome file later
+	r.GenomeSize = 0
+	r.Subs = subs
+	r.Score = 0
+	r.Chains = nil            // important
+	r.SimilarityDetails = nil // important
+	r.AlignedFraction = 0
+	return r
+}
+
 var poolSearchResults = &sync.Pool{New: func() interface{} {
 	tmp := make([]*SearchResult, 0, 16)
 	return &tmp
@@ -750,12 +1211,148 @@ var poolSearchResultsMap = &sync.Pool{New: func() interface{} {
 	return &m
 }}
 
+// recycleSearchResultsMap recycles all search results in the map and the map itself.
+func (idx *Index) recycleSearchResultsMap(m *map[int]*SearchResult) {
+	for _, r := range *m {
+		idx.RecycleSearchResult(r)
+	}
+	clear(*m)
+	poolSearchResultsMap.Put(m)
+}
+
 // --------------------------------------------------------------------------
 // searching
 
-// Search queries the index with a sequence.
+// Search queries the index with a sequence, using the default SearchOptions.
 // After using the result, do not forget to call RecycleSearchResult().
 func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
+	return idx.SearchWithOptions(s, nil)
+}
+
+// SearchWithOptions queries the index with a sequence and per-call options,
+// nil for the default ones. It's safe to search with different options concurrently.
+// Please use SearchContext to know if the results are truncated by limits in the options.
+// After using the result, do not forget to call RecycleSearchResult().
+func (idx *Index) SearchWithOptions(s []byte, so *SearchOptions) (*[]*SearchResult, error) {
+	rs, _, err := idx.SearchContext(context.Background(), s, so)
+	return rs, err
+}
+
+// SearchContext queries the index with a sequence and per-call options (nil for the default ones),
+// and it stops when the context is done, or some limits in the options are reached.
+// In these cases, partial results are returned, along with the reasons of truncation.
+// The context is checked in seed searching, chaining, and between alignments.
+// If the maximum time is reached before alignment, anchors already collected are still chained,
+// and genomes with the highest chaining scores are aligned, at most one per thread.
+// A single alignment can not be interrupted, so the search might take a little longer than the maximum time.
+// After using the result, do not forget to call RecycleSearchResult().
+func (idx *Index) SearchContext(ctx context.Context, s []byte, so *SearchOptions) (*[]*SearchResult, Truncation, error) {
+	if so == nil {
+		so = idx.SearchOptions()
+	} else if err := idx.CheckSearchOptions(so); err != nil {
+		return nil, 0, err
+	}
+
+	limits := &searchLimits{maxGenomes: so.MaxCandidateGenomes, maxAnchors: so.MaxAnchors, base: ctx}
+	if so.MaxTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, so.MaxTime)
+		defer cancel()
+	}
+
+	rs, err := idx.search(ctx, s, so, limits, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rs, limits.result(), nil
+}
+
+// SearchStream queries the index with a sequence and per-call options (nil for the default ones),
+// and calls fn with the result of each genome, along with its SimilarityDetails,
+// as soon as its alignment is done, so the results do not need to be all kept in memory.
+//
+// If ranked is false, results are emitted in the order of completion, except for genomes
+// split into multiple chunks in indexing, which are emitted after all alignments are done,
+// as alignments of these chunks need to be merged.
+// If ranked is true, results are emitted after all alignments are done, in the same order as SearchContext.
+//
+// fn is called in a single goroutine, and it owns the result, so do not forget to call
+// RecycleSearchResult() after using it. If fn returns an error, the search stops and the error is returned.
+func (idx *Index) SearchStream(ctx context.Context, s []byte, so *SearchOptions, ranked bool,
+	fn func(*SearchResult) error) (Truncation, error) {
+	if ranked {
+		rs, truncation, err := idx.SearchContext(ctx, s, so)
+		if err != nil || rs == nil {
+			return truncation, err
+		}
+		err = idx.emitSearchResults(rs, fn)
+		return truncation, err
+	}
+
+	if so == nil {
+		so = idx.SearchOptions()
+	} else if err := idx.CheckSearchOptions(so); err != nil {
+		return 0, err
+	}
+
+	limits := &searchLimits{maxGenomes: so.MaxCandidateGenomes, maxAnchors: so.MaxAnchors, base: ctx}
+	if so.MaxTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, so.MaxTime)
+		defer cancel()
+	}
+
+	_, err := idx.search(ctx, s, so, limits, fn)
+	if err != nil {
+		return 0, err
+	}
+	return limits.result(), nil
+}
+
+// emitSearchResults calls fn with each result in order, and recycles the remaining ones if fn fails.
+func (idx *Index) emitSearchResults(rs *[]*SearchResult, fn func(*SearchResult) error) error {
+	var err error
+	for _, r := range *rs {
+		if err != nil {
+			idx.RecycleSearchResult(r)
+			continue
+		}
+		err = fn(r)
+	}
+	*rs = (*rs)[:0]
+	poolSearchResults.Put(rs)
+	return err
+}
+
+// isGenomeChunk tells if the result is from a chunk of a genome split in indexing.
+func (idx *Index) isGenomeChunk(r *SearchResult) bool {
+	if !idx.hasGenomeChunks {
+		return false
+	}
+	_, ok := idx.genomeChunks[r.BatchGenomeIndex]
+	return ok
+}
+
+// search does the search work for SearchContext and SearchStream.
+// If emit is not nil, results of unsplit genomes are passed to emit as soon as they are ready,
+// and other results are passed to it in the end, with nil returned.
+func (idx *Index) search(ctx context.Context, s []byte, so *SearchOptions, limits *searchLimits,
+	emit func(*SearchResult) error) (*[]*SearchResult, error) {
+	// options of seed chaining and sequence comparing
+	co := *idx.chainingOptions
+	co.MaxGap = so.MaxGap
+	poolChainers := idx.chainerPool(co)
+
+	idx.muPools.Lock()
+	sco := *idx.seqCompareOption
+	idx.muPools.Unlock()
+	sco.MinAlignedFraction = so.MinAlignedFraction
+	if so.MinIdentity != sco.MinIdentity {
+		sco.MinIdentity = so.MinIdentity
+		sco.Chaining2Options.MinIdentity = so.MinIdentity
+	}
+	poolSeqComparator := idx.seqComparatorPool(sco)
+
 	// ----------------------------------------------------------------
 	// 1) mask the query sequence
 
@@ -767,6 +1364,17 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 	}
 	defer idx.lh.RecycleMaskResult(_kmers, _locses)
 
+	// errors from goroutines, only the first one is kept
+	var _err error
+	var muErr sync.Mutex
+	setErr := func(err error) {
+		muErr.Lock()
+		if _err == nil {
+			_err = err
+		}
+		muErr.Unlock()
+	}
+
 	// ----------------------------------------------------------------
 	// 2) matching the captured k-mers in databases
 
@@ -774,123 +1382,128 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 	m := poolSearchResultsMap.Get().(*map[int]*SearchResult)
 	clear(*m) // requires go >= v1.21
 
-	inMemorySearch := idx.opt.InMemorySearch
-
-	var searchers []*kv.Searcher
-	var searchersIM []*kv.InMemorySearcher
-	var nSearchers int
+	// anchors are spilled to temporary files if there are too many of them
+	sp := idx.newAnchorSpiller()
+	defer sp.close()
 
-	if inMemorySearch {
-		searchersIM = idx.InMemorySearchers
-		nSearchers = len(searchersIM)
-	} else {
-		searchers = idx.Searchers
-		nSearchers = len(searchers)
-	}
+	// in-memory searchers go first, followed by on-disk ones.
+	searchersIM := idx.InMemorySearchers
+	searchers := idx.Searchers
+	nSearchersIM := len(searchersIM)
+	nSearchers := nSearchersIM + len(searchers)
 
-	minPrefix := idx.opt.MinPrefix
+	minPrefix := so.MinPrefix
 	// maxMismatch := idx.opt.MaxMismatch
 
+	// for stopping seed searching when the maximum number of anchors is reached
+	seedCtx, stopSeeds := context.WithCancel(ctx)
+	defer stopSeeds()
+	limits.stop = stopSeeds
+
 	ch := make(chan *[]*kv.SearchResult, nSearchers)
 	done := make(chan int) // later, we will reuse this
 	var wg sync.WaitGroup
 	var beginM, endM int // range of mask of a chunk
 
 	// -----------------------
-	// reverse k-mers
-	_kmersR := idx.poolKmers.Get().(*[]*[]uint64)
-	_locsesR := idx.poolLocses.Get().(*[]*[]int)
-
-	chR := make(chan [3]uint64, nSearchers)
-	doneR := make(chan int)
-	go func() {
-		var v *[]uint64
-		for _, v = range *_kmersR {
-			*v = (*v)[:0]
-		}
+	// reverse k-mers, only for indexes with reversed seeds for suffix matching
+	hasReversedSeeds := idx.hasReversedSeeds
+	var _kmersR *[]*[]uint64
+	var _locsesR *[]*[]int
+	if hasReversedSeeds {
+		_kmersR = idx.poolKmers.Get().(*[]*[]uint64)
+		_locsesR = idx.poolLocses.Get().(*[]*[]int)
+
+		chR := make(chan [3]uint64, nSearchers)
+		doneR := make(chan int)
+		go func() {
+			var v *[]uint64
+			for _, v = range *_kmersR {
+				*v = (*v)[:0]
+			}
 
-		var vl *[]int
-		for _, vl = range *_locsesR {
-			*vl = (*vl)[:0]
-		}
+			var vl *[]int
+			for _, vl = range *_locsesR {
+				*vl = (*vl)[:0]
+			}
 
-		var _kmer, _v, newMask, oldMask uint64
-		var existed bool
+			var _kmer, _v, newMask, oldMask uint64
+			var existed bool
 
-		for i2k := range chR {
-			// multiple oldMask might points to the same newMask
-			newMask, _kmer, oldMask = i2k[0], i2k[1], i2k[2]
-			v = (*_kmersR)[newMask]
-			vl = (*_locsesR)[newMask]
+			for i2k := range chR {
+				// multiple oldMask might points to the same newMask
+				newMask, _kmer, oldMask = i2k[0], i2k[1], i2k[2]
+				v = (*_kmersR)[newMask]
+				vl = (*_locsesR)[newMask]
 
-			existed = false
-			for _, _v = range *v {
-				if _kmer == _v {
-					existed = true
-					break
+				existed = false
+				for _, _v = range *v {
+					if _kmer == _v {
+						existed = true
+						break
+					}
+				}
+				if !existed {
+					*v = append(*v, _kmer)
+					*vl = append(*vl, int(oldMask))
 				}
 			}
-			if !existed {
-				*v = append(*v, _kmer)
-				*vl = append(*vl, int(oldMask))
-			}
-		}
 
-		doneR <- 1
-	}()
-	for iS := 0; iS < nSearchers; iS++ {
-		if inMemorySearch {
-			beginM = searchersIM[iS].ChunkIndex
-			endM = searchersIM[iS].ChunkIndex + searchersIM[iS].ChunkSize
-		} else {
-			beginM = searchers[iS].ChunkIndex
-			endM = searchers[iS].ChunkIndex + searchers[iS].ChunkSize
-		}
+			doneR <- 1
+		}()
+		for iS := 0; iS < nSearchers; iS++ {
+			if iS < nSearchersIM {
+				beginM = searchersIM[iS].ChunkIndex
+				endM = searchersIM[iS].ChunkIndex + searchersIM[iS].ChunkSize
+			} else {
+				beginM = searchers[iS-nSearchersIM].ChunkIndex
+				endM = searchers[iS-nSearchersIM].ChunkIndex + searchers[iS-nSearchersIM].ChunkSize
+			}
 
-		wg.Add(1)
-		go func(iS, beginM, endM int) {
-			var iMasks *[]int
-			var j int
-			var minj int
-			var mask, h, minh uint64
-			k := idx.lh.K
-			lh := idx.lh
-
-			for i, kmer := range (*_kmers)[beginM:endM] {
-				if kmer == 0 {
-					continue
-				}
-				// fmt.Printf("mask: %d, %s\n", i+1, kmers.MustDecode(kmer, k))
-				kmer = kmers.MustReverse(kmer, k) // reverse the k-mer
-				iMasks = lh.MaskKmer(kmer)
-				minh = math.MaxUint64
-				for _, j = range *iMasks {
-					mask = lh.Masks[j]
-					h = mask ^ kmer
-					if h < minh {
-						minj, minh = j, h
+			wg.Add(1)
+			go func(iS, beginM, endM int) {
+				var iMasks *[]int
+				var j int
+				var minj int
+				var mask, h, minh uint64
+				k := idx.lh.K
+				lh := idx.lh
+
+				for i, kmer := range (*_kmers)[beginM:endM] {
+					if kmer == 0 {
+						continue
 					}
-				}
-				// fmt.Printf("mask: %d, kmer: %s, locs: %d,  new mask: %d\n",
-				// 	beginM+i, kmers.MustDecode(kmer, k), (*_locses)[beginM+i], minj)
+					// fmt.Printf("mask: %d, %s\n", i+1, kmers.MustDecode(kmer, k))
+					kmer = kmers.MustReverse(kmer, k) // reverse the k-mer
+					iMasks = lh.MaskKmer(kmer)
+					minh = math.MaxUint64
+					for _, j = range *iMasks {
+						mask = lh.Masks[j]
+						h = mask ^ kmer
+						if h < minh {
+							minj, minh = j, h
+						}
+					}
+					// fmt.Printf("mask: %d, kmer: %s, locs: %d,  new mask: %d\n",
+					// 	beginM+i, kmers.MustDecode(kmer, k), (*_locses)[beginM+i], minj)
 
-				// multiple beginM + i will points to the same minj
-				chR <- [3]uint64{uint64(minj), kmer, uint64(beginM + i)}
-				lh.RecycleMaskKmerResult(iMasks)
-			}
+					// multiple beginM + i will points to the same minj
+					chR <- [3]uint64{uint64(minj), kmer, uint64(beginM + i)}
+					lh.RecycleMaskKmerResult(iMasks)
+				}
 
-			wg.Done()
-		}(iS, beginM, endM)
+				wg.Done()
+			}(iS, beginM, endM)
+		}
+		wg.Wait()
+		close(chR)
+		<-doneR
 	}
-	wg.Wait()
-	close(chR)
-	<-doneR
 	// -----------------------
 
 	// 2.2) collect search results, they will be kept in RAM.
-	// For quries with a lot of hits, the memory would be high.
-	// And it's inevitable currently, but if we do want to decrease the memory usage,
-	// we can write these matches in temporal files.
+	// For quries with a lot of hits, the memory would be high,
+	// so they are spilled to temporary files when the memory budget is exceeded.
 	go func() {
 		var refpos uint64
 
@@ -910,7 +1523,6 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 		// K8 := idx.k8
 		var locs []int
 		var sr *kv.SearchResult
-		var ok bool
 
 		for srs := range ch {
 			// different k-mers in subjects,
@@ -979,6 +1591,15 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 							}
 						}
 
+						r, dropped, ok := limits.accept(m, refBatchAndIdx)
+						if dropped != nil {
+							sp.drop(dropped)
+							idx.RecycleSearchResult(dropped)
+						}
+						if !ok {
+							continue
+						}
+
 						_sub2 := poolSub.Get().(*SubstrPair)
 						_sub2.QBegin = int32(beginQ)
 						_sub2.TBegin = int32(beginT)
@@ -988,28 +1609,10 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 						// _sub2.Mismatch = mismatch
 						_sub2.QRC = rcQ
 						_sub2.TRC = rcT
-
-						var r *SearchResult
-						if r, ok = (*m)[refBatchAndIdx]; !ok {
-							subs := poolSubs.Get().(*[]*SubstrPair)
-							*subs = (*subs)[:0]
-
-							r = poolSearchResult.Get().(*SearchResult)
-							r.BatchGenomeIndex = uint64(refBatchAndIdx)
-							r.GenomeBatch = refBatchAndIdx >> BITS_GENOME_IDX
-							r.GenomeIndex = refBatchAndIdx & MASK_GENOME_IDX
-							r.ID = r.ID[:0] // extract it from genome file later
-							r.GenomeSize = 0
-							r.Subs = subs
-							r.Score = 0
-							r.Chains = nil            // important
-							r.SimilarityDetails = nil // important
-							r.AlignedFraction = 0
-
-							(*m)[refBatchAndIdx] = r
-						}
+						_sub2.K = uint8(K)
 
 						*r.Subs = append(*r.Subs, _sub2)
+						sp.added(m)
 					}
 				}
 			}
@@ -1022,71 +1625,110 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 	// 2.1) search with multiple searchers
 
 	for iS := 0; iS < nSearchers; iS++ {
-		if inMemorySearch {
+		if iS < nSearchersIM {
 			beginM = searchersIM[iS].ChunkIndex
 			endM = searchersIM[iS].ChunkIndex + searchersIM[iS].ChunkSize
 		} else {
-			beginM = searchers[iS].ChunkIndex
-			endM = searchers[iS].ChunkIndex + searchers[iS].ChunkSize
+			beginM = searchers[iS-nSearchersIM].ChunkIndex
+			endM = searchers[iS-nSearchersIM].ChunkIndex + searchers[iS-nSearchersIM].ChunkSize
 		}
 
 		wg.Add(1)
 		go func(iS, beginM, endM int) {
 			idx.searcherTokens[iS] <- 1 // get the access to the searcher
+			defer func() {
+				<-idx.searcherTokens[iS] // return the access
+				wg.Done()
+			}()
+
 			var srs *[]*kv.SearchResult
 			var srs2 *[]*kv.SearchResult
 			var err error
-			if inMemorySearch {
+			if iS < nSearchersIM {
 				// prefix search
 				// srs, err = searchersIM[iS].Search((*_kmers)[beginM:endM], minPrefix, maxMismatch)
-				srs, err = searchersIM[iS].Search((*_kmers)[beginM:endM], minPrefix, true, false)
+				srs, err = searchersIM[iS].SearchContext(seedCtx, (*_kmers)[beginM:endM], minPrefix, true, false)
 				if err != nil {
-					checkError(err)
+					setErr(err)
+					return
 				}
 
 				// suffix search
-				srs2, err = searchersIM[iS].Search2((*_kmersR)[beginM:endM], minPrefix, true, true)
-				if len(*srs2) > 0 {
-					*srs = append(*srs, (*srs2)...)
-					*srs2 = (*srs2)[:0]
+				if hasReversedSeeds {
+					srs2, err = searchersIM[iS].Search2Context(seedCtx, (*_kmersR)[beginM:endM], minPrefix, true, true)
 				}
-				kv.RecycleSearchResults(srs2)
 			} else {
 				// prefix search
-				// srs, err = searchers[iS].Search((*_kmers)[beginM:endM], minPrefix, maxMismatch)
-				srs, err = searchers[iS].Search((*_kmers)[beginM:endM], minPrefix, true, false)
+				// srs, err = searchers[iS-nSearchersIM].Search((*_kmers)[beginM:endM], minPrefix, maxMismatch)
+				srs, err = searchers[iS-nSearchersIM].SearchContext(seedCtx, (*_kmers)[beginM:endM], minPrefix, true, false)
 				if err != nil {
-					checkError(err)
+					setErr(err)
+					return
 				}
 
 				// suffix search
-				srs2, err = searchers[iS].Search2((*_kmersR)[beginM:endM], minPrefix, true, true)
+				if hasReversedSeeds {
+					srs2, err = searchers[iS-nSearchersIM].Search2Context(seedCtx, (*_kmersR)[beginM:endM], minPrefix, true, true)
+				}
+			}
+			if err != nil {
+				kv.RecycleSearchResults(srs)
+				setErr(err)
+				return
+			}
+			if srs2 != nil {
 				if len(*srs2) > 0 {
 					*srs = append(*srs, (*srs2)...)
 					*srs2 = (*srs2)[:0]
 				}
 				kv.RecycleSearchResults(srs2)
 			}
-			if err != nil {
-				checkError(err)
-			}
 
 			if len(*srs) == 0 { // no matcheds
 				kv.RecycleSearchResults(srs)
 			} else {
 				ch <- srs // send result
 			}
-
-			<-idx.searcherTokens[iS] // return the access
-			wg.Done()
 		}(iS, beginM, endM)
 	}
 	wg.Wait()
 	close(ch)
 	<-done
 
-	idx.poolKmers.Put(_kmersR)
-	idx.poolLocses.Put(_locsesR)
+	if hasReversedSeeds {
+		idx.poolKmers.Put(_kmersR)
+		idx.poolLocses.Put(_locsesR)
+	}
+
+	if _err != nil {
+		idx.recycleSearchResultsMap(m)
+		return nil, _err
+	}
+
+	// 2.3) anchors from the second mask set with a smaller k
+	if idx.hasSecondMasks &&
+		(idx.opt.SecondSeedsMode == SecondSeedsCombine ||
+			(idx.opt.SecondSeedsMode == SecondSeedsFallback && len(*m) == 0)) {
+		err = idx.searchSecondSeeds(seedCtx, s, m, minPrefix, limits, sp)
+		if err != nil {
+			idx.recycleSearchResultsMap(m)
+			return nil, err
+		}
+	}
+
+	if sp != nil && sp.err != nil {
+		idx.recycleSearchResultsMap(m)
+		return nil, sp.err
+	}
+
+	// partial means the maximum time is reached before alignment. Anchors already collected
+	// are still chained, and only a few genomes are aligned, see 3.2.
+	// The context without the maximum time is used, so these steps are not stopped immediately.
+	var partial bool
+	if limits.timeUp(ctx) {
+		partial = true
+		ctx = limits.base
+	}
 
 	if len(*m) == 0 { // no results
 		poolSearchResultsMap.Put(m)
@@ -1099,106 +1741,246 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 	// minMatchedBases := idx.opt.MinMatchedBases
 
 	// 3.1) preprocess substring matches and chaining for each reference genome
-	rs := poolSearchResults.Get().(*[]*SearchResult)
-	*rs = (*rs)[:0]
 
 	K := idx.k
 	// k8 := idx.k8
 	// var matches uint8
 	// checkMismatch := maxMismatch >= 0 && maxMismatch < K-int(idx.opt.MinPrefix)
 
-	ch1 := make(chan *SearchResult, idx.opt.NumCPUs)
 	tokens := make(chan int, idx.opt.NumCPUs)
 
-	// collect chaining result
-	go func() {
-		for r := range ch1 {
-			*rs = append(*rs, r)
-		}
+	// chainGenomes chains anchors of genomes in m, and m is recycled.
+	chainGenomes := func(m *map[int]*SearchResult) *[]*SearchResult {
+		rs := poolSearchResults.Get().(*[]*SearchResult)
+		*rs = (*rs)[:0]
 
-		done <- 1
-	}()
+		ch1 := make(chan *SearchResult, idx.opt.NumCPUs)
+		done1 := make(chan int)
 
-	for _, r := range *m {
-		tokens <- 1
-		wg.Add(1)
+		// collect chaining result
+		go func() {
+			for r := range ch1 {
+				*rs = append(*rs, r)
+			}
 
-		go func(r *SearchResult) {
-			ClearSubstrPairs(r.Subs, K) // remove duplicates and nested anchors
+			done1 <- 1
+		}()
 
-			// -----------------------------------------------------
-			// chaining
+		var wg sync.WaitGroup // chaining of the next group might run along with alignment
+		for _, r := range *m {
+			tokens <- 1
+			wg.Add(1)
 
-			chainer := idx.poolChainers.Get().(*Chainer)
-			r.Chains, r.Score = chainer.Chain(r.Subs)
+			go func(r *SearchResult) {
+				defer func() {
+					<-tokens
+					wg.Done()
+				}()
 
-			defer func() {
-				idx.poolChainers.Put(chainer)
-				<-tokens
-				wg.Done()
-			}()
+				if limits.timeUp(ctx) {
+					idx.RecycleSearchResult(r)
+					return
+				}
 
-			if r.Score < idx.chainingOptions.MinScore {
-				idx.RecycleSearchResult(r) // do not forget to recycle unused objects
-				return
-			}
+				ClearSubstrPairs(r.Subs, K) // remove duplicates and nested anchors
 
-			ch1 <- r
-		}(r)
-	}
+				// -----------------------------------------------------
+				// chaining
 
-	wg.Wait()
-	close(ch1)
-	<-done
+				chainer := poolChainers.Get().(*Chainer)
+				r.Chains, r.Score = chainer.ChainContext(ctx, r.Subs)
+				poolChainers.Put(chainer)
 
-	poolSearchResultsMap.Put(m)
+				// chaining interrupted by the context returns no chains,
+				// while genomes chained before the time is up are kept.
+				if r.Score < co.MinScore || len(*r.Chains) == 0 {
+					idx.RecycleSearchResult(r) // do not forget to recycle unused objects
+					return
+				}
+
+				ch1 <- r
+			}(r)
+		}
+
+		wg.Wait()
+		close(ch1)
+		<-done1
+
+		poolSearchResultsMap.Put(m)
+
+		return rs
+	}
 
 	// 3.2) only keep the top N targets
-	topN := idx.opt.TopN
-	if topN > 0 && len(*rs) > topN {
-		// sort subjects in descending order based on the score
-		// just use the standard library for a few seed pairs.
-		sort.Slice(*rs, func(i, j int) bool {
-			return (*rs)[i].Score > (*rs)[j].Score
-		})
+	topN := so.TopN
+	keepTopN := func(rs *[]*SearchResult, topN int) {
+		if topN > 0 && len(*rs) > topN {
+			// sort subjects in descending order based on the score,
+			// ties are broken by genome batch and index, so the chosen genomes are stable.
+			sort.Slice(*rs, func(i, j int) bool {
+				return lessChainedGenome((*rs)[i], (*rs)[j])
+			})
 
-		var r *SearchResult
-		for i := topN; i < len(*rs); i++ {
-			r = (*rs)[i]
+			var r *SearchResult
+			for i := topN; i < len(*rs); i++ {
+				r = (*rs)[i]
 
-			// do not forget to recycle the filtered result
-			idx.RecycleSearchResult(r)
+				// do not forget to recycle the filtered result
+				idx.RecycleSearchResult(r)
+			}
+			*rs = (*rs)[:topN]
 		}
-		*rs = (*rs)[:topN]
+	}
+
+	var rs *[]*SearchResult
+	// for genomes with spilled anchors, it returns chaining results of the next group, nil for no more groups.
+	var nextGroup func() (*[]*SearchResult, error)
+
+	if !sp.spilled() {
+		rs = chainGenomes(m)
+	} else {
+		err = sp.split(m)
+		poolSearchResultsMap.Put(m)
+		if err != nil {
+			return nil, err
+		}
+
+		var iGroup int
+		nextGroup = func() (*[]*SearchResult, error) {
+			for ; iGroup < spillGroups; iGroup++ {
+				g, err := sp.load(iGroup)
+				if err != nil {
+					return nil, err
+				}
+				if len(*g) == 0 {
+					poolSearchResultsMap.Put(g)
+					continue
+				}
+
+				iGroup++
+				return chainGenomes(g), nil
+			}
+			return nil, nil
+		}
+
+		if topN > 0 { // the top N targets are chosen from all groups
+			rs = poolSearchResults.Get().(*[]*SearchResult)
+			*rs = (*rs)[:0]
+			var rsg *[]*SearchResult
+			for {
+				if rsg, err = nextGroup(); err != nil {
+					idx.RecycleSearchResults(rs)
+					return nil, err
+				}
+				if rsg == nil {
+					break
+				}
+				*rs = append(*rs, (*rsg)...)
+				*rsg = (*rsg)[:0]
+				poolSearchResults.Put(rsg)
+
+				keepTopN(rs, topN)
+			}
+			nextGroup = nil
+		} else { // genomes are chained and aligned group by group
+			if rs, err = nextGroup(); err != nil {
+				return nil, err
+			}
+			if rs == nil {
+				return nil, nil
+			}
+		}
+	}
+
+	if !partial && limits.timeUp(ctx) {
+		partial = true
+		ctx = limits.base
+	}
+
+	keepTopN(rs, topN)
+	if partial {
+		// genomes with the highest chaining scores are aligned, one per thread,
+		// and genomes of following groups of spilled anchors are not chained.
+		if topN <= 0 || topN > idx.opt.NumCPUs {
+			keepTopN(rs, idx.opt.NumCPUs)
+		}
+		nextGroup = nil
 	}
 
 	// 3.3) alignment
 
+	cpr := poolSeqComparator.Get().(*SeqComparator)
+	// recycle the previou tree data
+	cpr.RecycleIndex()
+	err = cpr.Index(s) // index the query sequence
+	if err != nil {
+		poolSeqComparator.Put(cpr)
+		idx.RecycleSearchResults(rs)
+		return nil, err
+	}
+
 	rs2 := poolSearchResults.Get().(*[]*SearchResult)
 	*rs2 = (*rs2)[:0]
 
 	ch2 := make(chan *SearchResult, idx.opt.NumCPUs)
 
+	// for stopping alignment when emit fails
+	var stopAlign context.CancelFunc = func() {}
+	if emit != nil {
+		ctx, stopAlign = context.WithCancel(ctx)
+		defer stopAlign()
+	}
+
 	// collect hits with good alignment
 	go func() {
+		var err error
 		for r := range ch2 {
-			*rs2 = append(*rs2, r)
+			if emit == nil || idx.isGenomeChunk(r) {
+				*rs2 = append(*rs2, r)
+				continue
+			}
+
+			if err != nil { // emit failed
+				idx.RecycleSearchResult(r)
+				continue
+			}
+			r.SortBySeqID()
+			if err = emit(r); err != nil {
+				setErr(err)
+				stopAlign()
+			}
 		}
 
 		done <- 1
 	}()
 
-	cpr := idx.poolSeqComparator.Get().(*SeqComparator)
-	// recycle the previou tree data
-	cpr.RecycleIndex()
-	err = cpr.Index(s) // index the query sequence
-	if err != nil {
-		checkError(err)
-	}
+	alignMode := sco.AlignMode
+	alignOption := &wfa.Options{GlobalAlignment: alignMode != AlignSemiGlobal}
+	alignPenalties := sco.AlignPenalties.wfaPenalties()
 
-	alignOption := &wfa.Options{GlobalAlignment: true}
+	// genomes to align. For genomes with spilled anchors, the next group is
+	// chained when all genomes of the current group are sent.
+	chGenomes := make(chan *SearchResult)
+	go func() {
+		var err error
+		for rs != nil {
+			for _, r := range *rs {
+				chGenomes <- r
+			}
+			poolSearchResults.Put(rs)
 
-	for _, r := range *rs { // multiple references
+			rs = nil
+			if nextGroup != nil && !limits.timeUp(ctx) {
+				if rs, err = nextGroup(); err != nil {
+					setErr(err)
+					rs = nil
+				}
+			}
+		}
+		close(chGenomes)
+	}()
+
+	for r := range chGenomes { // multiple references
 		tokens <- 1
 		wg.Add(1)
 
@@ -1208,18 +1990,27 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 				wg.Done()
 			}()
 
+			var err error
+
+			if limits.timeUp(ctx) {
+				idx.RecycleSearchResult(r)
+				return
+			}
+
 			// -----------------------------------------------------
 			// alignment
 
-			minQcovGnm := idx.opt.MinQueryAlignedFractionInAGenome
-			minQcovHSP := idx.seqCompareOption.MinAlignedFraction
-			minPIdent := idx.seqCompareOption.MinIdentity
+			minQcovGnm := so.MinQueryAlignedFractionInAGenome
+			minQcovHSP := sco.MinAlignedFraction
+			minPIdent := sco.MinIdentity
+			maxEvalue := so.MaxEvalue
+			scorer := idx.scorer
 			extLen := idx.opt.ExtendLength
 			contigInterval := idx.contigInterval
-			outSeq := idx.opt.OutputSeq
-			accurateAlign := idx.opt.MoreAccurateAlignment
+			outSeq := so.OutputSeq
+			accurateAlign := so.MoreAccurateAlignment
 
-			algn := wfa.New(wfa.DefaultPenalties, alignOption)
+			algn := wfa.New(alignPenalties, alignOption)
 			algn.AdaptiveReduction(wfa.DefaultAdaptiveOption)
 			// algn.AdaptiveReduction(&wfa.AdaptiveReductionOption{
 			// 	MinWFLen:    10,
@@ -1237,17 +2028,24 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 			refID := r.GenomeIndex
 
 			var rdr *genome.Reader
+			var mrdr *genome.MmapReader
 			// sequence reader
-			if idx.hasGenomeRdrs {
+			if idx.hasGenomeMmapRdrs {
+				mrdr = idx.genomeMmapRdrs[refBatch]
+			} else if idx.hasGenomeRdrs {
 				rdr = <-idx.poolGenomeRdrs[refBatch]
 			} else {
 				idx.openFileTokens <- 1 // genome file
-				fileGenome := filepath.Join(idx.path, DirGenomes, batchDir(refBatch), FileGenomes)
+				fileGenome := filepath.Join(idx.path, DirGenomes, BatchDir(refBatch), FileGenomes)
 				rdr, err = genome.NewReader(fileGenome)
 				if err != nil {
-					checkError(fmt.Errorf("failed to read genome data file: %s", err))
+					<-idx.openFileTokens
+					setErr(fmt.Errorf("failed to read genome data file: %s", err))
+					idx.RecycleSearchResult(r)
+					return
 				}
 			}
+			var failed bool // errors in reading sequences or alignment, or the time is up
 
 			var sub *SubstrPair
 			qlen := len(s)
@@ -1272,7 +2070,14 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 			var hash uint64
 
 			// check sequences from all chains
+		CHAINS:
 			for _, chain := range *r.Chains { // for each lexichash chain
+				// results of a genome are dropped if the time is up before all chains are aligned.
+				if limits.timeUp(ctx) {
+					failed = true
+					break
+				}
+
 				// ------------------------------------------------------------------------
 				// extract subsequence from the refseq for comparing
 
@@ -1327,9 +2132,16 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 				// extract target sequence for comparison.
 				// Right now, we fetch seq from disk for each seq,
 				// In the future, we might buffer frequently accessed references for improving speed.
-				tSeq, err := rdr.SubSeq(refID, tBegin, tEnd)
+				var tSeq *genome.Genome
+				if mrdr != nil {
+					tSeq, err = mrdr.SubSeq(refID, tBegin, tEnd)
+				} else {
+					tSeq, err = rdr.SubSeq(refID, tBegin, tEnd)
+				}
 				if err != nil {
-					checkError(err)
+					setErr(err)
+					failed = true
+					break
 				}
 				// this happens when the matched sequene is the last one in the gneome
 				if len(tSeq.Seq) < tEnd-tBegin+1 {
@@ -1350,7 +2162,10 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 				// fmt.Printf("qBegin: %d, qEnd: %d, len(tseq): %d\n", qBegin, qEnd, len(tSeq.Seq))
 				cr, err := cpr.Compare(uint32(qBegin), uint32(qEnd), tSeq.Seq, qlen)
 				if err != nil {
-					checkError(err)
+					genome.RecycleGenome(tSeq)
+					setErr(err)
+					failed = true
+					break
 				}
 				if cr == nil {
 					// recycle target sequence
@@ -1505,10 +2320,17 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 										} else {
 											_tseq = tSeq.Seq[c.tPosOffsetBegin+c.TBegin-tBegin : c.tPosOffsetBegin+c.TEnd-tBegin+1]
 										}
+										if limits.timeUp(ctx) {
+											failed = true
+											break CHAINS
+										}
 										cigar, err = algn.Align(_qseq, _tseq)
 										if err != nil {
-											checkError(fmt.Errorf("fail to align sequence"))
+											setErr(fmt.Errorf("fail to align sequence: %s", err))
+											failed = true
+											break CHAINS
 										}
+										clipAlignment(alignMode, sco.AlignPenalties, cigar, c, rc, &_qseq, &_tseq)
 										c.AlignedBasesQ = c.QEnd - c.QBegin + 1
 										c.AlignedLength = int(cigar.AlignLen)
 										c.MatchedBases = int(cigar.Matches)
@@ -1518,6 +2340,7 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 											c.AlignedFraction = 100
 										}
 										c.PIdent = float64(c.MatchedBases) / float64(cigar.AlignLen) * 100
+										c.Score = scorer.score(cigar.Ops)
 
 										if !outSeq {
 											wfa.RecycleAlignmentResult(cigar)
@@ -1525,9 +2348,12 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 									} else {
 										c.AlignedLength = c.AlignedBasesQ
 										c.Gaps = -1
+										c.Score = scorer.pseudoScore(c.MatchedBases, c.AlignedLength)
 									}
 
-									if c.AlignedFraction < minQcovHSP || c.PIdent < minPIdent {
+									c.BitScore, c.Evalue = scorer.evalue(c.Score, cr.QueryLen)
+
+									if c.AlignedFraction < minQcovHSP || c.PIdent < minPIdent || (maxEvalue > 0 && c.Evalue > maxEvalue) {
 										poolChain2.Put(c)
 										(*r2.Chains)[i] = nil
 										continue
@@ -1696,10 +2522,17 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 								} else {
 									_tseq = tSeq.Seq[c.tPosOffsetBegin+c.TBegin-tBegin : c.tPosOffsetBegin+c.TEnd-tBegin+1]
 								}
-								cigar, err = algn.Align(s[c.QBegin:c.QEnd+1], _tseq)
+								if limits.timeUp(ctx) {
+									failed = true
+									break CHAINS
+								}
+								cigar, err = algn.Align(_qseq, _tseq)
 								if err != nil {
-									checkError(fmt.Errorf("fail to align sequence"))
+									setErr(fmt.Errorf("fail to align sequence: %s", err))
+									failed = true
+									break CHAINS
 								}
+								clipAlignment(alignMode, sco.AlignPenalties, cigar, c, rc, &_qseq, &_tseq)
 								c.AlignedBasesQ = c.QEnd - c.QBegin + 1
 								c.AlignedLength = int(cigar.AlignLen)
 								c.MatchedBases = int(cigar.Matches)
@@ -1709,6 +2542,7 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 									c.AlignedFraction = 100
 								}
 								c.PIdent = float64(c.MatchedBases) / float64(cigar.AlignLen) * 100
+								c.Score = scorer.score(cigar.Ops)
 
 								if !outSeq {
 									wfa.RecycleAlignmentResult(cigar)
@@ -1716,9 +2550,12 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 							} else {
 								c.AlignedLength = c.AlignedBasesQ
 								c.Gaps = -1
+								c.Score = scorer.pseudoScore(c.MatchedBases, c.AlignedLength)
 							}
 
-							if c.AlignedFraction < minQcovHSP || c.PIdent < minPIdent {
+							c.BitScore, c.Evalue = scorer.evalue(c.Score, cr.QueryLen)
+
+							if c.AlignedFraction < minQcovHSP || c.PIdent < minPIdent || (maxEvalue > 0 && c.Evalue > maxEvalue) {
 								poolChain2.Put(c)
 								(*r2.Chains)[i] = nil
 								continue
@@ -1801,18 +2638,12 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 			poolHashes.Put(hashes)
 			wfa.RecycleAligner(algn)
 
-			if len(*sds) == 0 { // no valid alignments
+			if failed || len(*sds) == 0 { // no valid alignments
 				idx.RecycleSimilarityDetails(sds)
 				idx.RecycleSearchResult(r) // do not forget to recycle unused objects
 
-				if idx.hasGenomeRdrs {
-					idx.poolGenomeRdrs[refBatch] <- rdr
-				} else {
-					err = rdr.Close()
-					if err != nil {
-						checkError(fmt.Errorf("failed to close genome data file: %s", err))
-					}
-					<-idx.openFileTokens
+				if err = idx.recycleGenomeReader(refBatch, rdr); err != nil {
+					setErr(err)
 				}
 
 				return
@@ -1844,14 +2675,8 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 					idx.RecycleSimilarityDetails(sds)
 					idx.RecycleSearchResult(r) // do not forget to recycle unused objects
 
-					if idx.hasGenomeRdrs {
-						idx.poolGenomeRdrs[refBatch] <- rdr
-					} else {
-						err = rdr.Close()
-						if err != nil {
-							checkError(fmt.Errorf("failed to close genome data file: %s", err))
-						}
-						<-idx.openFileTokens
+					if err = idx.recycleGenomeReader(refBatch, rdr); err != nil {
+						setErr(err)
 					}
 					return
 				}
@@ -1860,19 +2685,13 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 			// Within each subject genome, alignments (HSP) are sorted by qcovHSP*pident
 			// r.AlignResults = ars
 			sort.Slice(*sds, func(i, j int) bool {
-				return (*sds)[i].SimilarityScore > (*sds)[j].SimilarityScore
+				return lessSimilarityDetail((*sds)[i], (*sds)[j])
 			})
 			r.SimilarityDetails = sds
 
 			// recycle genome reader
-			if idx.hasGenomeRdrs {
-				idx.poolGenomeRdrs[refBatch] <- rdr
-			} else {
-				err = rdr.Close()
-				if err != nil {
-					checkError(fmt.Errorf("failed to close genome data file: %s", err))
-				}
-				<-idx.openFileTokens
+			if err = idx.recycleGenomeReader(refBatch, rdr); err != nil {
+				setErr(err)
 			}
 
 			// we don't need these data for outputing results.
@@ -1899,10 +2718,14 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 	wg.Wait()
 	close(ch2)
 	<-done
-	poolSearchResults.Put(rs)
 
 	// recycle this comparator
-	idx.poolSeqComparator.Put(cpr)
+	poolSeqComparator.Put(cpr)
+
+	if _err != nil {
+		idx.RecycleSearchResults(rs2)
+		return nil, _err
+	}
 
 	if len(*rs2) == 0 {
 		poolSearchResults.Put(rs2)
@@ -1911,6 +2734,11 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 
 	// merge search result from genome chunks, if has split genome
 	if idx.hasGenomeChunks {
+		// results come in the order of completion, sort them so that chunks are always merged into the same one.
+		sort.Slice(*rs2, func(i, j int) bool {
+			return lessGenomeIndex((*rs2)[i], (*rs2)[j])
+		})
+
 		var j int
 		var a, b uint64 // SearchResult.BatchGenomeIndex
 		var ok, merged bool
@@ -1955,7 +2783,7 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 
 		// recompute query coverage per genome
 		var alignedBasesGenome int
-		minQcovGnm := idx.opt.MinQueryAlignedFractionInAGenome
+		minQcovGnm := so.MinQueryAlignedFractionInAGenome
 		j = 0
 		for _, r := range *rs2 {
 			if r == nil {
@@ -1991,7 +2819,7 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 			// Within each subject genome, alignments (HSP) are sorted by qcovHSP*pident
 			// r.AlignResults = ars
 			sort.Slice(*r.SimilarityDetails, func(i, j int) bool {
-				return (*r.SimilarityDetails)[i].SimilarityScore > (*r.SimilarityDetails)[j].SimilarityScore
+				return lessSimilarityDetail((*r.SimilarityDetails)[i], (*r.SimilarityDetails)[j])
 			})
 
 			(*rs2)[j] = r
@@ -2000,9 +2828,9 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 		*rs2 = (*rs2)[:j]
 	}
 
-	// sort all genomes, by qcovHSP*pident of the best alignment.
+	// sort all genomes, by qcovHSP*pident of the best alignment, with ties broken deterministically.
 	sort.Slice(*rs2, func(i, j int) bool {
-		return (*(*rs2)[i].SimilarityDetails)[0].SimilarityScore > (*(*rs2)[j].SimilarityDetails)[0].SimilarityScore
+		return lessSearchResult((*rs2)[i], (*rs2)[j])
 	})
 
 	// ----------------------------------
@@ -2016,6 +2844,10 @@ func (idx *Index) Search(s []byte) (*[]*SearchResult, error) {
 		r.SortBySeqID()
 	}
 
+	if emit != nil {
+		return nil, idx.emitSearchResults(rs2, emit)
+	}
+
 	return rs2, nil
 }
 
@@ -0,0 +1,382 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/bundle"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/genome"
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
+	"github.com/shenwei356/lexichash"
+)
+
+// secondMaskSet is an optional and smaller mask set with a smaller k,
+// which captures shorter seeds for more divergent sequences.
+// Its seeds are saved in a separate directory (seeds_k<k>).
+type secondMaskSet struct {
+	lh *lexichash.LexicHash
+
+	maskPrefix uint8
+	chunks     int // the number of seed chunk files
+	chunkSize  int // the number of masks in a chunk file
+
+	datas []*map[uint64]*[]uint64 // k-mer-value data of all masks in a batch
+}
+
+// newSecondMaskSet generates and indexes a second mask set.
+func newSecondMaskSet(k int, nMasks int, seed int64, chunks int) (*secondMaskSet, error) {
+	lh, err := lexichash.NewWithSeed(k, nMasks, seed, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = indexMasks(lh)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSize := (nMasks + chunks - 1) / chunks
+	chunks = (nMasks + chunkSize - 1) / chunkSize
+
+	datas := make([]*map[uint64]*[]uint64, nMasks)
+	for i := range datas {
+		datas[i] = kv.PoolKmerData.Get().(*map[uint64]*[]uint64)
+	}
+
+	return &secondMaskSet{
+		lh:         lh,
+		maskPrefix: uint8(kv.MaskPrefix(nMasks)),
+		chunks:     chunks,
+		chunkSize:  chunkSize,
+		datas:      datas,
+	}, nil
+}
+
+// indexMasks creates lookup tables for faster masking.
+func indexMasks(lh *lexichash.LexicHash) error {
+	lenPrefix := 1
+	for 1<<(lenPrefix<<1) <= len(lh.Masks) {
+		lenPrefix++
+	}
+	lenPrefix--
+	err := lh.IndexMasks(lenPrefix)
+	if err != nil {
+		return fmt.Errorf("indexing masks: %s", err)
+	}
+	err = lh.IndexMasksWithDistinctPrefixes(lenPrefix + 1)
+	if err != nil {
+		return fmt.Errorf("indexing masks for distinct prefixes: %s", err)
+	}
+	return nil
+}
+
+// collect saves k-mers captured by the second mask set of a genome.
+// Only forward k-mers are saved, i.e., no reversed seeds for suffix matching.
+func (ms *secondMaskSet) collect(refseq *genome.Genome, batchIDAndRefIDShift uint64, threads int) {
+	if refseq.Kmers2 == nil {
+		return
+	}
+	_kmers := refseq.Kmers2
+	loces := refseq.Locses2
+
+	nMasks := len(ms.lh.Masks)
+	chunkSize := (nMasks + threads - 1) / threads
+	var wg sync.WaitGroup
+	var begin, end int
+	for j := 0; j < threads; j++ {
+		begin = j * chunkSize
+		end = begin + chunkSize
+		if end > nMasks {
+			end = nMasks
+		}
+		if begin >= end {
+			break
+		}
+
+		wg.Add(1)
+		go func(begin, end int) {
+			var kmer uint64
+			var loc int
+			var ok bool
+			var values *[]uint64
+			var data *map[uint64]*[]uint64
+
+			for i := begin; i < end; i++ {
+				if len((*loces)[i]) == 0 {
+					continue
+				}
+
+				data = ms.datas[i]
+				kmer = (*_kmers)[i]
+				if values, ok = (*data)[kmer]; !ok {
+					tmp := make([]uint64, 0, len((*loces)[i]))
+					values = &tmp
+					(*data)[kmer] = values
+				}
+				for _, loc = range (*loces)[i] {
+					*values = append(*values, batchIDAndRefIDShift|((uint64(loc)<<BITS_REVERSE)&MASK_NONE_IDX))
+				}
+			}
+			wg.Done()
+		}(begin, end)
+	}
+	wg.Wait()
+}
+
+// recycle returns k-mer-value data to the object pool.
+func (ms *secondMaskSet) recycle() {
+	for _, data := range ms.datas {
+		kv.PoolKmerData.Put(data)
+	}
+	ms.datas = nil
+}
+
+// Modes of using seeds of the second mask set in searching.
+const (
+	SecondSeedsFallback = iota // only search them when no anchors are found with the main mask set
+	SecondSeedsCombine         // combine anchors from both mask sets before chaining
+	SecondSeedsNone            // do not use them
+)
+
+// readSecondMaskSet reads masks and seeds of the second mask set.
+// nOpenSeedFiles is the number of seed files already opened for the main mask set.
+func (idx *Index) readSecondMaskSet(outDir string, info *IndexInfo, nOpenSeedFiles int) error {
+	opt := idx.opt
+	log := getLogger(opt.Logger)
+	k2 := int(info.K2)
+
+	if opt.Verbose || opt.Log2File {
+		log.Infof("  reading masks and seeds of the second mask set (k=%d)...", k2)
+	}
+
+	lh2, err := readMasks(filepath.Join(outDir, FileMasksK(k2)))
+	if err != nil {
+		return err
+	}
+	err = indexMasks(lh2)
+	if err != nil {
+		return err
+	}
+
+	dirSeeds := filepath.Join(outDir, DirSeedsK(k2))
+	fileSeeds := make([]string, 0, 64)
+	files, err := bundle.List(dirSeeds)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		if filepath.Ext(file) == ExtSeeds {
+			fileSeeds = append(fileSeeds, file)
+		}
+	}
+	if len(fileSeeds) == 0 {
+		return fmt.Errorf("seeds file not found in: %s", dirSeeds)
+	}
+
+	if !opt.InMemorySearch && opt.MaxOpenFiles <= nOpenSeedFiles+len(fileSeeds) {
+		return fmt.Errorf("MaxOpenFiles (%d) should be > number of seeds files (%d), or even bigger",
+			opt.MaxOpenFiles, nOpenSeedFiles+len(fileSeeds))
+	}
+
+	inMemorySearchers := make([]*kv.InMemorySearcher, len(fileSeeds))
+	searchers := make([]*kv.Searcher, len(fileSeeds))
+	errs := make([]error, len(fileSeeds))
+	var wg sync.WaitGroup
+	tokens := make(chan int, opt.NumCPUs)
+	for i, file := range fileSeeds {
+		wg.Add(1)
+		tokens <- 1
+		go func(i int, file string) {
+			if opt.InMemorySearch {
+				inMemorySearchers[i], errs[i] = kv.NewInMemomrySearcher(file)
+			} else {
+				searchers[i], errs[i] = kv.NewSearcher(file)
+			}
+
+			wg.Done()
+			<-tokens
+		}(i, file)
+	}
+	wg.Wait()
+
+	// only keep successfully created ones, which will be closed in idx.Close()
+	for i := range fileSeeds {
+		if inMemorySearchers[i] != nil {
+			idx.InMemorySearchers2 = append(idx.InMemorySearchers2, inMemorySearchers[i])
+		}
+		if searchers[i] != nil {
+			idx.Searchers2 = append(idx.Searchers2, searchers[i])
+			idx.openFileTokens <- 1 // increase the number of open files
+		}
+	}
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to create a searcher from file: %s: %s", fileSeeds[i], err)
+		}
+	}
+
+	idx.searcherTokens2 = make([]chan int, len(fileSeeds))
+	for i := range idx.searcherTokens2 {
+		idx.searcherTokens2[i] = make(chan int, 1)
+	}
+
+	idx.lh2 = lh2
+	idx.k2 = k2
+	idx.hasSecondMasks = true
+	return nil
+}
+
+// searchSecondSeeds searches k-mers captured by the second mask set,
+// and adds the anchors to the matches of each reference.
+// Anchors are all converted to the forward direction,
+// as there are no reversed seeds for the second mask set.
+// It stops when the context is done, and the limits of the query are also applied.
+// Anchors might be spilled to temporary files by sp.
+func (idx *Index) searchSecondSeeds(ctx context.Context, s []byte, m *map[int]*SearchResult, minPrefix uint8,
+	limits *searchLimits, sp *anchorSpiller) error {
+	_kmers, _locses, err := idx.lh2.MaskKnownDistinctPrefixes(s, nil, true)
+	if err != nil {
+		return err
+	}
+	defer idx.lh2.RecycleMaskResult(_kmers, _locses)
+
+	K := idx.k2
+	if minPrefix > uint8(K) {
+		minPrefix = uint8(K)
+	}
+
+	searchersIM := idx.InMemorySearchers2
+	searchers := idx.Searchers2
+	nSearchersIM := len(searchersIM)
+	nSearchers := nSearchersIM + len(searchers)
+
+	ch := make(chan *[]*kv.SearchResult, nSearchers)
+	done := make(chan int)
+
+	// collect search results
+	go func() {
+		var refpos uint64
+		var posQ, beginQ, posT, beginT, kPrefix, refBatchAndIdx int
+		var rcQ, rcT, ok bool
+		var sr *kv.SearchResult
+		var r, dropped *SearchResult
+
+		for srs := range ch {
+			for _, sr = range *srs {
+				kPrefix = int(sr.Len)
+
+				for _, posQ = range (*_locses)[sr.IQuery] {
+					rcQ = posQ&BITS_STRAND > 0
+					posQ >>= BITS_STRAND
+
+					for _, refpos = range sr.Values {
+						refBatchAndIdx = int(refpos >> BITS_NONE_IDX)
+						posT = int(refpos << BITS_IDX >> BITS_IDX_FLAGS)
+						rcT = refpos>>BITS_REVERSE&BITS_REVERSE > 0
+
+						if rcQ {
+							beginQ = posQ + K - kPrefix
+						} else {
+							beginQ = posQ
+						}
+						if rcT {
+							beginT = posT + K - kPrefix
+						} else {
+							beginT = posT
+						}
+
+						r, dropped, ok = limits.accept(m, refBatchAndIdx)
+						if dropped != nil {
+							sp.drop(dropped)
+							idx.RecycleSearchResult(dropped)
+						}
+						if !ok {
+							continue
+						}
+
+						_sub2 := poolSub.Get().(*SubstrPair)
+						_sub2.QBegin = int32(beginQ)
+						_sub2.TBegin = int32(beginT)
+						_sub2.Len = uint8(kPrefix)
+						_sub2.QRC = rcQ
+						_sub2.TRC = rcT
+						_sub2.K = uint8(K)
+
+						*r.Subs = append(*r.Subs, _sub2)
+						sp.added(m)
+					}
+				}
+			}
+
+			kv.RecycleSearchResults(srs)
+		}
+		done <- 1
+	}()
+
+	// search with multiple searchers
+	var wg sync.WaitGroup
+	var beginM, endM int
+	var _err error
+	var muErr sync.Mutex
+	for iS := 0; iS < nSearchers; iS++ {
+		if iS < nSearchersIM {
+			beginM = searchersIM[iS].ChunkIndex
+			endM = searchersIM[iS].ChunkIndex + searchersIM[iS].ChunkSize
+		} else {
+			beginM = searchers[iS-nSearchersIM].ChunkIndex
+			endM = searchers[iS-nSearchersIM].ChunkIndex + searchers[iS-nSearchersIM].ChunkSize
+		}
+
+		wg.Add(1)
+		go func(iS, beginM, endM int) {
+			idx.searcherTokens2[iS] <- 1 // get the access to the searcher
+			var srs *[]*kv.SearchResult
+			var err error
+			if iS < nSearchersIM {
+				srs, err = searchersIM[iS].SearchContext(ctx, (*_kmers)[beginM:endM], minPrefix, true, false)
+			} else {
+				srs, err = searchers[iS-nSearchersIM].SearchContext(ctx, (*_kmers)[beginM:endM], minPrefix, true, false)
+			}
+			if err != nil {
+				muErr.Lock()
+				_err = err
+				muErr.Unlock()
+			} else if len(*srs) == 0 {
+				kv.RecycleSearchResults(srs)
+			} else {
+				ch <- srs
+			}
+
+			<-idx.searcherTokens2[iS] // return the access
+			wg.Done()
+		}(iS, beginM, endM)
+	}
+	wg.Wait()
+	close(ch)
+	<-done
+
+	return _err
+}
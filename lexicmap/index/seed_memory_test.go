@@ -0,0 +1,67 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/shenwei356/LexicMap/lexicmap/cmd/kv"
+)
+
+// TestInMemorySizeUpperBound compares the estimated memory of in-memory seed chunks
+// with the memory of the data loaded from the demo index.
+func TestInMemorySizeUpperBound(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "demo", "refs", "*.fa.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("demo genomes not found")
+	}
+	outDir := buildTestIndex(t, t.TempDir(), files)
+
+	fileSeeds, err := filepath.Glob(filepath.Join(outDir, DirSeeds, "*"+ExtSeeds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range fileSeeds {
+		size, err := kv.InMemorySizeUpperBound(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scr, err := kv.NewInMemomrySearcher(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mem int64
+		for i, data := range scr.KVdata {
+			mem += int64(cap(data))<<3 + int64(cap(scr.Indexes[i]))<<3
+		}
+		scr.Close()
+
+		// the bound should not be too loose either, or fewer chunks are loaded
+		if size < mem || size > mem*3/2 {
+			t.Errorf("%s: estimated memory %d, loaded: %d", filepath.Base(file), size, mem)
+		}
+	}
+}
@@ -18,7 +18,7 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package cmd
+package index
 
 import (
 	"math"
@@ -42,6 +42,10 @@ type SeqComparatorOptions struct {
 	MinAlignedFraction float64 // minimum query aligned fraction in a HSP
 
 	MinIdentity float64
+
+	// alignment with WFA
+	AlignPenalties AlignPenalties // zero value for DefaultAlignPenalties
+	AlignMode      AlignMode
 }
 
 // DefaultSeqComparatorOptions contains the default options for SeqComparatorOptions.
@@ -61,6 +65,9 @@ var DefaultSeqComparatorOptions = SeqComparatorOptions{
 	},
 
 	MinAlignedFraction: 0,
+
+	AlignPenalties: DefaultAlignPenalties,
+	AlignMode:      AlignGlobal,
 }
 
 // SeqComparator is for fast and accurate similarity estimation of two sequences,
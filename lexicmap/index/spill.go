@@ -0,0 +1,297 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// spillGroups is the number of groups (temporary files) of spilled anchors.
+// Anchors of a genome are always in the same group.
+const spillGroups = 64
+
+// bytesPerAnchor is the estimated memory of an anchor, including its pointer in the list.
+const bytesPerAnchor = 40
+
+// spillRecordSize is the size of a spilled anchor:
+// genome (8 bytes), QBegin (4 bytes), TBegin (4 bytes), Len, K, and flags of strands.
+const spillRecordSize = 19
+
+// anchorSpiller spills anchors (seed matches) of a query to temporary files
+// when the number of anchors in memory reaches a threshold.
+// Anchors are partitioned into groups by genomes, so that genomes
+// could be chained and aligned group by group later.
+//
+// Files of groups are opened only when being written or read, one at a time,
+// with a token of Index.openFileTokens, so spilling queries respect MaxOpenFiles.
+type anchorSpiller struct {
+	idx *Index
+
+	maxAnchors int // maximum anchors in memory
+	anchors    int // anchors in memory
+
+	tmpDir string
+	dir    string
+	ids    [spillGroups][]int // genomes of each group in a spill
+	buf    [spillRecordSize]byte
+
+	groups []*map[int]*SearchResult // genomes of each group, their anchors are in files
+
+	droppedIDs map[int]struct{} // genomes dropped by searchLimits, their spilled anchors are skipped
+
+	err error // the first error in spilling
+}
+
+// newAnchorSpiller returns an anchorSpiller, nil for no memory budget.
+func (idx *Index) newAnchorSpiller() *anchorSpiller {
+	if idx.opt.AnchorMemBudget <= 0 {
+		return nil
+	}
+	return &anchorSpiller{
+		idx:        idx,
+		maxAnchors: int(max(1, idx.opt.AnchorMemBudget/bytesPerAnchor)),
+		tmpDir:     idx.opt.TmpDir,
+	}
+}
+
+// added records a new anchor added to m, and spills all anchors in m
+// if the threshold is reached. It's safe to call it with a nil anchorSpiller.
+func (sp *anchorSpiller) added(m *map[int]*SearchResult) {
+	if sp == nil || sp.err != nil {
+		return
+	}
+	sp.anchors++
+	if sp.anchors >= sp.maxAnchors {
+		sp.err = sp.spill(m)
+	}
+}
+
+// drop records a genome removed from candidates by searchLimits.
+// It's safe to call it with a nil anchorSpiller.
+func (sp *anchorSpiller) drop(r *SearchResult) {
+	if sp == nil {
+		return
+	}
+	sp.anchors -= len(*r.Subs)
+	if sp.spilled() {
+		if sp.droppedIDs == nil {
+			sp.droppedIDs = make(map[int]struct{}, 64)
+		}
+		sp.droppedIDs[int(r.BatchGenomeIndex)] = struct{}{}
+	}
+}
+
+// spilled tells if any anchors are spilled.
+func (sp *anchorSpiller) spilled() bool {
+	return sp != nil && sp.dir != ""
+}
+
+// file returns the path of the temporary file of the ith group.
+func (sp *anchorSpiller) file(i int) string {
+	return filepath.Join(sp.dir, fmt.Sprintf("anchors_%03d.bin", i))
+}
+
+// spill appends all anchors in m to temporary files, while genomes are kept in m.
+func (sp *anchorSpiller) spill(m *map[int]*SearchResult) error {
+	if sp.dir == "" {
+		dir, err := os.MkdirTemp(sp.tmpDir, "lexicmap-anchors-")
+		if err != nil {
+			return fmt.Errorf("failed to create directory for spilling anchors: %s", err)
+		}
+		sp.dir = dir
+	}
+
+	for i := range sp.ids {
+		sp.ids[i] = sp.ids[i][:0]
+	}
+	for id, r := range *m {
+		if len(*r.Subs) == 0 {
+			continue
+		}
+		sp.ids[id%spillGroups] = append(sp.ids[id%spillGroups], id)
+	}
+
+	for i, ids := range sp.ids {
+		if len(ids) == 0 {
+			continue
+		}
+		if err := sp.spillGroup(i, ids, m); err != nil {
+			return err
+		}
+	}
+	sp.anchors = 0
+	return nil
+}
+
+// spillGroup appends anchors of some genomes of the ith group to its file.
+func (sp *anchorSpiller) spillGroup(i int, ids []int, m *map[int]*SearchResult) (err error) {
+	sp.idx.openFileTokens <- 1
+	defer func() { <-sp.idx.openFileTokens }()
+
+	fh, err := os.OpenFile(sp.file(i), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create file for spilling anchors: %s", err)
+	}
+	defer func() {
+		if err1 := fh.Close(); err == nil && err1 != nil {
+			err = fmt.Errorf("failed to spill anchors: %s", err1)
+		}
+	}()
+	w := bufio.NewWriter(fh)
+
+	buf := sp.buf[:]
+	var flags uint8
+	var r *SearchResult
+	for _, id := range ids {
+		r = (*m)[id]
+		for _, sub := range *r.Subs {
+			be.PutUint64(buf[:8], uint64(id))
+			be.PutUint32(buf[8:12], uint32(sub.QBegin))
+			be.PutUint32(buf[12:16], uint32(sub.TBegin))
+			buf[16] = sub.Len
+			buf[17] = sub.K
+			flags = 0
+			if sub.QRC {
+				flags |= 1
+			}
+			if sub.TRC {
+				flags |= 2
+			}
+			buf[18] = flags
+			if _, err = w.Write(buf); err != nil {
+				return fmt.Errorf("failed to spill anchors: %s", err)
+			}
+			poolSub.Put(sub)
+		}
+
+		if cap(*r.Subs) > 1024 { // do not keep the big list
+			tmp := make([]*SubstrPair, 0, 64)
+			r.Subs = &tmp
+		} else {
+			*r.Subs = (*r.Subs)[:0]
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("failed to spill anchors: %s", err)
+	}
+	return nil
+}
+
+// split spills the remaining anchors, and moves genomes of m into groups.
+// It must be called after all anchors are added.
+func (sp *anchorSpiller) split(m *map[int]*SearchResult) error {
+	if sp.err != nil {
+		return sp.err
+	}
+	if err := sp.spill(m); err != nil {
+		return err
+	}
+
+	sp.groups = make([]*map[int]*SearchResult, spillGroups)
+	for i := range sp.groups {
+		g := poolSearchResultsMap.Get().(*map[int]*SearchResult)
+		clear(*g)
+		sp.groups[i] = g
+	}
+	for id, r := range *m {
+		(*sp.groups[id%spillGroups])[id] = r
+	}
+	clear(*m)
+	return nil
+}
+
+// load reads anchors of the ith group back, and returns genomes of the group.
+// The returned map is owned by the caller.
+func (sp *anchorSpiller) load(i int) (*map[int]*SearchResult, error) {
+	g := sp.groups[i]
+	sp.groups[i] = nil
+	if len(*g) == 0 {
+		return g, nil
+	}
+
+	sp.idx.openFileTokens <- 1
+	defer func() { <-sp.idx.openFileTokens }()
+
+	file := sp.file(i)
+	fh, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) { // anchors of these genomes were all filtered out
+			return g, nil
+		}
+		sp.idx.recycleSearchResultsMap(g)
+		return nil, fmt.Errorf("failed to read spilled anchors: %s", err)
+	}
+	defer fh.Close()
+	rdr := bufio.NewReader(fh)
+
+	buf := sp.buf[:]
+	var r *SearchResult
+	var id int
+	var ok bool
+	for {
+		if _, err = io.ReadFull(rdr, buf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			sp.idx.recycleSearchResultsMap(g)
+			return nil, fmt.Errorf("failed to read spilled anchors: %s", err)
+		}
+		id = int(be.Uint64(buf[:8]))
+		if r, ok = (*g)[id]; !ok {
+			if _, ok = sp.droppedIDs[id]; ok {
+				continue
+			}
+			sp.idx.recycleSearchResultsMap(g)
+			return nil, fmt.Errorf("broken spilled anchors: unknown genome")
+		}
+
+		sub := poolSub.Get().(*SubstrPair)
+		sub.QBegin = int32(be.Uint32(buf[8:12]))
+		sub.TBegin = int32(be.Uint32(buf[12:16]))
+		sub.Len = buf[16]
+		sub.K = buf[17]
+		sub.QRC = buf[18]&1 > 0
+		sub.TRC = buf[18]&2 > 0
+		*r.Subs = append(*r.Subs, sub)
+	}
+
+	// the file is not needed anymore
+	os.Remove(file)
+	return g, nil
+}
+
+// close recycles genomes not loaded and removes the temporary files.
+// It's safe to call it with a nil anchorSpiller.
+func (sp *anchorSpiller) close() {
+	if sp == nil || sp.dir == "" {
+		return
+	}
+	for _, g := range sp.groups {
+		if g != nil {
+			sp.idx.recycleSearchResultsMap(g)
+		}
+	}
+	os.RemoveAll(sp.dir)
+}
@@ -0,0 +1,158 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSearchSpill checks that spilling anchors to temporary files with a tiny
+// memory budget does not change results, with and without TopN,
+// and with genome reader pools which take most slots of open files.
+func TestSearchSpill(t *testing.T) {
+	dir := t.TempDir()
+
+	r := rand.New(rand.NewSource(2))
+	randSeq := func(n int) []byte {
+		s := make([]byte, n)
+		for i := range s {
+			s[i] = "ACGT"[r.Intn(4)]
+		}
+		return s
+	}
+	query := randSeq(2000)
+
+	// each genome has a copy of the query with a few different mutations
+	var files []string
+	for i := 0; i < 10; i++ {
+		q := append([]byte{}, query...)
+		for j := 0; j < 5*(i+1); j++ {
+			p := r.Intn(len(q))
+			q[p] = "ACGT"[(bytes.IndexByte([]byte("ACGT"), q[p])+1+r.Intn(3))&3]
+		}
+		contig := append(append(append([]byte{}, randSeq(5000)...), q...), randSeq(5000)...)
+
+		file := filepath.Join(dir, fmt.Sprintf("g%d.fa", i))
+		if err := os.WriteFile(file, []byte(fmt.Sprintf(">c1\n%s\n", contig)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	outDir := buildTestIndex(t, dir, files)
+
+	search := func(budget int64, topN int, maxOpenFiles int, genomeRdrPools bool, maxGenomes int) string {
+		sopt := DefaultIndexSearchingOptions
+		sopt.NumCPUs = 4
+		sopt.MaxOpenFiles = maxOpenFiles
+		sopt.TopN = topN
+		sopt.AnchorMemBudget = budget
+		sopt.TmpDir = dir
+		sopt.MaxCandidateGenomes = maxGenomes
+		idx, err := NewIndexSearcher(outDir, &sopt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idx.Close()
+		if idx.hasGenomeRdrs != genomeRdrPools {
+			t.Fatalf("unexpected genome reader pools with MaxOpenFiles %d: %v", maxOpenFiles, idx.hasGenomeRdrs)
+		}
+
+		idx.SetSeqCompareOptions(testSeqCompareOptions(idx.K()))
+
+		rs, err := idx.Search(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs == nil {
+			t.Fatalf("no hits found")
+		}
+		defer idx.RecycleSearchResults(rs)
+
+		var buf bytes.Buffer
+		for _, r := range *rs {
+			fmt.Fprintf(&buf, "%s %.3f\n", r.ID, r.AlignedFraction)
+			for _, sd := range *r.SimilarityDetails {
+				for _, c := range *sd.Similarity.Chains {
+					if c != nil {
+						fmt.Fprintf(&buf, "  %s %v %d-%d %d-%d %.3f\n", sd.SeqID, sd.RC,
+							c.QBegin, c.QEnd, c.TBegin, c.TEnd, c.PIdent)
+					}
+				}
+			}
+		}
+		return buf.String()
+	}
+
+	for _, topN := range []int{0, 3} {
+		expected := search(0, topN, 8, false, 0)
+		result := search(bytesPerAnchor*100, topN, 8, false, 0)
+		if result != expected {
+			t.Errorf("results with spilled anchors (TopN: %d) differ from the ones without:\n%s\nvs\n%s",
+				topN, result, expected)
+		}
+
+		// 4 seed files, 5 genome batches, and genome reader pools of 2 readers each,
+		// spilling still has free slots of open files.
+		done := make(chan string, 1)
+		go func() {
+			defer close(done) // search() might fail
+			done <- search(bytesPerAnchor*100, topN, 4+3*5, true, 0)
+		}()
+		var ok bool
+		select {
+		case result, ok = <-done:
+			if !ok {
+				return
+			}
+		case <-time.After(time.Minute):
+			t.Fatalf("searching with spilled anchors and genome reader pools (TopN: %d) hangs", topN)
+		}
+		if result != expected {
+			t.Errorf("results with spilled anchors and genome reader pools (TopN: %d) differ from the ones without:\n%s\nvs\n%s",
+				topN, result, expected)
+		}
+	}
+
+	// genomes dropped by MaxCandidateGenomes after their anchors are spilled
+	expected := search(0, 0, 8, false, 3)
+	if !strings.Contains(expected, "\n  ") {
+		t.Fatalf("no hits found with MaxCandidateGenomes")
+	}
+	for i := 0; i < 3; i++ {
+		if result := search(bytesPerAnchor*2, 0, 8, false, 3); result != expected {
+			t.Errorf("results with spilled anchors and MaxCandidateGenomes differ from the ones without:\n%s\nvs\n%s",
+				result, expected)
+		}
+	}
+
+	// temporary files should be removed
+	if matches, _ := filepath.Glob(filepath.Join(dir, "lexicmap-anchors-*")); len(matches) > 0 {
+		t.Errorf("temporary files are not removed: %v", matches)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright © 2023-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package index
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// MinK is the minimum k-mer size.
+const MinK = 10
+
+// MinMinPrefix is the smallest valid value of the minimum prefix length of matched seeds in searching.
+const MinMinPrefix = 5
+
+// Logger is used to report progress and warnings in building and searching indexes.
+// *logging.Logger of github.com/shenwei356/go-logging satisfies it.
+type Logger interface {
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+}
+
+// nopLogger discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Info(args ...interface{})                    {}
+func (nopLogger) Infof(format string, args ...interface{})    {}
+func (nopLogger) Warningf(format string, args ...interface{}) {}
+
+// getLogger returns a no-op logger for nil.
+func getLogger(log Logger) Logger {
+	if log == nil {
+		return nopLogger{}
+	}
+	return log
+}
+
+var defaultExts = []string{".gz", ".xz", ".zst", ".bz"}
+
+// filepathTrimExtension trims file extensions, and returns the name, the extension and the compression extension.
+func filepathTrimExtension(file string, suffixes []string) (string, string, string) {
+	if suffixes == nil {
+		suffixes = defaultExts
+	}
+
+	var e, e1, e2 string
+	f := strings.ToLower(file)
+	for _, s := range suffixes {
+		e = s
+		if strings.HasSuffix(f, e) {
+			e2 = e
+			file = file[0 : len(file)-len(e)]
+			break
+		}
+	}
+
+	e1 = filepath.Ext(file)
+	name := file[0 : len(file)-len(e1)]
+
+	return name, e1, e2
+}
+
+// lengthAAs returns the number of continuous A's.
+func lengthAAs(s []byte) int {
+	var p, b byte
+	var n int
+	for _, b = range s {
+		if b == 'A' && b == p {
+			n++
+		}
+
+		p = b
+	}
+	return n
+}